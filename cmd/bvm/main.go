@@ -8,6 +8,7 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/pi-apps-go/bvm-go/internal"
 	"github.com/pi-apps-go/bvm-go/pkg/cli"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
 )
 
 func main() {
@@ -69,11 +70,12 @@ func main() {
 
 				// Convert selections to parameters for DownloadWindowsISO
 				var release, version, arch, edition string
+				var err error
 
 				if selections.SelectedVersion == "Custom ISO" {
 					// Handle custom ISO
 					release = "Custom ISO"
-					internal.DownloadWindowsISO("", selections.VmName, release, "", "", "", selections.SelectedCustomISO, selections.SelectedCustomVirtio)
+					err = internal.DownloadWindowsISO("", selections.VmName, release, "", "", "", selections.SelectedCustomISO, selections.SelectedCustomVirtio)
 				} else {
 					// Handle standard Windows versions
 					release = selections.SelectedVersion
@@ -102,7 +104,11 @@ func main() {
 					// Set edition (default to empty for most cases)
 					edition = selections.SelectedEdition
 
-					internal.DownloadWindowsISO(selections.SelectedLanguage, selections.VmName, release, version, arch, edition)
+					err = internal.DownloadWindowsISO(selections.SelectedLanguage, selections.VmName, release, version, arch, edition)
+				}
+				if err != nil {
+					fmt.Printf("Error downloading Windows: %v\n", err)
+					os.Exit(1)
 				}
 
 				internal.StatusGreen("Download completed successfully!")
@@ -112,6 +118,10 @@ func main() {
 		}
 	case "list-languages":
 		fmt.Println(internal.ListDownloadLanguages())
+	case "list-provision-steps":
+		for _, step := range provision.Steps() {
+			fmt.Printf("%s: %s\n", step.Name, step.Description)
+		}
 	case "testGreen":
 		fmt.Println(internal.StatusCheckGreen())
 	case "generate-logo":
@@ -136,13 +146,30 @@ func main() {
 			os.Exit(1)
 		}
 	case "firstboot":
-		// First boot a VM using libvirt
-		if len(os.Args) < 3 {
+		// First boot a VM on the hypervisor from bvm-config.toml
+		var vmDir string
+		var opts cli.FirstBootOptions
+		for _, arg := range os.Args[2:] {
+			switch {
+			case arg == "--capture":
+				opts.Capture = true
+			case arg == "--headless":
+				opts.Headless = true
+			case arg == "--no-graphics":
+				opts.NoGraphics = true
+			case strings.HasPrefix(arg, "-"):
+				internal.ErrorNoExit("Unknown firstboot option: " + arg)
+				printHelp()
+				os.Exit(1)
+			case vmDir == "":
+				vmDir = arg
+			}
+		}
+		if vmDir == "" {
 			internal.ErrorNoExit("Must specify a VM directory for firstboot mode")
 			printHelp()
 			os.Exit(1)
 		}
-		vmDir := os.Args[2]
 
 		// Check if VM directory exists
 		if _, err := os.Stat(vmDir); os.IsNotExist(err) {
@@ -150,16 +177,143 @@ func main() {
 			os.Exit(1)
 		}
 
-		if err := cli.FirstBoot(vmDir); err != nil {
+		if err := cli.FirstBoot(vmDir, opts); err != nil {
 			fmt.Printf("Error during first boot: %v\n", err)
 			os.Exit(1)
 		}
-	case "boot":
-		//internal.BootVM()
-		fmt.Println("Not implemented")
-	case "boot-nodisplay":
-		//internal.BootVMNoDisplay()
-		fmt.Println("Not implemented")
+	case "domain-xml":
+		// Print the domain XML without defining it
+		var vmDir string
+		mode := "firstboot"
+		args := os.Args[2:]
+		for i := 0; i < len(args); i++ {
+			switch {
+			case args[i] == "--mode" && i+1 < len(args):
+				i++
+				mode = args[i]
+			case strings.HasPrefix(args[i], "--mode="):
+				mode = strings.TrimPrefix(args[i], "--mode=")
+			case strings.HasPrefix(args[i], "-"):
+				internal.ErrorNoExit("Unknown domain-xml option: " + args[i])
+				printHelp()
+				os.Exit(1)
+			case vmDir == "":
+				vmDir = args[i]
+			}
+		}
+		if vmDir == "" {
+			internal.ErrorNoExit("Must specify a VM directory for domain-xml")
+			printHelp()
+			os.Exit(1)
+		}
+		if err := cli.DomainXML(vmDir, mode); err != nil {
+			fmt.Printf("Error generating domain XML: %v\n", err)
+			os.Exit(1)
+		}
+	case "status":
+		if len(os.Args) < 3 {
+			internal.ErrorNoExit("Must specify a VM directory for status")
+			printHelp()
+			os.Exit(1)
+		}
+		if err := cli.VMStatus(os.Args[2]); err != nil {
+			fmt.Printf("Error getting VM status: %v\n", err)
+			os.Exit(1)
+		}
+	case "display-info":
+		if len(os.Args) < 3 {
+			internal.ErrorNoExit("Must specify a VM directory for display-info")
+			printHelp()
+			os.Exit(1)
+		}
+		if err := cli.DisplayInfo(os.Args[2]); err != nil {
+			fmt.Printf("Error getting display info: %v\n", err)
+			os.Exit(1)
+		}
+	case "qmp":
+		// Pass a QMP command to a running VM, for debugging
+		if len(os.Args) < 4 {
+			internal.ErrorNoExit("Must specify a VM directory and a QMP command for qmp mode")
+			printHelp()
+			os.Exit(1)
+		}
+		arguments := ""
+		if len(os.Args) > 4 {
+			arguments = os.Args[4]
+		}
+		if err := cli.QMP(os.Args[2], os.Args[3], arguments); err != nil {
+			fmt.Printf("Error running QMP command: %v\n", err)
+			os.Exit(1)
+		}
+	case "mem-stats":
+		if len(os.Args) < 3 {
+			internal.ErrorNoExit("Must specify a VM directory for mem-stats")
+			printHelp()
+			os.Exit(1)
+		}
+		if err := cli.MemStats(os.Args[2]); err != nil {
+			fmt.Printf("Error getting memory statistics: %v\n", err)
+			os.Exit(1)
+		}
+	case "usb":
+		// List host USB devices and hotplug them into a running VM
+		if len(os.Args) < 3 {
+			internal.ErrorNoExit("Must specify list, attach, detach or watch for usb mode")
+			printHelp()
+			os.Exit(1)
+		}
+		var err error
+		switch os.Args[2] {
+		case "list":
+			vmDir := ""
+			if len(os.Args) > 3 {
+				vmDir = os.Args[3]
+			}
+			err = cli.USBList(vmDir)
+		case "watch":
+			if len(os.Args) < 4 {
+				internal.ErrorNoExit("Must specify a VM directory for usb watch")
+				printHelp()
+				os.Exit(1)
+			}
+			err = cli.USBWatch(os.Args[3])
+		case "attach", "detach":
+			if len(os.Args) < 5 {
+				internal.ErrorNoExit("Must specify a VM directory and a USB device for usb " + os.Args[2])
+				printHelp()
+				os.Exit(1)
+			}
+			if os.Args[2] == "attach" {
+				err = cli.USBAttach(os.Args[3], os.Args[4])
+			} else {
+				err = cli.USBDetach(os.Args[3], os.Args[4])
+			}
+		default:
+			internal.ErrorNoExit("Unknown usb command: " + os.Args[2])
+			printHelp()
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Printf("Error managing USB devices: %v\n", err)
+			os.Exit(1)
+		}
+	case "boot", "boot-nodisplay":
+		// Run the installed Windows until it shuts down
+		if len(os.Args) < 3 {
+			internal.ErrorNoExit("Must specify a VM directory for " + os.Args[1])
+			printHelp()
+			os.Exit(1)
+		}
+		vmDir := os.Args[2]
+		if _, err := os.Stat(vmDir); os.IsNotExist(err) {
+			internal.ErrorNoExit("VM directory does not exist: " + vmDir)
+			os.Exit(1)
+		}
+
+		if err := cli.BootVM(vmDir, cli.BootOptions{NoDisplay: os.Args[1] == "boot-nodisplay"}); err != nil {
+			fmt.Printf("Error booting VM: %v\n", err)
+			os.Exit(1)
+		}
 	case "boot-gtk":
 		//internal.BootVMGTK()
 		fmt.Println("Not implemented")
@@ -169,9 +323,18 @@ func main() {
 	case "manage-vms":
 		//internal.ManageVMs()
 		fmt.Println("Not implemented")
+	case "list":
+		if err := cli.ListVMs(); err != nil {
+			fmt.Printf("Error listing VMs: %v\n", err)
+			os.Exit(1)
+		}
 	case "manage-vms-cli":
-		//internal.ManageVMsCLI()
-		fmt.Println("Not implemented")
+		// Interactive TUI for the VMs of the registry
+		program := tea.NewProgram(cli.ManageVMsCLI(), tea.WithAltScreen())
+		if _, err := program.Run(); err != nil {
+			internal.ErrorNoExit("TUI error: " + err.Error())
+			os.Exit(1)
+		}
 	case "connect":
 		//internal.ConnectVM()
 		fmt.Println("Not implemented")
@@ -212,19 +375,27 @@ func printHelp() {
 	fmt.Println("  This downloads Windows and necessary drivers, with a option to select the language and Windows version.")
 	fmt.Println()
 	internal.Status("  prepare - Prepare a VM for use")
-	fmt.Println("   This bundles everything up to get ready for first boot.")
+	fmt.Println("   This bundles everything up to get ready for first boot. It needs installer.iso from 'bvm download'.")
 	fmt.Println()
 	internal.Status("  firstboot - First boot a VM")
 	fmt.Println("   This runs the first boot of a VM, by running the 'bvm prepare' command and then the 'bvm start' command.")
 	fmt.Println("   If the Windows install is interrupted, you can run this command again to continue the install.")
+	fmt.Println("   It continues from the disk snapshot of the last phase that was reached.")
 	fmt.Println("   Be aware: when Windows finishes installing, the VM will shutdown and all .iso files and the unattended folder could be deleted once this step is complete.")
+	fmt.Println("   Add --capture to save a screenshot every minute and the serial console to firstboot-capture in the VM directory.")
+	fmt.Println("   If the install fails they are packed into a firstboot-failure tarball together with the logs and the answer file.")
+	fmt.Println("   Add --headless to install without a desktop session, for example over SSH. SPICE only listens on localhost then.")
+	fmt.Println("   Add --no-graphics to also leave out the SPICE server. Progress is followed through VM events and the guest logs.")
 	fmt.Println()
-	internal.Status("  boot - Start a VM (uses SDL2 for display)")
-	fmt.Println("   Main command to use the VM. Be aware: this mode will be laggy and lack crucial features.")
-	fmt.Println("   If you want to use the VM in a better way, start the VM in headless mode (using the 'bvm boot-nodisplay' command) and connect to it with RDP (using the 'bvm connect' command).")
+	internal.Status("  boot - Start a VM (uses a SPICE viewer for display)")
+	fmt.Println("   Main command to use the VM. It runs the VM on the hypervisor from bvm-config.toml until Windows shuts down.")
+	fmt.Println("   domain-overrides.xml is applied, USB devices in usb_passthrough are attached and the memory Windows doesn't need goes back to the host.")
+	fmt.Println("   Press Ctrl+C to shut Windows down, and again to force the VM off.")
+	fmt.Println("   If you want to use the VM in a better way, start the VM in headless mode (using the 'bvm boot-nodisplay' command) and connect to it with RDP.")
 	fmt.Println()
 	internal.Status("  boot-nodisplay - Start a VM in headless mode")
 	fmt.Println("   This starts a VM in headless mode, which means it will not have a display and will not be able to be used directly.")
+	fmt.Println("   It works without a desktop session, for example over SSH.")
 	fmt.Println()
 	internal.Status("  boot-gtk: Start a VM with GTK frontend")
 	fmt.Println("   This starts a VM, but uses GTK to show the VM. This is useful if you want to use the VM in a better way, but you don't want to use the connect mode.")
@@ -234,12 +405,17 @@ func printHelp() {
 	fmt.Println("   This mode is useful for troubleshooting.")
 	fmt.Println()
 	fmt.Println("Multiple VM management:")
+	internal.Status("  list - List VMs")
+	fmt.Println("   This lists the VMs bvm knows about with their directory, state, RAM, disk usage and RDP port.")
+	fmt.Println("   'bvm new-vm' adds the VMs it creates to $XDG_CONFIG_HOME/bvm-go/vms.toml.")
+	fmt.Println()
 	internal.Status("  manage-vms - Manage VMs")
 	fmt.Println("   This command is a GUI way to list all VMs, create a new VM, delete a VM, and edit a VM.")
 	fmt.Println("   This command will also show the VM's status, and the VM's configuration file.")
 	internal.Status("  manage-vms-cli - Manage VMs (CLI)")
 	fmt.Println("   This command is a CLI way to list all VMs, create a new VM, delete a VM, and edit a VM.")
-	fmt.Println("   This command will also show the VM's status, and the VM's configuration file.")
+	fmt.Println("   It can also add an existing VM directory to the list, rename a VM and clone a VM.")
+	fmt.Println("   Editing opens the VM's bvm-config.toml in $VISUAL or $EDITOR.")
 	fmt.Println()
 	fmt.Println("Single VM connection management:")
 	internal.Status("  connect - Connect to a VM")
@@ -255,11 +431,45 @@ func printHelp() {
 	fmt.Println("   This command will open a FreeRDP connection to the VM. You can use this to use the VM.")
 	fmt.Println("   The connect-freerdp mode is a fallback to the connect mode, if the Remmina client does not work.")
 	fmt.Println()
+	internal.Status("  domain-xml - Print the libvirt domain XML of a VM without starting it")
+	fmt.Println("   Use --mode firstboot (the default) or --mode boot to pick which domain is printed.")
+	fmt.Println("   Put a domain-overrides.xml with a <domain> root in the VM directory to change the generated XML:")
+	fmt.Println("   top-level elements like <cputune> replace the generated ones, devices replace the one with the same target")
+	fmt.Println("   or are added, and bvm-remove=\"yes\" on a device removes it.")
+	fmt.Println()
+	internal.Status("  status - Show how far the setup of a VM got")
+	fmt.Println("   Prints the state from state.json in the VM directory: created, downloaded, prepared, installing, installed or failed,")
+	fmt.Println("   the files each step made, the history of the VM and the command to run next.")
+	fmt.Println()
+	internal.Status("  display-info - Show how to connect to the display of a running VM")
+	fmt.Println("   Prints the SPICE and VNC addresses of the running VM, for remote-viewer or a VNC client.")
+	fmt.Println()
+	internal.Status("  qmp - Send a QMP command to a running VM")
+	fmt.Println("   For debugging, for example: bvm qmp ~/win11 query-status")
+	fmt.Println("   Arguments are passed as a JSON object: bvm qmp ~/win11 balloon '{\"value\": 4294967296}'")
+	fmt.Println("   The reply is printed as JSON. On libvirt this marks the domain as tainted.")
+	fmt.Println()
+	internal.Status("  usb - Pass USB devices through to a running VM")
+	fmt.Println("   bvm usb list [vmdir] lists the USB devices of this system, and which are attached to the VM.")
+	fmt.Println("   bvm usb attach ~/win11 05dc:a720 and bvm usb detach ~/win11 05dc:a720 hotplug a device.")
+	fmt.Println("   Devices are picked by vendor:product or by bus.device, both as lsusb prints them.")
+	fmt.Println("   Devices in usb_passthrough of bvm-config.toml are attached when the VM starts.")
+	fmt.Println("   While bvm boot or bvm firstboot runs the VM, devices matching usb_passthrough or usb_autoforward are attached")
+	fmt.Println("   as they are plugged in and detached when they are unplugged. What was forwarded is logged to usb-watch.log.")
+	fmt.Println("   bvm usb watch ~/win11 does the same for a VM started some other way, until the VM shuts down.")
+	fmt.Println()
+	internal.Status("  mem-stats - Follow the memory of the host and a running VM")
+	fmt.Println("   Prints what Linux has available, ZRAM and KSM next to the balloon of the VM every few seconds.")
+	fmt.Println("   Useful for picking vm_mem and free_ram_goal on a Pi with little RAM.")
+	fmt.Println()
 	fmt.Println("Other commands:")
 	fmt.Println()
 	internal.Status("  list-languages: List available languages")
 	fmt.Println("   This command will list all available languages for the Windows ISO images.")
 	fmt.Println()
+	internal.Status("  list-provision-steps: List first login provisioning steps")
+	fmt.Println("   This command will list the steps that can be used in the [provision] section of bvm-config.toml.")
+	fmt.Println()
 	internal.Status("  gui: Open the GUI")
 	fmt.Println("   This command will open the GUI. You can use this to graphically manage the VM.")
 }
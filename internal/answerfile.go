@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+)
+
+// answerFilesDir holds one autounattend.xml per delivery method, in the VM directory
+const answerFilesDir = "answerfiles"
+
+// answerFileDeliveryFile records the delivery method the guest reported using, in the VM directory
+const answerFileDeliveryFile = "answerfile-delivery"
+
+// windowsBuildFile records the build of the Windows in installer.iso, in the VM directory
+const windowsBuildFile = "windows-build"
+
+// AnswerFilePath returns the answer file rendered for a delivery method
+func AnswerFilePath(vmdir string, method unattend.DeliveryMethod) string {
+	return filepath.Join(vmdir, answerFilesDir, string(method)+".xml")
+}
+
+// AnswerFileDeliveryOrder returns the delivery methods firstboot tries, best first.
+// It is answer_file_delivery from [firstboot] or the default for the Windows build and architecture, with
+// the method that worked on an earlier firstboot of this VM moved to the front.
+func AnswerFileDeliveryOrder(vmdir string) []unattend.DeliveryMethod {
+	arch := windowsArch()
+
+	var order []unattend.DeliveryMethod
+	for _, name := range BVMConfig.AnswerFileDelivery {
+		method, err := unattend.ParseDeliveryMethod(name)
+		if err != nil {
+			Warning(err.Error())
+			continue
+		}
+		if !method.Supported(arch) {
+			Warning(fmt.Sprintf("Answer file delivery %q is not available on %s, skipping it", method, arch))
+			continue
+		}
+		order = append(order, method)
+	}
+	if len(order) == 0 {
+		order = unattend.DefaultDeliveryOrder(WindowsBuild(vmdir), arch)
+	}
+
+	if verified, ok := VerifiedAnswerFileDelivery(vmdir); ok {
+		for i, method := range order {
+			if method == verified {
+				order = append([]unattend.DeliveryMethod{method}, append(order[:i:i], order[i+1:]...)...)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// writeAnswerFiles renders autounattend.xml once for every delivery method available on this architecture.
+// Every copy records its own method in the guest so firstboot can tell which one Windows Setup used.
+func writeAnswerFiles(vmdir string, cfg unattend.Config) error {
+	if err := os.MkdirAll(filepath.Join(vmdir, answerFilesDir), 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %v", answerFilesDir, err)
+	}
+
+	for _, method := range unattend.DeliveryMethods() {
+		if !method.Supported(cfg.Arch) {
+			continue
+		}
+		cfg.Delivery = method
+		answerFile, err := unattend.Render(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to generate autounattend.xml: %v", err)
+		}
+		if err := os.WriteFile(AnswerFilePath(vmdir, method), answerFile, 0644); err != nil {
+			return fmt.Errorf("failed to write autounattend.xml: %v", err)
+		}
+	}
+
+	// Older versions put the answer file on unattended.iso, it must not be found twice
+	if err := os.Remove(filepath.Join(vmdir, "unattended", "autounattend.xml")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old autounattend.xml: %v", err)
+	}
+	return nil
+}
+
+// AnswerFileMediumPath returns the disk image that delivers the answer file by the given method
+func AnswerFileMediumPath(vmdir string, method unattend.DeliveryMethod) string {
+	switch method {
+	case unattend.DeliveryFloppy:
+		return filepath.Join(vmdir, "autounattend.img")
+	case unattend.DeliveryInstallerISO:
+		return filepath.Join(vmdir, "installer-bvm.iso")
+	}
+	return filepath.Join(vmdir, "answerfile.iso")
+}
+
+// PrepareAnswerFileMedium builds the disk image that delivers the answer file by the given method and returns its path.
+// Images are only rebuilt when the answer file or installer.iso changed since they were made.
+func PrepareAnswerFileMedium(vmdir string, method unattend.DeliveryMethod) (string, error) {
+	answerFile := AnswerFilePath(vmdir, method)
+	if _, err := os.Stat(answerFile); err != nil {
+		return "", fmt.Errorf("%s not found, run 'bvm prepare %s' again", answerFile, vmdir)
+	}
+
+	medium := AnswerFileMediumPath(vmdir, method)
+	switch method {
+	case unattend.DeliveryCDROM:
+		if isUpToDate(medium, answerFile) {
+			return medium, nil
+		}
+		return medium, makeAnswerFileISO(answerFile, medium)
+	case unattend.DeliveryFloppy:
+		if isUpToDate(medium, answerFile) {
+			return medium, nil
+		}
+		return medium, makeAnswerFileFloppy(answerFile, medium)
+	case unattend.DeliveryInstallerISO:
+		installerISO := filepath.Join(vmdir, "installer.iso")
+		if isUpToDate(medium, answerFile, installerISO) {
+			return medium, nil
+		}
+		return medium, makeAnswerFileInstallerISO(answerFile, installerISO, medium)
+	}
+	return "", fmt.Errorf("unknown answer file delivery method %q", method)
+}
+
+// RecordAnswerFileDelivery remembers the delivery method the guest reported, it is tried first next time
+func RecordAnswerFileDelivery(vmdir string, method unattend.DeliveryMethod) error {
+	if err := os.WriteFile(filepath.Join(vmdir, answerFileDeliveryFile), []byte(string(method)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record answer file delivery: %v", err)
+	}
+	return nil
+}
+
+// VerifiedAnswerFileDelivery returns the delivery method that worked on an earlier firstboot of this VM
+func VerifiedAnswerFileDelivery(vmdir string) (unattend.DeliveryMethod, bool) {
+	content, err := os.ReadFile(filepath.Join(vmdir, answerFileDeliveryFile))
+	if err != nil {
+		return "", false
+	}
+	method, err := unattend.ParseDeliveryMethod(string(content))
+	if err != nil {
+		return "", false
+	}
+	return method, true
+}
+
+// RecordWindowsBuild remembers the build of the Windows in installer.iso, 0 if wiminfo didn't report one
+func RecordWindowsBuild(vmdir string, build int) error {
+	if build == 0 {
+		if err := os.Remove(filepath.Join(vmdir, windowsBuildFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", windowsBuildFile, err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(vmdir, windowsBuildFile), []byte(strconv.Itoa(build)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record Windows build: %v", err)
+	}
+	return nil
+}
+
+// WindowsBuild returns the build of the Windows in installer.iso recorded by bvm prepare, 0 if it is unknown
+func WindowsBuild(vmdir string) int {
+	content, err := os.ReadFile(filepath.Join(vmdir, windowsBuildFile))
+	if err != nil {
+		return 0
+	}
+	build, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+	return build
+}
+
+// isUpToDate reports whether target exists and is newer than all sources
+func isUpToDate(target string, sources ...string) bool {
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return false
+	}
+	for _, source := range sources {
+		sourceInfo, err := os.Stat(source)
+		if err != nil || sourceInfo.ModTime().After(targetInfo.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// makeISO creates a data ISO from a directory with mkisofs, or genisoimage if mkisofs is missing
+func makeISO(output string, dir string) error {
+	// -l: allow full 31-character filenames
+	// -J: Generate Joliet directory records
+	// -r: Generate SUSP and RR records using the Rock Ridge protocol
+	// -allow-lowercase: Allow lowercase characters in addition to the usual ISO9660 allowed characters
+	// -allow-multidot: Allow more than one dot in filenames
+	args := []string{"-quiet", "-l", "-J", "-r", "-allow-lowercase", "-allow-multidot", "-o", output, dir}
+	if err := exec.Command("mkisofs", args...).Run(); err != nil {
+		if output, err := exec.Command("genisoimage", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("tried both mkisofs and genisoimage: %v\n%s", err, output)
+		}
+	}
+	return nil
+}
+
+// makeAnswerFileISO creates a small ISO holding only autounattend.xml
+func makeAnswerFileISO(answerFile string, medium string) error {
+	Status("Making " + filepath.Base(medium) + "...")
+	tempDir, err := os.MkdirTemp("", "bvm-answerfile-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := copyFile(answerFile, filepath.Join(tempDir, "autounattend.xml")); err != nil {
+		return fmt.Errorf("failed to copy autounattend.xml: %v", err)
+	}
+	if err := makeISO(medium, tempDir); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Base(medium), err)
+	}
+	return nil
+}
+
+// makeAnswerFileFloppy creates a 1.44MB FAT12 floppy image holding only autounattend.xml
+func makeAnswerFileFloppy(answerFile string, medium string) error {
+	Status("Making " + filepath.Base(medium) + "...")
+	os.Remove(medium)
+	if output, err := exec.Command("mkfs.fat", "-C", "-F", "12", "-n", "AUTOUNATTEND", medium, "1440").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create floppy image: %v\n%s", err, output)
+	}
+
+	// mtools writes to the image without root, otherwise it is loop mounted
+	if _, err := exec.LookPath("mcopy"); err == nil {
+		if output, err := exec.Command("mcopy", "-i", medium, answerFile, "::/autounattend.xml").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to copy autounattend.xml to floppy: %v\n%s", err, output)
+		}
+		return nil
+	}
+
+	tempMount, err := os.MkdirTemp("", "bvm-floppy-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp mount point: %v", err)
+	}
+	defer os.RemoveAll(tempMount)
+
+	if err := exec.Command("sudo", "mount", "-o", "loop", medium, tempMount).Run(); err != nil {
+		return fmt.Errorf("failed to mount floppy image: %v", err)
+	}
+	defer exec.Command("sudo", "umount", tempMount).Run()
+
+	if err := exec.Command("sudo", "cp", answerFile, filepath.Join(tempMount, "autounattend.xml")).Run(); err != nil {
+		return fmt.Errorf("failed to copy autounattend.xml to floppy: %v", err)
+	}
+	return nil
+}
+
+// makeAnswerFileInstallerISO rebuilds installer.iso with autounattend.xml in its root. installer.iso itself is left untouched.
+func makeAnswerFileInstallerISO(answerFile string, installerISO string, medium string) error {
+	Status("Rebuilding the installer ISO with the answer file, this only happens when the answer file changes...")
+	tempDir, err := os.MkdirTemp("", "bvm-installer-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := runCommandWithSpinner("Extracting installer ISO", "7z", "x", installerISO, "-o"+tempDir, "-y"); err != nil {
+		return fmt.Errorf("failed to extract installer ISO: %v", err)
+	}
+	if err := copyFile(answerFile, filepath.Join(tempDir, "autounattend.xml")); err != nil {
+		return fmt.Errorf("failed to copy autounattend.xml: %v", err)
+	}
+
+	// Build next to the target so an interrupted build never looks up to date
+	partial := strings.TrimSuffix(medium, ".iso") + ".partial.iso"
+	if err := rebuildISO(tempDir, partial); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("failed to rebuild installer ISO: %v", err)
+	}
+	if err := os.Rename(partial, medium); err != nil {
+		return fmt.Errorf("failed to move %s into place: %v", filepath.Base(medium), err)
+	}
+	StatusGreen("Created " + filepath.Base(medium))
+	return nil
+}
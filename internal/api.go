@@ -11,6 +11,9 @@ import (
 	"runtime"
 	"strings"
 	"time"
+
+	"github.com/pi-apps-go/bvm-go/pkg/registry"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
 )
 
 var (
@@ -604,24 +607,23 @@ func CreateNewVM(vmDir string) error {
 	}
 	Status("  ✓ Copied remmina configuration")
 
-	// Create GUI steps complete file
-	stepsFile := filepath.Join(vmDir, "gui-steps-complete")
-	if err := os.WriteFile(stepsFile, []byte("1"), 0644); err != nil {
-		return fmt.Errorf("failed to create gui-steps-complete file: %v", err)
+	// Start tracking the setup progress in state.json
+	if err := vmstate.New(vmDir).Set(vmstate.Created, vmstate.StepNewVM, "bvm-config.toml", "connect.remmina"); err != nil {
+		return err
 	}
-	Status("  ✓ Created GUI progress tracking file")
+	Status("  ✓ Created state.json")
 
-	// copy over autounattend.xml
-	autounattendSrc := filepath.Join(resourcesDir, "autounattend.xml")
-	autounattendDst := filepath.Join(vmDir, "unattended", "autounattend.xml")
-	// make the unattended directory if it doesn't exist
+	// make the unattended directory, the first login scripts are generated into it by the prepare step
 	if err := os.MkdirAll(filepath.Join(vmDir, "unattended"), 0755); err != nil {
 		return fmt.Errorf("failed to create unattended directory: %v", err)
 	}
-	if err := copyFile(autounattendSrc, autounattendDst); err != nil {
-		return fmt.Errorf("failed to copy autounattend.xml: %v", err)
+
+	// Add the VM to vms.toml, so bvm list and manage-vms-cli know about it
+	if vm, err := registry.Register(vmDir); err != nil {
+		Warning("Failed to add the VM to the VM list: " + err.Error())
+	} else {
+		Status("  ✓ Added to the VM list as " + vm.Name)
 	}
-	Status("  ✓ Copied autounattend.xml")
 
 	StatusGreen("Successfully created new VM at: " + vmDir)
 	Status("You should now be ready for the next step: bvm download " + vmDir)
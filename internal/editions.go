@@ -0,0 +1,214 @@
+package internal
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// editionsData is the single source of truth for Windows edition product keys
+//
+//go:embed data/editions.toml
+var editionsData []byte
+
+// WindowsEdition describes a Windows edition and the product keys BVM uses for it
+type WindowsEdition struct {
+	EditionID   string   `toml:"edition_id"`
+	DisplayName string   `toml:"display_name"`
+	Names       []string `toml:"names"`
+	InstallKey  string   `toml:"install_key"`
+	KMSKey      string   `toml:"kms_key"`
+}
+
+// editionTable is the decoded form of data/editions.toml
+type editionTable struct {
+	Version  int              `toml:"version"`
+	Editions []WindowsEdition `toml:"edition"`
+}
+
+var (
+	editionsOnce sync.Once
+	editions     editionTable
+	editionsErr  error
+)
+
+// fallbackEditionID is used when the installer contains an edition that is not in the data set
+const fallbackEditionID = "Professional"
+
+// loadEditions decodes the embedded edition data once
+func loadEditions() (editionTable, error) {
+	editionsOnce.Do(func() {
+		if _, err := toml.Decode(string(editionsData), &editions); err != nil {
+			editionsErr = fmt.Errorf("embedded editions.toml is invalid: %v", err)
+		}
+	})
+	return editions, editionsErr
+}
+
+// EditionsVersion returns the version of the embedded edition data set
+func EditionsVersion() int {
+	table, err := loadEditions()
+	if err != nil {
+		return 0
+	}
+	return table.Version
+}
+
+// ListEditions returns every edition in the embedded data set
+func ListEditions() []WindowsEdition {
+	table, err := loadEditions()
+	if err != nil {
+		Warning(err.Error())
+		return nil
+	}
+	return table.Editions
+}
+
+// LookupEdition finds the edition matching a WIM EditionID.
+//
+// name is the image name reported by wiminfo and is optional. It is only used to pick between
+// editions sharing the same EditionID (for example Windows Server 2019 and 2022).
+// If no EditionID is known, the edition is looked up by name alone.
+func LookupEdition(editionID string, name string) (WindowsEdition, bool) {
+	var byID []WindowsEdition
+	for _, edition := range ListEditions() {
+		if editionID != "" && strings.EqualFold(edition.EditionID, editionID) {
+			byID = append(byID, edition)
+		}
+	}
+
+	// Prefer the entry whose image name matches exactly
+	candidates := byID
+	if editionID == "" {
+		candidates = ListEditions()
+	}
+	if name != "" {
+		for _, edition := range candidates {
+			for _, n := range edition.Names {
+				if strings.EqualFold(n, name) {
+					return edition, true
+				}
+			}
+		}
+	}
+
+	if len(byID) > 0 {
+		return byID[0], true
+	}
+	return WindowsEdition{}, false
+}
+
+// LookupEditionOrFallback behaves like LookupEdition, but returns the Pro edition when nothing matches
+func LookupEditionOrFallback(editionID string, name string) (WindowsEdition, bool) {
+	if edition, ok := LookupEdition(editionID, name); ok {
+		return edition, true
+	}
+	edition, _ := LookupEdition(fallbackEditionID, "")
+	return edition, false
+}
+
+// DetectInstallerEdition mounts installer.iso from the VM directory and reads the EditionID, image name
+// and build of the first image in install.wim/install.esd using wiminfo
+func DetectInstallerEdition(vmdir string) (editionID string, name string, build int, err error) {
+	installerISO := filepath.Join(vmdir, "installer.iso")
+	if _, err := os.Stat(installerISO); os.IsNotExist(err) {
+		return "", "", 0, fmt.Errorf("installer.iso not found in %s", vmdir)
+	}
+
+	// Try to detect Windows edition from ISO
+	mountPoint := "/tmp/bvm_iso_detect"
+	os.MkdirAll(mountPoint, 0755)
+	defer os.RemoveAll(mountPoint)
+
+	// Mount ISO
+	cmd := exec.Command("sudo", "mount", "-r", installerISO, mountPoint)
+	if err := cmd.Run(); err != nil {
+		return "", "", 0, fmt.Errorf("failed to mount ISO: %v", err)
+	}
+	defer exec.Command("sudo", "umount", mountPoint).Run()
+
+	// Check for install.wim first, then install.esd
+	var wimFile string
+	installWim := filepath.Join(mountPoint, "sources", "install.wim")
+	installEsd := filepath.Join(mountPoint, "sources", "install.esd")
+
+	if _, err := os.Stat(installWim); err == nil {
+		wimFile = installWim
+	} else if _, err := os.Stat(installEsd); err == nil {
+		wimFile = installEsd
+	} else {
+		return "", "", 0, fmt.Errorf("neither install.wim nor install.esd found in ISO")
+	}
+
+	// Use wiminfo to get Windows edition
+	cmd = exec.Command("wiminfo", wimFile)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to run wiminfo: %v", err)
+	}
+
+	editionID, name = parseWiminfoEdition(string(output))
+	if editionID == "" && name == "" {
+		return "", "", 0, fmt.Errorf("could not detect Windows edition from ISO")
+	}
+	return editionID, name, parseWiminfoBuild(string(output)), nil
+}
+
+// parseWiminfoEdition extracts the EditionID and name of the first image from wiminfo output
+func parseWiminfoEdition(output string) (editionID string, name string) {
+	images := 0
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(key) {
+		case "Index":
+			images++
+		case "Name":
+			if images <= 1 && name == "" {
+				name = value
+			}
+		case "Edition ID":
+			if images <= 1 && editionID == "" {
+				editionID = value
+			}
+		}
+
+		// Only the first image is relevant
+		if images > 1 {
+			break
+		}
+	}
+	return editionID, name
+}
+
+// parseWiminfoBuild extracts the build number of the first image from wiminfo output, 0 if it has none
+func parseWiminfoBuild(output string) int {
+	images := 0
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Index":
+			images++
+		case "Build":
+			if images <= 1 {
+				build, _ := strconv.Atoi(strings.TrimSpace(value))
+				return build
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// productKey is the format of every key in editions.toml
+var productKey = regexp.MustCompile(`^[0-9A-Z]{5}(-[0-9A-Z]{5}){4}$`)
+
+func TestEmbeddedEditions(t *testing.T) {
+	table, err := loadEditions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Version < 1 {
+		t.Errorf("version = %d, want at least 1", table.Version)
+	}
+	if len(table.Editions) == 0 {
+		t.Fatal("editions.toml has no editions")
+	}
+
+	names := map[string]string{}
+	for _, edition := range table.Editions {
+		if edition.EditionID == "" || edition.DisplayName == "" {
+			t.Errorf("edition %+v has no edition_id or display_name", edition)
+		}
+		if !productKey.MatchString(edition.InstallKey) {
+			t.Errorf("%s has install_key %q, want a product key", edition.DisplayName, edition.InstallKey)
+		}
+		if edition.KMSKey != "" && !productKey.MatchString(edition.KMSKey) {
+			t.Errorf("%s has kms_key %q, want a product key", edition.DisplayName, edition.KMSKey)
+		}
+		// An image name that belongs to two editions would make LookupEdition pick one at random
+		for _, name := range edition.Names {
+			if other, ok := names[name]; ok {
+				t.Errorf("image name %q belongs to %s and %s", name, other, edition.DisplayName)
+			}
+			names[name] = edition.DisplayName
+		}
+	}
+
+	if _, ok := LookupEdition(fallbackEditionID, ""); !ok {
+		t.Errorf("fallback edition %s is not in editions.toml", fallbackEditionID)
+	}
+}
+
+func TestLookupEdition(t *testing.T) {
+	tests := []struct {
+		name      string
+		editionID string
+		imageName string
+		want      string
+		ok        bool
+	}{
+		{name: "edition ID", editionID: "Professional", want: "Windows Pro", ok: true},
+		{name: "edition ID ignores case", editionID: "professional", want: "Windows Pro", ok: true},
+		{name: "image name picks the release of a shared edition ID", editionID: "ServerStandard", imageName: "Windows Server 2019 Standard", want: "Windows Server 2019 Standard", ok: true},
+		{name: "unknown image name falls back to the first edition with the ID", editionID: "ServerStandard", imageName: "Windows Server 2025 Standard", want: "Windows Server 2022 Standard", ok: true},
+		{name: "image name without edition ID", imageName: "Windows 11 Home N", want: "Windows Home N", ok: true},
+		{name: "image name of another edition is ignored", editionID: "Core", imageName: "Windows 11 Pro", want: "Windows Home", ok: true},
+		{name: "unknown edition ID", editionID: "ProfessionalCountrySpecific"},
+		{name: "nothing known"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			edition, ok := LookupEdition(test.editionID, test.imageName)
+			if ok != test.ok || edition.DisplayName != test.want {
+				t.Errorf("LookupEdition(%q, %q) = %q, %v, want %q, %v", test.editionID, test.imageName, edition.DisplayName, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestLookupEditionOrFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		editionID string
+		imageName string
+		want      string
+		ok        bool
+	}{
+		{name: "known edition", editionID: "Enterprise", want: "Windows Enterprise", ok: true},
+		{name: "unknown edition ID falls back to Pro", editionID: "ProfessionalCountrySpecific", want: "Windows Pro"},
+		{name: "unknown image name falls back to Pro", imageName: "Windows 12 Pro", want: "Windows Pro"},
+		{name: "nothing known falls back to Pro", want: "Windows Pro"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			edition, ok := LookupEditionOrFallback(test.editionID, test.imageName)
+			if ok != test.ok || edition.DisplayName != test.want {
+				t.Errorf("LookupEditionOrFallback(%q, %q) = %q, %v, want %q, %v", test.editionID, test.imageName, edition.DisplayName, ok, test.want, test.ok)
+			}
+			if edition.InstallKey == "" {
+				t.Errorf("LookupEditionOrFallback(%q, %q) has no install key", test.editionID, test.imageName)
+			}
+		})
+	}
+}
+
+func TestParseWiminfoEdition(t *testing.T) {
+	captured, err := os.ReadFile(filepath.Join("testdata", "wiminfo-win11-arm64.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		output    string
+		editionID string
+		imageName string
+	}{
+		{
+			name:      "first image of a captured install.wim",
+			output:    string(captured),
+			editionID: "Core",
+			imageName: "Windows 11 Home",
+		},
+		{
+			name:      "image without edition ID",
+			output:    "Index:                  1\nName:                   Windows 10 Pro\nDisplay Name:           Windows 10 Pro\n",
+			imageName: "Windows 10 Pro",
+		},
+		{
+			name:      "edition ID of the second image is ignored",
+			output:    "Index:                  1\nName:                   Windows 10 Pro\nIndex:                  2\nName:                   Windows 10 Home\nEdition ID:             Core\n",
+			imageName: "Windows 10 Pro",
+		},
+		{
+			name:      "Windows line endings",
+			output:    "Index:                  1\r\nName:                   Windows 11 Pro\r\nEdition ID:             Professional\r\n",
+			editionID: "Professional",
+			imageName: "Windows 11 Pro",
+		},
+		{
+			name:   "no images",
+			output: "WIM Information:\n----------------\nImage Count:    0\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			editionID, imageName := parseWiminfoEdition(test.output)
+			if editionID != test.editionID || imageName != test.imageName {
+				t.Errorf("parseWiminfoEdition() = %q, %q, want %q, %q", editionID, imageName, test.editionID, test.imageName)
+			}
+		})
+	}
+}
+
+func TestParseWiminfoBuild(t *testing.T) {
+	captured, err := os.ReadFile(filepath.Join("testdata", "wiminfo-win11-arm64.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		output string
+		want   int
+	}{
+		{name: "captured install.wim", output: string(captured), want: 22631},
+		{name: "service pack build is not the build", output: "Index: 1\nService Pack Build:     2428\nBuild:                  19045\n", want: 19045},
+		{name: "build of the second image is ignored", output: "Index: 1\nName: Windows 10 Pro\nIndex: 2\nBuild: 15035\n", want: 0},
+		{name: "no build", output: "Index: 1\nName: Windows 10 Pro\n", want: 0},
+		{name: "not a number", output: "Index: 1\nBuild: unknown\n", want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if build := parseWiminfoBuild(test.output); build != test.want {
+				t.Errorf("parseWiminfoBuild() = %d, want %d", build, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordWindowsBuild(t *testing.T) {
+	vmdir := t.TempDir()
+	if build := WindowsBuild(vmdir); build != 0 {
+		t.Errorf("WindowsBuild() before prepare = %d, want 0", build)
+	}
+	if err := RecordWindowsBuild(vmdir, 15035); err != nil {
+		t.Fatal(err)
+	}
+	if build := WindowsBuild(vmdir); build != 15035 {
+		t.Errorf("WindowsBuild() = %d, want 15035", build)
+	}
+	// An installer.iso without a build forgets the recorded one
+	if err := RecordWindowsBuild(vmdir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if build := WindowsBuild(vmdir); build != 0 {
+		t.Errorf("WindowsBuild() after recording no build = %d, want 0", build)
+	}
+}
@@ -38,6 +38,9 @@ type TOMLConfig struct {
 		UsbPassthrough struct {
 			UsbPassthrough string `toml:"usb_passthrough"`
 		} `toml:"usb_passthrough"`
+		UsbAutoforward struct {
+			UsbAutoforward string `toml:"usb_autoforward"`
+		} `toml:"usb_autoforward"`
 		ReduceGraphics struct {
 			ReduceGraphics bool `toml:"reduce_graphics"`
 		} `toml:"reduce_graphics"`
@@ -62,7 +65,37 @@ type TOMLConfig struct {
 		Virtualization struct {
 			Virtualization string `toml:"virtualization"`
 		} `toml:"virtualization"`
+		ComputerName struct {
+			ComputerName string `toml:"computer_name"`
+		} `toml:"computer_name"`
+		TimeZone struct {
+			TimeZone string `toml:"timezone"`
+		} `toml:"timezone"`
+		KeyboardLayout struct {
+			KeyboardLayout string `toml:"keyboard_layout"`
+		} `toml:"keyboard_layout"`
 	} `toml:"config"`
+	Provision struct {
+		Steps     []string `toml:"steps"`
+		SkipSteps []string `toml:"skip_steps"`
+		DarkMode  *bool    `toml:"dark_mode"`
+		Wallpaper string   `toml:"wallpaper"`
+		Packages  struct {
+			Winget []string `toml:"winget"`
+			Choco  []string `toml:"choco"`
+		} `toml:"packages"`
+	} `toml:"provision"`
+	Firstboot struct {
+		Retries      *int   `toml:"retries"`
+		StallTimeout *int   `toml:"stall_timeout"`
+		Watchdog     string `toml:"watchdog"`
+		// AnswerFileDelivery is the order answer file delivery methods are tried in
+		AnswerFileDelivery []string `toml:"answer_file_delivery"`
+	} `toml:"firstboot"`
+	Libvirt struct {
+		URI         string `toml:"uri"`
+		StoragePool string `toml:"storage_pool"`
+	} `toml:"libvirt"`
 	BVM struct {
 		General struct {
 			DisableUpdates bool `toml:"disable_updates"`
@@ -87,6 +120,7 @@ var (
 		VMMem            int
 		RdpPort          int
 		UsbPassthrough   string
+		UsbAutoforward   string
 		ReduceGraphics   bool
 		Fullscreen       bool
 		BVMDebug         bool
@@ -97,6 +131,26 @@ var (
 		Splash           bool
 		Mode             string
 		Virtualization   string
+		ComputerName     string
+		TimeZone         string
+		KeyboardLayout   string
+
+		// [provision] section, see pkg/provision
+		ProvisionSteps          []string
+		ProvisionSkipSteps      []string
+		ProvisionDarkMode       bool
+		ProvisionWallpaper      string
+		ProvisionWingetPackages []string
+		ProvisionChocoPackages  []string
+
+		// [firstboot] section
+		FirstbootRetries      int
+		FirstbootStallTimeout int
+		FirstbootWatchdog     string
+		AnswerFileDelivery    []string
+		// [libvirt] section
+		LibvirtURI         string
+		LibvirtStoragePool string
 	}
 )
 
@@ -130,6 +184,7 @@ func Init() {
 	BVMConfig.VMMem = tomlConfig.Config.VMMem.VMMem
 	BVMConfig.FreeRamGoal = tomlConfig.Config.FreeRamGoal.FreeRamGoal
 	BVMConfig.UsbPassthrough = tomlConfig.Config.UsbPassthrough.UsbPassthrough
+	BVMConfig.UsbAutoforward = tomlConfig.Config.UsbAutoforward.UsbAutoforward
 	BVMConfig.ReduceGraphics = tomlConfig.Config.ReduceGraphics.ReduceGraphics
 	BVMConfig.Fullscreen = tomlConfig.Config.Fullscreen.Fullscreen
 	BVMConfig.BVMDebug = tomlConfig.Config.BVMDebug.BVMDebug
@@ -139,6 +194,29 @@ func Init() {
 	BVMConfig.NetworkFlags = tomlConfig.Config.NetworkFlags.NetworkFlags
 	BVMConfig.Splash = tomlConfig.BVM.Splash.Splash
 	BVMConfig.Virtualization = tomlConfig.Config.Virtualization.Virtualization
+	BVMConfig.ComputerName = tomlConfig.Config.ComputerName.ComputerName
+	BVMConfig.TimeZone = tomlConfig.Config.TimeZone.TimeZone
+	BVMConfig.KeyboardLayout = tomlConfig.Config.KeyboardLayout.KeyboardLayout
+	BVMConfig.ProvisionSteps = tomlConfig.Provision.Steps
+	BVMConfig.ProvisionSkipSteps = tomlConfig.Provision.SkipSteps
+	BVMConfig.ProvisionWallpaper = tomlConfig.Provision.Wallpaper
+	BVMConfig.ProvisionWingetPackages = tomlConfig.Provision.Packages.Winget
+	BVMConfig.ProvisionChocoPackages = tomlConfig.Provision.Packages.Choco
+	// dark_mode defaults to true, so tell an unset value apart from false
+	BVMConfig.ProvisionDarkMode = tomlConfig.Provision.DarkMode == nil || *tomlConfig.Provision.DarkMode
+	BVMConfig.FirstbootWatchdog = tomlConfig.Firstboot.Watchdog
+	BVMConfig.AnswerFileDelivery = tomlConfig.Firstboot.AnswerFileDelivery
+	BVMConfig.LibvirtURI = tomlConfig.Libvirt.URI
+	BVMConfig.LibvirtStoragePool = tomlConfig.Libvirt.StoragePool
+	// 0 turns retries and the stall check off, so tell an unset value apart from 0
+	BVMConfig.FirstbootRetries = 2
+	if tomlConfig.Firstboot.Retries != nil {
+		BVMConfig.FirstbootRetries = *tomlConfig.Firstboot.Retries
+	}
+	BVMConfig.FirstbootStallTimeout = 30
+	if tomlConfig.Firstboot.StallTimeout != nil {
+		BVMConfig.FirstbootStallTimeout = *tomlConfig.Firstboot.StallTimeout
+	}
 	// Populate the confugration file if it is empty
 	if BVMConfig.VMName == "" {
 		BVMConfig.VMName = "default-vm"
@@ -221,7 +299,22 @@ func Init() {
 		BVMConfig.Mode = "firstinstall"
 	}
 	if BVMConfig.Virtualization == "" {
-		BVMConfig.Virtualization = "qemu"
+		BVMConfig.Virtualization = "libvirt"
+	}
+	if BVMConfig.ComputerName == "" {
+		BVMConfig.ComputerName = "*"
+	}
+	if BVMConfig.ProvisionWallpaper == "" {
+		BVMConfig.ProvisionWallpaper = `C:\WINDOWS\web\wallpaper\Windows\img19.jpg`
+	}
+	if BVMConfig.LibvirtURI == "" {
+		BVMConfig.LibvirtURI = "qemu:///session"
+	}
+	if BVMConfig.LibvirtStoragePool == "" {
+		BVMConfig.LibvirtStoragePool = "default"
+	}
+	if BVMConfig.FirstbootWatchdog == "" {
+		BVMConfig.FirstbootWatchdog = "auto"
 	}
 	// The bvm-config.toml template file should already exist in the resources directory
 	// We don't need to generate it dynamically since it's a template with comments
@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+)
+
+// WindowsLanguage describes a language Windows can be downloaded in and the locale settings that go with it
+type WindowsLanguage struct {
+	// Code is the short-code used by ESD releases, for example "en-us"
+	Code string
+	// Name is the pretty name used by download_language, for example "English (United States)"
+	Name string
+	// LangID is the Windows language identifier in hex, used to build input locales
+	LangID string
+	// KeyboardLayout is the Windows keyboard layout ID (KLID) usually used with this language
+	KeyboardLayout string
+}
+
+// downloadLanguages lists every language in the order shown by ListDownloadLanguages
+var downloadLanguages = []WindowsLanguage{
+	{Code: "ar-sa", Name: "Arabic", LangID: "0401", KeyboardLayout: "00000401"},
+	{Code: "pt-br", Name: "Brazilian Portuguese", LangID: "0416", KeyboardLayout: "00000416"},
+	{Code: "bg-bg", Name: "Bulgarian", LangID: "0402", KeyboardLayout: "00030402"},
+	{Code: "zh-cn", Name: "Chinese (Simplified)", LangID: "0804", KeyboardLayout: "00000804"},
+	{Code: "zh-tw", Name: "Chinese (Traditional)", LangID: "0404", KeyboardLayout: "00000404"},
+	{Code: "hr-hr", Name: "Croatian", LangID: "041a", KeyboardLayout: "0000041a"},
+	{Code: "cs-cz", Name: "Czech", LangID: "0405", KeyboardLayout: "00000405"},
+	{Code: "da-dk", Name: "Danish", LangID: "0406", KeyboardLayout: "00000406"},
+	{Code: "nl-nl", Name: "Dutch", LangID: "0413", KeyboardLayout: "00020409"},
+	{Code: "en-us", Name: "English (United States)", LangID: "0409", KeyboardLayout: "00000409"},
+	{Code: "en-gb", Name: "English International", LangID: "0809", KeyboardLayout: "00000809"},
+	{Code: "et-ee", Name: "Estonian", LangID: "0425", KeyboardLayout: "00000425"},
+	{Code: "fi-fi", Name: "Finnish", LangID: "040b", KeyboardLayout: "0000040b"},
+	{Code: "fr-fr", Name: "French", LangID: "040c", KeyboardLayout: "0000040c"},
+	{Code: "fr-ca", Name: "French Canadian", LangID: "0c0c", KeyboardLayout: "00001009"},
+	{Code: "de-de", Name: "German", LangID: "0407", KeyboardLayout: "00000407"},
+	{Code: "el-gr", Name: "Greek", LangID: "0408", KeyboardLayout: "00000408"},
+	{Code: "he-il", Name: "Hebrew", LangID: "040d", KeyboardLayout: "0002040d"},
+	{Code: "hu-hu", Name: "Hungarian", LangID: "040e", KeyboardLayout: "0000040e"},
+	{Code: "it-it", Name: "Italian", LangID: "0410", KeyboardLayout: "00000410"},
+	{Code: "ja-jp", Name: "Japanese", LangID: "0411", KeyboardLayout: "00000411"},
+	{Code: "ko-kr", Name: "Korean", LangID: "0412", KeyboardLayout: "00000412"},
+	{Code: "lv-lv", Name: "Latvian", LangID: "0426", KeyboardLayout: "00020426"},
+	{Code: "lt-lt", Name: "Lithuanian", LangID: "0427", KeyboardLayout: "00010427"},
+	{Code: "nb-no", Name: "Norwegian", LangID: "0414", KeyboardLayout: "00000414"},
+	{Code: "pl-pl", Name: "Polish", LangID: "0415", KeyboardLayout: "00000415"},
+	{Code: "pt-pt", Name: "Portuguese", LangID: "0816", KeyboardLayout: "00000816"},
+	{Code: "ro-ro", Name: "Romanian", LangID: "0418", KeyboardLayout: "00010418"},
+	{Code: "ru-ru", Name: "Russian", LangID: "0419", KeyboardLayout: "00000419"},
+	{Code: "sr-latn-rs", Name: "Serbian Latin", LangID: "241a", KeyboardLayout: "0000081a"},
+	{Code: "sk-sk", Name: "Slovak", LangID: "041b", KeyboardLayout: "0000041b"},
+	{Code: "sl-si", Name: "Slovenian", LangID: "0424", KeyboardLayout: "00000424"},
+	{Code: "es-es", Name: "Spanish", LangID: "0c0a", KeyboardLayout: "0000040a"},
+	{Code: "es-mx", Name: "Spanish (Mexico)", LangID: "080a", KeyboardLayout: "0000080a"},
+	{Code: "sv-se", Name: "Swedish", LangID: "041d", KeyboardLayout: "0000041d"},
+	{Code: "th-th", Name: "Thai", LangID: "041e", KeyboardLayout: "0000041e"},
+	{Code: "tr-tr", Name: "Turkish", LangID: "041f", KeyboardLayout: "0000041f"},
+	{Code: "uk-ua", Name: "Ukrainian", LangID: "0422", KeyboardLayout: "00020422"},
+}
+
+// xkbInputLocales maps X11 keyboard layouts (and layout(variant) pairs) to Windows input locales
+var xkbInputLocales = map[string]string{
+	"us":          "0409:00000409",
+	"us(intl)":    "0409:00020409",
+	"us(dvorak)":  "0409:00010409",
+	"us(colemak)": "0409:00000409",
+	"gb":          "0809:00000809",
+	"ie":          "1809:00001809",
+	"de":          "0407:00000407",
+	"at":          "0c07:00000407",
+	"ch":          "0807:00000807",
+	"ch(fr)":      "100c:0000100c",
+	"fr":          "040c:0000040c",
+	"be":          "080c:0000080c",
+	"ca":          "0c0c:00001009",
+	"ca(multix)":  "1009:00011009",
+	"es":          "0c0a:0000040a",
+	"latam":       "080a:0000080a",
+	"it":          "0410:00000410",
+	"pt":          "0816:00000816",
+	"br":          "0416:00000416",
+	"nl":          "0413:00020409",
+	"dk":          "0406:00000406",
+	"no":          "0414:00000414",
+	"se":          "041d:0000041d",
+	"fi":          "040b:0000040b",
+	"is":          "040f:0000040f",
+	"ee":          "0425:00000425",
+	"lv":          "0426:00020426",
+	"lt":          "0427:00010427",
+	"pl":          "0415:00000415",
+	"cz":          "0405:00000405",
+	"sk":          "041b:0000041b",
+	"hu":          "040e:0000040e",
+	"ro":          "0418:00010418",
+	"hr":          "041a:0000041a",
+	"si":          "0424:00000424",
+	"rs":          "0c1a:00000c1a",
+	"rs(latin)":   "241a:0000081a",
+	"bg":          "0402:00030402",
+	"gr":          "0408:00000408",
+	"ru":          "0419:00000419",
+	"ua":          "0422:00020422",
+	"by":          "0423:00000423",
+	"tr":          "041f:0000041f",
+	"il":          "040d:0002040d",
+	"ara":         "0401:00000401",
+	"jp":          "0411:00000411",
+	"kr":          "0412:00000412",
+	"cn":          "0804:00000804",
+	"tw":          "0404:00000404",
+	"th":          "041e:0000041e",
+	"in":          "4009:00000409",
+}
+
+// ianaWindowsTimeZones maps IANA time zone names to Windows time zone IDs.
+// Based on the CLDR windowsZones table, limited to zones people commonly run BVM in.
+var ianaWindowsTimeZones = map[string]string{
+	"UTC":                            "UTC",
+	"Etc/UTC":                        "UTC",
+	"Etc/GMT":                        "UTC",
+	"Europe/London":                  "GMT Standard Time",
+	"Europe/Dublin":                  "GMT Standard Time",
+	"Europe/Lisbon":                  "GMT Standard Time",
+	"Atlantic/Reykjavik":             "Greenwich Standard Time",
+	"Europe/Berlin":                  "W. Europe Standard Time",
+	"Europe/Amsterdam":               "W. Europe Standard Time",
+	"Europe/Rome":                    "W. Europe Standard Time",
+	"Europe/Stockholm":               "W. Europe Standard Time",
+	"Europe/Vienna":                  "W. Europe Standard Time",
+	"Europe/Zurich":                  "W. Europe Standard Time",
+	"Europe/Oslo":                    "W. Europe Standard Time",
+	"Europe/Luxembourg":              "W. Europe Standard Time",
+	"Europe/Paris":                   "Romance Standard Time",
+	"Europe/Brussels":                "Romance Standard Time",
+	"Europe/Madrid":                  "Romance Standard Time",
+	"Europe/Copenhagen":              "Romance Standard Time",
+	"Europe/Warsaw":                  "Central European Standard Time",
+	"Europe/Zagreb":                  "Central European Standard Time",
+	"Europe/Sarajevo":                "Central European Standard Time",
+	"Europe/Skopje":                  "Central European Standard Time",
+	"Europe/Prague":                  "Central Europe Standard Time",
+	"Europe/Budapest":                "Central Europe Standard Time",
+	"Europe/Bratislava":              "Central Europe Standard Time",
+	"Europe/Ljubljana":               "Central Europe Standard Time",
+	"Europe/Belgrade":                "Central Europe Standard Time",
+	"Europe/Athens":                  "GTB Standard Time",
+	"Europe/Bucharest":               "GTB Standard Time",
+	"Europe/Helsinki":                "FLE Standard Time",
+	"Europe/Kiev":                    "FLE Standard Time",
+	"Europe/Kyiv":                    "FLE Standard Time",
+	"Europe/Riga":                    "FLE Standard Time",
+	"Europe/Sofia":                   "FLE Standard Time",
+	"Europe/Tallinn":                 "FLE Standard Time",
+	"Europe/Vilnius":                 "FLE Standard Time",
+	"Europe/Istanbul":                "Turkey Standard Time",
+	"Europe/Moscow":                  "Russian Standard Time",
+	"Europe/Minsk":                   "Belarus Standard Time",
+	"Asia/Jerusalem":                 "Israel Standard Time",
+	"Asia/Riyadh":                    "Arab Standard Time",
+	"Asia/Dubai":                     "Arabian Standard Time",
+	"Asia/Tehran":                    "Iran Standard Time",
+	"Asia/Karachi":                   "Pakistan Standard Time",
+	"Asia/Kolkata":                   "India Standard Time",
+	"Asia/Calcutta":                  "India Standard Time",
+	"Asia/Dhaka":                     "Bangladesh Standard Time",
+	"Asia/Bangkok":                   "SE Asia Standard Time",
+	"Asia/Jakarta":                   "SE Asia Standard Time",
+	"Asia/Ho_Chi_Minh":               "SE Asia Standard Time",
+	"Asia/Shanghai":                  "China Standard Time",
+	"Asia/Hong_Kong":                 "China Standard Time",
+	"Asia/Taipei":                    "Taipei Standard Time",
+	"Asia/Singapore":                 "Singapore Standard Time",
+	"Asia/Kuala_Lumpur":              "Singapore Standard Time",
+	"Asia/Manila":                    "Singapore Standard Time",
+	"Asia/Tokyo":                     "Tokyo Standard Time",
+	"Asia/Seoul":                     "Korea Standard Time",
+	"Australia/Perth":                "W. Australia Standard Time",
+	"Australia/Adelaide":             "Cen. Australia Standard Time",
+	"Australia/Darwin":               "AUS Central Standard Time",
+	"Australia/Brisbane":             "E. Australia Standard Time",
+	"Australia/Sydney":               "AUS Eastern Standard Time",
+	"Australia/Melbourne":            "AUS Eastern Standard Time",
+	"Australia/Canberra":             "AUS Eastern Standard Time",
+	"Australia/Hobart":               "Tasmania Standard Time",
+	"Pacific/Auckland":               "New Zealand Standard Time",
+	"Pacific/Honolulu":               "Hawaiian Standard Time",
+	"America/Anchorage":              "Alaskan Standard Time",
+	"America/Los_Angeles":            "Pacific Standard Time",
+	"America/Vancouver":              "Pacific Standard Time",
+	"America/Tijuana":                "Pacific Standard Time (Mexico)",
+	"America/Phoenix":                "US Mountain Standard Time",
+	"America/Denver":                 "Mountain Standard Time",
+	"America/Edmonton":               "Mountain Standard Time",
+	"America/Boise":                  "Mountain Standard Time",
+	"America/Chicago":                "Central Standard Time",
+	"America/Winnipeg":               "Central Standard Time",
+	"America/Mexico_City":            "Central Standard Time (Mexico)",
+	"America/Regina":                 "Canada Central Standard Time",
+	"America/New_York":               "Eastern Standard Time",
+	"America/Toronto":                "Eastern Standard Time",
+	"America/Detroit":                "Eastern Standard Time",
+	"America/Halifax":                "Atlantic Standard Time",
+	"America/St_Johns":               "Newfoundland Standard Time",
+	"America/Sao_Paulo":              "E. South America Standard Time",
+	"America/Argentina/Buenos_Aires": "Argentina Standard Time",
+	"America/Bogota":                 "SA Pacific Standard Time",
+	"America/Lima":                   "SA Pacific Standard Time",
+	"America/Santiago":               "Pacific SA Standard Time",
+	"America/Caracas":                "Venezuela Standard Time",
+	"Africa/Cairo":                   "Egypt Standard Time",
+	"Africa/Johannesburg":            "South Africa Standard Time",
+	"Africa/Lagos":                   "W. Central Africa Standard Time",
+	"Africa/Nairobi":                 "E. Africa Standard Time",
+	"Africa/Casablanca":              "Morocco Standard Time",
+}
+
+// The host keyboard layout and time zone are read through these, tests point them at a fake host
+var (
+	// localectlStatus returns the output of localectl status
+	localectlStatus = func() (string, error) {
+		return runCommand("localectl", "status")
+	}
+	// timedatectlTimeZone returns the time zone reported by timedatectl
+	timedatectlTimeZone = func() (string, error) {
+		output, err := exec.Command("timedatectl", "show", "--property=Timezone", "--value").Output()
+		return string(output), err
+	}
+	keyboardDefaultsFile = "/etc/default/keyboard"
+	localtimeFile        = "/etc/localtime"
+	timezoneFile         = "/etc/timezone"
+)
+
+// LookupDownloadLanguage finds a download language by pretty name or short-code
+func LookupDownloadLanguage(language string) (WindowsLanguage, bool) {
+	for _, lang := range downloadLanguages {
+		if strings.EqualFold(lang.Name, language) || strings.EqualFold(lang.Code, language) {
+			return lang, true
+		}
+	}
+	return WindowsLanguage{}, false
+}
+
+// GuestLocale returns the locale settings for the answer file.
+// The display language follows download_language, the keyboard follows keyboard_layout or the host.
+func GuestLocale() unattend.Locale {
+	lang, ok := LookupDownloadLanguage(BVMConfig.DownloadLanguage)
+	if !ok {
+		Warning("Unknown download_language " + BVMConfig.DownloadLanguage + ", using English (United States) locale")
+		lang, _ = LookupDownloadLanguage("en-us")
+	}
+
+	inputLocale := lang.LangID + ":" + lang.KeyboardLayout
+
+	// Put the host keyboard layout first so it becomes the default, and keep the language's own layout as a second option
+	layout := BVMConfig.KeyboardLayout
+	if layout == "" {
+		layout = HostKeyboardLayout()
+	}
+	if layout != "" {
+		if hostLocale, ok := xkbInputLocale(layout); ok {
+			if hostLocale != inputLocale {
+				inputLocale = hostLocale + ";" + inputLocale
+			}
+		} else {
+			Warning("Keyboard layout " + layout + " has no Windows equivalent known to BVM, using the " + lang.Name + " layout")
+		}
+	}
+
+	return unattend.Locale{
+		UILanguage:   lang.Code,
+		InputLocale:  inputLocale,
+		SystemLocale: lang.Code,
+		UserLocale:   lang.Code,
+	}
+}
+
+// xkbInputLocale converts an X11 layout like "de" or "us(intl)" to a Windows input locale
+func xkbInputLocale(layout string) (string, bool) {
+	layout = strings.ToLower(strings.TrimSpace(layout))
+	if inputLocale, ok := xkbInputLocales[layout]; ok {
+		return inputLocale, true
+	}
+	// Fall back to the base layout if the variant is unknown
+	if base, _, found := strings.Cut(layout, "("); found {
+		inputLocale, ok := xkbInputLocales[base]
+		return inputLocale, ok
+	}
+	return "", false
+}
+
+// HostKeyboardLayout returns the first X11 keyboard layout of the host in layout(variant) form, or "" if unknown
+func HostKeyboardLayout() string {
+	var layouts, variants string
+
+	if output, err := localectlStatus(); err == nil {
+		for _, line := range strings.Split(output, "\n") {
+			key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+			if !found {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "X11 Layout":
+				layouts = strings.TrimSpace(value)
+			case "X11 Variant":
+				variants = strings.TrimSpace(value)
+			}
+		}
+	}
+
+	// Debian based systems without systemd-localed keep the layout here
+	if layouts == "" {
+		if content, err := os.ReadFile(keyboardDefaultsFile); err == nil {
+			for _, line := range strings.Split(string(content), "\n") {
+				key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+				if !found {
+					continue
+				}
+				value = strings.Trim(strings.TrimSpace(value), `"'`)
+				switch key {
+				case "XKBLAYOUT":
+					layouts = value
+				case "XKBVARIANT":
+					variants = value
+				}
+			}
+		}
+	}
+
+	// Only the first of multiple configured layouts is used
+	layout, _, _ := strings.Cut(layouts, ",")
+	variant, _, _ := strings.Cut(variants, ",")
+	if layout == "" {
+		return ""
+	}
+	if variant != "" {
+		return layout + "(" + variant + ")"
+	}
+	return layout
+}
+
+// GuestTimeZone returns the Windows time zone ID for the answer file.
+// timezone from the config is used if set (either as a Windows ID or an IANA name), otherwise the host time zone.
+func GuestTimeZone() string {
+	timezone := BVMConfig.TimeZone
+	if timezone == "" {
+		timezone = HostTimeZone()
+		if timezone == "" {
+			return ""
+		}
+	}
+
+	// Windows time zone IDs never contain a slash, IANA names nearly always do
+	if windowsZone, ok := ianaWindowsTimeZones[timezone]; ok {
+		return windowsZone
+	}
+	if strings.Contains(timezone, "/") {
+		Warning("Time zone " + timezone + " has no Windows equivalent known to BVM, keeping the Windows default")
+		return ""
+	}
+	return timezone
+}
+
+// HostTimeZone returns the IANA time zone name of the host, or "" if unknown
+func HostTimeZone() string {
+	if output, err := timedatectlTimeZone(); err == nil {
+		if timezone := strings.TrimSpace(output); timezone != "" {
+			return timezone
+		}
+	}
+
+	// /etc/localtime is a symlink into the zoneinfo database on most distributions
+	if target, err := filepath.EvalSymlinks(localtimeFile); err == nil {
+		if _, timezone, found := strings.Cut(target, "zoneinfo/"); found {
+			return timezone
+		}
+	}
+
+	if content, err := os.ReadFile(timezoneFile); err == nil {
+		return strings.TrimSpace(string(content))
+	}
+	return ""
+}
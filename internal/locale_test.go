@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// localectlGerman is localectl status on a Raspberry Pi OS host set up with a German keyboard
+const localectlGerman = `   System Locale: LANG=de_DE.UTF-8
+       VC Keymap: de-nodeadkeys
+      X11 Layout: de
+       X11 Model: pc105
+     X11 Variant: nodeadkeys
+`
+
+// fakeHost is the host the keyboard layout and time zone are read from. Empty fields are missing on it.
+type fakeHost struct {
+	localectl   string
+	timedatectl string
+	// keyboard is the content of /etc/default/keyboard
+	keyboard string
+	// localtime is the zone /etc/localtime links to
+	localtime string
+	// timezone is the content of /etc/timezone
+	timezone string
+}
+
+// use makes the host detection of the test read from host, and resets BVMConfig when the test is done
+func (host fakeHost) use(t *testing.T) {
+	savedConfig := BVMConfig
+	savedLocalectl, savedTimedatectl := localectlStatus, timedatectlTimeZone
+	savedKeyboard, savedLocaltime, savedTimezone := keyboardDefaultsFile, localtimeFile, timezoneFile
+	t.Cleanup(func() {
+		BVMConfig = savedConfig
+		localectlStatus, timedatectlTimeZone = savedLocalectl, savedTimedatectl
+		keyboardDefaultsFile, localtimeFile, timezoneFile = savedKeyboard, savedLocaltime, savedTimezone
+	})
+
+	missing := errors.New("command not found")
+	localectlStatus = func() (string, error) {
+		if host.localectl == "" {
+			return "", missing
+		}
+		return host.localectl, nil
+	}
+	timedatectlTimeZone = func() (string, error) {
+		if host.timedatectl == "" {
+			return "", missing
+		}
+		return host.timedatectl, nil
+	}
+
+	dir := t.TempDir()
+	keyboardDefaultsFile = filepath.Join(dir, "keyboard")
+	localtimeFile = filepath.Join(dir, "localtime")
+	timezoneFile = filepath.Join(dir, "timezone")
+	if host.keyboard != "" {
+		writeTestFile(t, keyboardDefaultsFile, host.keyboard)
+	}
+	if host.localtime != "" {
+		zone := filepath.Join(dir, "zoneinfo", host.localtime)
+		writeTestFile(t, zone, "TZif2")
+		if err := os.Symlink(zone, localtimeFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if host.timezone != "" {
+		writeTestFile(t, timezoneFile, host.timezone)
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXkbInputLocale(t *testing.T) {
+	tests := []struct {
+		layout string
+		want   string
+		ok     bool
+	}{
+		{layout: "us", want: "0409:00000409", ok: true},
+		{layout: "de", want: "0407:00000407", ok: true},
+		{layout: "us(intl)", want: "0409:00020409", ok: true},
+		{layout: "ch(fr)", want: "100c:0000100c", ok: true},
+		{layout: " GB ", want: "0809:00000809", ok: true},
+		{layout: "de(nodeadkeys)", want: "0407:00000407", ok: true},
+		{layout: "fr(oss)", want: "040c:0000040c", ok: true},
+		{layout: "xx"},
+		{layout: "xx(yy)"},
+		{layout: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.layout, func(t *testing.T) {
+			inputLocale, ok := xkbInputLocale(test.layout)
+			if inputLocale != test.want || ok != test.ok {
+				t.Errorf("xkbInputLocale(%q) = %q, %v, want %q, %v", test.layout, inputLocale, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestHostKeyboardLayout(t *testing.T) {
+	tests := []struct {
+		name string
+		host fakeHost
+		want string
+	}{
+		{name: "localectl", host: fakeHost{localectl: localectlGerman}, want: "de(nodeadkeys)"},
+		{name: "localectl without variant", host: fakeHost{localectl: "      X11 Layout: gb\n       X11 Model: pc105\n"}, want: "gb"},
+		{name: "first of multiple layouts", host: fakeHost{localectl: "      X11 Layout: us,ru\n     X11 Variant: intl,\n"}, want: "us(intl)"},
+		{
+			name: "localectl without X11 layout falls back to /etc/default/keyboard",
+			host: fakeHost{localectl: "   System Locale: LANG=C.UTF-8\n       VC Keymap: n/a\n", keyboard: "XKBMODEL=\"pc105\"\nXKBLAYOUT=\"fr\"\nXKBVARIANT=\"\"\n"},
+			want: "fr",
+		},
+		{
+			name: "/etc/default/keyboard without localectl",
+			host: fakeHost{keyboard: "XKBLAYOUT='ch'\nXKBVARIANT='fr'\nBACKSPACE=\"guess\"\n"},
+			want: "ch(fr)",
+		},
+		{name: "nothing known", host: fakeHost{}, want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.host.use(t)
+			if layout := HostKeyboardLayout(); layout != test.want {
+				t.Errorf("HostKeyboardLayout() = %q, want %q", layout, test.want)
+			}
+		})
+	}
+}
+
+func TestHostTimeZone(t *testing.T) {
+	tests := []struct {
+		name string
+		host fakeHost
+		want string
+	}{
+		{name: "timedatectl", host: fakeHost{timedatectl: "Europe/Berlin\n", localtime: "Asia/Tokyo"}, want: "Europe/Berlin"},
+		{name: "/etc/localtime link", host: fakeHost{localtime: "America/Argentina/Buenos_Aires", timezone: "Europe/Paris\n"}, want: "America/Argentina/Buenos_Aires"},
+		{name: "/etc/timezone", host: fakeHost{timezone: "Europe/Paris\n"}, want: "Europe/Paris"},
+		{name: "empty timedatectl output", host: fakeHost{timedatectl: "\n", timezone: "Etc/UTC\n"}, want: "Etc/UTC"},
+		{name: "nothing known", host: fakeHost{}, want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.host.use(t)
+			if timezone := HostTimeZone(); timezone != test.want {
+				t.Errorf("HostTimeZone() = %q, want %q", timezone, test.want)
+			}
+		})
+	}
+}
+
+func TestGuestTimeZone(t *testing.T) {
+	tests := []struct {
+		name     string
+		timezone string
+		host     fakeHost
+		want     string
+	}{
+		{name: "IANA name from the config", timezone: "Europe/Berlin", host: fakeHost{timedatectl: "Asia/Tokyo"}, want: "W. Europe Standard Time"},
+		{name: "Windows ID from the config", timezone: "Tokyo Standard Time", want: "Tokyo Standard Time"},
+		{name: "unknown IANA name keeps the Windows default", timezone: "Antarctica/Troll", want: ""},
+		{name: "host time zone", host: fakeHost{timedatectl: "America/New_York\n"}, want: "Eastern Standard Time"},
+		{name: "host time zone from /etc/localtime", host: fakeHost{localtime: "Australia/Hobart"}, want: "Tasmania Standard Time"},
+		{name: "unknown host time zone", host: fakeHost{timezone: "Asia/Ulaanbaatar\n"}, want: ""},
+		{name: "nothing known", host: fakeHost{}, want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.host.use(t)
+			BVMConfig.TimeZone = test.timezone
+			if timezone := GuestTimeZone(); timezone != test.want {
+				t.Errorf("GuestTimeZone() = %q, want %q", timezone, test.want)
+			}
+		})
+	}
+}
+
+func TestGuestLocale(t *testing.T) {
+	tests := []struct {
+		name        string
+		language    string
+		layout      string
+		host        fakeHost
+		uiLanguage  string
+		inputLocale string
+	}{
+		{name: "language without a host layout", language: "English (United States)", uiLanguage: "en-us", inputLocale: "0409:00000409"},
+		{name: "short-code", language: "ja-jp", uiLanguage: "ja-jp", inputLocale: "0411:00000411"},
+		{name: "host layout of the language is not repeated", language: "German", host: fakeHost{localectl: localectlGerman}, uiLanguage: "de-de", inputLocale: "0407:00000407"},
+		{name: "host layout comes first", language: "French", host: fakeHost{localectl: localectlGerman}, uiLanguage: "fr-fr", inputLocale: "0407:00000407;040c:0000040c"},
+		{name: "keyboard_layout wins over the host", language: "German", layout: "us(intl)", host: fakeHost{localectl: localectlGerman}, uiLanguage: "de-de", inputLocale: "0409:00020409;0407:00000407"},
+		{name: "unknown keyboard_layout keeps the language layout", language: "Dutch", layout: "xx", uiLanguage: "nl-nl", inputLocale: "0413:00020409"},
+		{name: "unknown language falls back to English", language: "Klingon", uiLanguage: "en-us", inputLocale: "0409:00000409"},
+		{name: "no language falls back to English", host: fakeHost{keyboard: "XKBLAYOUT=\"gb\"\n"}, uiLanguage: "en-us", inputLocale: "0809:00000809;0409:00000409"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.host.use(t)
+			BVMConfig.DownloadLanguage = test.language
+			BVMConfig.KeyboardLayout = test.layout
+
+			locale := GuestLocale()
+			if locale.UILanguage != test.uiLanguage || locale.SystemLocale != test.uiLanguage || locale.UserLocale != test.uiLanguage {
+				t.Errorf("GuestLocale() languages = %q, %q, %q, want %q", locale.UILanguage, locale.SystemLocale, locale.UserLocale, test.uiLanguage)
+			}
+			if locale.InputLocale != test.inputLocale {
+				t.Errorf("GuestLocale().InputLocale = %q, want %q", locale.InputLocale, test.inputLocale)
+			}
+		})
+	}
+}
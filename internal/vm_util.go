@@ -7,10 +7,14 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
 )
 
 // Global variable to track current mount point for cleanup
@@ -266,8 +270,44 @@ func RemoveMicrosoftDefender(mountpoint string) error {
 	return nil
 }
 
-// PrepareVM prepares a VM for first boot by creating unattended.iso and disk.qcow2
+// errPrepareCancelled is returned by prepareVM when the user chose to keep the existing disk.qcow2
+var errPrepareCancelled = fmt.Errorf("exiting as you requested")
+
+// PrepareVM prepares a VM for first boot by creating unattended.iso and disk.qcow2, and records the outcome in state.json
 func PrepareVM(vmdir string) error {
+	state, err := vmstate.Load(vmdir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(vmdir, "installer.iso")); err != nil {
+		return fmt.Errorf("installer.iso not found in %s. Run 'bvm download %s' first", vmdir, vmdir)
+	}
+	if !state.CanMoveTo(vmstate.Prepared) {
+		return fmt.Errorf("the VM is %s, run 'bvm download %s' first", state.State, vmdir)
+	}
+
+	if err := prepareVM(vmdir); err != nil {
+		// Keeping the disk leaves the VM as it was
+		if err == errPrepareCancelled {
+			return err
+		}
+		if stateErr := state.Fail(vmstate.StepPrepare, err); stateErr != nil {
+			Warning("Failed to update state.json: " + stateErr.Error())
+		}
+		return err
+	}
+
+	artifacts := []string{"unattended.iso", "disk.qcow2"}
+	for _, method := range unattend.DeliveryMethods() {
+		if path, err := filepath.Rel(vmdir, AnswerFilePath(vmdir, method)); err == nil {
+			artifacts = append(artifacts, path)
+		}
+	}
+	return state.Set(vmstate.Prepared, vmstate.StepPrepare, artifacts...)
+}
+
+// prepareVM renders the answer files and makes unattended.iso and a blank disk.qcow2
+func prepareVM(vmdir string) error {
 	Status("Preparing VM for first boot...")
 
 	// Check if unattended directory exists
@@ -276,39 +316,45 @@ func PrepareVM(vmdir string) error {
 		return fmt.Errorf("unattended directory does not exist: %s", unattendedDir)
 	}
 
-	// Detect Windows edition and update autounattend.xml with correct product key
-	if err := updateAutounattendProductKey(vmdir); err != nil {
-		Warning("Failed to auto-detect Windows edition and update product key: " + err.Error())
-		Warning("Proceeding with existing autounattend.xml - you may need to manually fix the product key")
+	// Detect Windows edition to pick the product keys for setup and activation
+	edition, err := detectEdition(vmdir)
+	if err != nil {
+		edition, _ = LookupEditionOrFallback("", "")
+		Warning("Failed to auto-detect Windows edition: " + err.Error())
+		// A build recorded for an earlier installer.iso doesn't apply anymore
+		if err := RecordWindowsBuild(vmdir, 0); err != nil {
+			Warning(err.Error())
+		}
+		Warning(fmt.Sprintf("Proceeding with the %s product key", edition.DisplayName))
+	}
+
+	// Generate autounattend.xml from the VM configuration
+	if err := writeAutounattend(vmdir, edition); err != nil {
+		return err
+	}
+
+	// Copy the first login script, which activates Windows with the KMS client key of the same edition
+	if err := writeFirstLoginScript(vmdir, edition.KMSKey); err != nil {
+		return err
 	}
 
 	// Create unattended.iso from unattended directory
 	unattendedISO := filepath.Join(vmdir, "unattended.iso")
 	Status("Making unattended.iso...")
 
-	// Use mkisofs/genisoimage to create the ISO
-	// -l: allow full 31-character filenames
-	// -J: Generate Joliet directory records
-	// -r: Generate SUSP and RR records using the Rock Ridge protocol
-	// -allow-lowercase: Allow lowercase characters in addition to the usual ISO9660 allowed characters
-	// -allow-multidot: Allow more than one dot in filenames
-	cmd := exec.Command("mkisofs", "-quiet", "-l", "-J", "-r", "-allow-lowercase", "-allow-multidot", "-o", unattendedISO, unattendedDir)
-	if err := cmd.Run(); err != nil {
-		// Try genisoimage as fallback
-		cmd = exec.Command("genisoimage", "-quiet", "-l", "-J", "-r", "-allow-lowercase", "-allow-multidot", "-o", unattendedISO, unattendedDir)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to create unattended.iso (tried both mkisofs and genisoimage): %v", err)
-		}
+	if err := makeISO(unattendedISO, unattendedDir); err != nil {
+		return fmt.Errorf("failed to create unattended.iso: %v", err)
 	}
 	StatusGreen("unattended.iso created successfully")
 
-	// Create a second copy for duplicate mounting (needed for reliable autounattend.xml detection)
-	unattended2ISO := filepath.Join(vmdir, "unattended2.iso")
-	cmd = exec.Command("cp", unattendedISO, unattended2ISO)
-	if err := cmd.Run(); err != nil {
-		Warning("Failed to create unattended2.iso copy: " + err.Error())
-	} else {
-		Status("Created unattended2.iso copy for reliable Windows Setup detection")
+	// Older versions mounted a second copy of unattended.iso and put the answer file into installer.iso itself
+	os.Remove(filepath.Join(vmdir, "unattended2.iso"))
+	originalISO := filepath.Join(vmdir, "installer-original.iso")
+	if _, err := os.Stat(originalISO); err == nil {
+		Status("Restoring the unmodified installer.iso...")
+		if err := os.Rename(originalISO, filepath.Join(vmdir, "installer.iso")); err != nil {
+			return fmt.Errorf("failed to restore installer.iso: %v", err)
+		}
 	}
 
 	// Handle main hard drive creation
@@ -329,7 +375,7 @@ func PrepareVM(vmdir string) error {
 
 		answer = strings.TrimSpace(strings.ToLower(answer))
 		if answer == "n" || answer == "no" {
-			return fmt.Errorf("exiting as you requested")
+			return errPrepareCancelled
 		}
 	}
 
@@ -351,7 +397,7 @@ func PrepareVM(vmdir string) error {
 	// cluster_size=2M: Larger cluster size for better performance
 	// nocow=on: Disable copy-on-write for better performance on Btrfs
 	// preallocation=metadata: Pre-allocate metadata for better performance
-	cmd = exec.Command("qemu-img", "create", "-f", "qcow2",
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2",
 		"-o", "cluster_size=2M,nocow=on,preallocation=metadata",
 		diskPath, fmt.Sprintf("%dG", disksize))
 
@@ -434,142 +480,161 @@ func GetMountPoint() string {
 	return currentMountPoint
 }
 
-// updateAutounattendProductKey detects Windows edition and updates autounattend.xml with correct product key
-func updateAutounattendProductKey(vmdir string) error {
-	// Generic Install Keys for unattended setup (better for installation than KMS keys)
-	// These keys select the Windows edition during setup but don't activate Windows
-	editionKeys := map[string]string{
-		// Windows 11 Generic Install Keys
-		"Windows 11 Home":                   "TX9XD-98N7V-6WMQ6-BX7FG-H8Q99",
-		"Windows 11 Pro":                    "VK7JG-NPHTM-C97JM-9MPGT-3V66T",
-		"Windows 11 Pro N":                  "2B87N-8KFHP-DKV6R-Y2C8J-PKCKT",
-		"Windows 11 Pro for Workstations":   "DXG7C-N36C4-C4HTG-X4T3X-2YV77",
-		"Windows 11 Pro for Workstations N": "WYPNQ-8C467-V2W6J-TX4WX-WT2RQ",
-		"Windows 11 Pro Education":          "8PTT6-RNW4C-6V7J2-C2D3X-MHBPB",
-		"Windows 11 Pro Education N":        "GJTYN-HDMQY-FRR76-HVGC7-QPF8P",
-		"Windows 11 Education":              "YNMGQ-8RYV3-4PGQ3-C8XTP-7CFBY",
-		"Windows 11 Education N":            "84NGF-MHBT6-FXBX8-QWJK7-DRR8H",
-		"Windows 11 Enterprise":             "XGVPP-NMH47-7TTHJ-W3FW7-8HV2C",
-		"Windows 11 Enterprise N":           "WGGHN-J84D6-QYCPR-T7PJ7-X766F",
-		"Windows 11 Enterprise G":           "YYVX9-NTFWV-6MDM3-9PT4T-4M68B",
-		"Windows 11 Enterprise G N":         "44RPN-FTY23-9VTTB-MP9BX-T84FV",
-
-		// Windows 10 Generic Install Keys
-		"Windows 10 Home":                   "TX9XD-98N7V-6WMQ6-BX7FG-H8Q99",
-		"Windows 10 Pro":                    "VK7JG-NPHTM-C97JM-9MPGT-3V66T",
-		"Windows 10 Pro N":                  "2B87N-8KFHP-DKV6R-Y2C8J-PKCKT",
-		"Windows 10 Pro for Workstations":   "DXG7C-N36C4-C4HTG-X4T3X-2YV77",
-		"Windows 10 Pro for Workstations N": "WYPNQ-8C467-V2W6J-TX4WX-WT2RQ",
-		"Windows 10 Pro Education":          "8PTT6-RNW4C-6V7J2-C2D3X-MHBPB",
-		"Windows 10 Pro Education N":        "GJTYN-HDMQY-FRR76-HVGC7-QPF8P",
-		"Windows 10 Education":              "YNMGQ-8RYV3-4PGQ3-C8XTP-7CFBY",
-		"Windows 10 Education N":            "84NGF-MHBT6-FXBX8-QWJK7-DRR8H",
-		"Windows 10 Enterprise":             "XGVPP-NMH47-7TTHJ-W3FW7-8HV2C",
-		"Windows 10 Enterprise N":           "WGGHN-J84D6-QYCPR-T7PJ7-X766F",
-		"Windows 10 Enterprise G":           "YYVX9-NTFWV-6MDM3-9PT4T-4M68B",
-		"Windows 10 Enterprise G N":         "44RPN-FTY23-9VTTB-MP9BX-T84FV",
-		"Windows 10 Enterprise LTSC 2019":   "XGVPP-NMH47-7TTHJ-W3FW7-8HV2C", // Use generic Enterprise key for LTSC
-		"Windows 10 Enterprise LTSC 2021":   "XGVPP-NMH47-7TTHJ-W3FW7-8HV2C", // Use generic Enterprise key for LTSC
-
-		// Windows Server editions (using generic install keys)
-		"Windows Server 2019 Standard":   "N69G4-B89J2-4G8F4-WWYCC-J464C",
-		"Windows Server 2019 Datacenter": "WMDGN-G9PQG-XVVXX-R3X43-63DFG",
-		"Windows Server 2022 Standard":   "VDYBN-27WPP-V4HQT-9VMD4-VMK7H",
-		"Windows Server 2022 Datacenter": "WX4NM-KYWYW-QJJR4-XV3QB-6VM33",
-	}
-
-	installerISO := filepath.Join(vmdir, "installer.iso")
-	if _, err := os.Stat(installerISO); os.IsNotExist(err) {
-		return fmt.Errorf("installer.iso not found in %s", vmdir)
-	}
-
-	// Try to detect Windows edition from ISO
-	mountPoint := "/tmp/bvm_iso_detect"
-	os.MkdirAll(mountPoint, 0755)
-	defer os.RemoveAll(mountPoint)
-
-	// Mount ISO
-	cmd := exec.Command("sudo", "mount", "-r", installerISO, mountPoint)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to mount ISO: %v", err)
+// writeAutounattend generates autounattend.xml for every answer file delivery method from the VM configuration
+func writeAutounattend(vmdir string, edition WindowsEdition) error {
+	// Generic install keys select the Windows edition during setup but don't activate Windows
+	Status(fmt.Sprintf("Using generic install key for %s: %s", edition.DisplayName, edition.InstallKey))
+
+	cfg := unattend.Config{
+		Arch:         windowsArch(),
+		Username:     BVMConfig.VMUsername,
+		Password:     BVMConfig.VMPassword,
+		ComputerName: BVMConfig.ComputerName,
+		ProductKey:   edition.InstallKey,
+		Locale:       GuestLocale(),
+		TimeZone:     GuestTimeZone(),
+	}
+	if err := writeAnswerFiles(vmdir, cfg); err != nil {
+		return err
 	}
-	defer exec.Command("sudo", "umount", mountPoint).Run()
 
-	// Check for install.wim first, then install.esd
-	var wimFile string
-	installWim := filepath.Join(mountPoint, "sources", "install.wim")
-	installEsd := filepath.Join(mountPoint, "sources", "install.esd")
+	StatusGreen(fmt.Sprintf("Generated autounattend.xml for %s", edition.DisplayName))
+	return nil
+}
 
-	if _, err := os.Stat(installWim); err == nil {
-		wimFile = installWim
-	} else if _, err := os.Stat(installEsd); err == nil {
-		wimFile = installEsd
-	} else {
-		return fmt.Errorf("neither install.wim nor install.esd found in ISO")
+// windowsArch returns the Windows processor architecture matching the host
+func windowsArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "amd64"
+	case "arm":
+		return "arm"
+	default:
+		return "arm64"
 	}
+}
 
-	// Use wiminfo to get Windows edition
-	cmd = exec.Command("wiminfo", wimFile)
-	output, err := cmd.Output()
+// detectEdition detects the Windows edition in installer.iso and looks it up in the edition data set.
+// The build of the Windows in installer.iso is recorded for the answer file delivery order.
+func detectEdition(vmdir string) (WindowsEdition, error) {
+	editionID, name, build, err := DetectInstallerEdition(vmdir)
 	if err != nil {
-		return fmt.Errorf("failed to run wiminfo: %v", err)
+		return WindowsEdition{}, err
 	}
-
-	// Parse wiminfo output to find Windows edition name
-	var detectedEdition string
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "Name:") {
-			detectedEdition = strings.TrimSpace(strings.TrimPrefix(line, "Name:"))
-			break
-		}
+	Status(fmt.Sprintf("Detected Windows edition: %s (EditionID: %s, build %d)", name, editionID, build))
+	if err := RecordWindowsBuild(vmdir, build); err != nil {
+		Warning(err.Error())
 	}
 
-	if detectedEdition == "" {
-		return fmt.Errorf("could not detect Windows edition from ISO")
+	edition, found := LookupEditionOrFallback(editionID, name)
+	if !found {
+		Warning(fmt.Sprintf("No specific key found for %s, using %s key as fallback", name, edition.DisplayName))
 	}
+	return edition, nil
+}
 
-	Status(fmt.Sprintf("Detected Windows edition: %s", detectedEdition))
-
-	// Look up the product key for this edition
-	var productKey string
-	if key, exists := editionKeys[detectedEdition]; exists {
-		productKey = key
-		Status(fmt.Sprintf("Using KMS client key for %s: %s", detectedEdition, productKey))
-	} else {
-		productKey = "W269N-WFGWX-YVC9B-4J6C9-T83GX" // Fallback to Pro key
-		Warning(fmt.Sprintf("No specific key found for %s, using Windows 10/11 Pro key as fallback", detectedEdition))
+// writeFirstLoginScript assembles firstlogin.ps1 in the unattended directory from the [provision] config.
+// An empty activation key skips activation in the guest.
+func writeFirstLoginScript(vmdir string, activationKey string) error {
+	userScripts, err := listUserScripts(vmdir)
+	if err != nil {
+		return err
 	}
-
-	// Update autounattend.xml with the correct product key
-	autounattendPath := filepath.Join(vmdir, "unattended", "autounattend.xml")
-	if _, err := os.Stat(autounattendPath); os.IsNotExist(err) {
-		return fmt.Errorf("autounattend.xml not found at %s", autounattendPath)
+	packages, err := provisionPackages(vmdir)
+	if err != nil {
+		return err
 	}
 
-	// Read the file
-	content, err := os.ReadFile(autounattendPath)
+	script, err := provision.Assemble(provision.Config{
+		Steps:         BVMConfig.ProvisionSteps,
+		SkipSteps:     BVMConfig.ProvisionSkipSteps,
+		ActivationKey: activationKey,
+		Debloat:       BVMConfig.Debloat,
+		DarkMode:      BVMConfig.ProvisionDarkMode,
+		Wallpaper:     BVMConfig.ProvisionWallpaper,
+		Packages:      packages,
+		UserScripts:   userScripts,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to read autounattend.xml: %v", err)
+		return fmt.Errorf("failed to assemble firstlogin.ps1: %v", err)
 	}
 
-	// Replace product keys in the file using regex
-	contentStr := string(content)
+	scriptDst := filepath.Join(vmdir, "unattended", "firstlogin.ps1")
+	if err := os.WriteFile(scriptDst, script, 0644); err != nil {
+		return fmt.Errorf("failed to write firstlogin.ps1: %v", err)
+	}
+	return nil
+}
 
-	// Pattern 1: Simple ProductKey tag
-	productKeyPattern1 := regexp.MustCompile(`<ProductKey>[^<]*</ProductKey>`)
-	contentStr = productKeyPattern1.ReplaceAllString(contentStr, fmt.Sprintf("<ProductKey>%s</ProductKey>", productKey))
+// listUserScripts returns the scripts in unattended/scripts/ sorted by name, they end up on unattended.iso next to firstlogin.ps1
+func listUserScripts(vmdir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(vmdir, "unattended", "scripts"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user scripts: %v", err)
+	}
 
-	// Pattern 2: ProductKey with Key child element
-	productKeyPattern2 := regexp.MustCompile(`<Key>[^<]*</Key>`)
-	contentStr = productKeyPattern2.ReplaceAllString(contentStr, fmt.Sprintf("<Key>%s</Key>", productKey))
+	var scripts []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if !provision.IsUserScript(entry.Name()) {
+			Warning("Ignoring " + entry.Name() + " in unattended/scripts, only .ps1, .cmd and .bat files are run")
+			continue
+		}
+		scripts = append(scripts, entry.Name())
+	}
+	if len(scripts) > 0 {
+		Status("Found user scripts to run on first login: " + strings.Join(scripts, ", "))
+	}
+	return scripts, nil
+}
 
-	// Write the updated content back to the file
-	if err := os.WriteFile(autounattendPath, []byte(contentStr), 0644); err != nil {
-		return fmt.Errorf("failed to write updated autounattend.xml: %v", err)
+// provisionPackages builds the package list from [provision.packages] and matches offline installers in unattended/packages/.
+// An offline installer is named after the package ID, like 7zip.7zip.msi, and an .exe can have its silent install arguments in 7zip.7zip.args.
+func provisionPackages(vmdir string) ([]provision.Package, error) {
+	packagesDir := filepath.Join(vmdir, "unattended", "packages")
+	installers := map[string]string{}
+	entries, err := os.ReadDir(packagesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read offline installers: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && provision.IsOfflineInstaller(entry.Name()) {
+			id := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			installers[strings.ToLower(id)] = entry.Name()
+		}
 	}
 
-	StatusGreen(fmt.Sprintf("Updated autounattend.xml with product key for %s", detectedEdition))
-	return nil
+	var packages []provision.Package
+	add := func(manager string, ids []string) error {
+		for _, id := range ids {
+			if id == "" || strings.ContainsAny(id, "|\r\n") {
+				return fmt.Errorf("invalid %s package name: %q", manager, id)
+			}
+			pkg := provision.Package{ID: id, Manager: manager}
+			if installer, ok := installers[strings.ToLower(id)]; ok {
+				pkg.OfflineInstaller = installer
+				// NSIS style silent switch unless the installer comes with its own arguments
+				pkg.OfflineArgs = "/S"
+				argsFile := filepath.Join(packagesDir, strings.TrimSuffix(installer, filepath.Ext(installer))+".args")
+				if content, err := os.ReadFile(argsFile); err == nil {
+					pkg.OfflineArgs = strings.TrimSpace(string(content))
+				}
+				Status(fmt.Sprintf("Using offline installer %s as fallback for %s", installer, id))
+			}
+			packages = append(packages, pkg)
+		}
+		return nil
+	}
+	if err := add("winget", BVMConfig.ProvisionWingetPackages); err != nil {
+		return nil, err
+	}
+	if err := add("choco", BVMConfig.ProvisionChocoPackages); err != nil {
+		return nil, err
+	}
+	return packages, nil
 }
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListUserScripts(t *testing.T) {
+	vmdir := t.TempDir()
+	if scripts, err := listUserScripts(vmdir); err != nil || scripts != nil {
+		t.Errorf("listUserScripts() without unattended/scripts = %v, %v, want nothing", scripts, err)
+	}
+
+	scriptsDir := filepath.Join(vmdir, "unattended", "scripts")
+	for _, name := range []string{"20-drivers.cmd", "10-apps.ps1", "README.txt", "30-cleanup.BAT"} {
+		writeTestFile(t, filepath.Join(scriptsDir, name), "")
+	}
+	if err := os.Mkdir(filepath.Join(scriptsDir, "40-folder.ps1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scripts, err := listUserScripts(vmdir)
+	if err != nil {
+		t.Fatalf("listUserScripts() failed: %v", err)
+	}
+	if got, want := strings.Join(scripts, " "), "10-apps.ps1 20-drivers.cmd 30-cleanup.BAT"; got != want {
+		t.Errorf("listUserScripts() = %s, want %s", got, want)
+	}
+}
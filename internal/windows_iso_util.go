@@ -26,6 +26,7 @@ import (
 	"github.com/charmbracelet/bubbles/spinner"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/google/uuid"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
 )
 
 // Progress model for downloads
@@ -234,11 +235,17 @@ func (m isoProgressModel) View() string {
 		m.status)
 }
 
+// ListDownloadLanguages returns every download language as code:Name lines
 func ListDownloadLanguages() string {
-	return "ar-sa:Arabic\npt-br:Brazilian Portuguese\nbg-bg:Bulgarian\nzh-cn:Chinese (Simplified)\nzh-tw:Chinese (Traditional)\nhr-hr:Croatian\ncs-cz:Czech\nda-dk:Danish\nnl-nl:Dutch\nen-us:English (United States)\nen-gb:English International\net-ee:Estonian\nfi-fi:Finnish\nfr-fr:French\nfr-ca:French Canadian\nde-de:German\nel-gr:Greek\nhe-il:Hebrew\nhu-hu:Hungarian\nit-it:Italian\nja-jp:Japanese\nko-kr:Korean\nlv-lv:Latvian\nlt-lt:Lithuanian\nnb-no:Norwegian\npl-pl:Polish\npt-pt:Portuguese\nro-ro:Romanian\nru-ru:Russian\nsr-latn-rs:Serbian Latin\nsk-sk:Slovak\nsl-si:Slovenian\nes-es:Spanish\nes-mx:Spanish (Mexico)\nsv-se:Swedish\nth-th:Thai\ntr-tr:Turkish\nuk-ua:Ukrainian"
+	lines := make([]string, 0, len(downloadLanguages))
+	for _, lang := range downloadLanguages {
+		lines = append(lines, lang.Code+":"+lang.Name)
+	}
+	return strings.Join(lines, "\n")
 }
 
-// DownloadWindowsISO is the main function that downloads the Windows ISO image and prepares it for use in the VM
+// DownloadWindowsISO is the main function that downloads the Windows ISO image and prepares it for use in the VM,
+// and records the outcome in state.json
 //
 //	language: the language of the Windows ISO image
 //	vmdir: the directory to store the Windows ISO image
@@ -246,14 +253,38 @@ func ListDownloadLanguages() string {
 //	version: the build version of the Windows ISO image (valid are: 22631, 15035, none and optional, assume latest if not set)
 //	arch: the architecture of the Windows ISO image
 //	edition: the edition of the Windows ISO image (for example Home or Pro, only valid for build 22631 and optional, if not set then default to Pro)
-func DownloadWindowsISO(language string, vmdir string, release string, version string, arch string, edition string, customISOPath ...string) {
+func DownloadWindowsISO(language string, vmdir string, release string, version string, arch string, edition string, customISOPath ...string) error {
+	// Create VM directory if it doesn't exist
+	if err := os.MkdirAll(vmdir, 0755); err != nil {
+		return fmt.Errorf("failed to create VM directory: %v", err)
+	}
+
+	state, err := vmstate.Load(vmdir)
+	if err != nil {
+		return err
+	}
+	// A new installer.iso would not match the disk of an installation that is going on or done
+	if !state.CanMoveTo(vmstate.Downloaded) {
+		return fmt.Errorf("an installation of Windows is going on in %s, finish with 'bvm firstboot %s' or start over with 'bvm prepare %s' before downloading again", vmdir, vmdir, vmdir)
+	}
+
+	if err := downloadWindowsISO(language, vmdir, release, version, arch, edition, customISOPath...); err != nil {
+		if stateErr := state.Fail(vmstate.StepDownload, err); stateErr != nil {
+			Warning("Failed to update state.json: " + stateErr.Error())
+		}
+		return err
+	}
+	return state.Set(vmstate.Downloaded, vmstate.StepDownload, "installer.iso")
+}
+
+// downloadWindowsISO downloads the Windows ISO image into vmdir, see DownloadWindowsISO for the parameters
+func downloadWindowsISO(language string, vmdir string, release string, version string, arch string, edition string, customISOPath ...string) error {
 	Status("Starting Windows ISO download process...")
 
 	// Handle custom ISO case
 	if release == "Custom ISO" {
 		if len(customISOPath) == 0 || customISOPath[0] == "" {
-			ErrorNoExit("Custom ISO path not provided")
-			return
+			return fmt.Errorf("custom ISO path not provided")
 		}
 
 		// Extract custom VirtIO path if provided (second parameter)
@@ -264,18 +295,11 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 
 		Status("Processing custom Windows ISO...")
 		if err := ProcessCustomWindowsISO(customISOPath[0], vmdir, customVirtioPath); err != nil {
-			ErrorNoExit("Failed to process custom Windows ISO: " + err.Error())
-			return
+			return fmt.Errorf("failed to process custom Windows ISO: %v", err)
 		}
 
 		StatusGreen("Custom Windows ISO processed successfully!")
-		return
-	}
-
-	// Create VM directory if it doesn't exist
-	if err := os.MkdirAll(vmdir, 0755); err != nil {
-		ErrorNoExit("Failed to create VM directory: " + err.Error())
-		return
+		return nil
 	}
 
 	// Rest of the existing download logic for standard Windows versions...
@@ -285,10 +309,9 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 	if _, err := os.Stat(installerISO); err == nil {
 		Status("installer.iso already exists, proceeding to virtio driver download")
 		if err := DownloadVirtioDrivers(vmdir, arch); err != nil {
-			ErrorNoExit("Failed to download virtio drivers: " + err.Error())
-			return
+			return fmt.Errorf("failed to download virtio drivers: %v", err)
 		}
-		return
+		return nil
 	}
 
 	Debug("Download parameters:")
@@ -301,8 +324,7 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 
 	// Check if all required variables are set
 	if language == "" || vmdir == "" || release == "" || arch == "" {
-		ErrorNoExit("Missing required variables")
-		return
+		return fmt.Errorf("missing required variables")
 	}
 
 	// Typical editions you will find on the ISO's provided by the Microsoft website as a end user
@@ -316,8 +338,7 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 	if version == "22631" {
 		// Check if the edition is valid if not blank and if the build version is 22631
 		if edition != "" && !slices.Contains(validEditions, edition) {
-			ErrorNoExit("Invalid edition: " + edition)
-			return
+			return fmt.Errorf("invalid edition: %s", edition)
 		} else if edition == "" {
 			edition = "Pro"
 		}
@@ -334,8 +355,7 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 			} else if arch == "x64" {
 				Status("Downloading Windows 11 x64 build " + version + " (" + language + ")")
 			} else {
-				ErrorNoExit("Invalid architecture: " + arch)
-				return
+				return fmt.Errorf("invalid architecture: %s", arch)
 			}
 		} else if release == "10" {
 			if arch == "ARM64" {
@@ -346,15 +366,12 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 			} else if arch == "ARMv7" && version == "15035" {
 				Status("Downloading Windows 10 ARMv7 build " + version + " (" + language + ", only compatible version for ARMv7 CPUs)")
 			} else if arch == "ARMv7" {
-				ErrorNoExit("Only leaked Windows 10 ARMv7 build 15035 is compatible with ARMv7 CPUs, all other versions are not supported")
-				return
+				return fmt.Errorf("only leaked Windows 10 ARMv7 build 15035 is compatible with ARMv7 CPUs, all other versions are not supported")
 			} else {
-				ErrorNoExit("Invalid architecture/build: " + arch + " " + version)
-				return
+				return fmt.Errorf("invalid architecture/build: %s %s", arch, version)
 			}
 		} else {
-			ErrorNoExit("Invalid version: " + version)
-			return
+			return fmt.Errorf("invalid version: %s", version)
 		}
 	}
 
@@ -373,8 +390,7 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		} else if release == "10" || release == "Windows 10" {
 			URL = "https://www.microsoft.com/en-us/software-download/windows10"
 		} else {
-			ErrorNoExit("Invalid release: " + release)
-			return
+			return fmt.Errorf("invalid release: %s", release)
 		}
 	} else if arch == "ARMv7" && version == "15035" {
 		// There are 2 ways to download the Windows 10 ARMv7 leaked build 15035 without needing an account, either from archive.org or files.open-rt.party
@@ -388,8 +404,7 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		// Convert from pretty language name to short-code used by esd releases
 		langCode := getLanguageCode(language)
 		if langCode == "" {
-			ErrorNoExit("Language must be specified in download_language variable. Get list of available languages by running bvm list-languages")
-			return
+			return fmt.Errorf("language must be specified in download_language variable. Get list of available languages by running bvm list-languages")
 		}
 
 		// Get ESD catalog
@@ -398,39 +413,33 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		// Get the Windows ESD catalog
 		resp, err := http.Get(URL)
 		if err != nil {
-			ErrorNoExit("Could not get list of Windows ESD releases: " + err.Error())
-			return
+			return fmt.Errorf("could not get list of Windows ESD releases: %v", err)
 		}
 		defer resp.Body.Close()
 
 		catalogBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			ErrorNoExit("Failed to read catalog response: " + err.Error())
-			return
+			return fmt.Errorf("failed to read catalog response: %v", err)
 		}
 
 		catalog := string(catalogBody)
 		if catalog == "" {
-			ErrorNoExit("Could not get list of Windows ESD releases. If you ran this step several times recently, the site likely temporarily banned your IP address.")
-			return
+			return fmt.Errorf("could not get list of Windows ESD releases. If you ran this step several times recently, the site likely temporarily banned your IP address.")
 		}
 
 		// Parse catalog to extract language-specific section
 		catalog = parseCatalogForLanguage(catalog, langCode)
 		if catalog == "" {
-			ErrorNoExit("Could not find language " + langCode + " in catalog")
-			return
+			return fmt.Errorf("could not find language %s in catalog", langCode)
 		}
 
 		// Create esdextract directory
 		esdExtractDir := filepath.Join(vmdir, "esdextract")
 		if err := os.RemoveAll(esdExtractDir); err != nil {
-			ErrorNoExit("Failed to remove esdextract folder: " + err.Error())
-			return
+			return fmt.Errorf("failed to remove esdextract folder: %v", err)
 		}
 		if err := os.MkdirAll(esdExtractDir, 0755); err != nil {
-			ErrorNoExit("Directory creation failed: " + err.Error())
-			return
+			return fmt.Errorf("directory creation failed: %v", err)
 		}
 
 		// Extract download URL, size, and SHA1 hash
@@ -442,15 +451,13 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		if !isValidESDFile(sourceFile, expectedSHA1) {
 			fmt.Println("  - Downloading Windows ESD image")
 			if err := downloadFile(downloadURL, sourceFile); err != nil {
-				ErrorNoExit("Failed to download ESD image: " + err.Error())
-				return
+				return fmt.Errorf("failed to download ESD image: %v", err)
 			}
 
 			fmt.Println("  - Verifying download...")
 			if !verifyFileSHA1(sourceFile, expectedSHA1) {
 				os.Remove(sourceFile)
-				ErrorNoExit("Successfully downloaded ESD image but it appears to be corrupted. Please run bvm again.")
-				return
+				return fmt.Errorf("successfully downloaded ESD image but it appears to be corrupted. Please run bvm again.")
 			}
 			fmt.Println("Done")
 		} else {
@@ -461,51 +468,46 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		fmt.Println("  - Scanning ESD image for partitions...")
 		professionalPartitionNum, err := getWindowsEditionPartition(sourceFile, edition)
 		if err != nil {
-			ErrorNoExit("Could not find Windows " + edition + " in image.esd: " + err.Error())
-			return
+			return fmt.Errorf("could not find Windows %s in image.esd: %v", edition, err)
 		}
 
 		// Extract Windows Setup Media
 		Status("Extracting Windows Setup Media to esdextract")
 		if err := runCommandWithSpinner("Extracting Windows Setup Media", "wimapply", sourceFile, "1", esdExtractDir); err != nil {
-			ErrorNoExit("Operation failed: " + err.Error())
-			return
+			return fmt.Errorf("operation failed: %v", err)
 		}
 
 		// Extract Microsoft Windows PE to boot.wim
 		Status("Extracting Microsoft Windows PE to boot.wim")
 		bootWimPath := filepath.Join(esdExtractDir, "sources", "boot.wim")
 		if err := runCommandWithSpinner("Extracting Windows PE", "wimexport", sourceFile, "2", bootWimPath, "--compress=LZX", "--chunk-size=32K"); err != nil {
-			ErrorNoExit("Operation failed: " + err.Error())
-			return
+			return fmt.Errorf("operation failed: %v", err)
 		}
 
 		// Extract Microsoft Windows Setup to boot.wim
 		Status("Extracting Microsoft Windows Setup to boot.wim")
 		if err := runCommandWithSpinner("Extracting Windows Setup", "wimexport", sourceFile, "3", bootWimPath, "--compress=LZX", "--chunk-size=32K", "--boot"); err != nil {
-			ErrorNoExit("Operation failed: " + err.Error())
-			return
+			return fmt.Errorf("operation failed: %v", err)
 		}
 
 		// Extract Windows 11 Pro to install.wim
 		Status("Extracting Windows 11 Pro to install.wim")
 		installWimPath := filepath.Join(esdExtractDir, "sources", "install.wim")
 		if err := runCommandWithSpinner("Extracting Windows 11 Pro", "wimexport", sourceFile, professionalPartitionNum, installWimPath, "--compress=none"); err != nil {
-			ErrorNoExit("Operation failed: " + err.Error())
-			return
+			return fmt.Errorf("operation failed: %v", err)
 		}
 
 		// Make boot noninteractive
 		efisysPath := filepath.Join(esdExtractDir, "efi", "microsoft", "boot", "efisys.bin")
 		efisysNopromptPath := filepath.Join(esdExtractDir, "efi", "microsoft", "boot", "efisys_noprompt.bin")
 		if err := copyFile(efisysNopromptPath, efisysPath); err != nil {
-			ErrorNoExit("Failed to copy efisys_noprompt.bin: " + err.Error())
-			return
+			return fmt.Errorf("failed to copy efisys_noprompt.bin: %v", err)
 		}
 
 		// Create installer.iso
+		// genisoimage runs in esdextract, so the ISO goes to the parent folder
 		installerISOPath := filepath.Join("..", "installer.iso")
-		os.Remove(installerISOPath) // Remove if exists
+		os.Remove(filepath.Join(vmdir, "installer.iso")) // Remove if exists
 
 		Status("Making installer.iso disk image...")
 		// Initial cleanup
@@ -516,9 +518,10 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 			"-allow-limited-size", "."}
 
 		if err := runGenisoWithProgress(args, esdExtractDir); err != nil {
-			ErrorNoExit("Operation failed: " + err.Error())
 			fmt.Println("DEBUG: genisoimage " + strings.Join(args, " "))
-			return
+			// A partial installer.iso must not be mistaken for a finished download
+			os.Remove(filepath.Join(vmdir, "installer.iso"))
+			return fmt.Errorf("operation failed: %v", err)
 		}
 
 		// Cleanup
@@ -528,97 +531,83 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 
 		// Download virtio drivers
 		if err := DownloadVirtioDrivers(vmdir, arch); err != nil {
-			ErrorNoExit("Failed to download virtio drivers: " + err.Error())
-			return
+			return fmt.Errorf("failed to download virtio drivers: %v", err)
 		}
 
-		return
+		return nil
 	} else if arch == "ARM64" && (release == "11" || release == "Windows 11") {
 		// for the latest Windows 11 ARM64 build, we need to get the download link from the Microsoft website by scraping the website for the download link
 		if err := downloadWindowsFromMicrosoft(release, arch, language, vmdir); err != nil {
-			ErrorNoExit(err.Error())
-			return
+			return err
 		}
 		StatusGreen("Windows 11 ARM64 ISO downloaded successfully")
 
 		// Download virtio drivers
 		if err := DownloadVirtioDrivers(vmdir, arch); err != nil {
-			ErrorNoExit("Failed to download virtio drivers: " + err.Error())
-			return
+			return fmt.Errorf("failed to download virtio drivers: %v", err)
 		}
 
-		return
+		return nil
 	} else if arch == "ARM64" && (release == "10" || release == "Windows 10") {
 		// for the latest Windows 10 ARM64 build, we need to get the download link from the Microsoft website by scraping the website for the download link
 		if err := downloadWindowsFromMicrosoft(release, arch, language, vmdir); err != nil {
-			ErrorNoExit(err.Error())
-			return
+			return err
 		}
 		StatusGreen("Windows 10 ARM64 ISO downloaded successfully")
 
 		// Download virtio drivers
 		if err := DownloadVirtioDrivers(vmdir, arch); err != nil {
-			ErrorNoExit("Failed to download virtio drivers: " + err.Error())
-			return
+			return fmt.Errorf("failed to download virtio drivers: %v", err)
 		}
 		installerISOPath := filepath.Join(vmdir, "installer.iso")
 		// Patch the ISO to make it noninteractive
 		if err := PatchWindowsISO(installerISOPath); err != nil {
-			ErrorNoExit("Failed to patch ISO: " + err.Error())
-			return
+			return fmt.Errorf("failed to patch ISO: %v", err)
 		}
-		return
+		return nil
 	} else if arch == "x64" && (release == "11" || release == "Windows 11") {
 		// for the latest Windows 11 x64 build, we need to get the download link from the Microsoft website by scraping the website for the download link
 		if err := downloadWindowsFromMicrosoft(release, arch, language, vmdir); err != nil {
-			ErrorNoExit(err.Error())
-			return
+			return err
 		}
 		StatusGreen("Windows 11 x64 ISO downloaded successfully")
 
 		// Download virtio drivers
 		if err := DownloadVirtioDrivers(vmdir, arch); err != nil {
-			ErrorNoExit("Failed to download virtio drivers: " + err.Error())
-			return
+			return fmt.Errorf("failed to download virtio drivers: %v", err)
 		}
 		installerISOPath := filepath.Join(vmdir, "installer.iso")
 		// Patch the ISO to make it noninteractive
 		if err := PatchWindowsISO(installerISOPath); err != nil {
-			ErrorNoExit("Failed to patch ISO: " + err.Error())
-			return
+			return fmt.Errorf("failed to patch ISO: %v", err)
 		}
-		return
+		return nil
 	} else if arch == "x64" && (release == "10" || release == "Windows 10") {
 		// for the latest Windows 10 x64 build, we need to get the download link from the Microsoft website by scraping the website for the download link
 		if err := downloadWindowsFromMicrosoft(release, arch, language, vmdir); err != nil {
-			ErrorNoExit(err.Error())
-			return
+			return err
 		}
 		StatusGreen("Windows 10 x64 ISO downloaded successfully")
 
 		// Download virtio drivers
 		if err := DownloadVirtioDrivers(vmdir, arch); err != nil {
-			ErrorNoExit("Failed to download virtio drivers: " + err.Error())
-			return
+			return fmt.Errorf("failed to download virtio drivers: %v", err)
 		}
-		return
+		return nil
 	} else if arch == "ARMv7" && version == "15035" {
 		// for the Windows 10 ARMv7 leaked build, download a cached downloaded image from the open-rt.party file server
 		// Only English (United States) is supported for this build, will ignore any language other than specified
 		if language != "English (United States)" {
-			ErrorNoExit("Windows 10 ARMv7 build 15035 is only supported for English (United States)")
-			return
+			return fmt.Errorf("Windows 10 ARMv7 build 15035 is only supported for English (United States)")
 		}
 
 		// Create esdextract directory (same as build 22631 process)
 		esdExtractDir := filepath.Join(vmdir, "esdextract")
 		if err := os.RemoveAll(esdExtractDir); err != nil {
-			ErrorNoExit("Failed to remove esdextract folder: " + err.Error())
-			return
+			return fmt.Errorf("failed to remove esdextract folder: %v", err)
 		}
 		if err := os.MkdirAll(esdExtractDir, 0755); err != nil {
-			ErrorNoExit("Directory creation failed: " + err.Error())
-			return
+			return fmt.Errorf("directory creation failed: %v", err)
 		}
 
 		sourceFile := filepath.Join(vmdir, "image.7z")
@@ -627,8 +616,7 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
 			fmt.Println("  - Downloading Windows 10 ARMv7 build 15035 archive")
 			if err := downloadFile(URL, sourceFile); err != nil {
-				ErrorNoExit("Failed to download Windows 10 ARMv7 archive: " + err.Error())
-				return
+				return fmt.Errorf("failed to download Windows 10 ARMv7 archive: %v", err)
 			}
 		} else {
 			fmt.Println("  - Not downloading " + sourceFile + " - file exists")
@@ -637,21 +625,20 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		// Extract 7z archive using 7z command
 		Status("Extracting Windows 10 ARMv7 build 15035 archive")
 		if err := runCommandWithSpinner("Extracting archive", "7z", "x", sourceFile, "-o"+esdExtractDir); err != nil {
-			ErrorNoExit("Failed to extract 7z archive: " + err.Error())
-			return
+			return fmt.Errorf("failed to extract 7z archive: %v", err)
 		}
 
 		// Make boot noninteractive (same as build 22631 process)
 		efisysPath := filepath.Join(esdExtractDir, "efi", "microsoft", "boot", "efisys.bin")
 		efisysNopromptPath := filepath.Join(esdExtractDir, "efi", "microsoft", "boot", "efisys_noprompt.bin")
 		if err := copyFile(efisysNopromptPath, efisysPath); err != nil {
-			ErrorNoExit("Failed to copy efisys_noprompt.bin: " + err.Error())
-			return
+			return fmt.Errorf("failed to copy efisys_noprompt.bin: %v", err)
 		}
 
 		// Create installer.iso (same as build 22631 process)
+		// genisoimage runs in esdextract, so the ISO goes to the parent folder
 		installerISOPath := filepath.Join("..", "installer.iso")
-		os.Remove(installerISOPath) // Remove if exists
+		os.Remove(filepath.Join(vmdir, "installer.iso")) // Remove if exists
 
 		Status("Making installer.iso disk image...")
 		// Initial cleanup
@@ -662,9 +649,10 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 			"-allow-limited-size", "."}
 
 		if err := runGenisoWithProgress(args, esdExtractDir); err != nil {
-			ErrorNoExit("Operation failed: " + err.Error())
 			fmt.Println("DEBUG: genisoimage " + strings.Join(args, " "))
-			return
+			// A partial installer.iso must not be mistaken for a finished download
+			os.Remove(filepath.Join(vmdir, "installer.iso"))
+			return fmt.Errorf("operation failed: %v", err)
 		}
 
 		// Cleanup
@@ -679,56 +667,20 @@ func DownloadWindowsISO(language string, vmdir string, release string, version s
 		// 	ErrorNoExit("Failed to download virtio drivers: " + err.Error())
 		// 	return
 		// }
-		return
+		return nil
 	} else {
-		ErrorNoExit("Invalid architecture/build: " + arch + " " + version)
-		return
+		return fmt.Errorf("invalid architecture/build: %s %s", arch, version)
 	}
 }
 
 // getLanguageCode converts pretty language name to short-code used by ESD releases
 func getLanguageCode(language string) string {
-	languageMap := map[string]string{
-		"Arabic":                  "ar-sa",
-		"Brazilian Portuguese":    "pt-br",
-		"Bulgarian":               "bg-bg",
-		"Chinese (Simplified)":    "zh-cn",
-		"Chinese (Traditional)":   "zh-tw",
-		"Croatian":                "hr-hr",
-		"Czech":                   "cs-cz",
-		"Danish":                  "da-dk",
-		"Dutch":                   "nl-nl",
-		"English (United States)": "en-us",
-		"English International":   "en-gb",
-		"Estonian":                "et-ee",
-		"Finnish":                 "fi-fi",
-		"French":                  "fr-fr",
-		"French Canadian":         "fr-ca",
-		"German":                  "de-de",
-		"Greek":                   "el-gr",
-		"Hebrew":                  "he-il",
-		"Hungarian":               "hu-hu",
-		"Italian":                 "it-it",
-		"Japanese":                "ja-jp",
-		"Korean":                  "ko-kr",
-		"Latvian":                 "lv-lv",
-		"Lithuanian":              "lt-lt",
-		"Norwegian":               "nb-no",
-		"Polish":                  "pl-pl",
-		"Portuguese":              "pt-pt",
-		"Romanian":                "ro-ro",
-		"Russian":                 "ru-ru",
-		"Serbian Latin":           "sr-latn-rs",
-		"Slovak":                  "sk-sk",
-		"Slovenian":               "sl-si",
-		"Spanish":                 "es-es",
-		"Spanish (Mexico)":        "es-mx",
-		"Swedish":                 "sv-se",
-		"Thai":                    "th-th",
-		"Turkish":                 "tr-tr",
-		"Ukrainian":               "uk-ua",
-	}
-	return languageMap[language]
+	for _, lang := range downloadLanguages {
+		if lang.Name == language {
+			return lang.Code
+		}
+	}
+	return ""
 }
 
 // parseCatalogForLanguage extracts the language-specific section from the ESD catalog
@@ -0,0 +1,204 @@
+// Package balloon resizes the memory balloon of a running VM so Linux always keeps free_ram_goal of RAM available.
+//
+// The Controller only does arithmetic on samples. Reading them and applying its decisions is left to Run and the VM
+// it is given, so the same control loop drives libvirt, QMP and xl.
+package balloon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sample is one reading of host and guest memory, in KiB
+type Sample struct {
+	// HostAvailable is MemAvailable of the host
+	HostAvailable uint64
+	// GuestActual is the memory the guest has with the balloon as it is now
+	GuestActual uint64
+	// GuestUnused is memory the guest doesn't use at all, 0 when the balloon driver doesn't report it
+	GuestUnused uint64
+}
+
+// Config tunes the Controller, all sizes are in KiB
+type Config struct {
+	// Goal is the memory the host should keep available
+	Goal uint64
+	// Min and Max bound the memory of the guest, Max is what the VM was started with
+	Min uint64
+	Max uint64
+	// Hysteresis is how far above Goal the host may be before the guest gets memory back
+	Hysteresis uint64
+	// MaxStep limits how much the balloon changes at once
+	MaxStep uint64
+	// GrowInterval is the minimum time between two steps giving memory back to the guest.
+	// Taking memory away is not rate limited, the host running out of memory is worse than a slow guest.
+	GrowInterval time.Duration
+}
+
+// DefaultConfig is the configuration for a free_ram_goal and a VM of vmMiB
+func DefaultConfig(goalMiB int, vmMiB int) Config {
+	max := uint64(vmMiB) * 1024
+	// Windows gets unusable below 2 GiB
+	min := uint64(2048 * 1024)
+	if min > max {
+		min = max
+	}
+	return Config{
+		Goal:         uint64(goalMiB) * 1024,
+		Min:          min,
+		Max:          max,
+		Hysteresis:   256 * 1024,
+		MaxStep:      512 * 1024,
+		GrowInterval: 10 * time.Second,
+	}
+}
+
+// Controller decides the balloon size from samples
+type Controller struct {
+	config   Config
+	lastGrow time.Time
+}
+
+func NewController(config Config) *Controller {
+	return &Controller{config: config}
+}
+
+// Target returns the memory to give the guest after a sample, ok is false when the balloon should stay as it is
+func (c *Controller) Target(sample Sample, now time.Time) (target uint64, ok bool) {
+	config := c.config
+	current := sample.GuestActual
+
+	switch {
+	case sample.HostAvailable < config.Goal:
+		// A guest that is at Min already, or below it after a change of the config, doesn't shrink further
+		if current <= config.Min {
+			return 0, false
+		}
+		// Take what is missing and half the hysteresis, so the next sample lands in the middle of the band
+		shrink := minKiB(config.Goal-sample.HostAvailable+config.Hysteresis/2, config.MaxStep)
+		target = current - minKiB(shrink, current-config.Min)
+	case sample.HostAvailable > config.Goal+config.Hysteresis:
+		if current >= config.Max || now.Sub(c.lastGrow) < config.GrowInterval {
+			return 0, false
+		}
+		// A guest with memory to spare doesn't need more
+		if sample.GuestUnused > config.Hysteresis {
+			return 0, false
+		}
+		target = current + minKiB(sample.HostAvailable-config.Goal-config.Hysteresis/2, config.MaxStep)
+	default:
+		return 0, false
+	}
+
+	if target < config.Min {
+		target = config.Min
+	}
+	if target > config.Max {
+		target = config.Max
+	}
+	if target == current {
+		return 0, false
+	}
+	if target > current {
+		c.lastGrow = now
+	}
+	return target, true
+}
+
+func minKiB(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ParseMeminfo reads the fields of /proc/meminfo, in KiB
+func ParseMeminfo(r io.Reader) (map[string]uint64, error) {
+	fields := map[string]uint64{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		number := strings.TrimSuffix(strings.TrimSpace(value), " kB")
+		kib, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			continue
+		}
+		fields[strings.TrimSpace(name)] = kib
+	}
+	return fields, scanner.Err()
+}
+
+// ParseMemAvailable returns MemAvailable from the contents of /proc/meminfo
+func ParseMemAvailable(r io.Reader) (uint64, error) {
+	fields, err := ParseMeminfo(r)
+	if err != nil {
+		return 0, err
+	}
+	available, ok := fields["MemAvailable"]
+	if !ok {
+		return 0, fmt.Errorf("MemAvailable missing from meminfo, the kernel is older than 3.14")
+	}
+	return available, nil
+}
+
+// HostMemAvailable returns MemAvailable of this system
+func HostMemAvailable() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return ParseMemAvailable(file)
+}
+
+// VM is the balloon of a running VM
+type VM interface {
+	// Memory returns what the guest has and what it doesn't use, in KiB. unused is 0 when unknown.
+	Memory() (actual uint64, unused uint64, err error)
+	// SetMemory resizes the balloon so the guest has kib
+	SetMemory(kib uint64) error
+}
+
+// Run samples the host and the guest on every tick and resizes the balloon until stop is closed. The time of a tick
+// is what the controller goes by, ticks come from a time.Ticker outside of tests.
+// readHost returns MemAvailable of the host, HostMemAvailable outside of tests. changed is called after every
+// resize and may be nil. An error reading the guest ends Run, the VM is gone then.
+func Run(controller *Controller, vm VM, readHost func() (uint64, error), ticks <-chan time.Time, stop <-chan struct{}, changed func(Sample, uint64)) error {
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return nil
+		case now = <-ticks:
+		}
+
+		available, err := readHost()
+		if err != nil {
+			return fmt.Errorf("failed to read host memory: %v", err)
+		}
+		actual, unused, err := vm.Memory()
+		if err != nil {
+			return fmt.Errorf("failed to read guest memory: %v", err)
+		}
+		sample := Sample{HostAvailable: available, GuestActual: actual, GuestUnused: unused}
+
+		target, ok := controller.Target(sample, now)
+		if !ok {
+			continue
+		}
+		if err := vm.SetMemory(target); err != nil {
+			return fmt.Errorf("failed to resize the balloon: %v", err)
+		}
+		if changed != nil {
+			changed(sample, target)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package balloon
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	mib = 1024
+	gib = 1024 * mib
+)
+
+// testConfig keeps 1 GiB available on the host for a guest of 2 to 8 GiB
+var testConfig = Config{
+	Goal:         1 * gib,
+	Min:          2 * gib,
+	Max:          8 * gib,
+	Hysteresis:   256 * mib,
+	MaxStep:      512 * mib,
+	GrowInterval: 10 * time.Second,
+}
+
+var t0 = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample Sample
+		want   uint64
+		ok     bool
+	}{
+		{
+			name:   "shrink by what is missing and half the hysteresis",
+			sample: Sample{HostAvailable: 1*gib - 100*mib, GuestActual: 6 * gib},
+			want:   6*gib - 100*mib - 128*mib,
+			ok:     true,
+		},
+		{
+			name:   "shrink at most MaxStep",
+			sample: Sample{HostAvailable: 0, GuestActual: 6 * gib},
+			want:   6*gib - 512*mib,
+			ok:     true,
+		},
+		{
+			name:   "shrink stops at Min",
+			sample: Sample{HostAvailable: 0, GuestActual: 2*gib + 100*mib},
+			want:   2 * gib,
+			ok:     true,
+		},
+		{
+			name:   "guest at Min stays",
+			sample: Sample{HostAvailable: 0, GuestActual: 2 * gib},
+		},
+		{
+			name:   "guest below Min doesn't grow while the host is short",
+			sample: Sample{HostAvailable: 512 * mib, GuestActual: 1 * gib},
+		},
+		{
+			name:   "host at the goal",
+			sample: Sample{HostAvailable: 1 * gib, GuestActual: 4 * gib},
+		},
+		{
+			name:   "host inside the hysteresis band",
+			sample: Sample{HostAvailable: 1*gib + 200*mib, GuestActual: 4 * gib},
+		},
+		{
+			name:   "host at the top of the hysteresis band",
+			sample: Sample{HostAvailable: 1*gib + 256*mib, GuestActual: 4 * gib},
+		},
+		{
+			name:   "grow by what is over the goal and half the hysteresis",
+			sample: Sample{HostAvailable: 1*gib + 356*mib, GuestActual: 4 * gib},
+			want:   4*gib + 228*mib,
+			ok:     true,
+		},
+		{
+			name:   "grow at most MaxStep",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 4 * gib},
+			want:   4*gib + 512*mib,
+			ok:     true,
+		},
+		{
+			name:   "grow stops at Max",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 8*gib - 100*mib},
+			want:   8 * gib,
+			ok:     true,
+		},
+		{
+			name:   "guest at Max stays",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 8 * gib},
+		},
+		{
+			name:   "guest above Max doesn't shrink while the host has plenty",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 9 * gib},
+		},
+		{
+			name:   "guest below Min grows to Min",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 1*gib + 400*mib},
+			want:   2 * gib,
+			ok:     true,
+		},
+		{
+			name:   "guest with unused memory doesn't grow",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 4 * gib, GuestUnused: 300 * mib},
+		},
+		{
+			name:   "guest with a little unused memory grows",
+			sample: Sample{HostAvailable: 16 * gib, GuestActual: 4 * gib, GuestUnused: 100 * mib},
+			want:   4*gib + 512*mib,
+			ok:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, ok := NewController(testConfig).Target(test.sample, t0)
+			if ok != test.ok || target != test.want {
+				t.Errorf("Target() = %d MiB, %t, want %d MiB, %t", target/mib, ok, test.want/mib, test.ok)
+			}
+		})
+	}
+}
+
+func TestTargetGrowInterval(t *testing.T) {
+	controller := NewController(testConfig)
+	plenty := Sample{HostAvailable: 16 * gib, GuestActual: 4 * gib}
+	short := Sample{HostAvailable: 0, GuestActual: 4 * gib}
+
+	steps := []struct {
+		after  time.Duration
+		sample Sample
+		ok     bool
+	}{
+		{0, plenty, true},
+		// Taking memory away is not rate limited
+		{time.Second, short, true},
+		{5 * time.Second, plenty, false},
+		{10*time.Second - time.Nanosecond, plenty, false},
+		{10 * time.Second, plenty, true},
+		{15 * time.Second, plenty, false},
+		{20 * time.Second, plenty, true},
+	}
+	for _, step := range steps {
+		if _, ok := controller.Target(step.sample, t0.Add(step.after)); ok != step.ok {
+			t.Errorf("Target() after %s changed the balloon: %t, want %t", step.after, ok, step.ok)
+		}
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config := DefaultConfig(100, 4096)
+	if config.Goal != 100*mib || config.Min != 2*gib || config.Max != 4*gib {
+		t.Errorf("DefaultConfig(100, 4096) = goal %d, min %d, max %d KiB", config.Goal, config.Min, config.Max)
+	}
+	// A VM smaller than the minimum keeps all of its memory
+	if config := DefaultConfig(100, 1024); config.Min != 1*gib || config.Max != 1*gib {
+		t.Errorf("DefaultConfig(100, 1024) = min %d, max %d KiB, want 1 GiB both", config.Min, config.Max)
+	}
+}
+
+const meminfo = `MemTotal:        8039516 kB
+MemFree:          512340 kB
+MemAvailable:    4123456 kB
+Buffers:          100000 kB
+HugePages_Total:       0
+Hugepagesize:       2048 kB
+Broken line without a colon
+Corrupt:             abc kB
+`
+
+func TestParseMeminfo(t *testing.T) {
+	fields, err := ParseMeminfo(strings.NewReader(meminfo))
+	if err != nil {
+		t.Fatalf("ParseMeminfo() failed: %v", err)
+	}
+	want := map[string]uint64{
+		"MemTotal":        8039516,
+		"MemFree":         512340,
+		"MemAvailable":    4123456,
+		"Buffers":         100000,
+		"HugePages_Total": 0,
+		"Hugepagesize":    2048,
+	}
+	if len(fields) != len(want) {
+		t.Errorf("ParseMeminfo() returned %d fields, want %d: %v", len(fields), len(want), fields)
+	}
+	for name, value := range want {
+		if got, ok := fields[name]; !ok || got != value {
+			t.Errorf("%s = %d (present %t), want %d", name, got, ok, value)
+		}
+	}
+}
+
+func TestParseMemAvailable(t *testing.T) {
+	available, err := ParseMemAvailable(strings.NewReader(meminfo))
+	if err != nil || available != 4123456 {
+		t.Errorf("ParseMemAvailable() = %d, %v, want 4123456", available, err)
+	}
+	if _, err := ParseMemAvailable(strings.NewReader("MemTotal: 8039516 kB\n")); err == nil {
+		t.Error("ParseMemAvailable() without MemAvailable succeeded")
+	}
+}
+
+// fakeVM is a guest whose balloon follows SetMemory at once
+type fakeVM struct {
+	actual  uint64
+	sizes   []uint64
+	readErr error
+}
+
+func (vm *fakeVM) Memory() (uint64, uint64, error) {
+	return vm.actual, 0, vm.readErr
+}
+
+func (vm *fakeVM) SetMemory(kib uint64) error {
+	vm.actual = kib
+	vm.sizes = append(vm.sizes, kib)
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	vm := &fakeVM{actual: 4 * gib}
+	readHost := func() (uint64, error) {
+		return 16 * gib, nil
+	}
+	ticks := make(chan time.Time)
+	stop := make(chan struct{})
+	done := make(chan error)
+	changes := 0
+	go func() {
+		done <- Run(NewController(testConfig), vm, readHost, ticks, stop, func(Sample, uint64) {
+			changes++
+		})
+	}()
+
+	// Only the time of the ticks counts, the second one is within GrowInterval of the first
+	for _, after := range []time.Duration{0, time.Second, 10 * time.Second} {
+		ticks <- t0.Add(after)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+
+	want := []uint64{4*gib + 512*mib, 5 * gib}
+	if len(vm.sizes) != len(want) || vm.sizes[0] != want[0] || vm.sizes[1] != want[1] {
+		t.Errorf("Run() resized the balloon to %v KiB, want %v KiB", vm.sizes, want)
+	}
+	if changes != len(want) {
+		t.Errorf("changed was called %d times, want %d", changes, len(want))
+	}
+}
+
+func TestRunGuestGone(t *testing.T) {
+	vm := &fakeVM{readErr: errors.New("domain not found")}
+	ticks := make(chan time.Time, 1)
+	ticks <- t0
+	err := Run(NewController(testConfig), vm, func() (uint64, error) { return 16 * gib, nil }, ticks, make(chan struct{}), nil)
+	if err == nil || !strings.Contains(err.Error(), "domain not found") {
+		t.Errorf("Run() = %v, want the error reading the guest", err)
+	}
+}
@@ -0,0 +1,92 @@
+package balloon
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Swap is a line of /proc/swaps, sizes in KiB
+type Swap struct {
+	Device string
+	Size   uint64
+	Used   uint64
+}
+
+// Zram reports whether the swap is a compressed RAM disk, like the one the More RAM app of Pi-Apps sets up
+func (s Swap) Zram() bool {
+	return strings.HasPrefix(filepath.Base(s.Device), "zram")
+}
+
+// HostMemory is the RAM of the host and what makes it go further
+type HostMemory struct {
+	// Total and Available are MemTotal and MemAvailable, in KiB
+	Total     uint64
+	Available uint64
+	Swaps     []Swap
+	// KSM is whether the kernel merges identical pages, QEMU offers all guest memory for merging
+	KSM bool
+	// KSMSaved is the memory KSM merging saves, in KiB
+	KSMSaved uint64
+}
+
+// ZramSwaps returns the zram devices of the host that are used as swap
+func (h HostMemory) ZramSwaps() []Swap {
+	var zram []Swap
+	for _, swap := range h.Swaps {
+		if swap.Zram() {
+			zram = append(zram, swap)
+		}
+	}
+	return zram
+}
+
+// ParseSwaps reads the contents of /proc/swaps
+func ParseSwaps(r io.Reader) ([]Swap, error) {
+	var swaps []Swap
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The header is Filename Type Size Used Priority
+		if len(fields) < 4 || fields[0] == "Filename" {
+			continue
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		used, _ := strconv.ParseUint(fields[3], 10, 64)
+		swaps = append(swaps, Swap{Device: fields[0], Size: size, Used: used})
+	}
+	return swaps, scanner.Err()
+}
+
+// ReadHostMemory reads the memory of this system. Swap and KSM are left empty when the kernel doesn't have them.
+func ReadHostMemory() (HostMemory, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return HostMemory{}, err
+	}
+	defer file.Close()
+	fields, err := ParseMeminfo(file)
+	if err != nil {
+		return HostMemory{}, err
+	}
+	host := HostMemory{Total: fields["MemTotal"], Available: fields["MemAvailable"]}
+
+	if swapsFile, err := os.Open("/proc/swaps"); err == nil {
+		host.Swaps, _ = ParseSwaps(swapsFile)
+		swapsFile.Close()
+	}
+
+	run, err := os.ReadFile("/sys/kernel/mm/ksm/run")
+	host.KSM = err == nil && strings.TrimSpace(string(run)) == "1"
+	if sharing, err := os.ReadFile("/sys/kernel/mm/ksm/pages_sharing"); err == nil {
+		pages, _ := strconv.ParseUint(strings.TrimSpace(string(sharing)), 10, 64)
+		host.KSMSaved = pages * uint64(os.Getpagesize()) / 1024
+	}
+	return host, nil
+}
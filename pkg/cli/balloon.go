@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/balloon"
+)
+
+// hypervisorBalloon is the balloon of a VM on a hypervisor
+type hypervisorBalloon struct {
+	hv   Hypervisor
+	name string
+}
+
+func (b hypervisorBalloon) Memory() (uint64, uint64, error) {
+	stats, err := b.hv.MemoryStats(b.name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return stats.Actual, stats.Unused, nil
+}
+
+func (b hypervisorBalloon) SetMemory(kib uint64) error {
+	return b.hv.SetMemory(b.name, kib)
+}
+
+// startBalloon resizes the memory of a VM in the background to keep free_ram_goal available on the host.
+// The returned function stops it, call it before the VM is destroyed.
+func startBalloon(hv Hypervisor, spec *vmSpec) func() {
+	if internal.BVMConfig.FreeRamGoal < 0 {
+		internal.Debug("free_ram_goal is negative, the VM keeps all of its memory")
+		return func() {}
+	}
+	// The host memory read here is not the memory of a remote libvirt host
+	if hv.Name() == "libvirt" && isRemoteURI(internal.BVMConfig.LibvirtURI) {
+		internal.Debug("Not resizing the memory of a VM on a remote libvirt host")
+		return func() {}
+	}
+	// The balloon of a Xen guest needs the Xen PV drivers, which Windows doesn't have
+	if hv.Name() == "xen" {
+		internal.Debug("Not resizing the memory of a Xen guest, Windows has no balloon driver for it")
+		return func() {}
+	}
+
+	checkHostMemory()
+
+	controller := balloon.NewController(balloon.DefaultConfig(internal.BVMConfig.FreeRamGoal, spec.MemoryGiB*1024))
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		err := balloon.Run(controller, hypervisorBalloon{hv: hv, name: spec.Name}, balloon.HostMemAvailable, ticker.C, stop, func(sample balloon.Sample, target uint64) {
+			internal.Debug(fmt.Sprintf("Host has %d MiB available, VM memory %d MiB -> %d MiB", sample.HostAvailable/1024, sample.GuestActual/1024, target/1024))
+		})
+		if err != nil {
+			internal.Debug("Stopped resizing the VM memory: " + err.Error())
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// checkHostMemory points out what would make the RAM of a small host go further
+func checkHostMemory() {
+	host, err := balloon.ReadHostMemory()
+	if err != nil {
+		internal.Debug("Failed to read host memory: " + err.Error())
+		return
+	}
+	if zram := host.ZramSwaps(); len(zram) > 0 {
+		internal.Debug(fmt.Sprintf("Host swaps to %d zram devices, Linux compresses memory the VM pushes out", len(zram)))
+	} else if host.Total <= 4*1024*1024 {
+		internal.Warning("This system has 4GB of RAM or less and no ZRAM. Set it up with the More RAM app of Pi-Apps:")
+		internal.Warning("wget -qO- https://raw.githubusercontent.com/Botspot/pi-apps/master/apps/More%20RAM/install | bash")
+	}
+	if !host.KSM {
+		internal.Debug("KSM is off, enable it to merge identical pages of the VM: echo 1 | sudo tee /sys/kernel/mm/ksm/run")
+	}
+}
+
+// runningVMName returns the name of the VM of a VM directory that runs on hv
+func runningVMName(hv Hypervisor, vmdir string) (string, error) {
+	if libvirtHV, ok := hv.(*libvirtHypervisor); ok {
+		domains, err := vmDomains(libvirtHV.conn, vmdir)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			for _, domain := range domains {
+				domain.Free()
+			}
+		}()
+		if len(domains) > 0 {
+			return domains[0].GetName()
+		}
+	} else {
+		for _, name := range qemuVMNames(vmdir) {
+			if state, err := hv.State(name); err == nil && state != vmShutoff {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no VM of %s is running on %s", vmdir, hv.Name())
+}
+
+// MemStats prints the memory of the host and of the running VM of a VM directory every few seconds until the VM shuts down
+func MemStats(vmdir string) error {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+	hv, err := newHypervisor()
+	if err != nil {
+		return err
+	}
+	defer hv.Close()
+	name, err := runningVMName(hv, absVmdir)
+	if err != nil {
+		return err
+	}
+
+	host, err := balloon.ReadHostMemory()
+	if err != nil {
+		return fmt.Errorf("failed to read host memory: %v", err)
+	}
+	internal.Status(fmt.Sprintf("Host: %d MiB of RAM, free_ram_goal %d MiB", host.Total/1024, internal.BVMConfig.FreeRamGoal))
+	if zram := host.ZramSwaps(); len(zram) > 0 {
+		var devices []string
+		for _, swap := range zram {
+			devices = append(devices, fmt.Sprintf("%s (%d MiB)", filepath.Base(swap.Device), swap.Size/1024))
+		}
+		fmt.Println("ZRAM swap: " + strings.Join(devices, ", "))
+	} else {
+		fmt.Println("ZRAM swap: none")
+	}
+	if host.KSM {
+		fmt.Println("KSM: on")
+	} else {
+		fmt.Println("KSM: off")
+	}
+	internal.Status(fmt.Sprintf("VM %s: %d MiB of RAM, on %s", name, internal.BVMConfig.VMMem*1024, hv.Name()))
+	fmt.Println("Guest values are 0 until the balloon driver in Windows reports them.")
+	fmt.Println()
+
+	// All values are in MiB
+	fmt.Printf("%-8s  %10s  %9s  %9s  %10s  %10s  %10s\n", "TIME", "HOST AVAIL", "ZRAM USED", "KSM SAVED", "VM BALLOON", "VM UNUSED", "VM AVAIL")
+	ticker := time.NewTicker(balloonStatsPeriod * time.Second)
+	defer ticker.Stop()
+	for {
+		if state, err := hv.State(name); err != nil || state == vmShutoff {
+			internal.Status("VM " + name + " has shut down")
+			return nil
+		}
+		host, err := balloon.ReadHostMemory()
+		if err != nil {
+			return fmt.Errorf("failed to read host memory: %v", err)
+		}
+		guest, err := hv.MemoryStats(name)
+		if err != nil {
+			return err
+		}
+		var zramUsed uint64
+		for _, swap := range host.ZramSwaps() {
+			zramUsed += swap.Used
+		}
+		fmt.Printf("%-8s  %10d  %9d  %9d  %10d  %10d  %10d\n", time.Now().Format("15:04:05"),
+			host.Available/1024, zramUsed/1024, host.KSMSaved/1024, guest.Actual/1024, guest.Unused/1024, guest.Available/1024)
+		<-ticker.C
+	}
+}
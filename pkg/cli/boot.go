@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
+)
+
+// BootOptions are the command line options of bvm boot
+type BootOptions struct {
+	// NoDisplay leaves out the SPICE server, Windows is used over RDP then
+	NoDisplay bool
+}
+
+// BootVM starts the installed Windows of a VM directory on the hypervisor from bvm-config.toml and stays until it
+// shuts down. Meanwhile the balloon gives memory the guest doesn't need back to the host, and USB devices matching
+// usb_passthrough or usb_autoforward are attached as they are plugged in.
+// Ctrl+C asks Windows to shut down, pressing it again forces the VM off.
+func BootVM(vmdir string, opts BootOptions) error {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+	state, err := vmstate.Load(absVmdir)
+	if err != nil {
+		return err
+	}
+	if state.State != vmstate.Installed {
+		return fmt.Errorf("Windows is not installed in %s yet, the VM is %s. Run '%s' first", vmdir, state.State, nextStep(state, vmdir))
+	}
+
+	diskImage := filepath.Join(absVmdir, "disk.qcow2")
+	if _, err := os.Stat(diskImage); os.IsNotExist(err) {
+		return fmt.Errorf("disk.qcow2 not found at %s", diskImage)
+	}
+
+	if !opts.NoDisplay && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return fmt.Errorf("BVM needs a desktop environment to show the VM, use 'bvm boot-nodisplay %s' and connect over RDP instead", vmdir)
+	}
+
+	hv, err := newHypervisor()
+	if err != nil {
+		return err
+	}
+	defer hv.Close()
+	if uri := internal.BVMConfig.LibvirtURI; hv.Name() == "libvirt" {
+		if isRemoteURI(uri) {
+			return fmt.Errorf("bvm boot runs the VM from disk.qcow2 in %s, which a remote libvirt host can't see", vmdir)
+		}
+		if isSystemURI(uri) {
+			checkSystemAccess(diskImage)
+		}
+	}
+
+	spec, err := bootSpec(absVmdir)
+	if err != nil {
+		return fmt.Errorf("failed to describe the VM: %v", err)
+	}
+	spec.Graphics = !opts.NoDisplay
+
+	// libvirt forwards rdp_port with passt, without it Windows can only be reached over SPICE
+	if hv.Name() == "libvirt" {
+		if _, err := exec.LookPath("passt"); err != nil {
+			if opts.NoDisplay {
+				return fmt.Errorf("forwarding rdp_port to the VM needs passt, install it with: sudo apt install passt")
+			}
+			internal.Warning("passt is not installed, so rdp_port is not forwarded to the VM. Install it with: sudo apt install passt")
+			spec.RDPPort = 0
+		}
+	}
+
+	// A VM that is still around without running, like the domain of a bvm that was killed, is removed first
+	if state, err := hv.State(spec.Name); err == nil {
+		if state == vmRunning {
+			return fmt.Errorf("VM %s is already running", spec.Name)
+		}
+		hv.Destroy(spec.Name)
+	}
+
+	internal.Status("Starting " + spec.Name + " using " + hv.Name() + "...")
+	if err := hv.Start(spec); err != nil {
+		return err
+	}
+	defer hv.Destroy(spec.Name)
+	defer startBalloon(hv, spec)()
+	defer startUSBWatch(hv, spec)()
+
+	if opts.NoDisplay && hv.Name() == "xen" {
+		// Xen guests are bridged to the network, no port is forwarded
+		internal.Status("The VM has no display, connect to Windows over RDP at the address it gets on the Xen bridge")
+	} else if opts.NoDisplay {
+		internal.Status(fmt.Sprintf("The VM has no display, connect to Windows over RDP on localhost port %d", internal.BVMConfig.RdpPort))
+	} else if spicePort, err := hv.SpicePort(spec.Name); err != nil {
+		internal.Warning("Could not get SPICE port: " + err.Error())
+	} else {
+		internal.Status(fmt.Sprintf("SPICE server listening on port %d", spicePort))
+		go launchSpiceViewer(spicePort)
+	}
+
+	return waitForShutdown(hv, spec.Name)
+}
+
+// waitForShutdown returns once the guest has shut down. The first Ctrl+C shuts Windows down, the second returns
+// right away so the VM is forced off.
+func waitForShutdown(hv Hypervisor, name string) error {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	internal.Status("Windows is running. Press Ctrl+C to shut it down.")
+	shuttingDown := false
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupts:
+			if shuttingDown {
+				internal.Warning("Forcing the VM off")
+				return nil
+			}
+			shuttingDown = true
+			internal.Status("Shutting Windows down, press Ctrl+C again to force the VM off...")
+			if err := hv.Shutdown(name); err != nil {
+				internal.Warning("Failed to shut Windows down: " + err.Error())
+			}
+		case <-ticker.C:
+			state, err := hv.State(name)
+			if err != nil {
+				return fmt.Errorf("failed to get VM state: %v", err)
+			}
+			switch state {
+			case vmShutoff:
+				internal.StatusGreen("Windows has shut down")
+				return nil
+			case vmCrashed:
+				return fmt.Errorf("VM %s crashed", name)
+			}
+		}
+	}
+}
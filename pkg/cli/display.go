@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"libvirt.org/go/libvirt"
+)
+
+// displayEndpoint is one place a SPICE or VNC server of a running domain can be reached
+type displayEndpoint struct {
+	// Protocol is "spice" or "vnc"
+	Protocol string
+	// Host is empty for a unix socket
+	Host string
+	// Port, TLSPort and WebSocket are 0 when not in use
+	Port      int
+	TLSPort   int
+	WebSocket int
+	Socket    string
+}
+
+// URIs returns the addresses a viewer like remote-viewer connects to
+func (e displayEndpoint) URIs() []string {
+	if e.Socket != "" {
+		return []string{e.Protocol + "+unix://" + e.Socket}
+	}
+
+	host := e.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	var uris []string
+	switch {
+	case e.Port > 0 && e.TLSPort > 0:
+		uris = append(uris, fmt.Sprintf("%s://%s:%d?tls-port=%d", e.Protocol, host, e.Port, e.TLSPort))
+	case e.Port > 0:
+		uris = append(uris, fmt.Sprintf("%s://%s:%d", e.Protocol, host, e.Port))
+	case e.TLSPort > 0:
+		uris = append(uris, fmt.Sprintf("%s://%s?tls-port=%d", e.Protocol, host, e.TLSPort))
+	}
+	if e.WebSocket > 0 {
+		uris = append(uris, fmt.Sprintf("ws://%s:%d", host, e.WebSocket))
+	}
+	return uris
+}
+
+// domainDisplays returns the SPICE and VNC servers of a running domain from its live XML
+func domainDisplays(domain *libvirt.Domain) ([]displayEndpoint, error) {
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain XML: %v", err)
+	}
+	var current LibvirtDomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &current); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+
+	var endpoints []displayEndpoint
+	for _, graphics := range current.Devices.Graphics {
+		if graphics.Type != "spice" && graphics.Type != "vnc" {
+			continue
+		}
+
+		// Older libvirt only has the listen attribute
+		listens := graphics.Listens
+		if len(listens) == 0 {
+			listens = []GraphicsListen{{Type: "address", Address: graphics.Listen}}
+		}
+
+		for _, listen := range listens {
+			endpoint := displayEndpoint{
+				Protocol:  graphics.Type,
+				Port:      graphicsPort(graphics.Port),
+				TLSPort:   graphicsPort(graphics.TLSPort),
+				WebSocket: graphicsPort(graphics.WebSocket),
+			}
+			switch listen.Type {
+			case "socket":
+				endpoint = displayEndpoint{Protocol: graphics.Type, Socket: listen.Socket}
+			case "address", "network":
+				endpoint.Host = displayHost(listen.Address)
+				if endpoint.Port == 0 && endpoint.TLSPort == 0 {
+					// Ports are only assigned while the domain runs
+					continue
+				}
+			default:
+				// type "none" is only reachable through libvirt itself
+				continue
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+// graphicsPort converts a port attribute, -1 and missing ports become 0
+func graphicsPort(value string) int {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 0 {
+		return 0
+	}
+	return port
+}
+
+// displayHost turns a listen address into a host a viewer can connect to.
+// A server listening on all addresses is reached by the host name of this machine.
+func displayHost(address string) string {
+	ip := net.ParseIP(address)
+	if address != "" && (ip == nil || !ip.IsUnspecified()) {
+		return address
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+// getSpicePort retrieves the SPICE port from a running domain
+func getSpicePort(domain *libvirt.Domain) (int, error) {
+	endpoints, err := domainDisplays(domain)
+	if err != nil {
+		return 0, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Protocol == "spice" && endpoint.Port > 0 {
+			return endpoint.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("domain has no SPICE server listening on a TCP port")
+}
+
+// vmDomains returns the running domains that use a disk in the VM directory or are named after it.
+// Domains on a remote host use uploaded copies of the disks, they are only found by name.
+func vmDomains(conn *libvirt.Connect, vmdir string) ([]libvirt.Domain, error) {
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	var matching []libvirt.Domain
+	for _, domain := range domains {
+		name, _ := domain.GetName()
+		if strings.HasPrefix(name, "bvm-firstboot-"+filepath.Base(vmdir)+"-") || domainUsesDir(&domain, vmdir) {
+			matching = append(matching, domain)
+		} else {
+			domain.Free()
+		}
+	}
+	return matching, nil
+}
+
+// domainUsesDir reports whether any disk of a domain is stored in dir
+func domainUsesDir(domain *libvirt.Domain, dir string) bool {
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return false
+	}
+	var current LibvirtDomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &current); err != nil {
+		return false
+	}
+	for _, disk := range current.Devices.Disks {
+		if disk.Source != nil && filepath.Dir(disk.Source.File) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// DisplayInfo prints how to connect a viewer to the running domains of a VM
+func DisplayInfo(vmdir string) error {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+
+	conn, err := connectLibvirt()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	remote := isRemoteURI(internal.BVMConfig.LibvirtURI)
+
+	domains, err := vmDomains(conn, absVmdir)
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		return fmt.Errorf("no running VM uses %s", absVmdir)
+	}
+
+	for _, domain := range domains {
+		name, err := domain.GetName()
+		if err != nil {
+			name = "unknown"
+		}
+		internal.Status("Domain " + name + ":")
+
+		endpoints, err := domainDisplays(&domain)
+		if err != nil {
+			internal.Warning(err.Error())
+		} else if len(endpoints) == 0 {
+			fmt.Println("  No SPICE or VNC display")
+		}
+		for _, endpoint := range endpoints {
+			for _, uri := range endpoint.URIs() {
+				fmt.Printf("  %s: %s\n", strings.ToUpper(endpoint.Protocol), uri)
+			}
+		}
+		// The addresses are those of the libvirt host, virt-viewer tunnels through the libvirt connection
+		if remote && len(endpoints) > 0 {
+			fmt.Printf("  On the libvirt host, or from here with: virt-viewer --connect %s %s\n", internal.BVMConfig.LibvirtURI, name)
+		}
+		domain.Free()
+	}
+	return nil
+}
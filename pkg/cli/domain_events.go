@@ -0,0 +1,165 @@
+package cli
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"libvirt.org/go/libvirt"
+)
+
+// lifecycleEvent turns a libvirt lifecycle event into a vmEvent
+func lifecycleEvent(event libvirt.DomainEventLifecycle) vmEvent {
+	kind := vmEventInfo
+	switch event.Event {
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		switch libvirt.DomainEventStoppedDetailType(event.Detail) {
+		case libvirt.DOMAIN_EVENT_STOPPED_SHUTDOWN:
+			kind = vmEventShutdown
+		case libvirt.DOMAIN_EVENT_STOPPED_CRASHED, libvirt.DOMAIN_EVENT_STOPPED_FAILED:
+			kind = vmEventFailed
+		default:
+			kind = vmEventStopped
+		}
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		kind = vmEventCrashed
+	}
+	return vmEvent{kind: kind, message: event.String()}
+}
+
+// reportVMEvent prints a VM event, warning about anything that means the guest is in trouble
+func reportVMEvent(event vmEvent) {
+	switch event.kind {
+	case vmEventDiskError, vmEventCrashed:
+		internal.ErrorNoExit("VM: " + event.String())
+	case vmEventWatchdog:
+		internal.Warning("VM: " + event.String())
+	default:
+		internal.Status("VM: " + event.String())
+	}
+}
+
+// domainEventWatcher delivers the events of one domain on a channel
+type domainEventWatcher struct {
+	conn      *libvirt.Connect
+	callbacks []int
+	// lifecycle is false if lifecycle events could not be registered, state has to be polled then
+	lifecycle bool
+	events    chan vmEvent
+}
+
+// watchDomainEvents registers lifecycle, reboot, watchdog and I/O error callbacks for the domain.
+// The libvirt event loop has to be running, see startLibvirtEventLoop. Callbacks that fail to register are skipped with a warning.
+func watchDomainEvents(conn *libvirt.Connect, domain *libvirt.Domain) *domainEventWatcher {
+	w := &domainEventWatcher{
+		conn:   conn,
+		events: make(chan vmEvent, 64),
+	}
+
+	id, err := conn.DomainEventLifecycleRegister(domain, func(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		w.deliver(lifecycleEvent(*event))
+	})
+	w.register("lifecycle", id, err)
+	w.lifecycle = err == nil
+
+	id, err = conn.DomainEventRebootRegister(domain, func(c *libvirt.Connect, d *libvirt.Domain) {
+		w.deliver(vmEvent{kind: vmEventReboot, message: "Guest rebooted"})
+	})
+	w.register("reboot", id, err)
+
+	id, err = conn.DomainEventWatchdogRegister(domain, func(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventWatchdog) {
+		w.deliver(vmEvent{kind: vmEventWatchdog, message: fmt.Sprintf("Watchdog fired (action %s)", watchdogActionName(event.Action))})
+	})
+	w.register("watchdog", id, err)
+
+	id, err = conn.DomainEventIOErrorReasonRegister(domain, func(c *libvirt.Connect, d *libvirt.Domain, event *libvirt.DomainEventIOErrorReason) {
+		w.deliver(vmEvent{
+			kind:    vmEventDiskError,
+			message: fmt.Sprintf("Disk I/O error on %s (%s): %s", event.SrcPath, event.DevAlias, event.Reason),
+			// QEMU paused the guest, it won't get any further on its own
+			paused: event.Action == libvirt.DOMAIN_EVENT_IO_ERROR_PAUSE,
+		})
+	})
+	w.register("I/O error", id, err)
+
+	return w
+}
+
+// register remembers a callback ID so Close can deregister it
+func (w *domainEventWatcher) register(name string, id int, err error) {
+	if err != nil {
+		internal.Warning(fmt.Sprintf("Failed to watch %s events: %v", name, err))
+		return
+	}
+	w.callbacks = append(w.callbacks, id)
+}
+
+// deliver passes an event on without ever blocking the libvirt event loop
+func (w *domainEventWatcher) deliver(event vmEvent) {
+	select {
+	case w.events <- event:
+	default:
+		internal.Debug("Dropped libvirt event: " + event.String())
+	}
+}
+
+func (w *domainEventWatcher) Events() <-chan vmEvent {
+	return w.events
+}
+
+func (w *domainEventWatcher) Lifecycle() bool {
+	return w.lifecycle
+}
+
+// Close deregisters all callbacks
+func (w *domainEventWatcher) Close() {
+	for _, id := range w.callbacks {
+		if err := w.conn.DomainEventDeregister(id); err != nil {
+			internal.Debug(fmt.Sprintf("Failed to deregister libvirt callback %d: %v", id, err))
+		}
+	}
+	w.callbacks = nil
+}
+
+// watchdogActionName names what QEMU did when the watchdog fired
+func watchdogActionName(action libvirt.DomainEventWatchdogAction) string {
+	switch action {
+	case libvirt.DOMAIN_EVENT_WATCHDOG_NONE:
+		return "none"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_PAUSE:
+		return "pause"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_RESET:
+		return "reset"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_POWEROFF:
+		return "poweroff"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_SHUTDOWN:
+		return "shutdown"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_DEBUG:
+		return "debug"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_INJECTNMI:
+		return "inject-nmi"
+	}
+	return fmt.Sprintf("%d", action)
+}
+
+// startLibvirtEventLoop runs the default libvirt event loop that domain event callbacks need.
+// It has to be started before connecting to libvirt.
+func startLibvirtEventLoop() {
+	eventLoopOnce.Do(func() {
+		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+			internal.Warning("Failed to register libvirt event loop: " + err.Error())
+			return
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					internal.Debug("libvirt event loop: " + err.Error())
+					time.Sleep(time.Second)
+				}
+			}
+		}()
+	})
+}
+
+var eventLoopOnce sync.Once
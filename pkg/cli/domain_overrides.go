@@ -0,0 +1,242 @@
+package cli
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+)
+
+// domainOverridesFile is merged into every generated domain XML of a VM, in the VM directory
+const domainOverridesFile = "domain-overrides.xml"
+
+// removeAttr marks an element of domain-overrides.xml that deletes the matching generated element
+const removeAttr = "bvm-remove"
+
+// xmlNode is an XML element of any shape, so overrides can use elements LibvirtDomainXML doesn't know about
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []xmlNode  `xml:",any"`
+}
+
+// attr returns the value of an attribute, or "" if it is missing
+func (n *xmlNode) attr(name string) string {
+	for _, attr := range n.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element with the given name
+func (n *xmlNode) child(name string) *xmlNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// singletonDevices only appear once in a domain, an override replaces the generated one
+var singletonDevices = map[string]bool{
+	"emulator":   true,
+	"video":      true,
+	"sound":      true,
+	"tpm":        true,
+	"watchdog":   true,
+	"memballoon": true,
+}
+
+// deviceKey identifies a device within its element name, "" if it can't be told apart from others of the same kind
+func deviceKey(device *xmlNode) string {
+	sub := func(child string, attr string) string {
+		if node := device.child(child); node != nil {
+			return node.attr(attr)
+		}
+		return ""
+	}
+	switch device.XMLName.Local {
+	case "disk":
+		return sub("target", "dev")
+	case "controller":
+		if device.attr("index") == "" {
+			return ""
+		}
+		return device.attr("type") + "/" + device.attr("index")
+	case "interface":
+		return sub("mac", "address")
+	case "filesystem":
+		return sub("target", "dir")
+	case "channel":
+		return sub("target", "name")
+	case "graphics":
+		return device.attr("type")
+	}
+	if singletonDevices[device.XMLName.Local] {
+		return device.XMLName.Local
+	}
+	return ""
+}
+
+// mergeElements merges override elements into base. An element replaces the base element with the same name and key,
+// or is appended if there is none. Elements with bvm-remove="yes" delete the match instead.
+func mergeElements(base []xmlNode, overrides []xmlNode, key func(*xmlNode) string) []xmlNode {
+	for _, override := range overrides {
+		remove := override.attr(removeAttr) == "yes"
+		override.Attrs = withoutAttr(override.Attrs, removeAttr)
+
+		match := -1
+		if overrideKey := key(&override); overrideKey != "" {
+			for i := range base {
+				if base[i].XMLName.Local == override.XMLName.Local && key(&base[i]) == overrideKey {
+					match = i
+					break
+				}
+			}
+		}
+
+		switch {
+		case match >= 0 && remove:
+			base = append(base[:match], base[match+1:]...)
+		case match >= 0:
+			base[match] = override
+		case !remove:
+			base = append(base, override)
+		}
+	}
+	return base
+}
+
+// withoutAttr returns attrs without the attribute of the given name
+func withoutAttr(attrs []xml.Attr, name string) []xml.Attr {
+	var kept []xml.Attr
+	for _, attr := range attrs {
+		if attr.Name.Local != name {
+			kept = append(kept, attr)
+		}
+	}
+	return kept
+}
+
+// normalizeXMLNode drops xmlns attributes, which encoding/xml writes from the element names itself,
+// and the indentation between elements, which MarshalIndent adds again
+func normalizeXMLNode(node *xmlNode) {
+	if strings.TrimSpace(node.Content) == "" {
+		node.Content = ""
+	}
+	var kept []xml.Attr
+	for _, attr := range node.Attrs {
+		if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
+			kept = append(kept, attr)
+		}
+	}
+	node.Attrs = kept
+	for i := range node.Nodes {
+		normalizeXMLNode(&node.Nodes[i])
+	}
+}
+
+// mergeDomainXML merges an overrides document into a generated domain.
+//
+// Every top-level element of the overrides replaces the generated element of the same name, so <cputune> or <vcpu>
+// can simply be written out. <devices> is merged device by device instead: disks are matched by target dev,
+// controllers by type and index, interfaces by MAC address, filesystems by target dir, channels by target name and
+// graphics by type. Devices without a match are added.
+func mergeDomainXML(domainXML string, overridesXML []byte) (string, error) {
+	var domain, overrides xmlNode
+	if err := xml.Unmarshal([]byte(domainXML), &domain); err != nil {
+		return "", fmt.Errorf("failed to parse generated domain XML: %v", err)
+	}
+	if err := xml.Unmarshal(overridesXML, &overrides); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", domainOverridesFile, err)
+	}
+	if overrides.XMLName.Local != "domain" {
+		return "", fmt.Errorf("%s must have a <domain> root element, not <%s>", domainOverridesFile, overrides.XMLName.Local)
+	}
+	normalizeXMLNode(&domain)
+	normalizeXMLNode(&overrides)
+
+	// Attributes of the root element, like type='kvm', are replaced one by one
+	for _, attr := range overrides.Attrs {
+		domain.Attrs = append(withoutAttr(domain.Attrs, attr.Name.Local), attr)
+	}
+
+	var topLevel []xmlNode
+	for _, override := range overrides.Nodes {
+		if override.XMLName.Local != "devices" {
+			topLevel = append(topLevel, override)
+			continue
+		}
+		devices := domain.child("devices")
+		if devices == nil {
+			domain.Nodes = append(domain.Nodes, xmlNode{XMLName: xml.Name{Local: "devices"}})
+			devices = &domain.Nodes[len(domain.Nodes)-1]
+		}
+		devices.Nodes = mergeElements(devices.Nodes, override.Nodes, deviceKey)
+	}
+	domain.Nodes = mergeElements(domain.Nodes, topLevel, func(n *xmlNode) string { return n.XMLName.Space + " " + n.XMLName.Local })
+
+	xmlData, err := xml.MarshalIndent(domain, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal domain XML: %v", err)
+	}
+	return xml.Header + string(xmlData), nil
+}
+
+// applyDomainOverrides merges domain-overrides.xml from the VM directory into a generated domain, if there is one
+func applyDomainOverrides(vmdir string, domainXML string) (string, error) {
+	overridesPath := filepath.Join(vmdir, domainOverridesFile)
+	overridesXML, err := os.ReadFile(overridesPath)
+	if os.IsNotExist(err) {
+		return domainXML, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", overridesPath, err)
+	}
+	internal.Debug("Applying " + overridesPath)
+	return mergeDomainXML(domainXML, overridesXML)
+}
+
+// DomainXML prints the domain XML bvm would define for a VM, with domain-overrides.xml applied
+func DomainXML(vmdir string, mode string) error {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+
+	var domainXML string
+	switch mode {
+	case "firstboot":
+		// The first delivery method is the one firstboot starts with
+		cfg := firstBootDomainConfig{}
+		if deliveries := internal.AnswerFileDeliveryOrder(absVmdir); len(deliveries) > 0 {
+			cfg.answerMethod = deliveries[0]
+			cfg.answerMedium = internal.AnswerFileMediumPath(absVmdir, deliveries[0])
+		}
+		domainXML, err = generateFirstBootDomainXML(absVmdir, cfg)
+	case "boot":
+		var spec *vmSpec
+		if spec, err = bootSpec(absVmdir); err == nil {
+			domainXML, err = spec.libvirtDomainXML()
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected firstboot or boot", mode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate domain XML: %v", err)
+	}
+
+	domainXML, err = applyDomainOverrides(absVmdir, domainXML)
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimSpace(domainXML))
+	return nil
+}
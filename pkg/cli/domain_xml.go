@@ -0,0 +1,433 @@
+package cli
+
+import (
+	"encoding/xml"
+)
+
+// LibvirtDomainXML represents the structure for libvirt domain XML
+type LibvirtDomainXML struct {
+	XMLName       xml.Name       `xml:"domain"`
+	Type          string         `xml:"type,attr"`
+	Name          string         `xml:"name"`
+	UUID          string         `xml:"uuid,omitempty"`
+	Memory        Memory         `xml:"memory"`
+	CurrentMemory Memory         `xml:"currentMemory"`
+	MemoryBacking *MemoryBacking `xml:"memoryBacking,omitempty"`
+	VCPU          VCPU           `xml:"vcpu"`
+	CPUTune       *CPUTune       `xml:"cputune,omitempty"`
+	NUMATune      *NUMATune      `xml:"numatune,omitempty"`
+	OS            OS             `xml:"os"`
+	Features      Features       `xml:"features"`
+	CPU           CPU            `xml:"cpu"`
+	Clock         Clock          `xml:"clock"`
+	OnPoweroff    string         `xml:"on_poweroff"`
+	OnReboot      string         `xml:"on_reboot"`
+	OnCrash       string         `xml:"on_crash"`
+	Devices       Devices        `xml:"devices"`
+	// QemuCommandline passes extra arguments and environment variables straight to QEMU
+	QemuCommandline *QemuCommandline `xml:"http://libvirt.org/schemas/domain/qemu/1.0 commandline,omitempty"`
+}
+
+type Memory struct {
+	Unit  string `xml:"unit,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MemoryBacking is needed for virtiofs filesystems, which share guest memory with virtiofsd
+type MemoryBacking struct {
+	Source *MemorySource `xml:"source,omitempty"`
+	Access *MemoryAccess `xml:"access,omitempty"`
+}
+
+type MemorySource struct {
+	Type string `xml:"type,attr"`
+}
+
+type MemoryAccess struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type VCPU struct {
+	Placement string `xml:"placement,attr"`
+	Value     string `xml:",chardata"`
+}
+
+// CPUTune pins vCPUs and the emulator threads to host CPUs
+type CPUTune struct {
+	VCPUPins    []VCPUPin    `xml:"vcpupin,omitempty"`
+	EmulatorPin *EmulatorPin `xml:"emulatorpin,omitempty"`
+	Shares      string       `xml:"shares,omitempty"`
+	Period      string       `xml:"period,omitempty"`
+	Quota       string       `xml:"quota,omitempty"`
+}
+
+type VCPUPin struct {
+	VCPU   string `xml:"vcpu,attr"`
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type EmulatorPin struct {
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+// NUMATune binds guest memory to host NUMA nodes
+type NUMATune struct {
+	Memory   *NUMAMemory `xml:"memory,omitempty"`
+	MemNodes []MemNode   `xml:"memnode,omitempty"`
+}
+
+type NUMAMemory struct {
+	Mode    string `xml:"mode,attr,omitempty"`
+	Nodeset string `xml:"nodeset,attr,omitempty"`
+}
+
+type MemNode struct {
+	CellID  string `xml:"cellid,attr"`
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type OS struct {
+	Type     OSType  `xml:"type"`
+	Firmware string  `xml:"firmware,attr,omitempty"`
+	Loader   *Loader `xml:"loader,omitempty"`
+	NVRam    *NVRam  `xml:"nvram,omitempty"`
+	Boot     []Boot  `xml:"boot,omitempty"`
+}
+
+type OSType struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type Loader struct {
+	ReadOnly string `xml:"readonly,attr"`
+	Type     string `xml:"type,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type NVRam struct {
+	Value string `xml:",chardata"`
+}
+
+type Boot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type Features struct {
+	ACPI struct{} `xml:"acpi"`
+	APIC struct{} `xml:"apic"`
+	GIC  *GIC     `xml:"gic,omitempty"`
+}
+
+type GIC struct {
+	Version string `xml:"version,attr"`
+}
+
+type CPU struct {
+	Mode     string    `xml:"mode,attr"`
+	Check    string    `xml:"check,attr,omitempty"`
+	Topology *Topology `xml:"topology,omitempty"`
+}
+
+type Topology struct {
+	Sockets string `xml:"sockets,attr"`
+	Cores   string `xml:"cores,attr"`
+	Threads string `xml:"threads,attr"`
+}
+
+type Clock struct {
+	Offset string  `xml:"offset,attr"`
+	Timer  []Timer `xml:"timer"`
+}
+
+type Timer struct {
+	Name       string `xml:"name,attr"`
+	Tickpolicy string `xml:"tickpolicy,attr,omitempty"`
+	Present    string `xml:"present,attr,omitempty"`
+}
+
+type Devices struct {
+	Emulator    string       `xml:"emulator"`
+	Disks       []Disk       `xml:"disk"`
+	Controllers []Controller `xml:"controller"`
+	Interfaces  []Interface  `xml:"interface"`
+	Serials     []Serial     `xml:"serial"`
+	Consoles    []Console    `xml:"console"`
+	Channels    []Channel    `xml:"channel"`
+	Graphics    []Graphics   `xml:"graphics"`
+	Videos      []Video      `xml:"video"`
+	Inputs      []Input      `xml:"input"`
+	Hostdevs    []Hostdev    `xml:"hostdev,omitempty"`
+	Filesystems []Filesystem `xml:"filesystem,omitempty"`
+	RNGs        []RNG        `xml:"rng"`
+	Sounds      []Sound      `xml:"sound,omitempty"`
+	TPMs        []TPM        `xml:"tpm,omitempty"`
+	Watchdog    *Watchdog    `xml:"watchdog,omitempty"`
+	MemBalloon  *MemBalloon  `xml:"memballoon,omitempty"`
+}
+
+type Disk struct {
+	Type   string      `xml:"type,attr"`
+	Device string      `xml:"device,attr"`
+	Driver *DiskDriver `xml:"driver,omitempty"`
+	Source *DiskSource `xml:"source,omitempty"`
+	Target DiskTarget  `xml:"target"`
+	Boot   *Boot       `xml:"boot,omitempty"`
+}
+
+type DiskDriver struct {
+	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Cache   string `xml:"cache,attr,omitempty"`
+	IO      string `xml:"io,attr,omitempty"`
+	Discard string `xml:"discard,attr,omitempty"`
+}
+
+type DiskSource struct {
+	File string `xml:"file,attr,omitempty"`
+}
+
+type DiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr,omitempty"`
+}
+
+type Controller struct {
+	Type    string   `xml:"type,attr"`
+	Index   string   `xml:"index,attr"`
+	Model   string   `xml:"model,attr,omitempty"`
+	Address *Address `xml:"address,omitempty"`
+}
+
+type Interface struct {
+	Type         string            `xml:"type,attr"`
+	Source       *InterfaceSource  `xml:"source,omitempty"`
+	Backend      *InterfaceBackend `xml:"backend,omitempty"`
+	PortForwards []PortForward     `xml:"portForward"`
+	Model        *InterfaceModel   `xml:"model,omitempty"`
+}
+
+// InterfaceBackend selects the user-mode networking of a type="user" interface, only passt can forward ports
+type InterfaceBackend struct {
+	Type string `xml:"type,attr"`
+}
+
+// PortForward forwards host ports to the guest, Address is the host address to listen on
+type PortForward struct {
+	Proto   string      `xml:"proto,attr"`
+	Address string      `xml:"address,attr,omitempty"`
+	Ranges  []PortRange `xml:"range"`
+}
+
+// PortRange forwards the host ports from Start to End to the guest ports starting at To
+type PortRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr,omitempty"`
+	To    string `xml:"to,attr,omitempty"`
+}
+
+type InterfaceSource struct {
+	Network string `xml:"network,attr,omitempty"`
+}
+
+type InterfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type Serial struct {
+	Type   string        `xml:"type,attr"`
+	Source *SerialSource `xml:"source,omitempty"`
+	Target *SerialTarget `xml:"target,omitempty"`
+}
+
+type SerialSource struct {
+	Path string `xml:"path,attr,omitempty"`
+}
+
+type SerialTarget struct {
+	Type string `xml:"type,attr,omitempty"`
+	Port string `xml:"port,attr,omitempty"`
+}
+
+type Console struct {
+	Type   string         `xml:"type,attr"`
+	Target *ConsoleTarget `xml:"target,omitempty"`
+}
+
+type ConsoleTarget struct {
+	Type string `xml:"type,attr,omitempty"`
+	Port string `xml:"port,attr,omitempty"`
+}
+
+type Channel struct {
+	Type   string         `xml:"type,attr"`
+	Source *ChannelSource `xml:"source,omitempty"`
+	Target *ChannelTarget `xml:"target,omitempty"`
+}
+
+type ChannelSource struct {
+	Mode string `xml:"mode,attr,omitempty"`
+	Path string `xml:"path,attr,omitempty"`
+}
+
+type ChannelTarget struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr,omitempty"`
+}
+
+type Graphics struct {
+	Type     string `xml:"type,attr"`
+	Port     string `xml:"port,attr,omitempty"`
+	TLSPort  string `xml:"tlsPort,attr,omitempty"`
+	AutoPort string `xml:"autoport,attr,omitempty"`
+	// WebSocket is the VNC websocket port, -1 picks one automatically
+	WebSocket string `xml:"websocket,attr,omitempty"`
+	Listen    string `xml:"listen,attr,omitempty"`
+	// Listens are filled in by libvirt on a running domain, a listen attribute is only the first address
+	Listens []GraphicsListen `xml:"listen,omitempty"`
+}
+
+// GraphicsListen is where a graphics server listens: type "address" with an address, "socket" with a socket path or "none"
+type GraphicsListen struct {
+	Type    string `xml:"type,attr"`
+	Address string `xml:"address,attr,omitempty"`
+	Socket  string `xml:"socket,attr,omitempty"`
+}
+
+type Video struct {
+	Model VideoModel `xml:"model"`
+}
+
+type VideoModel struct {
+	Type    string `xml:"type,attr"`
+	VRam    string `xml:"vram,attr,omitempty"`
+	Heads   string `xml:"heads,attr,omitempty"`
+	Primary string `xml:"primary,attr,omitempty"`
+}
+
+type Input struct {
+	Type string `xml:"type,attr"`
+	Bus  string `xml:"bus,attr"`
+}
+
+// Hostdev passes a host USB or PCI device through to the guest.
+// USB devices are picked by vendor and product ID or by bus and device address, PCI devices by address.
+type Hostdev struct {
+	Mode    string         `xml:"mode,attr"`
+	Type    string         `xml:"type,attr"`
+	Managed string         `xml:"managed,attr,omitempty"`
+	Source  *HostdevSource `xml:"source"`
+	Address *Address       `xml:"address,omitempty"`
+}
+
+type HostdevSource struct {
+	Vendor  *USBVendor  `xml:"vendor,omitempty"`
+	Product *USBProduct `xml:"product,omitempty"`
+	Address *Address    `xml:"address,omitempty"`
+}
+
+type USBVendor struct {
+	ID string `xml:"id,attr"`
+}
+
+type USBProduct struct {
+	ID string `xml:"id,attr"`
+}
+
+type RNG struct {
+	Model   string     `xml:"model,attr"`
+	Backend RNGBackend `xml:"backend"`
+}
+
+type RNGBackend struct {
+	Model string `xml:"model,attr"`
+	Value string `xml:",chardata"`
+}
+
+type Sound struct {
+	Model string `xml:"model,attr"`
+}
+
+// Filesystem shares a host directory with the guest, over virtiofs when the driver type is "virtiofs"
+type Filesystem struct {
+	Type       string            `xml:"type,attr,omitempty"`
+	AccessMode string            `xml:"accessmode,attr,omitempty"`
+	Driver     *FilesystemDriver `xml:"driver,omitempty"`
+	Binary     *FilesystemBinary `xml:"binary,omitempty"`
+	Source     FilesystemSource  `xml:"source"`
+	Target     FilesystemTarget  `xml:"target"`
+	ReadOnly   *struct{}         `xml:"readonly,omitempty"`
+}
+
+type FilesystemDriver struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Queue string `xml:"queue,attr,omitempty"`
+}
+
+type FilesystemBinary struct {
+	Path string `xml:"path,attr,omitempty"`
+}
+
+type FilesystemSource struct {
+	Dir string `xml:"dir,attr"`
+}
+
+// FilesystemTarget is the mount tag the guest sees
+type FilesystemTarget struct {
+	Dir string `xml:"dir,attr"`
+}
+
+// TPM is a virtual TPM, Windows 11 needs version 2.0
+type TPM struct {
+	Model   string     `xml:"model,attr,omitempty"`
+	Backend TPMBackend `xml:"backend"`
+}
+
+type TPMBackend struct {
+	Type    string `xml:"type,attr"`
+	Version string `xml:"version,attr,omitempty"`
+}
+
+type Watchdog struct {
+	Model  string `xml:"model,attr"`
+	Action string `xml:"action,attr,omitempty"`
+}
+
+type MemBalloon struct {
+	Model             string           `xml:"model,attr"`
+	AutoDeflate       string           `xml:"autodeflate,attr,omitempty"`
+	FreePageReporting string           `xml:"freePageReporting,attr,omitempty"`
+	Stats             *MemBalloonStats `xml:"stats,omitempty"`
+}
+
+// MemBalloonStats makes the guest report memory statistics every Period seconds
+type MemBalloonStats struct {
+	Period string `xml:"period,attr"`
+}
+
+type Address struct {
+	Type     string `xml:"type,attr,omitempty"`
+	Domain   string `xml:"domain,attr,omitempty"`
+	Bus      string `xml:"bus,attr,omitempty"`
+	Slot     string `xml:"slot,attr,omitempty"`
+	Function string `xml:"function,attr,omitempty"`
+	// Device is the device number of a USB host device
+	Device string `xml:"device,attr,omitempty"`
+}
+
+// QemuCommandline is the qemu:commandline element, see LibvirtDomainXML
+type QemuCommandline struct {
+	Args []QemuArg `xml:"arg"`
+	Envs []QemuEnv `xml:"env"`
+}
+
+type QemuArg struct {
+	Value string `xml:"value,attr"`
+}
+
+type QemuEnv struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr,omitempty"`
+}
@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"encoding/xml"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testSpec is a firstboot VM for arch with every optional device, independent of the host bvm runs on
+func testSpec(arch string) *vmSpec {
+	spec := &vmSpec{
+		Name:              "bvm-firstboot-win11",
+		Dir:               "/home/pi/win11",
+		Arch:              arch,
+		MemoryGiB:         4,
+		CPUs:              4,
+		Graphics:          true,
+		SerialLog:         "/home/pi/win11/serial.log",
+		ProgressLog:       "/home/pi/win11/" + firstLoginProgressFile,
+		FreePageReporting: true,
+		DeflateOnOOM:      true,
+		USBDevices: []usb.Selector{
+			{VendorID: "046d", ProductID: "c52b"},
+			{Bus: 1, Address: 4},
+		},
+		RDPPort: 3390,
+	}
+	cdromBus := "usb"
+	answerFile := vmDisk{Path: "/home/pi/win11/autounattend-cdrom.iso", Format: "raw", Device: "cdrom", Bus: cdromBus, Target: "sdb"}
+	switch arch {
+	case "aarch64":
+		spec.Machine = "virt"
+		spec.Emulator = "/usr/bin/qemu-system-aarch64"
+		spec.Firmware = "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"
+	case "x86_64":
+		spec.Machine = "q35"
+		spec.Emulator = "/usr/bin/qemu-system-x86_64"
+		spec.Firmware = "/usr/share/OVMF/OVMF_CODE_4M.fd"
+		spec.WatchdogModel = "i6300esb"
+		cdromBus = "sata"
+		answerFile = vmDisk{Path: "/home/pi/win11/autounattend.img", Format: "raw", Device: "floppy", Bus: "fdc", Target: "fda"}
+	}
+	spec.Disks = []vmDisk{
+		{Path: "/home/pi/win11/disk.qcow2", Format: "qcow2", Device: "disk", Bus: "virtio", Target: "vda"},
+		{Path: "/home/pi/win11/installer.iso", Format: "raw", Device: "cdrom", Bus: "ide", Target: "hda", Boot: true},
+		{Path: "/home/pi/win11/unattended.iso", Format: "raw", Device: "cdrom", Bus: cdromBus, Target: "sda"},
+		answerFile,
+	}
+	return spec
+}
+
+func TestLibvirtDomainXML(t *testing.T) {
+	for _, arch := range []string{"aarch64", "x86_64"} {
+		t.Run(arch, func(t *testing.T) {
+			got, err := testSpec(arch).libvirtDomainXML()
+			if err != nil {
+				t.Fatalf("libvirtDomainXML() failed: %v", err)
+			}
+
+			golden := filepath.Join("testdata", "domain-"+arch+".xml")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file, run go test -update to create it: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("libvirtDomainXML() differs from %s, run go test -update if the change is intended:\n%s", golden, got)
+			}
+
+			// bvm boot-nodisplay sends the user to rdp_port, user-mode networking only forwards it with passt
+			forward := `<interface type="user">
+      <backend type="passt"></backend>
+      <portForward proto="tcp" address="127.0.0.1">
+        <range start="3390" to="3389"></range>
+      </portForward>`
+			if !strings.Contains(string(want), forward) {
+				t.Errorf("%s doesn't forward rdp_port 3390 to RDP in the guest", golden)
+			}
+		})
+	}
+}
+
+func TestLibvirtDomainXMLWithoutRDPPort(t *testing.T) {
+	spec := testSpec("aarch64")
+	spec.RDPPort = 0
+	got, err := spec.libvirtDomainXML()
+	if err != nil {
+		t.Fatalf("libvirtDomainXML() failed: %v", err)
+	}
+	if !strings.Contains(got, `<interface type="user">
+      <model type="virtio"></model>`) || strings.Contains(got, `<backend type="passt">`) || strings.Contains(got, "portForward") {
+		t.Errorf("libvirtDomainXML() without rdp_port has a passt port forward:\n%s", got)
+	}
+}
+
+func TestLibvirtDomainXMLRoundTrip(t *testing.T) {
+	for _, arch := range []string{"aarch64", "x86_64"} {
+		t.Run(arch, func(t *testing.T) {
+			domain := testSpec(arch).libvirtDomain()
+			domain.QemuCommandline = &QemuCommandline{
+				Args: []QemuArg{{Value: "-global"}, {Value: "ICH9-LPC.disable_s3=1"}},
+				Envs: []QemuEnv{{Name: "QEMU_AUDIO_DRV", Value: "none"}, {Name: "SPICE_DEBUG_ALLOW_MC"}},
+			}
+
+			first, err := xml.MarshalIndent(domain, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			var decoded LibvirtDomainXML
+			if err := xml.Unmarshal([]byte(xml.Header+string(first)), &decoded); err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			second, err := xml.MarshalIndent(decoded, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal again: %v", err)
+			}
+			if string(first) != string(second) {
+				t.Errorf("domain XML changed in a round trip\nfirst:\n%s\nsecond:\n%s", first, second)
+			}
+
+			// Fields both marshals drop alike would pass the comparison, so the devices are checked by hand as well
+			devices := decoded.Devices
+			if len(devices.Hostdevs) != 2 {
+				t.Errorf("round trip kept %d hostdevs, want 2", len(devices.Hostdevs))
+			} else if selector, ok := hostdevUSBSelector(devices.Hostdevs[0]); !ok || selector.VendorID != "046d" || selector.ProductID != "c52b" {
+				t.Errorf("round trip turned the first hostdev into %+v", selector)
+			} else if selector, ok := hostdevUSBSelector(devices.Hostdevs[1]); !ok || selector.Bus != 1 || selector.Address != 4 {
+				t.Errorf("round trip turned the second hostdev into %+v", selector)
+			}
+			if arch == "x86_64" && (devices.Watchdog == nil || devices.Watchdog.Model != "i6300esb" || devices.Watchdog.Action != "pause") {
+				t.Errorf("round trip watchdog = %+v, want i6300esb pausing the guest", devices.Watchdog)
+			}
+			if balloon := devices.MemBalloon; balloon == nil || balloon.Stats == nil || balloon.Stats.Period == "" ||
+				balloon.FreePageReporting != "on" || balloon.AutoDeflate != "on" {
+				t.Errorf("round trip memballoon = %+v, want stats, free page reporting and autodeflate", balloon)
+			}
+			if len(devices.Interfaces) != 1 || devices.Interfaces[0].Backend == nil || len(devices.Interfaces[0].PortForwards) != 1 ||
+				len(devices.Interfaces[0].PortForwards[0].Ranges) != 1 || devices.Interfaces[0].PortForwards[0].Ranges[0].Start != "3390" {
+				t.Errorf("round trip interfaces = %+v, want one forwarding port 3390", devices.Interfaces)
+			}
+			if cmdline := decoded.QemuCommandline; cmdline == nil || len(cmdline.Args) != 2 || len(cmdline.Envs) != 2 ||
+				cmdline.Args[1].Value != "ICH9-LPC.disable_s3=1" || cmdline.Envs[0].Value != "none" {
+				t.Errorf("round trip qemu:commandline = %+v", cmdline)
+			}
+		})
+	}
+}
+
+// TestQemuCommandlineFromLibvirt reads qemu:commandline the way libvirt writes it, with a prefix declared on the root
+func TestQemuCommandlineFromLibvirt(t *testing.T) {
+	const libvirtXML = `<domain type='kvm' xmlns:qemu='http://libvirt.org/schemas/domain/qemu/1.0'>
+  <name>bvm-win11</name>
+  <devices>
+    <memballoon model='virtio' freePageReporting='on'>
+      <stats period='5'/>
+    </memballoon>
+  </devices>
+  <qemu:commandline>
+    <qemu:arg value='-device'/>
+    <qemu:arg value='virtio-balloon-pci'/>
+    <qemu:env name='QEMU_AUDIO_DRV' value='none'/>
+  </qemu:commandline>
+</domain>`
+
+	var domain LibvirtDomainXML
+	if err := xml.Unmarshal([]byte(libvirtXML), &domain); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if cmdline := domain.QemuCommandline; cmdline == nil || len(cmdline.Args) != 2 || cmdline.Args[0].Value != "-device" ||
+		len(cmdline.Envs) != 1 || cmdline.Envs[0].Name != "QEMU_AUDIO_DRV" {
+		t.Errorf("qemu:commandline = %+v", cmdline)
+	}
+	if balloon := domain.Devices.MemBalloon; balloon == nil || balloon.Stats == nil || balloon.Stats.Period != "5" {
+		t.Errorf("memballoon = %+v, want stats every 5 seconds", balloon)
+	}
+
+	output, err := xml.Marshal(domain)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	if !strings.Contains(string(output), `<commandline xmlns="http://libvirt.org/schemas/domain/qemu/1.0"><arg value="-device">`) {
+		t.Errorf("qemu:commandline isn't written in the qemu namespace:\n%s", output)
+	}
+}
@@ -0,0 +1,305 @@
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"libvirt.org/go/libvirt"
+)
+
+// firstBootCaptureDir is where bvm firstboot --capture collects debugging material, in the VM directory
+const firstBootCaptureDir = "firstboot-capture"
+
+// screenshotInterval is the minimum time between two screenshots
+const screenshotInterval = time.Minute
+
+// maxScreenshots is how many screenshots are kept, older ones are deleted
+const maxScreenshots = 120
+
+// firstBootCapture records screenshots, the serial console, the domain XML and the libvirt log of every attempt.
+// If firstboot fails they are packed into a tarball together with the answer file for bug reports.
+type firstBootCapture struct {
+	vmdir          string
+	dir            string
+	screenshots    []string
+	lastScreenshot time.Time
+	lastImage      []byte
+	attempts       int
+	// delivery is the answer file delivery method of the last attempt
+	delivery unattend.DeliveryMethod
+}
+
+// newFirstBootCapture empties the capture directory of an earlier run
+func newFirstBootCapture(vmdir string) (*firstBootCapture, error) {
+	dir := filepath.Join(vmdir, firstBootCaptureDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear %s: %v", firstBootCaptureDir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", firstBootCaptureDir, err)
+	}
+	internal.Status("Capturing screenshots and the serial console to " + dir)
+	return &firstBootCapture{vmdir: vmdir, dir: dir}, nil
+}
+
+// serialLog is the file the serial console of a domain is written to
+func (c *firstBootCapture) serialLog(domainName string) string {
+	return filepath.Join(c.dir, "serial-"+domainName+".log")
+}
+
+// screenshotDue reports whether the throttle allows another screenshot
+func (c *firstBootCapture) screenshotDue(now time.Time) bool {
+	return now.Sub(c.lastScreenshot) >= screenshotInterval
+}
+
+// screenshot saves the screen of the domain as a PNG, skipping it if nothing changed since the last one
+func (c *firstBootCapture) screenshot(conn *libvirt.Connect, domain *libvirt.Domain, now time.Time) error {
+	c.lastScreenshot = now
+
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return fmt.Errorf("failed to create stream: %v", err)
+	}
+	defer stream.Free()
+
+	mimeType, err := domain.Screenshot(stream, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to take screenshot: %v", err)
+	}
+	var data bytes.Buffer
+	err = stream.RecvAll(func(s *libvirt.Stream, chunk []byte) (int, error) {
+		return data.Write(chunk)
+	})
+	if err != nil {
+		stream.Abort()
+		return fmt.Errorf("failed to receive screenshot: %v", err)
+	}
+	if err := stream.Finish(); err != nil {
+		return fmt.Errorf("failed to finish screenshot: %v", err)
+	}
+
+	if bytes.Equal(data.Bytes(), c.lastImage) {
+		return nil
+	}
+	c.lastImage = data.Bytes()
+
+	// QEMU sends PNG when it supports it and PPM otherwise
+	encoded := data.Bytes()
+	if mimeType != "image/png" {
+		img, err := decodePPM(encoded)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s screenshot: %v", mimeType, err)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return fmt.Errorf("failed to encode screenshot: %v", err)
+		}
+		encoded = buf.Bytes()
+	}
+
+	path := filepath.Join(c.dir, "screenshot-"+now.Format("20060102-150405")+".png")
+	if err := os.WriteFile(path, encoded, 0644); err != nil {
+		return fmt.Errorf("failed to save screenshot: %v", err)
+	}
+	c.screenshots = append(c.screenshots, path)
+	for len(c.screenshots) > maxScreenshots {
+		os.Remove(c.screenshots[0])
+		c.screenshots = c.screenshots[1:]
+	}
+	return nil
+}
+
+// attemptEnded keeps the domain XML and the libvirt log of an attempt before the domain is removed
+func (c *firstBootCapture) attemptEnded(conn *libvirt.Connect, domain *libvirt.Domain, domainName string, delivery unattend.DeliveryMethod) {
+	c.attempts++
+	c.delivery = delivery
+
+	if xmlDesc, err := domain.GetXMLDesc(0); err == nil {
+		if err := os.WriteFile(filepath.Join(c.dir, "domain-"+domainName+".xml"), []byte(xmlDesc), 0644); err != nil {
+			internal.Warning("Failed to save domain XML: " + err.Error())
+		}
+	} else {
+		internal.Debug("Failed to get domain XML: " + err.Error())
+	}
+
+	logPath := libvirtDomainLog(conn, domainName)
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		internal.Debug("Failed to read libvirt log " + logPath + ": " + err.Error())
+		return
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, "libvirt-"+domainName+".log"), content, 0644); err != nil {
+		internal.Warning("Failed to save libvirt log: " + err.Error())
+	}
+}
+
+// libvirtDomainLog returns where libvirt writes the QEMU log of a domain
+func libvirtDomainLog(conn *libvirt.Connect, domainName string) string {
+	if uri, err := conn.GetURI(); err == nil && strings.HasSuffix(uri, "/session") {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = filepath.Join(os.Getenv("HOME"), ".cache")
+		}
+		return filepath.Join(cacheDir, "libvirt", "qemu", "log", domainName+".log")
+	}
+	return filepath.Join("/var/log/libvirt/qemu", domainName+".log")
+}
+
+// bundle packs everything captured plus the answer file of the last attempt and firstboot state into a tarball in the VM directory
+func (c *firstBootCapture) bundle() (string, error) {
+	tarball := filepath.Join(c.vmdir, "firstboot-failure-"+time.Now().Format("20060102-150405")+".tar.gz")
+	file, err := os.Create(tarball)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", tarball, err)
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %v", firstBootCaptureDir, err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, filepath.Join(firstBootCaptureDir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	files = append(files,
+		filepath.Join("answerfiles", string(c.delivery)+".xml"),
+		filepath.Join("unattended", "firstlogin.ps1"),
+		firstBootRecoveryFile,
+		firstBootTimingsFile,
+		firstLoginProgressFile,
+	)
+
+	for _, name := range files {
+		if err := addFileToTar(tw, filepath.Join(c.vmdir, name), name); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", tarball, err)
+	}
+	if err := gz.Close(); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", tarball, err)
+	}
+	return tarball, nil
+}
+
+// addFileToTar adds a single file to the tarball under name
+func addFileToTar(tw *tar.Writer, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %v", path, err)
+	}
+	header.Name = filepath.ToSlash(name)
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to add %s: %v", path, err)
+	}
+	if _, err := io.Copy(tw, file); err != nil {
+		return fmt.Errorf("failed to add %s: %v", path, err)
+	}
+	return nil
+}
+
+// decodePPM decodes the binary PPM (P6) images QEMU takes screenshots in
+func decodePPM(data []byte) (image.Image, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	// The header is the magic number, width, height and maximum value separated by whitespace, with # comments
+	var fields []int
+	magic, err := readPPMToken(reader)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported PPM format %q", magic)
+	}
+	for len(fields) < 3 {
+		token, err := readPPMToken(reader)
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.Atoi(token)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("invalid PPM header value %q", token)
+		}
+		fields = append(fields, value)
+	}
+	width, height, maxValue := fields[0], fields[1], fields[2]
+	if maxValue > 255 {
+		return nil, fmt.Errorf("16-bit PPM images are not supported")
+	}
+
+	pixels := make([]byte, width*height*3)
+	if _, err := io.ReadFull(reader, pixels); err != nil {
+		return nil, fmt.Errorf("truncated PPM image: %v", err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		img.Set(i%width, i/width, color.RGBA{
+			R: uint8(int(pixels[3*i]) * 255 / maxValue),
+			G: uint8(int(pixels[3*i+1]) * 255 / maxValue),
+			B: uint8(int(pixels[3*i+2]) * 255 / maxValue),
+			A: 255,
+		})
+	}
+	return img, nil
+}
+
+// readPPMToken reads the next whitespace separated header token and the single whitespace after it
+func readPPMToken(reader *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("truncated PPM header: %v", err)
+		}
+		switch {
+		case b == '#' && len(token) == 0:
+			if _, err := reader.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("truncated PPM header: %v", err)
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, b)
+		}
+	}
+}
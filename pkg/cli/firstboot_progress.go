@@ -0,0 +1,442 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/progress"
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+)
+
+// installPhase is a phase of the unattended Windows installation, in the order they happen
+type installPhase int
+
+const (
+	phaseWinPE installPhase = iota
+	phaseSpecialize
+	phaseOOBE
+	phaseFirstLogin
+	phaseDebloat
+	phaseShutdown
+	phaseDone
+)
+
+// installPhases describes every phase before phaseDone. The estimates are used until the VM directory has timings of a previous run.
+var installPhases = []struct {
+	key      string
+	title    string
+	estimate time.Duration
+}{
+	phaseWinPE:      {"winpe", "Copying Windows files", 40 * time.Minute},
+	phaseSpecialize: {"specialize", "Setting up devices", 20 * time.Minute},
+	phaseOOBE:       {"oobe", "Out-of-box experience", 15 * time.Minute},
+	phaseFirstLogin: {"first-login", "First login setup", 20 * time.Minute},
+	phaseDebloat:    {"debloat", "Removing bloatware", 15 * time.Minute},
+	phaseShutdown:   {"shutdown", "Shutting down", 2 * time.Minute},
+}
+
+// firstBootTimingsFile stores how long each phase took on previous runs, in the VM directory
+const firstBootTimingsFile = "firstboot-timings.json"
+
+// maxTimingRuns is how many previous runs are kept for the estimate
+const maxTimingRuns = 5
+
+// firstBootTimings holds the duration in seconds of every phase, one map per completed run
+type firstBootTimings struct {
+	Runs []map[string]float64 `json:"runs"`
+}
+
+// loadFirstBootTimings reads the timings of previous runs, a missing or broken file gives no runs
+func loadFirstBootTimings(vmdir string) firstBootTimings {
+	var timings firstBootTimings
+	content, err := os.ReadFile(filepath.Join(vmdir, firstBootTimingsFile))
+	if err != nil {
+		return timings
+	}
+	if err := json.Unmarshal(content, &timings); err != nil {
+		internal.Warning("Ignoring invalid " + firstBootTimingsFile + ": " + err.Error())
+		return firstBootTimings{}
+	}
+	return timings
+}
+
+// save adds a run to the timings and writes them to the VM directory
+func (t firstBootTimings) save(vmdir string, run map[string]float64) error {
+	t.Runs = append(t.Runs, run)
+	if len(t.Runs) > maxTimingRuns {
+		t.Runs = t.Runs[len(t.Runs)-maxTimingRuns:]
+	}
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode timings: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(vmdir, firstBootTimingsFile), content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", firstBootTimingsFile, err)
+	}
+	return nil
+}
+
+// estimate returns the expected duration of a phase, averaged over previous runs
+func (t firstBootTimings) estimate(phase installPhase) time.Duration {
+	key := installPhases[phase].key
+	var total float64
+	var count int
+	for _, run := range t.Runs {
+		if seconds, ok := run[key]; ok {
+			total += seconds
+			count++
+		}
+	}
+	if count == 0 {
+		return installPhases[phase].estimate
+	}
+	return time.Duration(total / float64(count) * float64(time.Second))
+}
+
+// remaining estimates the time left for the current and all later phases
+func (t firstBootTimings) remaining(phase installPhase, phaseStarted time.Time, now time.Time) time.Duration {
+	if phase >= phaseDone {
+		return 0
+	}
+	left := t.estimate(phase) - now.Sub(phaseStarted)
+	if left < 0 {
+		left = 0
+	}
+	for later := phase + 1; later < phaseDone; later++ {
+		left += t.estimate(later)
+	}
+	return left
+}
+
+// phaseTracker follows the installation through its phases
+type phaseTracker struct {
+	timings      firstBootTimings
+	started      time.Time
+	phase        installPhase
+	phaseStarted time.Time
+	durations    map[string]float64
+	reboots      int
+	// writeRate is the disk write rate in bytes per second
+	writeRate float64
+	// resumed is set when the attempt restarted from a snapshot, the earlier phases were not timed then
+	resumed bool
+}
+
+func newPhaseTracker(vmdir string, now time.Time) *phaseTracker {
+	return &phaseTracker{
+		timings:      loadFirstBootTimings(vmdir),
+		started:      now,
+		phase:        phaseWinPE,
+		phaseStarted: now,
+		durations:    map[string]float64{},
+	}
+}
+
+// resume starts the tracker at the phase an attempt restarts from
+func (t *phaseTracker) resume(from installPhase) {
+	t.phase = from
+	t.resumed = from > phaseWinPE
+	switch {
+	case from >= phaseOOBE:
+		t.reboots = 2
+	case from == phaseSpecialize:
+		t.reboots = 1
+	}
+}
+
+// advance moves to a later phase, phases never go backwards. Skipped phases are recorded as taking no time.
+func (t *phaseTracker) advance(to installPhase, now time.Time) bool {
+	if to <= t.phase {
+		return false
+	}
+	t.durations[installPhases[t.phase].key] = now.Sub(t.phaseStarted).Round(time.Second).Seconds()
+	for skipped := t.phase + 1; skipped < to && skipped < phaseDone; skipped++ {
+		t.durations[installPhases[skipped].key] = 0
+	}
+	t.phase = to
+	t.phaseStarted = now
+	return true
+}
+
+// reboot counts a guest reboot. Windows Setup reboots once after copying files and once after specialize.
+func (t *phaseTracker) reboot(now time.Time) bool {
+	t.reboots++
+	if t.reboots == 1 {
+		return t.advance(phaseSpecialize, now)
+	}
+	return t.advance(phaseOOBE, now)
+}
+
+// progressEvent moves the phase along based on what firstlogin.ps1 reports
+func (t *phaseTracker) progressEvent(event provision.ProgressEvent, now time.Time) bool {
+	switch {
+	case event.Kind == provision.ProgressStep && event.Step == "debloat":
+		return t.advance(phaseDebloat, now)
+	case event.Kind == provision.ProgressStep && event.Step == "shutdown", event.Kind == provision.ProgressDone:
+		return t.advance(phaseShutdown, now)
+	default:
+		return t.advance(phaseFirstLogin, now)
+	}
+}
+
+// finish records the timings of a completed run in the VM directory
+func (t *phaseTracker) finish(vmdir string, now time.Time) {
+	t.advance(phaseDone, now)
+	if t.resumed {
+		return
+	}
+	if err := t.timings.save(vmdir, t.durations); err != nil {
+		internal.Warning("Failed to save installation timings: " + err.Error())
+	}
+}
+
+// firstBootUpdate is sent by the monitor whenever something changed
+type firstBootUpdate struct {
+	phase        installPhase
+	phaseStarted time.Time
+	durations    map[string]float64
+	remaining    time.Duration
+	reboots      int
+	writeRate    float64
+	// event is a progress line from firstlogin.ps1, if that is what changed
+	event *provision.ProgressEvent
+	// vmEvent is what the hypervisor reported about the VM, if that is what changed
+	vmEvent *vmEvent
+	// warning is something that went wrong in the monitor itself
+	warning string
+}
+
+// snapshot copies the tracker state into an update
+func (t *phaseTracker) snapshot(now time.Time) firstBootUpdate {
+	durations := make(map[string]float64, len(t.durations))
+	for key, seconds := range t.durations {
+		durations[key] = seconds
+	}
+	return firstBootUpdate{
+		phase:        t.phase,
+		phaseStarted: t.phaseStarted,
+		durations:    durations,
+		remaining:    t.timings.remaining(t.phase, t.phaseStarted, now),
+		reboots:      t.reboots,
+		writeRate:    t.writeRate,
+	}
+}
+
+// isTerminal reports whether stdout is a terminal that can show the progress view
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// showFirstBootProgress shows updates until the channel is closed, in the progress view if possible.
+// Quitting the view falls back to plain output so the installation keeps running.
+func showFirstBootProgress(updates <-chan firstBootUpdate, started time.Time, timings firstBootTimings) {
+	if isTerminal() {
+		model := newFirstBootModel(updates, started, timings)
+		finalModel, err := tea.NewProgram(model).Run()
+		if err != nil {
+			internal.Warning("Progress view failed: " + err.Error())
+		} else if final, ok := finalModel.(firstBootModel); ok && final.finished {
+			return
+		}
+		internal.Status("Progress view closed, installation continues in the background...")
+	}
+
+	lastPhase := installPhase(-1)
+	for update := range updates {
+		if update.event != nil {
+			reportFirstLoginProgress(*update.event)
+		}
+		if update.vmEvent != nil {
+			reportVMEvent(*update.vmEvent)
+		}
+		if update.warning != "" {
+			internal.Warning(update.warning)
+		}
+		if update.phase != lastPhase && update.phase < phaseDone {
+			internal.Status(fmt.Sprintf("Installation phase: %s (about %s left)", installPhases[update.phase].title, formatDuration(update.remaining)))
+			lastPhase = update.phase
+		}
+	}
+}
+
+// firstBootUpdateMsg carries an update into the progress view
+type firstBootUpdateMsg struct {
+	update firstBootUpdate
+	ok     bool
+}
+
+type firstBootTickMsg time.Time
+
+// firstBootModel is the bubbletea progress view for firstboot
+type firstBootModel struct {
+	updates  <-chan firstBootUpdate
+	started  time.Time
+	timings  firstBootTimings
+	last     firstBootUpdate
+	recent   []string
+	now      time.Time
+	finished bool
+
+	spinner  spinner.Model
+	progress progress.Model
+}
+
+func newFirstBootModel(updates <-chan firstBootUpdate, started time.Time, timings firstBootTimings) firstBootModel {
+	s := spinner.New()
+	s.Spinner = spinner.Dot
+	return firstBootModel{
+		updates:  updates,
+		started:  started,
+		timings:  timings,
+		now:      started,
+		last:     firstBootUpdate{phaseStarted: started, durations: map[string]float64{}},
+		spinner:  s,
+		progress: progress.New(progress.WithDefaultGradient()),
+	}
+}
+
+// waitForUpdate reads the next update from the monitor
+func waitForUpdate(updates <-chan firstBootUpdate) tea.Cmd {
+	return func() tea.Msg {
+		update, ok := <-updates
+		return firstBootUpdateMsg{update: update, ok: ok}
+	}
+}
+
+func firstBootTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return firstBootTickMsg(t)
+	})
+}
+
+func (m firstBootModel) Init() tea.Cmd {
+	return tea.Batch(waitForUpdate(m.updates), m.spinner.Tick, firstBootTick())
+}
+
+func (m firstBootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "q":
+			return m, tea.Quit
+		}
+	case tea.WindowSizeMsg:
+		m.progress.Width = min(msg.Width-4, 80)
+	case firstBootUpdateMsg:
+		if !msg.ok {
+			m.finished = true
+			return m, tea.Quit
+		}
+		m.last = msg.update
+		if event := msg.update.event; event != nil {
+			m.addRecent(formatProgressEvent(*event))
+		}
+		if event := msg.update.vmEvent; event != nil {
+			m.addRecent("VM: " + event.String())
+		}
+		if msg.update.warning != "" {
+			m.addRecent("Warning: " + msg.update.warning)
+		}
+		return m, waitForUpdate(m.updates)
+	case firstBootTickMsg:
+		m.now = time.Time(msg)
+		return m, firstBootTick()
+	case spinner.TickMsg:
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+	}
+	return m, nil
+}
+
+func (m firstBootModel) View() string {
+	var b strings.Builder
+	b.WriteString(headerStyle.Render("BVM - Installing Windows"))
+	b.WriteString("\n")
+
+	for phase := phaseWinPE; phase < phaseDone; phase++ {
+		info := installPhases[phase]
+		switch {
+		case phase < m.last.phase:
+			fmt.Fprintf(&b, "%s %-28s %s\n", doneStyle.Render("✓"), info.title, formatDuration(time.Duration(m.last.durations[info.key]*float64(time.Second))))
+		case phase == m.last.phase:
+			fmt.Fprintf(&b, "%s %-28s %s\n", m.spinner.View(), info.title, formatDuration(m.now.Sub(m.last.phaseStarted)))
+		default:
+			fmt.Fprintf(&b, "  %s\n", pendingStyle.Render(info.title))
+		}
+	}
+	b.WriteString("\n")
+
+	// Elapsed time versus the estimate drives the bar, since the phases take very different amounts of time
+	elapsed := m.now.Sub(m.started)
+	remaining := m.timings.remaining(m.last.phase, m.last.phaseStarted, m.now)
+	percent := 0.0
+	if elapsed+remaining > 0 {
+		percent = float64(elapsed) / float64(elapsed+remaining)
+	}
+	b.WriteString(m.progress.ViewAs(percent))
+	b.WriteString("\n")
+
+	estimateSource := "default estimate"
+	if len(m.timings.Runs) > 0 {
+		estimateSource = fmt.Sprintf("based on %d previous run(s)", len(m.timings.Runs))
+	}
+	fmt.Fprintf(&b, "Elapsed: %s   Remaining: about %s (%s)\n", formatDuration(elapsed), formatDuration(remaining), estimateSource)
+	fmt.Fprintf(&b, "Disk writes: %.1f MiB/s   Reboots: %d\n", m.last.writeRate/1024/1024, m.last.reboots)
+
+	if len(m.recent) > 0 {
+		b.WriteString("\n")
+		for _, line := range m.recent {
+			b.WriteString(infoStyle.Render(line))
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("\n")
+	b.WriteString(infoStyle.Render("Press q to hide this view, the installation keeps running."))
+	b.WriteString("\n")
+	return b.String()
+}
+
+// addRecent adds a line to the recent events shown below the progress bar
+func (m *firstBootModel) addRecent(line string) {
+	m.recent = append(m.recent, line)
+	if len(m.recent) > 5 {
+		m.recent = m.recent[len(m.recent)-5:]
+	}
+}
+
+// formatProgressEvent turns a progress line from firstlogin.ps1 into text for the view
+func formatProgressEvent(event provision.ProgressEvent) string {
+	switch event.Kind {
+	case provision.ProgressStep:
+		return "First login: " + event.Message + " (" + event.Step + ")"
+	case provision.ProgressError:
+		return "First login error: " + event.Message
+	case provision.ProgressDelivery:
+		return "Answer file delivered by: " + event.Message
+	}
+	return "First login: " + event.Message
+}
+
+// formatDuration prints a duration as 1h02m or 5m03s
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+var (
+	doneStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("#04B575"))
+	pendingStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#888888"))
+)
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// builtInTotal is the sum of the built-in estimates of every phase
+func builtInTotal() time.Duration {
+	var total time.Duration
+	for _, phase := range installPhases {
+		total += phase.estimate
+	}
+	return total
+}
+
+func TestFirstBootTimingsEstimate(t *testing.T) {
+	tests := []struct {
+		name  string
+		runs  []map[string]float64
+		phase installPhase
+		want  time.Duration
+	}{
+		{name: "built-in estimate without previous runs", phase: phaseWinPE, want: 40 * time.Minute},
+		{name: "built-in estimate of a later phase", phase: phaseShutdown, want: 2 * time.Minute},
+		{name: "single run", runs: []map[string]float64{{"winpe": 1800}}, phase: phaseWinPE, want: 30 * time.Minute},
+		{
+			name:  "average of previous runs",
+			runs:  []map[string]float64{{"oobe": 600}, {"oobe": 900}, {"oobe": 1200}},
+			phase: phaseOOBE,
+			want:  15 * time.Minute,
+		},
+		{
+			name:  "runs without the phase don't count",
+			runs:  []map[string]float64{{"winpe": 2400}, {"winpe": 2000, "debloat": 90}, {"winpe": 2200}},
+			phase: phaseDebloat,
+			want:  90 * time.Second,
+		},
+		{
+			name:  "built-in estimate when no run has the phase",
+			runs:  []map[string]float64{{"winpe": 2400, "specialize": 600}},
+			phase: phaseFirstLogin,
+			want:  20 * time.Minute,
+		},
+		{name: "fractions of a second", runs: []map[string]float64{{"shutdown": 1.5}, {"shutdown": 2}}, phase: phaseShutdown, want: 1750 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timings := firstBootTimings{Runs: test.runs}
+			if got := timings.estimate(test.phase); got != test.want {
+				t.Errorf("estimate(%s) = %v, want %v", installPhases[test.phase].key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFirstBootTimingsRemaining(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	previous := firstBootTimings{Runs: []map[string]float64{{
+		"winpe": 1200, "specialize": 600, "oobe": 300, "first-login": 600, "debloat": 300, "shutdown": 60,
+	}}}
+
+	tests := []struct {
+		name    string
+		timings firstBootTimings
+		phase   installPhase
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{name: "start without previous runs", phase: phaseWinPE, want: builtInTotal()},
+		{name: "into the first phase without previous runs", phase: phaseWinPE, elapsed: 10 * time.Minute, want: builtInTotal() - 10*time.Minute},
+		{name: "start with a previous run", timings: previous, phase: phaseWinPE, want: 51 * time.Minute},
+		{name: "later phase", timings: previous, phase: phaseFirstLogin, elapsed: 4 * time.Minute, want: 6*time.Minute + 5*time.Minute + time.Minute},
+		{name: "phase taking longer than estimated", timings: previous, phase: phaseDebloat, elapsed: time.Hour, want: time.Minute},
+		{name: "last phase overdue", timings: previous, phase: phaseShutdown, elapsed: 5 * time.Minute, want: 0},
+		{name: "done", timings: previous, phase: phaseDone, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.timings.remaining(test.phase, started, started.Add(test.elapsed))
+			if got != test.want {
+				t.Errorf("remaining() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFirstBootTimingsSave(t *testing.T) {
+	vmdir := t.TempDir()
+	if timings := loadFirstBootTimings(vmdir); len(timings.Runs) != 0 {
+		t.Fatalf("loadFirstBootTimings() without a file = %+v, want no runs", timings)
+	}
+
+	// Only the last maxTimingRuns runs are kept
+	for i := 1; i <= maxTimingRuns+2; i++ {
+		if err := loadFirstBootTimings(vmdir).save(vmdir, map[string]float64{"winpe": float64(i * 60)}); err != nil {
+			t.Fatalf("save() failed: %v", err)
+		}
+	}
+	timings := loadFirstBootTimings(vmdir)
+	if len(timings.Runs) != maxTimingRuns {
+		t.Fatalf("saved %d runs, want %d", len(timings.Runs), maxTimingRuns)
+	}
+	if first, last := timings.Runs[0]["winpe"], timings.Runs[maxTimingRuns-1]["winpe"]; first != 180 || last != 420 {
+		t.Errorf("kept runs from %v to %v seconds, want the last %d from 180 to 420", first, last, maxTimingRuns)
+	}
+	if got := timings.estimate(phaseWinPE); got != 5*time.Minute {
+		t.Errorf("estimate(winpe) = %v, want the 5 minute average of the kept runs", got)
+	}
+
+	// A broken file falls back to the built-in estimates
+	if err := os.WriteFile(filepath.Join(vmdir, firstBootTimingsFile), []byte("{runs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadFirstBootTimings(vmdir).remaining(phaseWinPE, time.Time{}, time.Time{}); got != builtInTotal() {
+		t.Errorf("remaining() with a broken %s = %v, want the built-in %v", firstBootTimingsFile, got, builtInTotal())
+	}
+}
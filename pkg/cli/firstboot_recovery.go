@@ -0,0 +1,263 @@
+package cli
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
+	"libvirt.org/go/libvirt"
+)
+
+// firstBootRecoveryFile records the attempts of the last firstboot run and why they failed, in the VM directory
+const firstBootRecoveryFile = "firstboot-recovery.json"
+
+// installFailure is a failed installation attempt that may get further when retried from a snapshot
+type installFailure struct {
+	phase  installPhase
+	reason string
+}
+
+func (f *installFailure) Error() string {
+	return fmt.Sprintf("%s during phase %q", f.reason, installPhases[f.phase].title)
+}
+
+// firstBootAttempt is one run of the installer domain
+type firstBootAttempt struct {
+	Started     time.Time `json:"started"`
+	Ended       time.Time `json:"ended,omitempty"`
+	FromPhase   string    `json:"from_phase"`
+	Delivery    string    `json:"delivery"`
+	Result      string    `json:"result"`
+	FailedPhase string    `json:"failed_phase,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// firstBootRecovery keeps the disk snapshots of a firstboot run so a failed attempt can restart from the last good phase.
+//
+// Every snapshot is a qcow2 overlay named after the phase it was taken before. The overlay of a phase is backed by the
+// overlay of the phase before it and the first one by disk.qcow2, so the backing file of an overlay holds the disk as it
+// was when its phase started. Restarting a phase means replacing its overlay with an empty one.
+type firstBootRecovery struct {
+	Retries  int                `json:"retries"`
+	Attempts []firstBootAttempt `json:"attempts"`
+	vmdir    string
+	// snapshots are the phases that have an overlay, oldest first
+	snapshots []installPhase
+	// storage is set when the domain runs on a remote libvirt host. The disk is uploaded there and no snapshots are taken.
+	storage *remoteStorage
+}
+
+func newFirstBootRecovery(vmdir string) *firstBootRecovery {
+	return &firstBootRecovery{vmdir: vmdir}
+}
+
+// overlayPath is the snapshot taken before a phase
+func (r *firstBootRecovery) overlayPath(phase installPhase) string {
+	return filepath.Join(r.vmdir, "firstboot-"+installPhases[phase].key+".qcow2")
+}
+
+// startDisk drops the snapshots of from and later phases and returns a fresh overlay to run the domain from
+func (r *firstBootRecovery) startDisk(from installPhase) (string, error) {
+	if r.storage != nil {
+		// disk.qcow2 is still empty, a fresh copy starts over
+		return r.storage.upload(filepath.Join(r.vmdir, "disk.qcow2"), true)
+	}
+
+	for phase := from; phase < phaseDone; phase++ {
+		if err := os.Remove(r.overlayPath(phase)); err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to remove old snapshot: %v", err)
+		}
+	}
+	kept := r.snapshots[:0]
+	for _, phase := range r.snapshots {
+		if phase < from {
+			kept = append(kept, phase)
+		}
+	}
+	r.snapshots = kept
+
+	backing := filepath.Join(r.vmdir, "disk.qcow2")
+	if len(r.snapshots) > 0 {
+		backing = r.overlayPath(r.snapshots[len(r.snapshots)-1])
+	}
+	overlay := r.overlayPath(from)
+	output, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", backing, overlay).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot %s: %v\n%s", filepath.Base(overlay), err, output)
+	}
+	r.snapshots = append(r.snapshots, from)
+	r.recordPhase(from)
+	return overlay, nil
+}
+
+// snapshot switches the running domain to a new overlay before a phase.
+// It is only taken when the guest reboots into the phase, the only time the disk is consistent.
+func (r *firstBootRecovery) snapshot(domain *libvirt.Domain, phase installPhase) error {
+	if r.storage != nil {
+		return nil
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return fmt.Errorf("failed to get domain XML: %v", err)
+	}
+	var current LibvirtDomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &current); err != nil {
+		return fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+
+	// Only the installation disk gets an overlay, the ISOs and the floppy are left alone
+	var disks strings.Builder
+	for _, disk := range current.Devices.Disks {
+		if disk.Target.Dev == "vda" {
+			fmt.Fprintf(&disks, "    <disk name='vda' snapshot='external'><source file='%s'/></disk>\n", xmlEscape(r.overlayPath(phase)))
+		} else {
+			fmt.Fprintf(&disks, "    <disk name='%s' snapshot='no'/>\n", xmlEscape(disk.Target.Dev))
+		}
+	}
+	snapshotXML := fmt.Sprintf("<domainsnapshot>\n  <name>bvm-%s</name>\n  <disks>\n%s  </disks>\n</domainsnapshot>", installPhases[phase].key, disks.String())
+
+	snapshot, err := domain.CreateSnapshotXML(snapshotXML, libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY|libvirt.DOMAIN_SNAPSHOT_CREATE_NO_METADATA|libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot disk: %v", err)
+	}
+	snapshot.Free()
+	r.snapshots = append(r.snapshots, phase)
+	r.recordPhase(phase)
+	return nil
+}
+
+// recordPhase remembers in state.json that a later firstboot can resume from the snapshot of a phase
+func (r *firstBootRecovery) recordPhase(phase installPhase) {
+	state, err := vmstate.Load(r.vmdir)
+	if err == nil {
+		err = state.SetPhase(installPhases[phase].key)
+	}
+	if err != nil {
+		internal.Warning("Failed to update state.json: " + err.Error())
+	}
+}
+
+// resume picks up the snapshots an interrupted or failed firstboot left behind and returns the phase to start from.
+// The snapshots of all phases before it are needed, without them the installation starts over.
+func (r *firstBootRecovery) resume() installPhase {
+	if r.storage != nil {
+		return phaseWinPE
+	}
+	state, err := vmstate.Load(r.vmdir)
+	if err != nil || state.Phase == "" {
+		return phaseWinPE
+	}
+	from := phaseWinPE
+	for phase := phaseWinPE; phase < phaseDone; phase++ {
+		if installPhases[phase].key == state.Phase {
+			from = phase
+		}
+	}
+
+	for phase := phaseWinPE; phase < from; phase++ {
+		if _, err := os.Stat(r.overlayPath(phase)); err != nil {
+			internal.Warning(fmt.Sprintf("The snapshot %s is missing, starting the installation over", filepath.Base(r.overlayPath(phase))))
+			r.snapshots = nil
+			return phaseWinPE
+		}
+		r.snapshots = append(r.snapshots, phase)
+	}
+	if from != phaseWinPE {
+		internal.Status(fmt.Sprintf("Resuming the installation from phase %q", installPhases[from].title))
+	}
+	return from
+}
+
+// restartPhase is the phase a failed attempt restarts from: the last one with a snapshot
+func (r *firstBootRecovery) restartPhase() installPhase {
+	if len(r.snapshots) == 0 {
+		return phaseWinPE
+	}
+	return r.snapshots[len(r.snapshots)-1]
+}
+
+// commit merges the snapshots back into disk.qcow2 and removes them.
+// On a remote libvirt host the installed disk is downloaded over disk.qcow2 instead.
+func (r *firstBootRecovery) commit() error {
+	if r.storage != nil {
+		return r.storage.download(filepath.Join(r.vmdir, "disk.qcow2"))
+	}
+	if len(r.snapshots) == 0 {
+		return nil
+	}
+	internal.Status("Merging installation snapshots into disk.qcow2...")
+	top := r.overlayPath(r.snapshots[len(r.snapshots)-1])
+	output, err := exec.Command("qemu-img", "commit", "-b", filepath.Join(r.vmdir, "disk.qcow2"), top).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to merge snapshots: %v\n%s", err, output)
+	}
+	for _, phase := range r.snapshots {
+		if err := os.Remove(r.overlayPath(phase)); err != nil {
+			internal.Warning("Failed to remove snapshot: " + err.Error())
+		}
+	}
+	r.snapshots = nil
+	return nil
+}
+
+// startAttempt records a new attempt starting from a phase with the answer file delivered by method
+func (r *firstBootRecovery) startAttempt(from installPhase, method unattend.DeliveryMethod) {
+	r.Attempts = append(r.Attempts, firstBootAttempt{
+		Started:   time.Now(),
+		FromPhase: installPhases[from].key,
+		Delivery:  string(method),
+		Result:    "running",
+	})
+	r.Retries = len(r.Attempts) - 1
+	r.save()
+}
+
+// delivery is the answer file delivery method of the current attempt
+func (r *firstBootRecovery) delivery() unattend.DeliveryMethod {
+	return unattend.DeliveryMethod(r.Attempts[len(r.Attempts)-1].Delivery)
+}
+
+// endAttempt records the outcome of the current attempt
+func (r *firstBootRecovery) endAttempt(err error) {
+	attempt := &r.Attempts[len(r.Attempts)-1]
+	attempt.Ended = time.Now()
+	switch failure := err.(type) {
+	case nil:
+		attempt.Result = "completed"
+	case *installFailure:
+		attempt.Result = "failed"
+		attempt.FailedPhase = installPhases[failure.phase].key
+		attempt.Reason = failure.reason
+	default:
+		attempt.Result = "failed"
+		attempt.Reason = err.Error()
+	}
+	r.save()
+}
+
+// save writes the attempts to the VM directory
+func (r *firstBootRecovery) save() {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(r.vmdir, firstBootRecoveryFile), content, 0644)
+	}
+	if err != nil {
+		internal.Warning("Failed to record firstboot attempts: " + err.Error())
+	}
+}
+
+// xmlEscape escapes a string for use in an XML attribute
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
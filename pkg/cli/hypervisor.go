@@ -0,0 +1,149 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+// vmState is the state of a VM as every hypervisor reports it
+type vmState string
+
+const (
+	vmRunning vmState = "running"
+	// vmPaused is also reported when the watchdog fired, the guest is paused then
+	vmPaused  vmState = "paused"
+	vmShutoff vmState = "shut off"
+	vmCrashed vmState = "crashed"
+)
+
+// balloonStatsPeriod is how often the balloon driver of the guest reports its memory statistics, in seconds
+const balloonStatsPeriod = 2
+
+// vmMemoryStats is the memory of a guest in KiB, values the guest doesn't report are 0
+type vmMemoryStats struct {
+	// Actual is the memory the guest has with the balloon as it is now
+	Actual uint64
+	// Unused is memory the guest doesn't use at all
+	Unused uint64
+	// Available is the memory the guest can use, Actual less what the guest keeps for itself
+	Available uint64
+}
+
+// Hypervisor runs VMs described by a vmSpec. VMs are addressed by the name of their spec.
+type Hypervisor interface {
+	// Name is the value of virtualization in bvm-config.toml that selects the hypervisor
+	Name() string
+	// Start creates the VM and boots it
+	Start(spec *vmSpec) error
+	State(name string) (vmState, error)
+	// Shutdown asks the guest to power off through ACPI
+	Shutdown(name string) error
+	// Destroy stops the VM immediately and removes what Start created
+	Destroy(name string) error
+	// SetMemory sets the memory the guest can use through the balloon
+	SetMemory(name string, kib uint64) error
+	// MemoryStats returns what the balloon driver of the guest reports
+	MemoryStats(name string) (vmMemoryStats, error)
+	// SpicePort is the localhost port of the SPICE server of a running VM
+	SpicePort(name string) (int, error)
+	Close() error
+}
+
+// deliveryFilter is implemented by hypervisors that can't attach the answer file medium of every delivery method
+type deliveryFilter interface {
+	SupportsDelivery(method unattend.DeliveryMethod) bool
+}
+
+// usbHotplugger is implemented by hypervisors that pass USB devices of the host through to running VMs
+type usbHotplugger interface {
+	// AttachUSB attaches a device, attaching it again refreshes a device that enumerated again
+	AttachUSB(name string, selector usb.Selector) error
+	DetachUSB(name string, selector usb.Selector) error
+	// AttachedUSB returns the passed through devices of a VM
+	AttachedUSB(name string) ([]usb.Selector, error)
+}
+
+// vmEventKind is what happened to a VM
+type vmEventKind int
+
+const (
+	// vmEventInfo is only reported
+	vmEventInfo vmEventKind = iota
+	vmEventReboot
+	// vmEventShutdown is the guest powering itself off
+	vmEventShutdown
+	// vmEventStopped is the VM stopped from outside, most likely on purpose
+	vmEventStopped
+	// vmEventFailed is the VM stopped because the hypervisor failed
+	vmEventFailed
+	vmEventCrashed
+	vmEventWatchdog
+	vmEventDiskError
+)
+
+// vmEvent is something a hypervisor reported about a VM as it happened
+type vmEvent struct {
+	kind vmEventKind
+	// message describes the event for the log
+	message string
+	// paused is set for disk errors that paused the guest
+	paused bool
+}
+
+// String describes the event for the log
+func (e vmEvent) String() string {
+	return e.message
+}
+
+// vmEventWatcher delivers the events of one VM until it is closed
+type vmEventWatcher interface {
+	Events() <-chan vmEvent
+	// Lifecycle reports whether the VM stopping is among the events, its state has to be polled otherwise
+	Lifecycle() bool
+	Close()
+}
+
+// vmEventSource is implemented by hypervisors that report what happens to a VM as it happens
+type vmEventSource interface {
+	WatchEvents(name string) (vmEventWatcher, error)
+}
+
+// firstBootInspector is implemented by hypervisors that can look inside a running installer VM.
+// Without one a failed attempt starts over from the beginning and hangs are only caught by the watchdog.
+type firstBootInspector interface {
+	// InspectFirstBoot starts inspecting a VM, capture is nil unless --capture was given
+	InspectFirstBoot(name string, capture *firstBootCapture) (firstBootInspection, error)
+}
+
+// firstBootInspection looks inside one installer VM
+type firstBootInspection interface {
+	// Snapshot switches the disk to a new overlay before a phase, see firstBootRecovery
+	Snapshot(recovery *firstBootRecovery, phase installPhase) error
+	// DiskIO returns the bytes read from and written to the installation disk so far
+	DiskIO() (read int64, written int64, err error)
+	// AgentRunning reports whether the guest agent answers, firstlogin.ps1 installs it
+	AgentRunning() bool
+	// Screenshot saves the screen to the capture directory
+	Screenshot(now time.Time) error
+	// Close keeps what --capture wants of the attempt and releases the VM
+	Close(delivery unattend.DeliveryMethod)
+}
+
+// newHypervisor returns the hypervisor selected by virtualization in bvm-config.toml
+func newHypervisor() (Hypervisor, error) {
+	switch backend := internal.BVMConfig.Virtualization; backend {
+	case "libvirt", "qemu":
+		// "qemu" is what older config files have, it always meant QEMU through libvirt
+		return newLibvirtHypervisor()
+	case "qemu-direct":
+		return newQemuHypervisor(), nil
+	case "xen":
+		return newXenHypervisor()
+	default:
+		return nil, fmt.Errorf("unknown virtualization %q in bvm-config.toml, expected \"libvirt\", \"qemu-direct\" or \"xen\"", backend)
+	}
+}
@@ -0,0 +1,305 @@
+package cli
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+	"libvirt.org/go/libvirt"
+)
+
+// libvirtHypervisor runs VMs as libvirt domains on the URI from bvm-config.toml
+type libvirtHypervisor struct {
+	conn *libvirt.Connect
+}
+
+func newLibvirtHypervisor() (*libvirtHypervisor, error) {
+	// Events are only delivered for connections opened after the event loop is registered
+	startLibvirtEventLoop()
+	internal.Status("Connecting to libvirt at " + internal.BVMConfig.LibvirtURI + "...")
+	conn, err := connectLibvirt()
+	if err != nil {
+		return nil, err
+	}
+	return &libvirtHypervisor{conn: conn}, nil
+}
+
+func (h *libvirtHypervisor) Name() string {
+	return "libvirt"
+}
+
+// Start defines the domain with domain-overrides.xml applied and starts it
+func (h *libvirtHypervisor) Start(spec *vmSpec) error {
+	domainXML, err := spec.libvirtDomainXML()
+	if err != nil {
+		return fmt.Errorf("failed to generate domain XML: %v", err)
+	}
+	domainXML, err = applyDomainOverrides(spec.Dir, domainXML)
+	if err != nil {
+		return err
+	}
+	internal.Debug("Generated domain XML:")
+	internal.Debug(domainXML)
+
+	domain, err := h.conn.DomainDefineXML(domainXML)
+	if err != nil {
+		return fmt.Errorf("failed to define domain: %v", err)
+	}
+	defer domain.Free()
+	if err := domain.Create(); err != nil {
+		cleanupSingleDomain(domain, spec.Name)
+		return fmt.Errorf("failed to start domain: %v", err)
+	}
+	return nil
+}
+
+func (h *libvirtHypervisor) State(name string) (vmState, error) {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+
+	state, _, err := domain.GetState()
+	if err != nil {
+		return "", fmt.Errorf("failed to get domain state: %v", err)
+	}
+	switch state {
+	case libvirt.DOMAIN_PAUSED, libvirt.DOMAIN_PMSUSPENDED:
+		return vmPaused, nil
+	case libvirt.DOMAIN_SHUTOFF:
+		return vmShutoff, nil
+	case libvirt.DOMAIN_CRASHED:
+		return vmCrashed, nil
+	default:
+		// Blocked and shutting down guests are still running
+		return vmRunning, nil
+	}
+}
+
+func (h *libvirtHypervisor) Shutdown(name string) error {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+	if err := domain.Shutdown(); err != nil {
+		return fmt.Errorf("failed to shut down domain: %v", err)
+	}
+	return nil
+}
+
+// Destroy stops the domain and undefines it
+func (h *libvirtHypervisor) Destroy(name string) error {
+	cleanupLibvirtDomain(h.conn, name)
+	return nil
+}
+
+func (h *libvirtHypervisor) SetMemory(name string, kib uint64) error {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+	if err := domain.SetMemoryFlags(kib, libvirt.DOMAIN_MEM_LIVE); err != nil {
+		return fmt.Errorf("failed to set balloon size: %v", err)
+	}
+	return nil
+}
+
+func (h *libvirtHypervisor) MemoryStats(name string) (vmMemoryStats, error) {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return vmMemoryStats{}, fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+	memStats, err := domain.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	if err != nil {
+		return vmMemoryStats{}, fmt.Errorf("failed to get memory statistics: %v", err)
+	}
+
+	var stats vmMemoryStats
+	for _, stat := range memStats {
+		switch libvirt.DomainMemoryStatTags(stat.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			stats.Actual = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			stats.Unused = stat.Val
+		case libvirt.DOMAIN_MEMORY_STAT_USABLE:
+			stats.Available = stat.Val
+		}
+	}
+	return stats, nil
+}
+
+// usbHostdevs returns the USB hostdevs of a running domain with the selectors they were attached by
+func usbHostdevs(domain *libvirt.Domain) ([]Hostdev, []usb.Selector, error) {
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get domain XML: %v", err)
+	}
+	var current LibvirtDomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &current); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+	var hostdevs []Hostdev
+	var selectors []usb.Selector
+	for _, hostdev := range current.Devices.Hostdevs {
+		if selector, ok := hostdevUSBSelector(hostdev); ok {
+			hostdevs = append(hostdevs, hostdev)
+			selectors = append(selectors, selector)
+		}
+	}
+	return hostdevs, selectors, nil
+}
+
+// detachHostdev removes a hostdev from a running domain
+func detachHostdev(domain *libvirt.Domain, hostdev Hostdev) error {
+	hostdevXML, err := hostdevXML(hostdev)
+	if err != nil {
+		return err
+	}
+	return domain.DetachDeviceFlags(hostdevXML, libvirt.DOMAIN_DEVICE_MODIFY_LIVE)
+}
+
+// AttachUSB hotplugs a hostdev. libvirt holds on to the address a device had when it was attached, so a device
+// that enumerated again after a guest driver reset is detached and attached anew.
+func (h *libvirtHypervisor) AttachUSB(name string, selector usb.Selector) error {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+
+	hostdevs, selectors, err := usbHostdevs(domain)
+	if err != nil {
+		return err
+	}
+	for i, attached := range selectors {
+		if attached == selector {
+			internal.Debug("USB device " + selector.String() + " is already attached, attaching it again")
+			if err := detachHostdev(domain, hostdevs[i]); err != nil {
+				internal.Debug("Failed to detach the old device: " + err.Error())
+			}
+		}
+	}
+
+	hostdevXML, err := hostdevXML(usbHostdev(selector))
+	if err != nil {
+		return err
+	}
+	if err := domain.AttachDeviceFlags(hostdevXML, libvirt.DOMAIN_DEVICE_MODIFY_LIVE); err != nil {
+		return fmt.Errorf("failed to attach USB device %s: %v", selector, err)
+	}
+	return nil
+}
+
+func (h *libvirtHypervisor) DetachUSB(name string, selector usb.Selector) error {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+
+	hostdevs, selectors, err := usbHostdevs(domain)
+	if err != nil {
+		return err
+	}
+	for i, attached := range selectors {
+		if attached == selector {
+			if err := detachHostdev(domain, hostdevs[i]); err != nil {
+				return fmt.Errorf("failed to detach USB device %s: %v", selector, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("USB device %s is not attached to %s", selector, name)
+}
+
+func (h *libvirtHypervisor) AttachedUSB(name string) ([]usb.Selector, error) {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+	_, selectors, err := usbHostdevs(domain)
+	return selectors, err
+}
+
+func (h *libvirtHypervisor) SpicePort(name string) (int, error) {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+	return getSpicePort(domain)
+}
+
+// WatchEvents follows the lifecycle, reboot, watchdog and I/O error events of a domain
+func (h *libvirtHypervisor) WatchEvents(name string) (vmEventWatcher, error) {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	defer domain.Free()
+	return watchDomainEvents(h.conn, domain), nil
+}
+
+// InspectFirstBoot looks inside an installer domain: disk snapshots, block statistics, the guest agent and screenshots
+func (h *libvirtHypervisor) InspectFirstBoot(name string, capture *firstBootCapture) (firstBootInspection, error) {
+	domain, err := h.conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find domain %s: %v", name, err)
+	}
+	return &libvirtFirstBootInspection{conn: h.conn, domain: domain, name: name, capture: capture}, nil
+}
+
+// libvirtFirstBootInspection is the firstBootInspection of a libvirt domain
+type libvirtFirstBootInspection struct {
+	conn    *libvirt.Connect
+	domain  *libvirt.Domain
+	name    string
+	capture *firstBootCapture
+}
+
+func (i *libvirtFirstBootInspection) Snapshot(recovery *firstBootRecovery, phase installPhase) error {
+	return recovery.snapshot(i.domain, phase)
+}
+
+func (i *libvirtFirstBootInspection) DiskIO() (int64, int64, error) {
+	stats, err := i.domain.BlockStats("vda")
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get block statistics: %v", err)
+	}
+	if !stats.RdBytesSet || !stats.WrBytesSet {
+		return 0, 0, fmt.Errorf("the hypervisor doesn't count the bytes read and written")
+	}
+	return stats.RdBytes, stats.WrBytes, nil
+}
+
+func (i *libvirtFirstBootInspection) AgentRunning() bool {
+	_, err := i.domain.QemuAgentCommand(`{"execute":"guest-ping"}`, libvirt.DomainQemuAgentCommandTimeout(5), 0)
+	return err == nil
+}
+
+func (i *libvirtFirstBootInspection) Screenshot(now time.Time) error {
+	if i.capture == nil {
+		return nil
+	}
+	return i.capture.screenshot(i.conn, i.domain, now)
+}
+
+func (i *libvirtFirstBootInspection) Close(delivery unattend.DeliveryMethod) {
+	if i.capture != nil {
+		i.capture.attemptEnded(i.conn, i.domain, i.name, delivery)
+	}
+	i.domain.Free()
+}
+
+func (h *libvirtHypervisor) Close() error {
+	_, err := h.conn.Close()
+	return err
+}
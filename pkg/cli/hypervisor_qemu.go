@@ -0,0 +1,775 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+	"github.com/pi-apps-go/bvm-go/pkg/qmp"
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+// qemuLogFile receives the output of a qemu-system process started by the qemu-direct backend, in the VM directory
+const qemuLogFile = "qemu.log"
+
+// qemuHypervisor runs qemu-system directly, for hosts without libvirtd.
+// The VM is controlled through QMP on a UNIX socket, so VMs started by another bvm process can be controlled too.
+// A second QMP socket stays connected while bvm runs the VM, to receive its events.
+type qemuHypervisor struct {
+	mu        sync.Mutex
+	processes map[string]*qemuProcess
+}
+
+// qemuProcess is a qemu-system process started by this bvm process
+type qemuProcess struct {
+	cmd       *exec.Cmd
+	done      chan struct{}
+	err       error
+	spicePort int
+	// monitor is connected to the event socket
+	monitor *qmp.Client
+	// destroyed is set when bvm stopped the process itself, its exit status says nothing about the guest then
+	destroyed bool
+}
+
+func newQemuHypervisor() *qemuHypervisor {
+	return &qemuHypervisor{processes: map[string]*qemuProcess{}}
+}
+
+func (h *qemuHypervisor) Name() string {
+	return "qemu-direct"
+}
+
+// qemuRuntimeDir holds the QMP and guest agent sockets
+func qemuRuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return os.TempDir()
+}
+
+// qmpSocketPath is the QMP socket of a VM for commands, VM names already start with bvm-
+func qmpSocketPath(name string) string {
+	return filepath.Join(qemuRuntimeDir(), name+".qmp")
+}
+
+// qmpEventSocketPath is the QMP socket of a VM the process that started it receives events on
+func qmpEventSocketPath(name string) string {
+	return filepath.Join(qemuRuntimeDir(), name+".events.qmp")
+}
+
+// agentSocketPath is the guest agent socket of a VM
+func agentSocketPath(name string) string {
+	return filepath.Join(qemuRuntimeDir(), name+".agent")
+}
+
+// spicePortAttempts is how often Start tries another SPICE port when the free one was taken before QEMU bound it
+const spicePortAttempts = 3
+
+// errSpicePortInUse is returned by start when QEMU could not bind its SPICE port
+var errSpicePortInUse = errors.New("SPICE port is already in use")
+
+// Start runs qemu-system in the background and waits until QMP answers
+func (h *qemuHypervisor) Start(spec *vmSpec) error {
+	if _, err := qmpExecute(spec.Name, "query-status", nil); err == nil {
+		return fmt.Errorf("VM %s is already running", spec.Name)
+	}
+
+	emulator := spec.Emulator
+	if _, err := os.Stat(emulator); err != nil {
+		if emulator, err = exec.LookPath(filepath.Base(spec.Emulator)); err != nil {
+			return fmt.Errorf("%s not found, install it with: sudo apt install qemu-system", filepath.Base(spec.Emulator))
+		}
+	}
+
+	// freeLocalPort can't keep the SPICE port until QEMU binds it. When something else took it in between, QEMU
+	// exits and is started again on another port.
+	for attempt := 1; ; attempt++ {
+		err := h.start(spec, emulator)
+		if !errors.Is(err, errSpicePortInUse) || attempt == spicePortAttempts {
+			return err
+		}
+		internal.Debug(err.Error() + ", starting QEMU again")
+	}
+}
+
+// start runs emulator in the background once and waits until QMP answers
+func (h *qemuHypervisor) start(spec *vmSpec, emulator string) error {
+	process := &qemuProcess{done: make(chan struct{})}
+	if spec.Graphics {
+		port, err := freeLocalPort()
+		if err != nil {
+			return fmt.Errorf("failed to find a free port for SPICE: %v", err)
+		}
+		process.spicePort = port
+	}
+
+	args, err := qemuArgs(spec, process.spicePort)
+	if err != nil {
+		return err
+	}
+	internal.Debug("QEMU command line: " + emulator + " " + strings.Join(args, " "))
+
+	logPath := filepath.Join(spec.Dir, qemuLogFile)
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", logPath, err)
+	}
+	os.Remove(qmpSocketPath(spec.Name))
+	os.Remove(qmpEventSocketPath(spec.Name))
+
+	process.cmd = exec.Command(emulator, args...)
+	process.cmd.Stdout = logFile
+	process.cmd.Stderr = logFile
+	if err := process.cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("failed to start %s: %v", filepath.Base(emulator), err)
+	}
+	go func() {
+		process.err = process.cmd.Wait()
+		logFile.Close()
+		os.Remove(qmpSocketPath(spec.Name))
+		os.Remove(qmpEventSocketPath(spec.Name))
+		os.Remove(agentSocketPath(spec.Name))
+		close(process.done)
+	}()
+
+	h.mu.Lock()
+	h.processes[spec.Name] = process
+	h.mu.Unlock()
+
+	// QEMU creates the QMP socket before the guest starts, an error on the command line makes it exit instead
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		select {
+		case <-process.done:
+			if spec.Graphics && spiceBindFailed(logPath) {
+				return fmt.Errorf("%w: %d", errSpicePortInUse, process.spicePort)
+			}
+			return fmt.Errorf("QEMU exited right after starting: %v\n%s", process.err, tailFile(logPath, 20))
+		default:
+		}
+		monitor, err := qmp.Dial(qmpEventSocketPath(spec.Name), 2*time.Second)
+		if err == nil {
+			internal.Debug("QEMU " + monitor.Greeting.Version() + " started")
+			// The balloon driver only reports statistics when asked to
+			if _, err := monitor.Execute("qom-set", map[string]any{"path": "/machine/peripheral/balloon0", "property": "guest-stats-polling-interval", "value": balloonStatsPeriod}); err != nil {
+				internal.Debug("Failed to enable balloon statistics: " + err.Error())
+			}
+			h.mu.Lock()
+			process.monitor = monitor
+			h.mu.Unlock()
+			return nil
+		} else if time.Now().After(deadline) {
+			h.Destroy(spec.Name)
+			return fmt.Errorf("QEMU did not open its QMP socket: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// WatchEvents follows the QMP events of a VM started by this bvm process, like RESET when the guest reboots.
+// QEMU exits when the guest powers off, which the events don't tell apart from a crash, so the state has to be polled.
+func (h *qemuHypervisor) WatchEvents(name string) (vmEventWatcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	process := h.processes[name]
+	if process == nil || process.monitor == nil {
+		return nil, fmt.Errorf("VM %s was not started by this bvm process", name)
+	}
+	w := &qmpEventWatcher{events: make(chan vmEvent, 64), stop: make(chan struct{})}
+	go w.run(process.monitor.Events())
+	return w, nil
+}
+
+// qmpEventWatcher passes on the QMP events of one VM as vmEvents
+type qmpEventWatcher struct {
+	events chan vmEvent
+	stop   chan struct{}
+}
+
+// run converts events until the watcher is closed, the events channel is closed when QEMU exits
+func (w *qmpEventWatcher) run(events <-chan qmp.Event) {
+	defer close(w.events)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			internal.Debug("QMP event: " + event.Name)
+			vmEvent, ok := qmpVMEvent(event)
+			if !ok {
+				continue
+			}
+			select {
+			case w.events <- vmEvent:
+			case <-w.stop:
+				return
+			}
+		}
+	}
+}
+
+func (w *qmpEventWatcher) Events() <-chan vmEvent {
+	return w.events
+}
+
+func (w *qmpEventWatcher) Lifecycle() bool {
+	return false
+}
+
+func (w *qmpEventWatcher) Close() {
+	close(w.stop)
+}
+
+// qmpVMEvent turns the QMP events that matter for a running guest into a vmEvent
+func qmpVMEvent(event qmp.Event) (vmEvent, bool) {
+	switch event.Name {
+	case "RESET":
+		var reset struct {
+			Guest bool `json:"guest"`
+		}
+		json.Unmarshal(event.Data, &reset)
+		// Resets from the host side, like system_reset, aren't a new phase of the guest
+		if reset.Guest {
+			return vmEvent{kind: vmEventReboot, message: "Guest rebooted"}, true
+		}
+	case "WATCHDOG":
+		var watchdog struct {
+			Action string `json:"action"`
+		}
+		json.Unmarshal(event.Data, &watchdog)
+		return vmEvent{kind: vmEventWatchdog, message: fmt.Sprintf("Watchdog fired (action %s)", watchdog.Action)}, true
+	case "GUEST_PANICKED":
+		return vmEvent{kind: vmEventCrashed, message: "Guest crashed"}, true
+	case "BLOCK_IO_ERROR":
+		var ioError struct {
+			Device string `json:"device"`
+			Action string `json:"action"`
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(event.Data, &ioError)
+		return vmEvent{
+			kind:    vmEventDiskError,
+			message: fmt.Sprintf("Disk I/O error on %s: %s", ioError.Device, ioError.Reason),
+			paused:  ioError.Action == "stop",
+		}, true
+	}
+	return vmEvent{}, false
+}
+
+// process returns the process of a VM started by this bvm process, nil for others
+func (h *qemuHypervisor) process(name string) *qemuProcess {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.processes[name]
+}
+
+func (h *qemuHypervisor) State(name string) (vmState, error) {
+	if process := h.process(name); process != nil {
+		select {
+		case <-process.done:
+			h.mu.Lock()
+			destroyed := process.destroyed
+			h.mu.Unlock()
+			// QEMU exits with status 0 when the guest powers off
+			if process.err != nil && !destroyed {
+				return vmCrashed, nil
+			}
+			return vmShutoff, nil
+		default:
+		}
+	}
+
+	result, err := qmpExecute(name, "query-status", nil)
+	if err != nil {
+		if process := h.process(name); process != nil {
+			return "", err
+		}
+		// Nothing listens on the socket, the VM isn't running
+		return vmShutoff, nil
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(result, &status); err != nil {
+		return "", fmt.Errorf("failed to parse query-status: %v", err)
+	}
+	switch status.Status {
+	case "running", "prelaunch", "finish-migrate", "inmigrate", "postmigrate":
+		return vmRunning, nil
+	case "shutdown":
+		return vmShutoff, nil
+	case "guest-panicked", "internal-error":
+		return vmCrashed, nil
+	default:
+		// paused, watchdog, io-error, suspended and the like
+		return vmPaused, nil
+	}
+}
+
+func (h *qemuHypervisor) Shutdown(name string) error {
+	_, err := qmpExecute(name, "system_powerdown", nil)
+	return err
+}
+
+// Destroy quits QEMU, a process that doesn't react is killed
+func (h *qemuHypervisor) Destroy(name string) error {
+	process := h.process(name)
+	if process != nil {
+		h.mu.Lock()
+		process.destroyed = true
+		h.mu.Unlock()
+	}
+	_, quitErr := qmpExecute(name, "quit", nil)
+	if process == nil {
+		return quitErr
+	}
+
+	select {
+	case <-process.done:
+	case <-time.After(10 * time.Second):
+		internal.Warning("QEMU did not quit, killing it")
+		process.cmd.Process.Kill()
+		<-process.done
+	}
+	h.mu.Lock()
+	if process.monitor != nil {
+		process.monitor.Close()
+	}
+	delete(h.processes, name)
+	h.mu.Unlock()
+	return nil
+}
+
+// SetMemory resizes the balloon, QMP takes the size in bytes
+func (h *qemuHypervisor) SetMemory(name string, kib uint64) error {
+	_, err := qmpExecute(name, "balloon", map[string]any{"value": kib * 1024})
+	return err
+}
+
+// MemoryStats combines the balloon size with the statistics the balloon driver reports, QMP has them in bytes
+func (h *qemuHypervisor) MemoryStats(name string) (vmMemoryStats, error) {
+	result, err := qmpExecute(name, "query-balloon", nil)
+	if err != nil {
+		return vmMemoryStats{}, err
+	}
+	var balloonInfo struct {
+		Actual uint64 `json:"actual"`
+	}
+	if err := json.Unmarshal(result, &balloonInfo); err != nil {
+		return vmMemoryStats{}, fmt.Errorf("failed to parse query-balloon: %v", err)
+	}
+	stats := vmMemoryStats{Actual: balloonInfo.Actual / 1024}
+
+	// Without a balloon driver in the guest every statistic is -1
+	result, err = qmpExecute(name, "qom-get", map[string]any{"path": "/machine/peripheral/balloon0", "property": "guest-stats"})
+	if err != nil {
+		internal.Debug("No balloon statistics: " + err.Error())
+		return stats, nil
+	}
+	var guestStats struct {
+		Stats map[string]int64 `json:"stats"`
+	}
+	if err := json.Unmarshal(result, &guestStats); err != nil {
+		return stats, fmt.Errorf("failed to parse balloon statistics: %v", err)
+	}
+	if free := guestStats.Stats["stat-free-memory"]; free > 0 {
+		stats.Unused = uint64(free) / 1024
+	}
+	if available := guestStats.Stats["stat-available-memory"]; available > 0 {
+		stats.Available = uint64(available) / 1024
+	}
+	return stats, nil
+}
+
+// AttachUSB adds a usb-host device. QEMU follows a device picked by IDs when it enumerates again, so attaching
+// one that is already there is not an error.
+func (h *qemuHypervisor) AttachUSB(name string, selector usb.Selector) error {
+	arguments := map[string]any{"driver": "usb-host", "id": qemuUSBDeviceID(selector)}
+	if selector.ByID() {
+		vendor, _ := strconv.ParseUint(selector.VendorID, 16, 16)
+		product, _ := strconv.ParseUint(selector.ProductID, 16, 16)
+		arguments["vendorid"] = vendor
+		arguments["productid"] = product
+	} else {
+		arguments["hostbus"] = selector.Bus
+		arguments["hostaddr"] = selector.Address
+	}
+	_, err := qmpExecute(name, "device_add", arguments)
+	if err != nil && strings.Contains(err.Error(), "Duplicate") {
+		internal.Status("USB device " + selector.String() + " is already attached")
+		return nil
+	}
+	return err
+}
+
+func (h *qemuHypervisor) DetachUSB(name string, selector usb.Selector) error {
+	if _, err := qmpExecute(name, "device_del", map[string]any{"id": qemuUSBDeviceID(selector)}); err != nil {
+		return fmt.Errorf("USB device %s is not attached to %s: %v", selector, name, err)
+	}
+	return nil
+}
+
+// AttachedUSB reads the selectors back from the IDs of the usb-host devices
+func (h *qemuHypervisor) AttachedUSB(name string) ([]usb.Selector, error) {
+	result, err := qmpExecute(name, "qom-list", map[string]any{"path": "/machine/peripheral"})
+	if err != nil {
+		return nil, err
+	}
+	var properties []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(result, &properties); err != nil {
+		return nil, fmt.Errorf("failed to parse qom-list: %v", err)
+	}
+
+	var selectors []usb.Selector
+	for _, property := range properties {
+		if property.Type != "child<usb-host>" || !strings.HasPrefix(property.Name, "usb-") {
+			continue
+		}
+		first, second, _ := strings.Cut(strings.TrimPrefix(property.Name, "usb-"), "-")
+		selector, err := usb.ParseSelector(first + ":" + second)
+		if err != nil {
+			selector, err = usb.ParseSelector(first + "." + second)
+		}
+		if err == nil {
+			selectors = append(selectors, selector)
+		}
+	}
+	return selectors, nil
+}
+
+func (h *qemuHypervisor) SpicePort(name string) (int, error) {
+	if process := h.process(name); process != nil && process.spicePort > 0 {
+		return process.spicePort, nil
+	}
+	result, err := qmpExecute(name, "query-spice", nil)
+	if err != nil {
+		return 0, err
+	}
+	var spice struct {
+		Enabled bool `json:"enabled"`
+		Port    int  `json:"port"`
+	}
+	if err := json.Unmarshal(result, &spice); err != nil {
+		return 0, fmt.Errorf("failed to parse query-spice: %v", err)
+	}
+	if !spice.Enabled || spice.Port == 0 {
+		return 0, fmt.Errorf("VM has no SPICE server listening on a TCP port")
+	}
+	return spice.Port, nil
+}
+
+// Close leaves running VMs alone, they keep running after bvm exits
+func (h *qemuHypervisor) Close() error {
+	return nil
+}
+
+// qemuArgs builds the qemu-system command line of a spec, the same machine libvirtDomain describes
+func qemuArgs(spec *vmSpec, spicePort int) ([]string, error) {
+	x86 := spec.Arch == "x86_64"
+	machine := spec.Machine + ",accel=kvm"
+	if x86 {
+		machine += ",hpet=off"
+	} else {
+		machine += ",gic-version=2"
+	}
+	args := []string{
+		"-name", "guest=" + spec.Name,
+		"-machine", machine,
+		"-cpu", "host",
+		"-smp", strconv.Itoa(spec.CPUs),
+		"-m", strconv.Itoa(spec.MemoryGiB) + "G",
+		"-rtc", "base=localtime,driftfix=slew",
+		"-nodefaults",
+		"-qmp", "unix:" + qmpSocketPath(spec.Name) + ",server=on,wait=off",
+		"-qmp", "unix:" + qmpEventSocketPath(spec.Name) + ",server=on,wait=off",
+	}
+
+	// UEFI firmware, x86 keeps its variables in a writable copy in the VM directory
+	if x86 {
+		vars := filepath.Join(spec.Dir, "OVMF_VARS.fd")
+		if _, err := os.Stat(vars); os.IsNotExist(err) {
+			if err := copyFile(strings.Replace(spec.Firmware, "_CODE", "_VARS", 1), vars); err != nil {
+				return nil, fmt.Errorf("failed to create UEFI variable store: %v", err)
+			}
+		}
+		args = append(args,
+			"-drive", "if=pflash,format=raw,readonly=on,file="+spec.Firmware,
+			"-drive", "if=pflash,format=raw,file="+vars)
+	} else {
+		args = append(args, "-bios", spec.Firmware)
+	}
+
+	args = append(args, "-device", "qemu-xhci,id=usb")
+
+	// Windows Setup boots from the installer, the disk comes next
+	bootIndex := 1
+	ahciPort := 0
+	floppy := false
+	for _, disk := range spec.Disks {
+		id := "drive-" + disk.Target
+		drive := "file=" + disk.Path + ",format=" + disk.Format + ",if=none,id=" + id
+		var device string
+		bus := disk.Bus
+		if !x86 && (bus == "ide" || bus == "sata" || bus == "fdc") {
+			// The virt machine has neither IDE, AHCI nor a floppy controller
+			bus = "usb"
+		}
+		switch {
+		case disk.Device == "disk" && bus == "virtio":
+			drive += ",cache=none,aio=threads,discard=unmap"
+			device = "virtio-blk-pci,drive=" + id
+		case bus == "ide" || bus == "sata":
+			// q35 has a single AHCI controller, its ports are called ide.N
+			device = fmt.Sprintf("ide-cd,drive=%s,bus=ide.%d", id, ahciPort)
+			ahciPort++
+		case bus == "fdc":
+			if !floppy {
+				args = append(args, "-device", "isa-fdc,id=fdc")
+				floppy = true
+			}
+			device = "floppy,drive=" + id + ",bus=fdc.0"
+		default:
+			device = "usb-storage,drive=" + id + ",removable=on"
+		}
+		if disk.Device != "disk" {
+			drive += ",readonly=on"
+		}
+		if disk.Boot {
+			device += ",bootindex=0"
+		} else if disk.Device == "disk" {
+			device += ",bootindex=" + strconv.Itoa(bootIndex)
+			bootIndex++
+		}
+		args = append(args, "-drive", drive, "-device", device)
+	}
+
+	// Network from network_flags, the same flags the original bash bvm passed to QEMU
+	netArgs, err := qemuNetworkArgs(internal.BVMConfig.NetworkFlags)
+	if err != nil {
+		return nil, err
+	}
+	if len(netArgs) > 0 {
+		args = append(args, netArgs...)
+	} else {
+		args = append(args, "-nic", "none")
+	}
+
+	// Display
+	if x86 {
+		args = append(args, "-device", "virtio-vga")
+	} else {
+		args = append(args, "-device", "virtio-gpu-pci")
+	}
+	args = append(args, "-display", "none")
+	if spec.Graphics {
+		args = append(args, "-spice", fmt.Sprintf("port=%d,addr=127.0.0.1,disable-ticketing=on", spicePort))
+	}
+	args = append(args, "-device", "usb-kbd", "-device", "usb-tablet")
+	for _, selector := range spec.USBDevices {
+		args = append(args, "-device", qemuUSBDevice(selector))
+	}
+
+	// Channels for the QEMU guest agent, for firstlogin.ps1 to report its progress and for SPICE
+	args = append(args,
+		"-device", "virtio-serial-pci,id=serial0",
+		"-chardev", "socket,id=agent,path="+agentSocketPath(spec.Name)+",server=on,wait=off",
+		"-device", "virtserialport,chardev=agent,name=org.qemu.guest_agent.0")
+	if spec.ProgressLog != "" {
+		args = append(args,
+			"-chardev", "file,id=progress,path="+spec.ProgressLog,
+			"-device", "virtserialport,chardev=progress,name="+provision.ProgressChannel)
+	}
+	if spec.Graphics {
+		args = append(args,
+			"-chardev", "spicevmc,id=vdagent,name=vdagent",
+			"-device", "virtserialport,chardev=vdagent,name=com.redhat.spice.0")
+	}
+
+	if spec.SerialLog != "" {
+		args = append(args, "-serial", "file:"+spec.SerialLog)
+	}
+
+	args = append(args,
+		"-object", "rng-random,id=rng0,filename=/dev/urandom",
+		"-device", "virtio-rng-pci,rng=rng0")
+
+	switch spec.WatchdogModel {
+	case "":
+	case "itco":
+		// The TCO watchdog is part of the q35 chipset, it only needs to be allowed to act
+		args = append(args, "-global", "ICH9-LPC.noreboot=off", "-action", "watchdog=pause")
+	default:
+		args = append(args, "-device", spec.WatchdogModel, "-action", "watchdog=pause")
+	}
+
+	balloonDevice := "virtio-balloon-pci,id=balloon0"
+	if spec.DeflateOnOOM {
+		balloonDevice += ",deflate-on-oom=on"
+	}
+	if spec.FreePageReporting {
+		balloonDevice += ",free-page-reporting=on"
+	}
+	args = append(args, "-device", balloonDevice)
+	return args, nil
+}
+
+// qemuNetworkArgs splits network_flags into QEMU arguments.
+// The value is a bash array like "(-netdev user,... -device virtio-net-pci,netdev=nic)" that may use ${rdp_port},
+// and its words are split like bash does, so quoted words can contain spaces.
+func qemuNetworkArgs(flags string) ([]string, error) {
+	flags = strings.TrimSpace(flags)
+	flags = strings.TrimSuffix(strings.TrimPrefix(flags, "("), ")")
+	rdpPort := strconv.Itoa(internal.BVMConfig.RdpPort)
+	flags = strings.ReplaceAll(flags, "${rdp_port}", rdpPort)
+	flags = strings.ReplaceAll(flags, "$rdp_port", rdpPort)
+
+	args, err := splitShellWords(flags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network_flags: %v", err)
+	}
+	return args, nil
+}
+
+// splitShellWords splits a command line into words the way a POSIX shell does without expanding anything.
+// Single quotes keep everything literally, double quotes only let a backslash escape $, `, ", \ and a newline.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			// A backslash at the end of a line continues it, a trailing one is kept
+			if i+1 < len(line) {
+				i++
+				if line[i] == '\n' {
+					continue
+				}
+			}
+			word.WriteByte(line[i])
+			inWord = true
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(line); i++ {
+				if line[i] == '"' {
+					closed = true
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("$`\"\\\n", line[i+1]) >= 0 {
+					i++
+					if line[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(line[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// spiceBindFailed reports whether QEMU logged that it couldn't listen on its SPICE port
+func spiceBindFailed(logPath string) bool {
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(content)), "failed to initialize spice server")
+}
+
+// freeLocalPort returns a TCP port on localhost nothing listens on right now. The port is not reserved, so
+// something else can take it before the caller binds it.
+func freeLocalPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// copyFile copies src to dst
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// tailFile returns the last lines of a file, for error messages
+func tailFile(path string, lines int) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	all := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n")
+}
+
+// qmpExecute runs one command on the QMP socket of a VM.
+// The socket takes one client at a time, so the connection is not kept and bvm qmp can use it in between.
+func qmpExecute(name string, command string, arguments any) (json.RawMessage, error) {
+	client, err := qmp.Dial(qmpSocketPath(name), 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP of %s: %v", name, err)
+	}
+	defer client.Close()
+	return client.Execute(command, arguments)
+}
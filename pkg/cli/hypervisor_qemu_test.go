@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  string
+	}{
+		{line: "-netdev user,id=nic -device virtio-net-pci,netdev=nic", want: []string{"-netdev", "user,id=nic", "-device", "virtio-net-pci,netdev=nic"}},
+		{line: "  -nic\tuser  \n", want: []string{"-nic", "user"}},
+		{line: `-netdev 'user,id=nic,smb=/home/pi/Shared Files'`, want: []string{"-netdev", "user,id=nic,smb=/home/pi/Shared Files"}},
+		{line: `-netdev "user,id=nic,smb=/home/pi/Shared Files"`, want: []string{"-netdev", "user,id=nic,smb=/home/pi/Shared Files"}},
+		{line: `-netdev user,id=nic,smb=/home/pi/Shared\ Files`, want: []string{"-netdev", "user,id=nic,smb=/home/pi/Shared Files"}},
+		{line: `-object "secret,id=s0,data=a \"quoted\" \$value"`, want: []string{"-object", `secret,id=s0,data=a "quoted" $value`}},
+		{line: `"double \n stays" 'single \" stays'`, want: []string{`double \n stays`, `single \" stays`}},
+		{line: `user,id=nic,hostfwd="tcp::3389"-:3389`, want: []string{"user,id=nic,hostfwd=tcp::3389-:3389"}},
+		{line: `'' ""`, want: []string{"", ""}},
+		{line: "-netdev user,id=nic \\\n  -device e1000,netdev=nic", want: []string{"-netdev", "user,id=nic", "-device", "e1000,netdev=nic"}},
+		{line: `trailing\`, want: []string{`trailing\`}},
+		{line: "", want: nil},
+		{line: `-netdev 'user,id=nic`, err: "unterminated single quote"},
+		{line: `-netdev "user,id=nic`, err: "unterminated double quote"},
+		{line: `-netdev "user,id=nic\"`, err: "unterminated double quote"},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			words, err := splitShellWords(test.line)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("splitShellWords() = %q, %v, want error %q", words, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitShellWords() failed: %v", err)
+			}
+			if strings.Join(words, "|") != strings.Join(test.want, "|") || len(words) != len(test.want) {
+				t.Errorf("splitShellWords() = %q, want %q", words, test.want)
+			}
+		})
+	}
+}
+
+func TestQemuNetworkArgs(t *testing.T) {
+	savedPort := internal.BVMConfig.RdpPort
+	internal.BVMConfig.RdpPort = 3390
+	t.Cleanup(func() { internal.BVMConfig.RdpPort = savedPort })
+
+	args, err := qemuNetworkArgs("(-netdev user,id=nic,hostfwd=tcp:127.0.0.1:${rdp_port}-:3389 -device virtio-net-pci,netdev=nic)")
+	if err != nil {
+		t.Fatalf("qemuNetworkArgs() failed: %v", err)
+	}
+	want := []string{"-netdev", "user,id=nic,hostfwd=tcp:127.0.0.1:3390-:3389", "-device", "virtio-net-pci,netdev=nic"}
+	if strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Errorf("qemuNetworkArgs() = %q, want %q", args, want)
+	}
+
+	args, err = qemuNetworkArgs(`(-netdev "user,id=nic,hostfwd=tcp::$rdp_port-:3389,smb=/home/pi/My Files" -device e1000,netdev=nic)`)
+	if err != nil {
+		t.Fatalf("qemuNetworkArgs() failed: %v", err)
+	}
+	if len(args) != 4 || args[1] != "user,id=nic,hostfwd=tcp::3390-:3389,smb=/home/pi/My Files" {
+		t.Errorf("qemuNetworkArgs() = %q, want the quoted netdev kept as one argument", args)
+	}
+
+	if _, err := qemuNetworkArgs(`(-netdev "user,id=nic)`); err == nil || !strings.Contains(err.Error(), "invalid network_flags") {
+		t.Errorf("qemuNetworkArgs() with an open quote = %v, want an invalid network_flags error", err)
+	}
+}
+
+func TestSpiceBindFailed(t *testing.T) {
+	tests := []struct {
+		log  string
+		want bool
+	}{
+		{"reds_init_socket: binding socket to 127.0.0.1:5930 failed\nqemu-system-aarch64: failed to initialize spice server\n", true},
+		{"qemu-system-x86_64: -device virtio-gpu-pci: 'virtio-gpu-pci' is not a valid device model name\n", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		logPath := filepath.Join(t.TempDir(), qemuLogFile)
+		if err := os.WriteFile(logPath, []byte(test.log), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := spiceBindFailed(logPath); got != test.want {
+			t.Errorf("spiceBindFailed(%q) = %v, want %v", test.log, got, test.want)
+		}
+	}
+	if spiceBindFailed(filepath.Join(t.TempDir(), "missing.log")) {
+		t.Error("spiceBindFailed() without a log = true, want false")
+	}
+}
@@ -0,0 +1,298 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+)
+
+// xenHypervisor runs VMs as Xen HVM guests through the xl toolstack of dom0
+type xenHypervisor struct {
+	mu sync.Mutex
+	// spicePorts are the SPICE ports of the guests started by this bvm process
+	spicePorts map[string]int
+}
+
+// newXenHypervisor makes sure this system can create Xen guests
+func newXenHypervisor() (*xenHypervisor, error) {
+	if err := checkXenDom0(); err != nil {
+		return nil, err
+	}
+	return &xenHypervisor{spicePorts: map[string]int{}}, nil
+}
+
+// checkXenDom0 explains what is missing when this system can't create Xen guests
+func checkXenDom0() error {
+	if runtime.GOARCH != "amd64" {
+		return fmt.Errorf("Xen on %s only runs guests with Xen drivers, which Windows doesn't have. Set virtualization to \"libvirt\" or \"qemu-direct\" in bvm-config.toml", runtime.GOARCH)
+	}
+
+	hypervisorType, _ := os.ReadFile("/sys/hypervisor/type")
+	capabilities, err := os.ReadFile("/proc/xen/capabilities")
+	switch {
+	case err != nil && strings.TrimSpace(string(hypervisorType)) != "xen":
+		return fmt.Errorf("this system is not running on Xen. Install Xen (sudo apt install xen-system-amd64), reboot into the Xen entry of the boot menu, or set virtualization to \"libvirt\" or \"qemu-direct\" in bvm-config.toml")
+	case err != nil:
+		return fmt.Errorf("this system runs on Xen but xenfs is not mounted, mount it with: sudo mount -t xenfs xenfs /proc/xen")
+	case !strings.Contains(string(capabilities), "control_d"):
+		return fmt.Errorf("this system is a Xen guest (domU), VMs can only be created from dom0. Run bvm in dom0 or set virtualization to \"libvirt\" or \"qemu-direct\" in bvm-config.toml")
+	}
+
+	if _, err := exec.LookPath("xl"); err != nil {
+		return fmt.Errorf("xl not found, install the Xen tools with: sudo apt install xen-utils-common")
+	}
+	return nil
+}
+
+func (h *xenHypervisor) Name() string {
+	return "xen"
+}
+
+// SupportsDelivery reports whether the answer file medium of a delivery method can be attached, xl has no floppy drives
+func (h *xenHypervisor) SupportsDelivery(method unattend.DeliveryMethod) bool {
+	return method != unattend.DeliveryFloppy
+}
+
+// xl runs the xl toolstack, through sudo unless bvm runs as root
+func xl(args ...string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if os.Geteuid() == 0 {
+		cmd = exec.Command("xl", args...)
+	} else {
+		cmd = exec.Command("sudo", append([]string{"xl"}, args...)...)
+		cmd.Stdin = os.Stdin
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("xl %s failed: %v\n%s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// xlConfigPath is where the domain config of a guest is written, in the VM directory
+func xlConfigPath(spec *vmSpec) string {
+	return filepath.Join(spec.Dir, spec.Name+".xl.cfg")
+}
+
+// Start writes the xl domain config of the spec and creates the guest
+func (h *xenHypervisor) Start(spec *vmSpec) error {
+	spicePort := 0
+	if spec.Graphics {
+		port, err := freeLocalPort()
+		if err != nil {
+			return fmt.Errorf("failed to find a free port for SPICE: %v", err)
+		}
+		spicePort = port
+	}
+
+	config, err := xlConfig(spec, spicePort)
+	if err != nil {
+		return err
+	}
+	internal.Debug("Generated xl config:")
+	internal.Debug(config)
+	configPath := xlConfigPath(spec)
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", configPath, err)
+	}
+
+	if _, err := xl("create", configPath); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.spicePorts[spec.Name] = spicePort
+	h.mu.Unlock()
+	return nil
+}
+
+// xlList returns the columns of xl list for a guest: name, ID, memory in MiB, VCPUs, state and CPU time
+func xlList(name string) ([]string, error) {
+	output, err := xl("list", name)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 5 {
+		return nil, fmt.Errorf("unexpected output of xl list: %s", output)
+	}
+	return fields, nil
+}
+
+// State parses the state column of xl list, a guest xl doesn't know about is shut off
+func (h *xenHypervisor) State(name string) (vmState, error) {
+	fields, err := xlList(name)
+	if err != nil {
+		return vmShutoff, nil
+	}
+
+	// The state is a flag per letter, like r----- or --p---
+	switch flags := fields[4]; {
+	case strings.Contains(flags, "c"):
+		return vmCrashed, nil
+	case strings.Contains(flags, "s"), strings.Contains(flags, "d"):
+		return vmShutoff, nil
+	case strings.Contains(flags, "p"):
+		return vmPaused, nil
+	default:
+		return vmRunning, nil
+	}
+}
+
+// Shutdown falls back to an ACPI power button press, Windows has no Xen drivers
+func (h *xenHypervisor) Shutdown(name string) error {
+	_, err := xl("shutdown", "-F", name)
+	return err
+}
+
+// Destroy stops the guest, the config file is kept for reference
+func (h *xenHypervisor) Destroy(name string) error {
+	h.mu.Lock()
+	delete(h.spicePorts, name)
+	h.mu.Unlock()
+	if state, _ := h.State(name); state == vmShutoff {
+		return nil
+	}
+	_, err := xl("destroy", name)
+	return err
+}
+
+// SetMemory sets the balloon target, it only takes effect with the Xen PV drivers installed in Windows
+func (h *xenHypervisor) SetMemory(name string, kib uint64) error {
+	_, err := xl("mem-set", name, strconv.FormatUint(kib, 10)+"k")
+	return err
+}
+
+// MemoryStats only knows the memory of the guest, statistics from inside need the Xen PV drivers
+func (h *xenHypervisor) MemoryStats(name string) (vmMemoryStats, error) {
+	fields, err := xlList(name)
+	if err != nil {
+		return vmMemoryStats{}, err
+	}
+	mib, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return vmMemoryStats{}, fmt.Errorf("unexpected memory in xl list: %s", fields[2])
+	}
+	return vmMemoryStats{Actual: mib * 1024}, nil
+}
+
+func (h *xenHypervisor) SpicePort(name string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if port := h.spicePorts[name]; port > 0 {
+		return port, nil
+	}
+	return 0, fmt.Errorf("guest %s has no SPICE server started by this bvm process", name)
+}
+
+func (h *xenHypervisor) Close() error {
+	return nil
+}
+
+// xlConfig renders a spec as an xl domain config for an HVM guest.
+//
+// Windows has no Xen drivers, so everything is emulated by the device model: the disk appears on IDE next to
+// the CD-ROMs and the network card is an e1000 on the default bridge. The progress channel is added to the
+// device model as virtio-serial, the same device the other hypervisors use.
+func xlConfig(spec *vmSpec, spicePort int) (string, error) {
+	var b strings.Builder
+	setting := func(key string, value string) {
+		fmt.Fprintf(&b, "%s = %s\n", key, value)
+	}
+	list := func(key string, values []string) {
+		quoted := make([]string, len(values))
+		for i, value := range values {
+			quoted[i] = xlString(value)
+		}
+		setting(key, "[ "+strings.Join(quoted, ", ")+" ]")
+	}
+
+	memory := strconv.Itoa(spec.MemoryGiB * 1024)
+	setting("name", xlString(spec.Name))
+	setting("type", xlString("hvm"))
+	setting("bios", xlString("ovmf"))
+	setting("memory", memory)
+	setting("maxmem", memory)
+	setting("vcpus", strconv.Itoa(spec.CPUs))
+	// Hyper-V enlightenments, Windows runs noticeably faster with them
+	setting("viridian", "1")
+	setting("localtime", "1")
+	setting("hpet", "0")
+	setting("on_poweroff", xlString("destroy"))
+	setting("on_reboot", xlString("restart"))
+	setting("on_crash", xlString("restart"))
+
+	// IDE has four drives, the disk takes the first one. The boot CD-ROM goes to hdc, which boot = "dc" tries first.
+	cdromSlots := []string{"hdc", "hdd", "hdb"}
+	var disks []string
+	for _, disk := range spec.Disks {
+		switch disk.Device {
+		case "disk":
+			disks = append(disks, fmt.Sprintf("format=%s, vdev=xvda, access=rw, target=%s", disk.Format, disk.Path))
+		case "cdrom":
+			if len(cdromSlots) == 0 {
+				return "", fmt.Errorf("too many CD-ROM drives for Xen, IDE only has four drives")
+			}
+			disks = append(disks, fmt.Sprintf("format=%s, vdev=%s, access=ro, devtype=cdrom, target=%s", disk.Format, cdromSlots[0], disk.Path))
+			cdromSlots = cdromSlots[1:]
+		default:
+			return "", fmt.Errorf("xl can't attach %s %s, Xen guests have no %s drive", disk.Device, filepath.Base(disk.Path), disk.Device)
+		}
+	}
+	list("disk", disks)
+	setting("boot", xlString("dc"))
+
+	list("vif", []string{"model=e1000"})
+
+	setting("vga", xlString("stdvga"))
+	setting("videoram", "16")
+	setting("vnc", "0")
+	if spec.Graphics {
+		setting("spice", "1")
+		setting("spicehost", xlString("127.0.0.1"))
+		setting("spiceport", strconv.Itoa(spicePort))
+		setting("spicedisable_ticketing", "1")
+		setting("spicevdagent", "1")
+	}
+	setting("usb", "1")
+	list("usbdevice", []string{"tablet"})
+
+	if spec.SerialLog != "" {
+		setting("serial", xlString("file:"+spec.SerialLog))
+	}
+
+	var deviceModelArgs []string
+	if spec.ProgressLog != "" {
+		deviceModelArgs = append(deviceModelArgs,
+			"-device", "virtio-serial-pci,id=bvm-serial",
+			"-chardev", "file,id=progress,path="+spec.ProgressLog,
+			"-device", "virtserialport,bus=bvm-serial.0,chardev=progress,name="+provision.ProgressChannel,
+		)
+	}
+	// The device model passes USB devices through itself, xl usbdev needs PV USB drivers in the guest
+	for _, selector := range spec.USBDevices {
+		deviceModelArgs = append(deviceModelArgs, "-device", qemuUSBDevice(selector))
+	}
+	if len(deviceModelArgs) > 0 {
+		list("device_model_args_hvm", deviceModelArgs)
+	}
+	if spec.WatchdogModel != "" {
+		internal.Debug("Xen guests get no watchdog")
+	}
+
+	return b.String(), nil
+}
+
+// xlString quotes a value for an xl config file
+func xlString(value string) string {
+	return strconv.Quote(value)
+}
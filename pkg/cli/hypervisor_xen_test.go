@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+// xlSettings splits an xl config into its settings
+func xlSettings(t *testing.T, config string) map[string]string {
+	settings := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(config), "\n") {
+		key, value, found := strings.Cut(line, " = ")
+		if !found {
+			t.Fatalf("xl config line without a setting: %q", line)
+		}
+		if _, ok := settings[key]; ok {
+			t.Errorf("%s is set twice", key)
+		}
+		settings[key] = value
+	}
+	return settings
+}
+
+// xenTestSpec is a Windows VM with the given drives
+func xenTestSpec(disks ...vmDisk) *vmSpec {
+	return &vmSpec{Name: "bvm-firstboot-win11", Dir: "/vm", Arch: "x86_64", MemoryGiB: 4, CPUs: 2, Disks: disks}
+}
+
+var (
+	xenDisk      = vmDisk{Path: "/vm/disk.qcow2", Format: "qcow2", Device: "disk", Bus: "virtio", Target: "vda"}
+	xenInstaller = vmDisk{Path: "/vm/installer.iso", Format: "raw", Device: "cdrom", Bus: "ide", Target: "hda", Boot: true}
+	xenUnattend  = vmDisk{Path: "/vm/unattended.iso", Format: "raw", Device: "cdrom", Bus: "sata", Target: "sda"}
+	xenAnswer    = vmDisk{Path: "/vm/autounattend-cdrom.iso", Format: "raw", Device: "cdrom", Bus: "sata", Target: "sdb"}
+	xenFloppy    = vmDisk{Path: "/vm/autounattend.img", Format: "raw", Device: "floppy", Bus: "fdc", Target: "fda"}
+)
+
+func TestXLConfigDisks(t *testing.T) {
+	tests := []struct {
+		name  string
+		disks []vmDisk
+		want  string
+		err   string
+	}{
+		{
+			name:  "installed system",
+			disks: []vmDisk{xenDisk},
+			want:  `[ "format=qcow2, vdev=xvda, access=rw, target=/vm/disk.qcow2" ]`,
+		},
+		{
+			name:  "boot CD-ROM goes to hdc",
+			disks: []vmDisk{xenDisk, xenInstaller},
+			want: `[ "format=qcow2, vdev=xvda, access=rw, target=/vm/disk.qcow2", ` +
+				`"format=raw, vdev=hdc, access=ro, devtype=cdrom, target=/vm/installer.iso" ]`,
+		},
+		{
+			name:  "firstboot with the answer file on a CD-ROM",
+			disks: []vmDisk{xenDisk, xenInstaller, xenUnattend, xenAnswer},
+			want: `[ "format=qcow2, vdev=xvda, access=rw, target=/vm/disk.qcow2", ` +
+				`"format=raw, vdev=hdc, access=ro, devtype=cdrom, target=/vm/installer.iso", ` +
+				`"format=raw, vdev=hdd, access=ro, devtype=cdrom, target=/vm/unattended.iso", ` +
+				`"format=raw, vdev=hdb, access=ro, devtype=cdrom, target=/vm/autounattend-cdrom.iso" ]`,
+		},
+		{
+			name:  "CD-ROM slots don't depend on the disk",
+			disks: []vmDisk{xenInstaller, xenUnattend, xenDisk},
+			want: `[ "format=raw, vdev=hdc, access=ro, devtype=cdrom, target=/vm/installer.iso", ` +
+				`"format=raw, vdev=hdd, access=ro, devtype=cdrom, target=/vm/unattended.iso", ` +
+				`"format=qcow2, vdev=xvda, access=rw, target=/vm/disk.qcow2" ]`,
+		},
+		{
+			name:  "too many CD-ROMs",
+			disks: []vmDisk{xenDisk, xenInstaller, xenUnattend, xenAnswer, {Path: "/vm/extra.iso", Format: "raw", Device: "cdrom"}},
+			err:   "too many CD-ROM drives for Xen",
+		},
+		{
+			name:  "floppy",
+			disks: []vmDisk{xenDisk, xenInstaller, xenUnattend, xenFloppy},
+			err:   "xl can't attach floppy autounattend.img, Xen guests have no floppy drive",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := xlConfig(xenTestSpec(test.disks...), 0)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("xlConfig() = %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("xlConfig() failed: %v", err)
+			}
+			settings := xlSettings(t, config)
+			if settings["disk"] != test.want {
+				t.Errorf("disk = %s\nwant %s", settings["disk"], test.want)
+			}
+			if settings["boot"] != `"dc"` {
+				t.Errorf("boot = %s, want \"dc\"", settings["boot"])
+			}
+		})
+	}
+}
+
+func TestXLConfigDeviceModelArgs(t *testing.T) {
+	const progress = `"-device", "virtio-serial-pci,id=bvm-serial", ` +
+		`"-chardev", "file,id=progress,path=/vm/firstlogin-progress.log", ` +
+		`"-device", "virtserialport,bus=bvm-serial.0,chardev=progress,name=org.bvm.firstlogin.0"`
+	const usbDevices = `"-device", "usb-host,id=usb-046d-c52b,vendorid=0x046d,productid=0xc52b", ` +
+		`"-device", "usb-host,id=usb-1-4,hostbus=1,hostaddr=4"`
+	selectors := []usb.Selector{{VendorID: "046d", ProductID: "c52b"}, {Bus: 1, Address: 4}}
+
+	tests := []struct {
+		name        string
+		progressLog string
+		usbDevices  []usb.Selector
+		want        string
+	}{
+		{name: "nothing for the device model"},
+		{name: "progress channel", progressLog: "/vm/firstlogin-progress.log", want: "[ " + progress + " ]"},
+		{name: "USB devices", usbDevices: selectors, want: "[ " + usbDevices + " ]"},
+		{
+			name:        "progress channel and USB devices",
+			progressLog: "/vm/firstlogin-progress.log",
+			usbDevices:  selectors,
+			want:        "[ " + progress + ", " + usbDevices + " ]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := xenTestSpec(xenDisk)
+			spec.ProgressLog = test.progressLog
+			spec.USBDevices = test.usbDevices
+			config, err := xlConfig(spec, 0)
+			if err != nil {
+				t.Fatalf("xlConfig() failed: %v", err)
+			}
+			args, ok := xlSettings(t, config)["device_model_args_hvm"]
+			if test.want == "" {
+				if ok {
+					t.Errorf("device_model_args_hvm = %s, want none", args)
+				}
+				return
+			}
+			if args != test.want {
+				t.Errorf("device_model_args_hvm = %s\nwant %s", args, test.want)
+			}
+		})
+	}
+}
+
+func TestXLConfigMachine(t *testing.T) {
+	spec := xenTestSpec(xenDisk)
+	spec.Graphics = true
+	spec.SerialLog = "/vm/serial.log"
+	// Xen has no watchdog for the guest, the setting is left out
+	spec.WatchdogModel = "i6300esb"
+	config, err := xlConfig(spec, 5930)
+	if err != nil {
+		t.Fatalf("xlConfig() failed: %v", err)
+	}
+	settings := xlSettings(t, config)
+
+	want := map[string]string{
+		"name":      `"bvm-firstboot-win11"`,
+		"type":      `"hvm"`,
+		"bios":      `"ovmf"`,
+		"memory":    "4096",
+		"maxmem":    "4096",
+		"vcpus":     "2",
+		"vif":       `[ "model=e1000" ]`,
+		"spice":     "1",
+		"spicehost": `"127.0.0.1"`,
+		"spiceport": "5930",
+		"serial":    `"file:/vm/serial.log"`,
+		"usbdevice": `[ "tablet" ]`,
+	}
+	for key, value := range want {
+		if settings[key] != value {
+			t.Errorf("%s = %q, want %q", key, settings[key], value)
+		}
+	}
+	for key := range settings {
+		if strings.Contains(key, "watchdog") {
+			t.Errorf("%s is set, Xen has no watchdog", key)
+		}
+	}
+
+	// Without graphics there is no SPICE server
+	spec.Graphics = false
+	config, err = xlConfig(spec, 0)
+	if err != nil {
+		t.Fatalf("xlConfig() failed: %v", err)
+	}
+	for key := range xlSettings(t, config) {
+		if strings.HasPrefix(key, "spice") {
+			t.Errorf("%s is set without graphics", key)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package cli
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"libvirt.org/go/libvirt"
+)
+
+// connectLibvirt connects to the libvirt URI from bvm-config.toml
+func connectLibvirt() (*libvirt.Connect, error) {
+	uri := internal.BVMConfig.LibvirtURI
+	conn, err := libvirt.NewConnect(uri)
+	if err != nil {
+		if isRemoteURI(uri) {
+			return nil, fmt.Errorf("failed to connect to libvirt at %s: %v\nPlease ensure libvirtd runs on the remote host and you can log in there without a password, for example with 'ssh-copy-id'", uri, err)
+		}
+		return nil, fmt.Errorf("failed to connect to libvirt at %s: %v\nPlease ensure:\n1. libvirtd service is running: sudo systemctl start libvirtd\n2. User session services are available\n3. You may need to install libvirt-daemon-config-network", uri, err)
+	}
+	return conn, nil
+}
+
+// isRemoteURI reports whether a libvirt URI points to another host, like qemu+ssh://pi@host/session
+func isRemoteURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return u.Host != "" && u.Hostname() != "localhost"
+}
+
+// isSystemURI reports whether a libvirt URI is the system daemon, whose QEMU processes run as another user
+func isSystemURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return u.Path == "/system"
+}
+
+// hostCapabilities is the part of the libvirt capabilities XML bvm uses
+type hostCapabilities struct {
+	Host struct {
+		CPU struct {
+			Arch string `xml:"arch"`
+		} `xml:"cpu"`
+	} `xml:"host"`
+}
+
+// checkHostArch makes sure the libvirt host has the architecture the domain XML is generated for
+func checkHostArch(conn *libvirt.Connect) error {
+	capsXML, err := conn.GetCapabilities()
+	if err != nil {
+		return fmt.Errorf("failed to get host capabilities: %v", err)
+	}
+	var caps hostCapabilities
+	if err := xml.Unmarshal([]byte(capsXML), &caps); err != nil {
+		return fmt.Errorf("failed to parse host capabilities: %v", err)
+	}
+
+	local := map[string]string{"amd64": "x86_64", "arm64": "aarch64"}[runtime.GOARCH]
+	if caps.Host.CPU.Arch != local {
+		return fmt.Errorf("the libvirt host is %s but this computer is %s, run bvm on a computer of the same architecture", caps.Host.CPU.Arch, local)
+	}
+	return nil
+}
+
+// checkSystemAccess warns about files the QEMU user of the system daemon can't reach.
+// The system daemon runs QEMU as its own user, so every parent directory needs to be searchable by others.
+func checkSystemAccess(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.Mode().Perm()&0004 == 0 {
+		internal.Warning(fmt.Sprintf("%s is not readable by the libvirt QEMU user. Consider running: chmod o+r %s", path, path))
+	}
+	for dir := filepath.Dir(path); dir != "/"; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return
+		}
+		if info.Mode().Perm()&0001 == 0 {
+			internal.Warning(fmt.Sprintf("%s can't be entered by the libvirt QEMU user. Consider running: chmod o+x %s", dir, dir))
+			return
+		}
+	}
+}
+
+// remoteStorage copies VM files into a storage pool of a remote libvirt host, where the domain can use them
+type remoteStorage struct {
+	conn *libvirt.Connect
+	pool *libvirt.StoragePool
+	// prefix keeps the volumes of different VMs apart
+	prefix string
+}
+
+// newRemoteStorage opens the storage pool from bvm-config.toml on the libvirt host
+func newRemoteStorage(conn *libvirt.Connect, prefix string) (*remoteStorage, error) {
+	poolName := internal.BVMConfig.LibvirtStoragePool
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find storage pool %q on the libvirt host: %v\nCreate it with 'virsh pool-define-as %s dir --target /var/lib/libvirt/images' and start it, or set storage_pool in bvm-config.toml", poolName, err, poolName)
+	}
+	if err := pool.Refresh(0); err != nil {
+		internal.Debug("Failed to refresh storage pool: " + err.Error())
+	}
+	return &remoteStorage{conn: conn, pool: pool, prefix: prefix}, nil
+}
+
+// Close frees the storage pool
+func (s *remoteStorage) Close() {
+	s.pool.Free()
+}
+
+// volumeName is the name of the volume holding a local file.
+// Read-only media carry the modification time of the file, so a rebuilt ISO gets a new volume.
+func (s *remoteStorage) volumeName(localPath string, info os.FileInfo, replace bool) string {
+	if replace {
+		return s.prefix + "-" + filepath.Base(localPath)
+	}
+	return fmt.Sprintf("%s-%x-%s", s.prefix, info.ModTime().Unix(), filepath.Base(localPath))
+}
+
+// removeStaleVolumes deletes the volumes of earlier versions of a local file
+func (s *remoteStorage) removeStaleVolumes(localPath string, keep string) {
+	vols, err := s.pool.ListAllStorageVolumes(0)
+	if err != nil {
+		internal.Debug("Failed to list volumes: " + err.Error())
+		return
+	}
+	for _, vol := range vols {
+		name, err := vol.GetName()
+		stale := err == nil && name != keep && strings.HasPrefix(name, s.prefix+"-") && strings.HasSuffix(name, "-"+filepath.Base(localPath))
+		if stale {
+			if err := vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+				internal.Warning(fmt.Sprintf("Failed to delete old volume %s: %v", name, err))
+			}
+		}
+		vol.Free()
+	}
+}
+
+// upload copies a local file into a volume and returns the path of the volume on the libvirt host.
+// Read-only media are only uploaded when they changed, replace uploads the file every time.
+func (s *remoteStorage) upload(localPath string, replace bool) (string, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %v", localPath, err)
+	}
+	name := s.volumeName(localPath, info, replace)
+
+	if vol, err := s.pool.LookupStorageVolByName(name); err == nil {
+		if !replace {
+			defer vol.Free()
+			internal.Debug("Reusing volume " + name)
+			return vol.GetPath()
+		}
+		if err := vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+			vol.Free()
+			return "", fmt.Errorf("failed to delete old volume %s: %v", name, err)
+		}
+		vol.Free()
+	}
+	s.removeStaleVolumes(localPath, name)
+
+	volXML := fmt.Sprintf("<volume>\n  <name>%s</name>\n  <capacity unit='bytes'>%d</capacity>\n  <target><format type='raw'/></target>\n</volume>", xmlEscape(name), info.Size())
+	vol, err := s.pool.StorageVolCreateXML(volXML, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create volume %s: %v", name, err)
+	}
+	defer vol.Free()
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", localPath, err)
+	}
+	defer file.Close()
+
+	stream, err := s.conn.NewStream(0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create stream: %v", err)
+	}
+	defer stream.Free()
+
+	internal.Status(fmt.Sprintf("Uploading %s to the libvirt host (%d MB)...", filepath.Base(localPath), info.Size()/1024/1024))
+	if err := vol.Upload(stream, 0, uint64(info.Size()), 0); err != nil {
+		return "", fmt.Errorf("failed to start upload of %s: %v", name, err)
+	}
+	err = stream.SendAll(func(st *libvirt.Stream, nbytes int) ([]byte, error) {
+		buf := make([]byte, nbytes)
+		n, err := file.Read(buf)
+		if err == io.EOF {
+			return buf[:0], nil
+		}
+		return buf[:n], err
+	})
+	if err != nil {
+		stream.Abort()
+		return "", fmt.Errorf("failed to upload %s: %v", filepath.Base(localPath), err)
+	}
+	if err := stream.Finish(); err != nil {
+		return "", fmt.Errorf("failed to finish upload of %s: %v", filepath.Base(localPath), err)
+	}
+	return vol.GetPath()
+}
+
+// download copies the volume of a local file back over the local file and deletes the volume
+func (s *remoteStorage) download(localPath string) error {
+	name := s.volumeName(localPath, nil, true)
+	vol, err := s.pool.LookupStorageVolByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find volume %s: %v", name, err)
+	}
+	defer vol.Free()
+
+	partial := localPath + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", partial, err)
+	}
+	defer os.Remove(partial)
+	defer file.Close()
+
+	stream, err := s.conn.NewStream(0)
+	if err != nil {
+		return fmt.Errorf("failed to create stream: %v", err)
+	}
+	defer stream.Free()
+
+	internal.Status("Downloading " + filepath.Base(localPath) + " from the libvirt host, this can take a while...")
+	if err := vol.Download(stream, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to start download of %s: %v", name, err)
+	}
+	err = stream.RecvAll(func(st *libvirt.Stream, chunk []byte) (int, error) {
+		return file.Write(chunk)
+	})
+	if err != nil {
+		stream.Abort()
+		return fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	if err := stream.Finish(); err != nil {
+		return fmt.Errorf("failed to finish download of %s: %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", partial, err)
+	}
+	if err := os.Rename(partial, localPath); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", localPath, err)
+	}
+
+	if err := vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+		internal.Warning(fmt.Sprintf("Failed to delete volume %s: %v", name, err))
+	}
+	return nil
+}
+
+// launchRemoteViewer opens the display of a domain on a remote libvirt host.
+// virt-viewer tunnels SPICE through the libvirt connection, the SPICE port itself only listens on the remote localhost.
+func launchRemoteViewer(uri string, domainName string) {
+	if _, err := exec.LookPath("virt-viewer"); err != nil {
+		internal.Warning("virt-viewer not found, it is needed to watch a VM on a remote libvirt host")
+		internal.Status(fmt.Sprintf("You can connect later using: virt-viewer --connect %s %s", uri, domainName))
+		return
+	}
+	if err := exec.Command("virt-viewer", "--connect", uri, "--wait", domainName).Start(); err != nil {
+		internal.Warning("Failed to launch virt-viewer: " + err.Error())
+		return
+	}
+	internal.Status("Launched virt-viewer for VM display")
+}
@@ -0,0 +1,367 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/pi-apps-go/bvm-go/internal"
+)
+
+type manageState int
+
+const (
+	browsingVMs manageState = iota
+	enteringInput
+	confirmingDelete
+	workingOnVM
+)
+
+// manageAction is what the text input of manage-vms-cli is asked for
+type manageAction int
+
+const (
+	actionCreate manageAction = iota
+	actionAdd
+	actionRename
+	actionClone
+)
+
+// vmItem is a VM in the list of manage-vms-cli
+type vmItem struct {
+	vm vmInfo
+}
+
+func (i vmItem) Title() string { return fmt.Sprintf("%s (%s)", i.vm.Name, i.vm.State) }
+func (i vmItem) Description() string {
+	memory := "RAM auto"
+	if i.vm.MemoryGiB > 0 {
+		memory = fmt.Sprintf("%d GiB RAM", i.vm.MemoryGiB)
+	}
+	return fmt.Sprintf("%s · %s · %s on disk · RDP port %d", i.vm.Path, memory, formatBytes(i.vm.DiskUsage), i.vm.RdpPort)
+}
+func (i vmItem) FilterValue() string { return i.vm.Name }
+
+// vmsLoadedMsg carries the VMs of the registry after they were read
+type vmsLoadedMsg struct {
+	vms []vmInfo
+	err error
+}
+
+// vmActionDoneMsg reports the outcome of an action on a VM
+type vmActionDoneMsg struct {
+	status string
+	err    error
+}
+
+// funcCommand runs Go code that prints to the terminal through tea.Exec, so it doesn't draw over the list
+type funcCommand struct {
+	run func() error
+}
+
+func (c funcCommand) Run() error          { return c.run() }
+func (c funcCommand) SetStdin(io.Reader)  {}
+func (c funcCommand) SetStdout(io.Writer) {}
+func (c funcCommand) SetStderr(io.Writer) {}
+
+var manageKeys = struct {
+	create, add, rename, clone, remove, edit, refresh key.Binding
+}{
+	create:  key.NewBinding(key.WithKeys("n"), key.WithHelp("n", "new")),
+	add:     key.NewBinding(key.WithKeys("a"), key.WithHelp("a", "add existing")),
+	rename:  key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "rename")),
+	clone:   key.NewBinding(key.WithKeys("c"), key.WithHelp("c", "clone")),
+	remove:  key.NewBinding(key.WithKeys("x"), key.WithHelp("x", "delete")),
+	edit:    key.NewBinding(key.WithKeys("e"), key.WithHelp("e", "edit config")),
+	refresh: key.NewBinding(key.WithKeys("R"), key.WithHelp("R", "refresh")),
+}
+
+type manageVMsModel struct {
+	state  manageState
+	action manageAction
+
+	vmList list.Model
+	input  textinput.Model
+
+	// status is the outcome of the last action, shown above the list
+	status string
+	failed bool
+
+	width  int
+	height int
+}
+
+// ManageVMsCLI lists the VMs of the registry and creates, adds, renames, clones, deletes and edits them
+func ManageVMsCLI() tea.Model {
+	vmList := list.New(nil, list.NewDefaultDelegate(), 0, 0)
+	vmList.Title = "Virtual machines"
+	vmList.SetShowStatusBar(false)
+	vmList.SetFilteringEnabled(false)
+	vmList.Styles.Title = titleStyle
+	vmList.SetStatusBarItemName("VM", "VMs")
+	vmList.AdditionalShortHelpKeys = func() []key.Binding {
+		return []key.Binding{manageKeys.create, manageKeys.clone, manageKeys.remove, manageKeys.edit}
+	}
+	vmList.AdditionalFullHelpKeys = func() []key.Binding {
+		return []key.Binding{manageKeys.create, manageKeys.add, manageKeys.rename, manageKeys.clone, manageKeys.remove, manageKeys.edit, manageKeys.refresh}
+	}
+
+	return manageVMsModel{
+		state:  workingOnVM,
+		status: "Reading the VM list...",
+		vmList: vmList,
+	}
+}
+
+func loadVMs() tea.Msg {
+	vms, err := listVMs()
+	return vmsLoadedMsg{vms: vms, err: err}
+}
+
+func (m manageVMsModel) Init() tea.Cmd {
+	return loadVMs
+}
+
+// selectedVM returns the VM under the cursor, nil when the list is empty
+func (m manageVMsModel) selectedVM() *vmInfo {
+	selected, ok := m.vmList.SelectedItem().(vmItem)
+	if !ok {
+		return nil
+	}
+	return &selected.vm
+}
+
+func (m manageVMsModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		m.vmList.SetWidth(msg.Width)
+		m.vmList.SetHeight(msg.Height - 6)
+		m.input.Width = msg.Width - 4
+		return m, nil
+
+	case vmsLoadedMsg:
+		m.state = browsingVMs
+		if msg.err != nil {
+			m.status, m.failed = msg.err.Error(), true
+			return m, nil
+		}
+		if m.status == "Reading the VM list..." {
+			m.status = ""
+		}
+		items := make([]list.Item, len(msg.vms))
+		for i, vm := range msg.vms {
+			items[i] = vmItem{vm: vm}
+		}
+		return m, m.vmList.SetItems(items)
+
+	case vmActionDoneMsg:
+		m.state = workingOnVM
+		if msg.err != nil {
+			m.status, m.failed = msg.err.Error(), true
+		} else {
+			m.status, m.failed = msg.status, false
+		}
+		return m, loadVMs
+
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		switch m.state {
+		case enteringInput:
+			return m.updateInput(msg)
+		case confirmingDelete:
+			return m.updateConfirmDelete(msg)
+		case workingOnVM:
+			return m, nil
+		}
+		if model, cmd, handled := m.handleBrowsingKey(msg); handled {
+			return model, cmd
+		}
+	}
+
+	var cmd tea.Cmd
+	if m.state == browsingVMs {
+		m.vmList, cmd = m.vmList.Update(msg)
+	}
+	return m, cmd
+}
+
+// handleBrowsingKey starts the action of a key, handled is false for keys the list handles itself
+func (m manageVMsModel) handleBrowsingKey(msg tea.KeyMsg) (model tea.Model, cmd tea.Cmd, handled bool) {
+	vm := m.selectedVM()
+	switch {
+	case key.Matches(msg, manageKeys.create):
+		return m.askInput(actionCreate, "Directory of the new VM:", "~/win11"), textinput.Blink, true
+	case key.Matches(msg, manageKeys.add):
+		return m.askInput(actionAdd, "Existing VM directory to add to the list:", ""), textinput.Blink, true
+	case key.Matches(msg, manageKeys.refresh):
+		m.state, m.status, m.failed = workingOnVM, "Reading the VM list...", false
+		return m, loadVMs, true
+	}
+	if vm == nil {
+		return m, nil, false
+	}
+
+	switch {
+	case key.Matches(msg, manageKeys.rename):
+		m = m.askInput(actionRename, "New name for "+vm.Name+":", "")
+		m.input.SetValue(vm.Name)
+		return m, textinput.Blink, true
+	case key.Matches(msg, manageKeys.clone):
+		return m.askInput(actionClone, "Directory for the copy of "+vm.Name+":", vm.Path+"-copy"), textinput.Blink, true
+	case key.Matches(msg, manageKeys.remove):
+		m.state = confirmingDelete
+		return m, nil, true
+	case key.Matches(msg, manageKeys.edit):
+		path := vm.Path
+		return m, tea.ExecProcess(editorCommand(path), func(err error) tea.Msg {
+			return vmActionDoneMsg{status: "Edited " + path + "/bvm-config.toml", err: err}
+		}), true
+	}
+	return m, nil, false
+}
+
+// askInput switches to the text input for an action
+func (m manageVMsModel) askInput(action manageAction, prompt string, placeholder string) manageVMsModel {
+	input := textinput.New()
+	input.Prompt = prompt + " "
+	input.Placeholder = placeholder
+	input.Width = m.width - 4
+	input.Focus()
+	m.input = input
+	m.action = action
+	m.state = enteringInput
+	return m
+}
+
+func (m manageVMsModel) updateInput(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "esc":
+		m.state = browsingVMs
+		return m, nil
+	case "enter":
+		value := strings.TrimSpace(m.input.Value())
+		if value == "" {
+			value = m.input.Placeholder
+		}
+		if value == "" {
+			return m, nil
+		}
+		return m.runAction(expandHome(value))
+	}
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+// runAction does what the text input was asked for
+func (m manageVMsModel) runAction(value string) (tea.Model, tea.Cmd) {
+	m.state = workingOnVM
+	m.failed = false
+	vm := m.selectedVM()
+
+	switch m.action {
+	case actionCreate:
+		m.status = "Creating " + value + "..."
+		// CreateNewVM prints its progress, let it have the terminal
+		return m, tea.Exec(funcCommand{run: func() error { return internal.CreateNewVM(value) }}, func(err error) tea.Msg {
+			return vmActionDoneMsg{status: "Created " + value + ", download Windows next with: bvm download " + value, err: err}
+		})
+	case actionAdd:
+		m.status = "Adding " + value + "..."
+		return m, func() tea.Msg {
+			added, err := addVM(value)
+			if err != nil {
+				return vmActionDoneMsg{err: err}
+			}
+			return vmActionDoneMsg{status: "Added " + added.Path + " as " + added.Name}
+		}
+	case actionRename:
+		name := vm.Name
+		m.status = "Renaming " + name + "..."
+		return m, func() tea.Msg {
+			return vmActionDoneMsg{status: "Renamed " + name + " to " + value, err: renameVM(name, value)}
+		}
+	case actionClone:
+		name := vm.Name
+		m.status = "Copying " + name + " to " + value + ", this takes a while for a large disk..."
+		return m, func() tea.Msg {
+			clone, err := cloneVM(name, value)
+			if err != nil {
+				return vmActionDoneMsg{err: err}
+			}
+			return vmActionDoneMsg{status: fmt.Sprintf("Cloned %s as %s in %s", name, clone.Name, clone.Path)}
+		}
+	}
+	return m, nil
+}
+
+func (m manageVMsModel) updateConfirmDelete(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	vm := m.selectedVM()
+	if vm == nil {
+		m.state = browsingVMs
+		return m, nil
+	}
+	name, path := vm.Name, vm.Path
+	switch msg.String() {
+	case "y":
+		m.state, m.status, m.failed = workingOnVM, "Deleting "+path+"...", false
+		return m, func() tea.Msg {
+			return vmActionDoneMsg{status: "Deleted " + name + " and " + path, err: deleteVM(name, true)}
+		}
+	case "l":
+		m.state, m.failed = workingOnVM, false
+		return m, func() tea.Msg {
+			return vmActionDoneMsg{status: "Removed " + name + " from the list, " + path + " is still there", err: deleteVM(name, false)}
+		}
+	case "n", "esc":
+		m.state = browsingVMs
+	}
+	return m, nil
+}
+
+// expandHome replaces a leading ~ with the home directory, the text input doesn't go through a shell
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + path[1:]
+		}
+	}
+	return path
+}
+
+func (m manageVMsModel) View() string {
+	status := ""
+	if m.status != "" {
+		if m.failed {
+			status = errorStyle.Render("✗ " + m.status)
+		} else {
+			status = infoStyle.Render(m.status)
+		}
+	}
+
+	var body string
+	switch m.state {
+	case enteringInput:
+		body = m.input.View() + "\n\n" + infoStyle.Render("enter to confirm, esc to cancel")
+	case confirmingDelete:
+		vm := m.selectedVM()
+		body = fmt.Sprintf("Delete %s?\n\n  y  delete the VM and everything in %s\n  l  only remove it from the list, keep the files\n  n  cancel", vm.Name, vm.Path)
+	default:
+		if len(m.vmList.Items()) == 0 && m.state == browsingVMs {
+			body = "No VMs yet. Press n to create one or a to add an existing VM directory.\n\n" + m.vmList.View()
+		} else {
+			body = m.vmList.View()
+		}
+	}
+
+	return fmt.Sprintf("%s\n%s\n\n%s", headerStyle.Render("BVM - Manage VMs"), status, body)
+}
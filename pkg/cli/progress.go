@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+)
+
+// firstLoginProgressFile is the file in the VM directory that receives the guest's progress channel
+const firstLoginProgressFile = "firstlogin-progress.log"
+
+// tailFirstLoginProgress follows the progress written by firstlogin.ps1 and passes every event to onEvent until stop is closed
+func tailFirstLoginProgress(path string, stop <-chan struct{}, onEvent func(provision.ProgressEvent)) {
+	var offset int64
+	var partial string
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		stopping := false
+		select {
+		case <-stop:
+			// Read whatever arrived since the last tick before returning
+			stopping = true
+		case <-ticker.C:
+		}
+
+		data, newOffset, restarted := readProgressFrom(path, offset)
+		if restarted {
+			// The file was truncated when the domain started again
+			partial = ""
+		}
+		offset = newOffset
+
+		lines := strings.Split(partial+string(data), "\n")
+		partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			if event, ok := provision.ParseProgressLine(line); ok {
+				onEvent(event)
+			}
+		}
+
+		if stopping {
+			return
+		}
+	}
+}
+
+// readProgressFrom returns the bytes of path after offset, the new offset and whether the file got shorter since the last read
+func readProgressFrom(path string, offset int64) ([]byte, int64, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		// The channel file only appears once the domain is running
+		return nil, offset, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, false
+	}
+	restarted := info.Size() < offset
+	if restarted {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, restarted
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, offset, restarted
+	}
+	return data, offset + int64(len(data)), restarted
+}
+
+// reportFirstLoginProgress prints a single progress event from the guest
+func reportFirstLoginProgress(event provision.ProgressEvent) {
+	switch event.Kind {
+	case provision.ProgressStep:
+		internal.Status("First login: " + event.Message + " (" + event.Step + ")")
+	case provision.ProgressError:
+		internal.ErrorNoExit("First login: " + event.Message)
+	case provision.ProgressDone:
+		internal.StatusGreen("First login: " + event.Message)
+	case provision.ProgressDelivery:
+		internal.Status("Answer file delivered by: " + event.Message)
+	default:
+		internal.Status("First login: " + event.Message)
+	}
+}
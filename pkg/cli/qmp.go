@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"libvirt.org/go/libvirt"
+)
+
+// qemuVMNames are the names of the VMs bvm runs on qemu-direct for a VM directory
+func qemuVMNames(vmdir string) []string {
+	return []string{
+		fmt.Sprintf("bvm-%s", filepath.Base(vmdir)),
+		fmt.Sprintf("bvm-firstboot-%s", filepath.Base(vmdir)),
+	}
+}
+
+// QMP runs a QMP command on the running VM of a VM directory and prints what it returned, for debugging.
+// arguments is a JSON object, or empty for a command without arguments.
+func QMP(vmdir string, command string, arguments string) error {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+
+	var args any
+	if arguments != "" {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(arguments), &object); err != nil {
+			return fmt.Errorf("arguments must be a JSON object like '{\"value\": 2147483648}': %v", err)
+		}
+		args = json.RawMessage(arguments)
+	}
+
+	var result json.RawMessage
+	switch internal.BVMConfig.Virtualization {
+	case "qemu-direct":
+		result, err = qmpDirect(absVmdir, command, args)
+	case "xen":
+		return fmt.Errorf("QMP is not available on Xen, xl talks to the device model itself")
+	default:
+		result, err = qmpLibvirt(absVmdir, command, args)
+	}
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, result, "", "  "); err != nil {
+		out.Reset()
+		out.Write(result)
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+// qmpDirect runs a command on the QMP socket of a VM started by qemu-direct
+func qmpDirect(vmdir string, command string, args any) (json.RawMessage, error) {
+	for _, name := range qemuVMNames(vmdir) {
+		if _, err := os.Stat(qmpSocketPath(name)); err == nil {
+			return qmpExecute(name, command, args)
+		}
+	}
+	return nil, fmt.Errorf("no VM of %s is running on qemu-direct", vmdir)
+}
+
+// qmpLibvirt passes a command to the QEMU monitor of a libvirt domain.
+// libvirt marks the domain as tainted, so this is for debugging only.
+func qmpLibvirt(vmdir string, command string, args any) (json.RawMessage, error) {
+	conn, err := connectLibvirt()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	domains, err := vmDomains(conn, vmdir)
+	if err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no running VM uses %s", vmdir)
+	}
+	for _, domain := range domains[1:] {
+		domain.Free()
+	}
+	domain := domains[0]
+	defer domain.Free()
+
+	request := map[string]any{"execute": command}
+	if args != nil {
+		request["arguments"] = args
+	}
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	replyJSON, err := domain.QemuMonitorCommand(string(requestJSON), libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v", command, err)
+	}
+
+	var reply struct {
+		Return json.RawMessage `json:"return"`
+		Error  *struct {
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(replyJSON), &reply); err != nil {
+		return nil, fmt.Errorf("failed to parse reply to %s: %v", command, err)
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("%s failed: %s", command, reply.Error.Desc)
+	}
+	return reply.Return, nil
+}
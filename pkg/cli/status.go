@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
+)
+
+// statusTimeFormat is how bvm status prints times
+const statusTimeFormat = "2006-01-02 15:04:05"
+
+// nextStep is the command that moves a VM on from its state
+func nextStep(state *vmstate.VMState, vmdir string) string {
+	switch state.State {
+	case vmstate.Created:
+		return "bvm download " + vmdir
+	case vmstate.Downloaded:
+		return "bvm prepare " + vmdir
+	case vmstate.Prepared, vmstate.Installing:
+		return "bvm firstboot " + vmdir
+	case vmstate.Installed:
+		return "bvm boot " + vmdir
+	case vmstate.Failed:
+		return "bvm " + state.FailedStep + " " + vmdir
+	}
+	return ""
+}
+
+// installPhaseTitle is the title of the installation phase with a key, the key itself if there is none
+func installPhaseTitle(key string) string {
+	for _, phase := range installPhases {
+		if phase.key == key {
+			return phase.title
+		}
+	}
+	return key
+}
+
+// VMStatus prints the state of a VM directory from its state.json
+func VMStatus(vmdir string) error {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+	state, err := vmstate.Load(absVmdir)
+	if err != nil {
+		return err
+	}
+
+	running, closeCheck := vmRunningCheck()
+	isRunning := running(absVmdir)
+	closeCheck()
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "VM directory:\t%s\n", absVmdir)
+	if state.Updated.IsZero() {
+		fmt.Fprintf(table, "State:\t%s\n", state.State)
+	} else {
+		fmt.Fprintf(table, "State:\t%s since %s\n", state.State, state.Updated.Local().Format(statusTimeFormat))
+	}
+	if state.State == vmstate.Failed {
+		fmt.Fprintf(table, "Failed step:\t%s\n", state.FailedStep)
+		fmt.Fprintf(table, "Error:\t%s\n", state.Error)
+	}
+	if state.Phase != "" {
+		fmt.Fprintf(table, "Resumes from phase:\t%s\n", installPhaseTitle(state.Phase))
+	}
+	fmt.Fprintf(table, "Running:\t%t\n", isRunning)
+	if next := nextStep(state, vmdir); next != "" {
+		fmt.Fprintf(table, "Next step:\t%s\n", next)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if state.Migrated {
+		internal.Warning("This VM was set up by an older version, its state was worked out from the files in it. The next step writes " + vmstate.FileName + ".")
+		return nil
+	}
+
+	if len(state.Artifacts) > 0 {
+		fmt.Println()
+		internal.Status("Files made by each step:")
+		table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, step := range []string{vmstate.StepNewVM, vmstate.StepDownload, vmstate.StepPrepare, vmstate.StepFirstboot} {
+			for _, artifact := range state.Artifacts[step] {
+				line := fmt.Sprintf("  %s\t%s\t%s\t%s", step, artifact.Path, formatBytes(artifact.Size), artifact.Modified.Local().Format(statusTimeFormat))
+				if _, err := os.Stat(filepath.Join(absVmdir, artifact.Path)); err != nil {
+					line += "\t(missing)"
+				}
+				fmt.Fprintln(table, line)
+			}
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	internal.Status("History:")
+	table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, transition := range state.History {
+		from := string(transition.From)
+		if from == "" {
+			from = "-"
+		}
+		line := fmt.Sprintf("  %s\t%s\t%s -> %s", transition.Time.Local().Format(statusTimeFormat), transition.Step, from, transition.To)
+		if transition.Error != "" {
+			line += ": " + transition.Error
+		}
+		fmt.Fprintln(table, line)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+// configUSBDevices returns the devices of usb_passthrough that are plugged in.
+// A device picked by bus.device is passed on by vendor:product when that is unique, so it survives enumerating again.
+func configUSBDevices() ([]usb.Selector, error) {
+	selectors, err := usb.ParseSelectors(internal.BVMConfig.UsbPassthrough)
+	if err != nil {
+		return nil, fmt.Errorf("usb_passthrough in bvm-config.toml: %v", err)
+	}
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+	// The devices of a remote libvirt host are not in the sysfs of this one
+	if internal.BVMConfig.Virtualization != "qemu-direct" && internal.BVMConfig.Virtualization != "xen" && isRemoteURI(internal.BVMConfig.LibvirtURI) {
+		return selectors, nil
+	}
+
+	devices, err := usb.List()
+	if err != nil {
+		return nil, err
+	}
+	var present []usb.Selector
+	for _, selector := range selectors {
+		found := usb.Find(devices, selector)
+		if len(found) == 0 {
+			internal.Warning("USB device " + selector.String() + " from usb_passthrough is not plugged in, skipping it")
+			continue
+		}
+		if selector.ByID() {
+			present = append(present, selector)
+		} else {
+			present = append(present, usb.Stable(devices, found[0]))
+		}
+	}
+	return present, nil
+}
+
+// resolveUSBDevice picks the host device for bvm usb attach and detach
+func resolveUSBDevice(value string) (usb.Selector, error) {
+	selector, err := usb.ParseSelector(value)
+	if err != nil {
+		return usb.Selector{}, err
+	}
+	devices, err := usb.List()
+	if err != nil {
+		// Detaching works without the device, it may have been unplugged
+		internal.Debug(err.Error())
+		return selector, nil
+	}
+	found := usb.Find(devices, selector)
+	switch {
+	case len(found) == 0:
+		return selector, nil
+	case len(found) > 1:
+		internal.Warning(fmt.Sprintf("%d devices are %s, passing the first one on. Pick one by bus.device from bvm usb list to choose.", len(found), selector))
+	}
+	if selector.ByID() {
+		return selector, nil
+	}
+	return usb.Stable(devices, found[0]), nil
+}
+
+// usbHostdev is the libvirt hostdev of a USB device
+func usbHostdev(selector usb.Selector) Hostdev {
+	source := &HostdevSource{}
+	if selector.ByID() {
+		source.Vendor = &USBVendor{ID: "0x" + selector.VendorID}
+		source.Product = &USBProduct{ID: "0x" + selector.ProductID}
+	} else {
+		source.Address = &Address{Bus: strconv.Itoa(selector.Bus), Device: strconv.Itoa(selector.Address)}
+	}
+	return Hostdev{Mode: "subsystem", Type: "usb", Managed: "yes", Source: source}
+}
+
+// hostdevXML renders a hostdev on its own, for attaching and detaching it
+func hostdevXML(hostdev Hostdev) (string, error) {
+	var b strings.Builder
+	if err := xml.NewEncoder(&b).EncodeElement(hostdev, xml.StartElement{Name: xml.Name{Local: "hostdev"}}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// hostdevUSBSelector is the selector of a USB hostdev in domain XML, ok is false for other hostdevs.
+// libvirt adds the address it found to hostdevs picked by vendor and product, the IDs are what counts then.
+func hostdevUSBSelector(hostdev Hostdev) (selector usb.Selector, ok bool) {
+	if hostdev.Type != "usb" || hostdev.Source == nil {
+		return usb.Selector{}, false
+	}
+	source := hostdev.Source
+	if source.Vendor != nil && source.Product != nil {
+		return usb.Selector{
+			VendorID:  strings.TrimPrefix(strings.ToLower(source.Vendor.ID), "0x"),
+			ProductID: strings.TrimPrefix(strings.ToLower(source.Product.ID), "0x"),
+		}, true
+	}
+	if source.Address != nil {
+		bus, err1 := strconv.Atoi(source.Address.Bus)
+		address, err2 := strconv.Atoi(source.Address.Device)
+		if err1 == nil && err2 == nil {
+			return usb.Selector{Bus: bus, Address: address}, true
+		}
+	}
+	return usb.Selector{}, false
+}
+
+// qemuUSBDeviceID is the QEMU device ID of a passed through USB device, like usb-05dc-a720 or usb-1-5
+func qemuUSBDeviceID(selector usb.Selector) string {
+	return "usb-" + strings.NewReplacer(":", "-", ".", "-").Replace(selector.String())
+}
+
+// qemuUSBDevice is the usb-host device of a selector. QEMU picks up a device picked by IDs again when it re-enumerates.
+func qemuUSBDevice(selector usb.Selector) string {
+	if selector.ByID() {
+		return fmt.Sprintf("usb-host,id=%s,vendorid=0x%s,productid=0x%s", qemuUSBDeviceID(selector), selector.VendorID, selector.ProductID)
+	}
+	return fmt.Sprintf("usb-host,id=%s,hostbus=%d,hostaddr=%d", qemuUSBDeviceID(selector), selector.Bus, selector.Address)
+}
+
+// runningUSBHotplugger connects to the hypervisor and finds the running VM of a VM directory
+func runningUSBHotplugger(vmdir string) (usbHotplugger, string, func(), error) {
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+	hv, err := newHypervisor()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	hotplugger, ok := hv.(usbHotplugger)
+	if !ok {
+		hv.Close()
+		return nil, "", nil, fmt.Errorf("%s can't attach USB devices to a running VM, add them to usb_passthrough in bvm-config.toml, they are attached when bvm boot or bvm firstboot starts the VM", hv.Name())
+	}
+	name, err := runningVMName(hv, absVmdir)
+	if err != nil {
+		hv.Close()
+		return nil, "", nil, err
+	}
+	return hotplugger, name, func() { hv.Close() }, nil
+}
+
+// USBList prints the USB devices of the host, marking those attached to the running VM of vmdir if it is given
+func USBList(vmdir string) error {
+	devices, err := usb.List()
+	if err != nil {
+		return err
+	}
+
+	var attached []usb.Selector
+	if vmdir != "" {
+		hotplugger, name, closeHV, err := runningUSBHotplugger(vmdir)
+		if err != nil {
+			return err
+		}
+		attached, err = hotplugger.AttachedUSB(name)
+		closeHV()
+		if err != nil {
+			return err
+		}
+	}
+	configured, err := usb.ParseSelectors(internal.BVMConfig.UsbPassthrough)
+	if err != nil {
+		internal.Warning("usb_passthrough in bvm-config.toml: " + err.Error())
+	}
+
+	fmt.Printf("%-8s  %-9s  %-10s  %s\n", "BUS.DEV", "ID", "PORT", "NAME")
+	for _, device := range devices {
+		if device.Hub {
+			continue
+		}
+		var marks []string
+		for _, selector := range attached {
+			if selector.Matches(device) {
+				marks = append(marks, "attached")
+				break
+			}
+		}
+		for _, selector := range configured {
+			if selector.Matches(device) {
+				marks = append(marks, "usb_passthrough")
+				break
+			}
+		}
+		line := fmt.Sprintf("%-8s  %-9s  %-10s  %s", fmt.Sprintf("%d.%d", device.Bus, device.Address), device.ID(), device.Port, device.Name())
+		if len(marks) > 0 {
+			line += " (" + strings.Join(marks, ", ") + ")"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// USBAttach passes a USB device of the host through to the running VM of a VM directory
+func USBAttach(vmdir string, device string) error {
+	selector, err := resolveUSBDevice(device)
+	if err != nil {
+		return err
+	}
+	hotplugger, name, closeHV, err := runningUSBHotplugger(vmdir)
+	if err != nil {
+		return err
+	}
+	defer closeHV()
+	if err := hotplugger.AttachUSB(name, selector); err != nil {
+		return err
+	}
+	internal.StatusGreen("Attached USB device " + selector.String() + " to " + name)
+	return nil
+}
+
+// USBDetach gives a USB device of the running VM of a VM directory back to the host
+func USBDetach(vmdir string, device string) error {
+	selector, err := resolveUSBDevice(device)
+	if err != nil {
+		return err
+	}
+	hotplugger, name, closeHV, err := runningUSBHotplugger(vmdir)
+	if err != nil {
+		return err
+	}
+	defer closeHV()
+	if err := hotplugger.DetachUSB(name, selector); err != nil {
+		return err
+	}
+	internal.StatusGreen("Detached USB device " + selector.String() + " from " + name)
+	return nil
+}
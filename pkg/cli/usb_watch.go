@@ -0,0 +1,194 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+// usbWatchLog is the file in the VM directory bvm usb watch logs what it forwarded to
+const usbWatchLog = "usb-watch.log"
+
+// usbForwardRules are the rules of usb_passthrough and usb_autoforward
+func usbForwardRules() ([]usb.Rule, error) {
+	passthrough, err := usb.ParseRules(internal.BVMConfig.UsbPassthrough)
+	if err != nil {
+		return nil, fmt.Errorf("usb_passthrough in bvm-config.toml: %v", err)
+	}
+	autoforward, err := usb.ParseRules(internal.BVMConfig.UsbAutoforward)
+	if err != nil {
+		return nil, fmt.Errorf("usb_autoforward in bvm-config.toml: %v", err)
+	}
+	return append(passthrough, autoforward...), nil
+}
+
+// USBWatch attaches USB devices that match usb_passthrough or usb_autoforward to the running VM of a VM directory
+// as they are plugged in, and detaches them when they are unplugged. It returns when the VM shuts down.
+// bvm boot and bvm firstboot do the same in the background, this is for VMs started some other way.
+func USBWatch(vmdir string) error {
+	rules, err := usbForwardRules()
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("usb_passthrough and usb_autoforward in bvm-config.toml are empty, no device would be forwarded")
+	}
+
+	hotplugger, name, closeHV, err := runningUSBHotplugger(vmdir)
+	if err != nil {
+		return err
+	}
+	defer closeHV()
+	return watchUSB(hotplugger.(Hypervisor), name, vmdir, rules, nil, internal.Status)
+}
+
+// startUSBWatch forwards USB devices to a VM in the background while bvm runs it, see USBWatch.
+// The returned function stops it, call it before the VM is destroyed.
+func startUSBWatch(hv Hypervisor, spec *vmSpec) func() {
+	rules, err := usbForwardRules()
+	if err != nil {
+		internal.Warning("Not forwarding USB devices as they are plugged in: " + err.Error())
+		return func() {}
+	}
+	if len(rules) == 0 {
+		return func() {}
+	}
+	if _, ok := hv.(usbHotplugger); !ok {
+		internal.Debug(hv.Name() + " can't attach USB devices to a running VM, not forwarding them as they are plugged in")
+		return func() {}
+	}
+	// Devices plugged into this system can't be passed through to a remote libvirt host
+	if hv.Name() == "libvirt" && isRemoteURI(internal.BVMConfig.LibvirtURI) {
+		internal.Debug("Not forwarding USB devices to a VM on a remote libvirt host")
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The progress view of firstboot owns the terminal, what was forwarded is in usb-watch.log
+		if err := watchUSB(hv, spec.Name, spec.Dir, rules, stop, internal.Debug); err != nil {
+			internal.Warning("Stopped forwarding USB devices: " + err.Error())
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// watchUSB attaches and detaches devices matching the rules as they are plugged in and out, until the VM shuts down
+// or stop is closed. What it does is logged to usb-watch.log in the VM directory and passed to report.
+func watchUSB(hv Hypervisor, name string, vmdir string, rules []usb.Rule, stop <-chan struct{}, report func(string)) error {
+	hotplugger := hv.(usbHotplugger)
+
+	monitor, err := usb.NewMonitor()
+	if err != nil {
+		return err
+	}
+	uevents := make(chan usb.Uevent, 64)
+	received := make(chan struct{})
+	go func() {
+		defer close(uevents)
+		for {
+			uevent, err := monitor.Receive()
+			if err != nil {
+				return
+			}
+			select {
+			case uevents <- uevent:
+			case <-received:
+				return
+			}
+		}
+	}()
+	defer close(received)
+	defer monitor.Close()
+
+	logFile, err := os.OpenFile(filepath.Join(vmdir, usbWatchLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		internal.Warning("Failed to open " + usbWatchLog + ": " + err.Error())
+	} else {
+		defer logFile.Close()
+	}
+	logAction := func(message string) {
+		report(message)
+		if logFile != nil {
+			fmt.Fprintf(logFile, "%s %s\n", time.Now().Format(time.RFC3339), message)
+		}
+	}
+
+	var ruleNames []string
+	for _, rule := range rules {
+		ruleNames = append(ruleNames, rule.String())
+	}
+	logAction(fmt.Sprintf("Forwarding USB devices matching %v to %s as they are plugged in", ruleNames, name))
+
+	// attached are the selectors devices were attached by, by sysfs port, to detach them when they are unplugged
+	attached := map[string]usb.Selector{}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			logAction("VM " + name + " is stopping, no longer forwarding USB devices")
+			return nil
+		case <-ticker.C:
+			if state, err := hv.State(name); err != nil || state == vmShutoff {
+				logAction("VM " + name + " has shut down, no longer forwarding USB devices")
+				return nil
+			}
+			continue
+		case uevent, ok := <-uevents:
+			if !ok {
+				return fmt.Errorf("stopped receiving uevents")
+			}
+			event, ok := usb.DeviceEvent(uevent)
+			if !ok {
+				continue
+			}
+			device := event.Device
+
+			if !event.Add {
+				selector, ok := attached[device.Port]
+				if !ok {
+					continue
+				}
+				delete(attached, device.Port)
+				if err := hotplugger.DetachUSB(name, selector); err != nil {
+					logAction(fmt.Sprintf("Unplugged %s (%s), failed to detach it: %v", selector, device.Port, err))
+				} else {
+					logAction(fmt.Sprintf("Unplugged %s (%s), detached it from %s", selector, device.Port, name))
+				}
+				continue
+			}
+
+			matched := false
+			for _, rule := range rules {
+				if rule.Matches(device) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				internal.Debug(fmt.Sprintf("Plugged in %s %s, no rule matches it", device.ID(), device.Name()))
+				continue
+			}
+			selector := usb.Selector{VendorID: device.VendorID, ProductID: device.ProductID}
+			if devices, err := usb.List(); err == nil {
+				selector = usb.Stable(devices, device)
+			}
+			if err := hotplugger.AttachUSB(name, selector); err != nil {
+				logAction(fmt.Sprintf("Plugged in %s %s, failed to attach it: %v", device.ID(), device.Name(), err))
+				continue
+			}
+			attached[device.Port] = selector
+			logAction(fmt.Sprintf("Plugged in %s %s, attached it to %s as %s", device.ID(), device.Name(), name, selector))
+		}
+	}
+}
@@ -1,283 +1,102 @@
 package cli
 
 import (
-	"encoding/xml"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
 	"libvirt.org/go/libvirt"
 )
 
-// LibvirtDomainXML represents the structure for libvirt domain XML
-type LibvirtDomainXML struct {
-	XMLName       xml.Name `xml:"domain"`
-	Type          string   `xml:"type,attr"`
-	Name          string   `xml:"name"`
-	UUID          string   `xml:"uuid,omitempty"`
-	Memory        Memory   `xml:"memory"`
-	CurrentMemory Memory   `xml:"currentMemory"`
-	VCPU          VCPU     `xml:"vcpu"`
-	OS            OS       `xml:"os"`
-	Features      Features `xml:"features"`
-	CPU           CPU      `xml:"cpu"`
-	Clock         Clock    `xml:"clock"`
-	OnPoweroff    string   `xml:"on_poweroff"`
-	OnReboot      string   `xml:"on_reboot"`
-	OnCrash       string   `xml:"on_crash"`
-	Devices       Devices  `xml:"devices"`
-}
-
-type Memory struct {
-	Unit  string `xml:"unit,attr"`
-	Value string `xml:",chardata"`
-}
-
-type VCPU struct {
-	Placement string `xml:"placement,attr"`
-	Value     string `xml:",chardata"`
-}
-
-type OS struct {
-	Type     OSType  `xml:"type"`
-	Firmware string  `xml:"firmware,attr,omitempty"`
-	Loader   *Loader `xml:"loader,omitempty"`
-	NVRam    *NVRam  `xml:"nvram,omitempty"`
-	Boot     []Boot  `xml:"boot,omitempty"`
-}
-
-type OSType struct {
-	Arch    string `xml:"arch,attr"`
-	Machine string `xml:"machine,attr"`
-	Value   string `xml:",chardata"`
-}
-
-type Loader struct {
-	ReadOnly string `xml:"readonly,attr"`
-	Type     string `xml:"type,attr"`
-	Value    string `xml:",chardata"`
-}
-
-type NVRam struct {
-	Value string `xml:",chardata"`
-}
-
-type Boot struct {
-	Dev string `xml:"dev,attr"`
-}
-
-type Features struct {
-	ACPI struct{} `xml:"acpi"`
-	APIC struct{} `xml:"apic"`
-	GIC  *GIC     `xml:"gic,omitempty"`
-}
-
-type GIC struct {
-	Version string `xml:"version,attr"`
-}
-
-type CPU struct {
-	Mode     string    `xml:"mode,attr"`
-	Check    string    `xml:"check,attr,omitempty"`
-	Topology *Topology `xml:"topology,omitempty"`
-}
-
-type Topology struct {
-	Sockets string `xml:"sockets,attr"`
-	Cores   string `xml:"cores,attr"`
-	Threads string `xml:"threads,attr"`
-}
-
-type Clock struct {
-	Offset string  `xml:"offset,attr"`
-	Timer  []Timer `xml:"timer"`
-}
-
-type Timer struct {
-	Name       string `xml:"name,attr"`
-	Tickpolicy string `xml:"tickpolicy,attr,omitempty"`
-	Present    string `xml:"present,attr,omitempty"`
-}
-
-type Devices struct {
-	Emulator    string       `xml:"emulator"`
-	Disks       []Disk       `xml:"disk"`
-	Controllers []Controller `xml:"controller"`
-	Interfaces  []Interface  `xml:"interface"`
-	Serials     []Serial     `xml:"serial"`
-	Consoles    []Console    `xml:"console"`
-	Channels    []Channel    `xml:"channel"`
-	Graphics    []Graphics   `xml:"graphics"`
-	Videos      []Video      `xml:"video"`
-	Inputs      []Input      `xml:"input"`
-	USBs        []USB        `xml:"hostdev,omitempty"`
-	RNGs        []RNG        `xml:"rng"`
-	Sounds      []Sound      `xml:"sound,omitempty"`
-	MemBalloon  *MemBalloon  `xml:"memballoon,omitempty"`
-}
-
-type Disk struct {
-	Type   string      `xml:"type,attr"`
-	Device string      `xml:"device,attr"`
-	Driver *DiskDriver `xml:"driver,omitempty"`
-	Source *DiskSource `xml:"source,omitempty"`
-	Target DiskTarget  `xml:"target"`
-	Boot   *Boot       `xml:"boot,omitempty"`
-}
-
-type DiskDriver struct {
-	Name    string `xml:"name,attr"`
-	Type    string `xml:"type,attr,omitempty"`
-	Cache   string `xml:"cache,attr,omitempty"`
-	IO      string `xml:"io,attr,omitempty"`
-	Discard string `xml:"discard,attr,omitempty"`
-}
-
-type DiskSource struct {
-	File string `xml:"file,attr,omitempty"`
-}
-
-type DiskTarget struct {
-	Dev string `xml:"dev,attr"`
-	Bus string `xml:"bus,attr,omitempty"`
-}
-
-type Controller struct {
-	Type    string   `xml:"type,attr"`
-	Index   string   `xml:"index,attr"`
-	Model   string   `xml:"model,attr,omitempty"`
-	Address *Address `xml:"address,omitempty"`
-}
-
-type Interface struct {
-	Type   string           `xml:"type,attr"`
-	Source *InterfaceSource `xml:"source,omitempty"`
-	Model  *InterfaceModel  `xml:"model,omitempty"`
-}
-
-type InterfaceSource struct {
-	Network string `xml:"network,attr,omitempty"`
-}
-
-type InterfaceModel struct {
-	Type string `xml:"type,attr"`
-}
-
-type Serial struct {
-	Type   string        `xml:"type,attr"`
-	Target *SerialTarget `xml:"target,omitempty"`
-}
-
-type SerialTarget struct {
-	Type string `xml:"type,attr,omitempty"`
-	Port string `xml:"port,attr,omitempty"`
-}
-
-type Console struct {
-	Type   string         `xml:"type,attr"`
-	Target *ConsoleTarget `xml:"target,omitempty"`
-}
-
-type ConsoleTarget struct {
-	Type string `xml:"type,attr,omitempty"`
-	Port string `xml:"port,attr,omitempty"`
-}
-
-type Channel struct {
-	Type   string         `xml:"type,attr"`
-	Target *ChannelTarget `xml:"target,omitempty"`
-}
-
-type ChannelTarget struct {
-	Type string `xml:"type,attr"`
-	Name string `xml:"name,attr,omitempty"`
-}
-
-type Graphics struct {
-	Type     string `xml:"type,attr"`
-	Port     string `xml:"port,attr,omitempty"`
-	AutoPort string `xml:"autoport,attr,omitempty"`
-	Listen   string `xml:"listen,attr,omitempty"`
-}
-
-type Video struct {
-	Model VideoModel `xml:"model"`
-}
-
-type VideoModel struct {
-	Type    string `xml:"type,attr"`
-	VRam    string `xml:"vram,attr,omitempty"`
-	Heads   string `xml:"heads,attr,omitempty"`
-	Primary string `xml:"primary,attr,omitempty"`
-}
-
-type Input struct {
-	Type string `xml:"type,attr"`
-	Bus  string `xml:"bus,attr"`
-}
-
-type USB struct {
-	Mode   string     `xml:"mode,attr"`
-	Type   string     `xml:"type,attr"`
-	Source *USBSource `xml:"source"`
-}
-
-type USBSource struct {
-	Vendor  *USBVendor  `xml:"vendor"`
-	Product *USBProduct `xml:"product"`
-}
-
-type USBVendor struct {
-	ID string `xml:"id,attr"`
-}
-
-type USBProduct struct {
-	ID string `xml:"id,attr"`
+func NewVM(vmdir string) {
+	internal.CreateNewVM(vmdir)
 }
 
-type RNG struct {
-	Model   string     `xml:"model,attr"`
-	Backend RNGBackend `xml:"backend"`
+// FirstBootOptions are the command line options of bvm firstboot
+type FirstBootOptions struct {
+	// Capture records screenshots and the serial console and packs them into a tarball if the installation fails
+	Capture bool
+	// Headless runs without a desktop session: SPICE only listens on localhost and no viewer is started
+	Headless bool
+	// NoGraphics leaves out the SPICE server entirely, it implies Headless
+	NoGraphics bool
 }
 
-type RNGBackend struct {
-	Model string `xml:"model,attr"`
-	Value string `xml:",chardata"`
-}
+// FirstBoot runs the Windows installation process on the hypervisor from bvm-config.toml
+func FirstBoot(vmdir string, opts FirstBootOptions) error {
+	state, err := vmstate.Load(vmdir)
+	if err != nil {
+		return err
+	}
+	if err := checkFirstBootState(state, vmdir); err != nil {
+		return err
+	}
 
-type Sound struct {
-	Model string `xml:"model,attr"`
-}
+	var capture *firstBootCapture
+	if opts.Capture {
+		absVmdir, err := filepath.Abs(vmdir)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+		}
+		capture, err = newFirstBootCapture(absVmdir)
+		if err != nil {
+			return err
+		}
+	}
 
-type MemBalloon struct {
-	Model string `xml:"model,attr"`
-}
+	if opts.NoGraphics {
+		opts.Headless = true
+	}
 
-type Address struct {
-	Type     string `xml:"type,attr,omitempty"`
-	Domain   string `xml:"domain,attr,omitempty"`
-	Bus      string `xml:"bus,attr,omitempty"`
-	Slot     string `xml:"slot,attr,omitempty"`
-	Function string `xml:"function,attr,omitempty"`
+	err = runFirstBoot(vmdir, opts, capture)
+	// An installation that got going is failed, checks that failed before it started leave the state alone
+	if err != nil {
+		if state, stateErr := vmstate.Load(vmdir); stateErr == nil && state.State == vmstate.Installing {
+			if stateErr := state.Fail(vmstate.StepFirstboot, err); stateErr != nil {
+				internal.Warning("Failed to update state.json: " + stateErr.Error())
+			}
+		}
+	}
+	if err != nil && capture != nil && capture.attempts > 0 {
+		if tarball, bundleErr := capture.bundle(); bundleErr != nil {
+			internal.Warning("Failed to pack the captured files: " + bundleErr.Error())
+		} else {
+			internal.Status("Screenshots, logs and the answer file were saved to " + tarball + ", please attach it to bug reports")
+		}
+	}
+	return err
 }
 
-func NewVM(vmdir string) {
-	internal.CreateNewVM(vmdir)
+// checkFirstBootState refuses to run firstboot on a VM that isn't prepared or is already installed.
+// An installation that was interrupted or failed is resumed.
+func checkFirstBootState(state *vmstate.VMState, vmdir string) error {
+	switch {
+	case state.State == vmstate.Installed:
+		return fmt.Errorf("Windows is already installed in %s. Run 'bvm prepare %s' to start over with a clean install", vmdir, vmdir)
+	case state.State == vmstate.Failed && state.FailedStep != vmstate.StepFirstboot:
+		return fmt.Errorf("bvm %s failed last time: %s. Run 'bvm %s %s' again first", state.FailedStep, state.Error, state.FailedStep, vmdir)
+	case !state.CanMoveTo(vmstate.Installing):
+		return fmt.Errorf("the VM is %s, run 'bvm prepare %s' first", state.State, vmdir)
+	case state.State != vmstate.Prepared:
+		internal.Status("The last firstboot of " + vmdir + " did not finish, trying again")
+	}
+	return nil
 }
 
-// FirstBoot runs the Windows installation process using libvirt
-func FirstBoot(vmdir string) error {
-	internal.Status("Starting Windows installation using libvirt...")
+// runFirstBoot installs Windows, capture is nil unless --capture was given
+func runFirstBoot(vmdir string, opts FirstBootOptions, capture *firstBootCapture) error {
+	internal.Status("Starting Windows installation using " + internal.BVMConfig.Virtualization + "...")
 
-	// Check for desktop environment
-	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
-		return fmt.Errorf("BVM needs a desktop environment to run firstboot")
+	// Check for desktop environment, the SPICE viewer needs one
+	if !opts.Headless && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return fmt.Errorf("BVM needs a desktop environment to run firstboot, use 'bvm firstboot --headless %s' to install without one", vmdir)
 	}
 
 	// Convert to absolute path for proper file checking
@@ -306,415 +125,291 @@ func FirstBoot(vmdir string) error {
 		return fmt.Errorf("disk.qcow2 not found at %s. Run 'bvm prepare %s' first", diskImage, vmdir)
 	}
 
-	// Check file permissions for libvirt access
+	// Check file permissions for libvirt access, a remote host gets its own copies
+	uri := internal.BVMConfig.LibvirtURI
+	remote := isRemoteURI(uri)
 	for _, file := range []string{installerISO, unattendedISO, diskImage} {
-		if info, err := os.Stat(file); err == nil {
-			// Check if file is readable
-			if info.Mode().Perm()&0444 == 0 {
-				internal.Warning(fmt.Sprintf("File %s may not be readable by libvirt. Consider running: chmod +r %s", file, file))
+		switch {
+		case remote:
+		case isSystemURI(uri):
+			checkSystemAccess(file)
+		default:
+			if info, err := os.Stat(file); err == nil {
+				// Check if file is readable
+				if info.Mode().Perm()&0444 == 0 {
+					internal.Warning(fmt.Sprintf("File %s may not be readable by libvirt. Consider running: chmod +r %s", file, file))
+				}
 			}
 		}
 	}
 
-	// For enhanced compatibility with newer Windows Setup, try embedding autounattend.xml in installer ISO
-	if err := createBootDriveAutounattend(absVmdir); err != nil {
-		internal.Warning("Failed to create enhanced installer ISO: " + err.Error())
-		internal.Warning("Proceeding with standard method...")
-	}
-
-	// Create floppy disk with autounattend.xml as additional fallback
-	if err := createAutounattendFloppy(absVmdir); err != nil {
-		internal.Warning("Failed to create autounattend floppy: " + err.Error())
+	// The answer files are rendered by bvm prepare, older versions put a single one on unattended.iso
+	if _, err := os.Stat(filepath.Join(absVmdir, "answerfiles")); os.IsNotExist(err) {
+		return fmt.Errorf("no answer files found in %s, this VM was prepared by an older version. Run 'bvm prepare %s' again", absVmdir, vmdir)
 	}
+	deliveries := internal.AnswerFileDeliveryOrder(absVmdir)
 
-	// Ensure display environment is available for graphics
-	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
-		return fmt.Errorf("no display environment found - please run in a desktop session")
+	if err := vmstate.Record(absVmdir, vmstate.Installing, vmstate.StepFirstboot); err != nil {
+		return err
 	}
 
-	// Connect to libvirt (use session to avoid permission issues with user files)
-	internal.Status("Connecting to libvirt...")
-	conn, err := libvirt.NewConnect("qemu:///session")
+	// libvirt uses the session daemon by default to avoid permission issues with user files
+	hv, err := newHypervisor()
 	if err != nil {
-		return fmt.Errorf("failed to connect to libvirt: %v\nPlease ensure:\n1. libvirtd service is running: sudo systemctl start libvirtd\n2. User session services are available\n3. You may need to install libvirt-daemon-config-network", err)
+		return err
+	}
+	defer hv.Close()
+	if _, ok := hv.(firstBootInspector); !ok {
+		if capture != nil {
+			internal.Warning("--capture needs the libvirt backend, nothing is captured with " + hv.Name())
+			capture = nil
+		}
+		internal.Status("Disk snapshots need the libvirt backend, a failed attempt restarts the installation from the beginning")
+	}
+	if deliveries, err = supportedDeliveries(hv, deliveries); err != nil {
+		return err
 	}
-	defer conn.Close()
 
 	// Generate domain name based on vmdir
 	baseDomainName := fmt.Sprintf("bvm-firstboot-%s", filepath.Base(vmdir))
 
-	// Clean up any existing domain with this name first
-	cleanupLibvirtDomain(conn, baseDomainName)
-
-	// Generate unique domain name with timestamp for this run
-	domainName := fmt.Sprintf("%s-%d", baseDomainName, time.Now().Unix())
+	// A remote host can't see the VM directory, the ISOs and the disk are uploaded into a storage pool there
+	var storage *remoteStorage
+	if libvirtHV, ok := hv.(*libvirtHypervisor); ok && remote {
+		if err := checkHostArch(libvirtHV.conn); err != nil {
+			return err
+		}
+		storage, err = newRemoteStorage(libvirtHV.conn, baseDomainName)
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+		internal.Status("Disk snapshots are not available on a remote libvirt host, a failed attempt restarts the installation from the beginning")
+	}
 
-	// Generate domain XML with the unique name
-	domainXML, err := generateFirstBootDomainXML(vmdir, domainName)
-	if err != nil {
-		return fmt.Errorf("failed to generate domain XML: %v", err)
+	// A VM left over from an interrupted run would keep the disk open
+	if state, err := hv.State(baseDomainName); err == nil && state != vmShutoff {
+		internal.Status("Stopping VM " + baseDomainName + " left over from an earlier run...")
+		if err := hv.Destroy(baseDomainName); err != nil {
+			return fmt.Errorf("failed to stop VM %s: %v", baseDomainName, err)
+		}
 	}
 
-	internal.Debug("Generated domain XML:")
-	internal.Debug(domainXML)
+	// Failed attempts are retried from the last disk snapshot.
+	// Windows Setup only needs the answer file in WinPE, so a failure there moves on to the next delivery method.
+	recovery := newFirstBootRecovery(absVmdir)
+	recovery.storage = storage
+	from := recovery.resume()
+	delivery := 0
+	for {
+		recovery.startAttempt(from, deliveries[delivery])
+		err := runFirstBootAttempt(hv, absVmdir, baseDomainName, recovery, from, opts, capture)
+		recovery.endAttempt(err)
+		if err == nil {
+			break
+		}
+		failure, ok := err.(*installFailure)
+		if ok && failure.phase == phaseWinPE && delivery+1 < len(deliveries) {
+			delivery++
+			from = phaseWinPE
+			internal.Warning("Installation failed: " + failure.Error())
+			internal.Warning(fmt.Sprintf("Retrying with the answer file delivered by %s", deliveries[delivery]))
+			continue
+		}
+		if !ok || recovery.Retries >= internal.BVMConfig.FirstbootRetries {
+			return fmt.Errorf("error during installation monitoring: %v", err)
+		}
+		from = recovery.restartPhase()
+		internal.Warning("Installation failed: " + failure.Error())
+		internal.Warning(fmt.Sprintf("Retrying from phase %q (retry %d of %d)", installPhases[from].title, recovery.Retries+1, internal.BVMConfig.FirstbootRetries))
+	}
 
-	// Create domain
-	domain, err := conn.DomainDefineXML(domainXML)
-	if err != nil {
-		return fmt.Errorf("failed to define domain: %v", err)
+	// The installed system has to be back in disk.qcow2 before it gets mounted
+	if err := recovery.commit(); err != nil {
+		return err
 	}
 
-	// Cleanup this specific domain when done
-	defer cleanupLibvirtDomain(conn, domainName)
-	defer domain.Free()
+	// Post-installation cleanup
+	return postFirstBootCleanup(vmdir)
+}
 
-	// Start the domain
-	if err := domain.Create(); err != nil {
-		return fmt.Errorf("failed to start domain: %v", err)
+// supportedDeliveries leaves out the delivery methods whose medium the hypervisor can't attach
+func supportedDeliveries(hv Hypervisor, deliveries []unattend.DeliveryMethod) ([]unattend.DeliveryMethod, error) {
+	filter, ok := hv.(deliveryFilter)
+	if !ok {
+		return deliveries, nil
+	}
+	var supported []unattend.DeliveryMethod
+	for _, method := range deliveries {
+		if filter.SupportsDelivery(method) {
+			supported = append(supported, method)
+		} else {
+			internal.Debug(fmt.Sprintf("Skipping %s delivery, %s can't attach its medium", method, hv.Name()))
+		}
+	}
+	if len(supported) == 0 {
+		return nil, fmt.Errorf("none of the answer file delivery methods %v works with %s", deliveries, hv.Name())
 	}
+	return supported, nil
+}
 
-	internal.Status("Windows installation started. This will take several hours.")
-	internal.Status("The VM will automatically shut down when installation is complete.")
+// runFirstBootAttempt runs the installer VM once, starting from a phase on a fresh snapshot of the disk
+func runFirstBootAttempt(hv Hypervisor, vmdir string, baseDomainName string, recovery *firstBootRecovery, from installPhase, opts FirstBootOptions, capture *firstBootCapture) error {
+	diskPath, err := recovery.startDisk(from)
+	if err != nil {
+		return err
+	}
 
-	// Get SPICE port for viewer
-	spicePort, err := getSpicePort(domain)
+	// Only the medium of one delivery method is attached, Windows Setup must not find two answer files
+	delivery := recovery.delivery()
+	answerMedium, err := internal.PrepareAnswerFileMedium(vmdir, delivery)
 	if err != nil {
-		internal.Warning("Could not get SPICE port: " + err.Error())
-	} else {
-		internal.Status(fmt.Sprintf("SPICE server listening on port %d", spicePort))
-		// Launch SPICE viewer in the background
-		go launchSpiceViewer(spicePort)
+		return fmt.Errorf("failed to prepare the answer file for %s delivery: %v", delivery, err)
 	}
+	internal.Status(fmt.Sprintf("Delivering the answer file by %s", delivery))
 
-	// Monitor the domain
-	if err := monitorFirstBootProgress(domain, vmdir); err != nil {
-		return fmt.Errorf("error during installation monitoring: %v", err)
+	installerISO := filepath.Join(vmdir, "installer.iso")
+	unattendedISO := filepath.Join(vmdir, "unattended.iso")
+	if recovery.storage != nil {
+		if answerMedium, err = recovery.storage.upload(answerMedium, false); err != nil {
+			return err
+		}
+		if unattendedISO, err = recovery.storage.upload(unattendedISO, false); err != nil {
+			return err
+		}
+		// installer-iso delivery replaces installer.iso
+		if delivery != unattend.DeliveryInstallerISO {
+			if installerISO, err = recovery.storage.upload(installerISO, false); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Post-installation cleanup
-	return postFirstBootCleanup(vmdir)
-}
+	// Start with an empty progress file so old runs aren't reported again
+	if err := os.Remove(filepath.Join(vmdir, firstLoginProgressFile)); err != nil && !os.IsNotExist(err) {
+		internal.Warning("Failed to remove old first login progress: " + err.Error())
+	}
 
-// generateFirstBootDomainXML creates the libvirt domain XML for Windows installation
-func generateFirstBootDomainXML(vmdir string, domainName ...string) (string, error) {
-	// Convert vmdir to absolute path for libvirt
-	absVmdir, err := filepath.Abs(vmdir)
+	// libvirt domains get a unique name with a timestamp for every run, the other hypervisors use the name bvm list looks for
+	domainName := baseDomainName
+	if _, ok := hv.(*libvirtHypervisor); ok {
+		domainName = fmt.Sprintf("%s-%d", baseDomainName, time.Now().Unix())
+	}
+
+	// Generate domain XML with the unique name
+	domainConfig := firstBootDomainConfig{
+		diskPath:      diskPath,
+		installerISO:  installerISO,
+		unattendedISO: unattendedISO,
+		answerMethod:  delivery,
+		answerMedium:  answerMedium,
+		noGraphics:    opts.NoGraphics,
+		// The progress file and the serial log would be written on the remote host
+		noProgressLog: recovery.storage != nil,
+	}
+	if capture != nil && recovery.storage == nil {
+		domainConfig.serialLog = capture.serialLog(domainName)
+	}
+	spec, err := firstBootSpec(vmdir, domainConfig, domainName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
-	}
-
-	// Determine CPU architecture and cores
-	var arch, machine, emulator string
-	var cores int
-
-	switch runtime.GOARCH {
-	case "arm64":
-		arch = "aarch64"
-		machine = "virt"
-		emulator = "/usr/bin/qemu-system-aarch64"
-		// Handle big.LITTLE CPU optimization
-		cores = getCPUCores()
-	case "amd64":
-		arch = "x86_64"
-		machine = "q35"
-		emulator = "/usr/bin/qemu-system-x86_64"
-		cores = runtime.NumCPU()
-	default:
-		return "", fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
+		return fmt.Errorf("failed to generate domain XML: %v", err)
 	}
 
-	// Determine domain name
-	var name string
-	if len(domainName) > 0 && domainName[0] != "" {
-		name = domainName[0]
-	} else {
-		name = fmt.Sprintf("bvm-firstboot-%s", filepath.Base(vmdir))
-	}
-
-	// Build the domain configuration
-	domain := LibvirtDomainXML{
-		Type: "kvm",
-		Name: name,
-		Memory: Memory{
-			Unit:  "GiB",
-			Value: strconv.Itoa(internal.BVMConfig.VMMem),
-		},
-		CurrentMemory: Memory{
-			Unit:  "GiB",
-			Value: strconv.Itoa(internal.BVMConfig.VMMem),
-		},
-		VCPU: VCPU{
-			Placement: "static",
-			Value:     strconv.Itoa(cores),
-		},
-		OS: OS{
-			Type: OSType{
-				Arch:    arch,
-				Machine: machine,
-				Value:   "hvm",
-			},
-			Boot: []Boot{
-				{Dev: "cdrom"},
-				{Dev: "hd"},
-			},
-		},
-		Features: Features{
-			ACPI: struct{}{},
-			APIC: struct{}{},
-		},
-		CPU: CPU{
-			Mode:  "host-passthrough",
-			Check: "none",
-		},
-		Clock: Clock{
-			Offset: "localtime",
-			Timer: []Timer{
-				{Name: "rtc", Tickpolicy: "catchup"},
-				{Name: "pit", Tickpolicy: "delay"},
-				{Name: "hpet", Present: "no"},
-			},
-		},
-		OnPoweroff: "destroy",
-		OnReboot:   "restart",
-		OnCrash:    "restart",
-		Devices: Devices{
-			Emulator: emulator,
-		},
-	}
-
-	// Configure UEFI firmware for both ARM64 and x86_64
-	if runtime.GOARCH == "arm64" {
-		domain.OS.Firmware = "efi"
-		domain.OS.Loader = &Loader{
-			ReadOnly: "yes",
-			Type:     "pflash",
-			Value:    "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
-		}
-		domain.Features.GIC = &GIC{Version: "2"}
-	} else if runtime.GOARCH == "amd64" {
-		domain.OS.Firmware = "efi"
-		domain.OS.Loader = &Loader{
-			ReadOnly: "yes",
-			Type:     "pflash",
-			Value:    "/usr/share/OVMF/OVMF_CODE_4M.fd",
+	// Define and start the domain, it is cleaned up when done
+	if err := hv.Start(spec); err != nil {
+		return err
+	}
+	defer hv.Destroy(domainName)
+	defer startBalloon(hv, spec)()
+	defer startUSBWatch(hv, spec)()
+
+	var inspection firstBootInspection
+	if inspector, ok := hv.(firstBootInspector); ok {
+		if inspection, err = inspector.InspectFirstBoot(domainName, capture); err != nil {
+			return err
 		}
-		// Let libvirt handle NVRAM automatically instead of specifying a fixed path
-		// domain.OS.NVRam = &NVRam{
-		//	Value: "/usr/share/OVMF/OVMF_VARS_4M.fd",
-		// }
-	}
-
-	// Add main disk
-	domain.Devices.Disks = append(domain.Devices.Disks, Disk{
-		Type:   "file",
-		Device: "disk",
-		Driver: &DiskDriver{
-			Name:    "qemu",
-			Type:    "qcow2",
-			Cache:   "none",
-			IO:      "threads",
-			Discard: "unmap",
-		},
-		Source: &DiskSource{
-			File: filepath.Join(absVmdir, "disk.qcow2"),
-		},
-		Target: DiskTarget{
-			Dev: "vda",
-			Bus: "virtio",
-		},
-	})
-
-	// Add installer ISO as IDE CD-ROM (more reliable for older Windows Setup)
-	domain.Devices.Disks = append(domain.Devices.Disks, Disk{
-		Type:   "file",
-		Device: "cdrom",
-		Driver: &DiskDriver{
-			Name: "qemu",
-			Type: "raw",
-		},
-		Source: &DiskSource{
-			File: filepath.Join(absVmdir, "installer.iso"),
-		},
-		Target: DiskTarget{
-			Dev: "hda",
-			Bus: "ide",
-		},
-		Boot: &Boot{Dev: "cdrom"},
-	})
-
-	// Add multiple copies of unattended.iso with different bus types for maximum compatibility
-	// This helps ensure Windows Setup finds the autounattend.xml file regardless of drive letter changes
-	unattendedISOPath := filepath.Join(absVmdir, "unattended.iso")
-
-	// Primary unattended ISO as IDE (Windows Setup checks IDE drives first)
-	domain.Devices.Disks = append(domain.Devices.Disks, Disk{
-		Type:   "file",
-		Device: "cdrom",
-		Driver: &DiskDriver{
-			Name: "qemu",
-			Type: "raw",
-		},
-		Source: &DiskSource{
-			File: unattendedISOPath,
-		},
-		Target: DiskTarget{
-			Dev: "hdb",
-			Bus: "ide",
-		},
-	})
-
-	// Secondary unattended ISO as SATA (for newer systems)
-	domain.Devices.Disks = append(domain.Devices.Disks, Disk{
-		Type:   "file",
-		Device: "cdrom",
-		Driver: &DiskDriver{
-			Name: "qemu",
-			Type: "raw",
-		},
-		Source: &DiskSource{
-			File: unattendedISOPath,
-		},
-		Target: DiskTarget{
-			Dev: "sda",
-			Bus: "sata",
-		},
-	})
-
-	// Tertiary unattended ISO as SCSI (additional fallback)
-	domain.Devices.Disks = append(domain.Devices.Disks, Disk{
-		Type:   "file",
-		Device: "cdrom",
-		Driver: &DiskDriver{
-			Name: "qemu",
-			Type: "raw",
-		},
-		Source: &DiskSource{
-			File: unattendedISOPath,
-		},
-		Target: DiskTarget{
-			Dev: "sdb",
-			Bus: "scsi",
-		},
-	})
-
-	// Add floppy disk with autounattend.xml if it exists
-	floppyPath := filepath.Join(absVmdir, "autounattend.img")
-	if _, err := os.Stat(floppyPath); err == nil {
-		domain.Devices.Disks = append(domain.Devices.Disks, Disk{
-			Type:   "file",
-			Device: "floppy",
-			Driver: &DiskDriver{
-				Name: "qemu",
-				Type: "raw",
-			},
-			Source: &DiskSource{
-				File: floppyPath,
-			},
-			Target: DiskTarget{
-				Dev: "fda",
-				Bus: "fdc",
-			},
-		})
-		internal.Debug("Added autounattend.img as floppy disk")
+		// Runs before the VM is destroyed, so the capture still gets its XML
+		defer inspection.Close(delivery)
 	}
 
-	internal.Debug("Added installer.iso as IDE CD-ROM")
-	internal.Debug("Added unattended.iso with multiple bus types for reliable detection")
+	if from == phaseWinPE {
+		internal.Status("Windows installation started. This will take several hours.")
+	} else {
+		internal.Status(fmt.Sprintf("Windows installation restarted from phase %q.", installPhases[from].title))
+	}
+	internal.Status("The VM will automatically shut down when installation is complete.")
 
-	// Add controllers - support both IDE and SATA for maximum compatibility
-	if runtime.GOARCH == "amd64" {
-		domain.Devices.Controllers = []Controller{
-			{Type: "usb", Index: "0", Model: "qemu-xhci"},
-			{Type: "pci", Index: "0", Model: "pcie-root"},
-			{Type: "ide", Index: "0"},                        // IDE controller for legacy compatibility
-			{Type: "sata", Index: "0"},                       // SATA controller for modern drives
-			{Type: "scsi", Index: "0", Model: "virtio-scsi"}, // SCSI controller for additional drives
-			{Type: "fdc", Index: "0"},                        // Floppy disk controller
+	// Get SPICE port for viewer
+	if !opts.NoGraphics && recovery.storage != nil {
+		uri := internal.BVMConfig.LibvirtURI
+		if opts.Headless {
+			internal.Status(fmt.Sprintf("Watch the installation with: virt-viewer --connect %s %s", uri, domainName))
+		} else {
+			go launchRemoteViewer(uri, domainName)
 		}
-	} else {
-		domain.Devices.Controllers = []Controller{
-			{Type: "usb", Index: "0", Model: "qemu-xhci"},
-			{Type: "pci", Index: "0", Model: "pci-root"},
-			{Type: "ide", Index: "0"},                        // IDE controller for legacy compatibility
-			{Type: "sata", Index: "0"},                       // SATA controller for modern drives
-			{Type: "scsi", Index: "0", Model: "virtio-scsi"}, // SCSI controller for additional drives
-			{Type: "fdc", Index: "0"},                        // Floppy disk controller
+	} else if !opts.NoGraphics {
+		spicePort, err := hv.SpicePort(domainName)
+		if err != nil {
+			internal.Warning("Could not get SPICE port: " + err.Error())
+		} else if opts.Headless {
+			internal.Status(fmt.Sprintf("SPICE server listening on 127.0.0.1:%d, forward it over SSH to watch the installation", spicePort))
+		} else {
+			internal.Status(fmt.Sprintf("SPICE server listening on port %d", spicePort))
+			// Launch SPICE viewer in the background
+			go launchSpiceViewer(spicePort)
 		}
 	}
 
-	// Add network interface
-	domain.Devices.Interfaces = []Interface{
-		{
-			Type:  "user",
-			Model: &InterfaceModel{Type: "virtio"},
-		},
-	}
-
-	// Add graphics (GTK for direct window display)
-	domain.Devices.Graphics = []Graphics{
-		{
-			Type:     "spice",
-			Port:     "-1",
-			AutoPort: "yes",
-			Listen:   "127.0.0.1",
-		},
-	}
-
-	// Add video device
-	domain.Devices.Videos = []Video{
-		{
-			Model: VideoModel{
-				Type:    "virtio",
-				VRam:    "16384",
-				Heads:   "1",
-				Primary: "yes",
-			},
-		},
-	}
-
-	// Add input devices
-	domain.Devices.Inputs = []Input{
-		{Type: "keyboard", Bus: "usb"},
-		{Type: "tablet", Bus: "usb"},
-	}
-
-	// Add channels for SPICE guest agent
-	domain.Devices.Channels = []Channel{
-		{
-			Type: "spicevmc",
-			Target: &ChannelTarget{
-				Type: "virtio",
-				Name: "com.redhat.spice.0",
-			},
-		},
-	}
-
-	// Add RNG device
-	domain.Devices.RNGs = []RNG{
-		{
-			Model: "virtio",
-			Backend: RNGBackend{
-				Model: "random",
-				Value: "/dev/urandom",
-			},
-		},
-	}
-
-	// Add sound device (commented out due to audio backend issues in libvirt)
-	// domain.Devices.Sounds = []Sound{
-	//	{Model: "ich9"},
-	// }
-
-	// Add memory balloon
-	domain.Devices.MemBalloon = &MemBalloon{Model: "virtio"}
-
-	// Marshal to XML
-	xmlData, err := xml.MarshalIndent(domain, "", "  ")
+	return monitorFirstBootProgress(hv, domainName, inspection, vmdir, recovery, from, capture)
+}
+
+// firstBootDomainConfig holds what differs between firstboot attempts
+type firstBootDomainConfig struct {
+	// diskPath is the image to install to, disk.qcow2 in the VM directory if empty
+	diskPath string
+	// installerISO and unattendedISO are the files in the VM directory if empty
+	installerISO  string
+	unattendedISO string
+	// answerMethod is how autounattend.xml reaches Windows Setup and answerMedium the image that carries it
+	answerMethod unattend.DeliveryMethod
+	answerMedium string
+	// serialLog receives the serial console if set
+	serialLog string
+	// noGraphics leaves out the SPICE server, the guest still gets a video device
+	noGraphics bool
+	// noProgressLog leaves out the channel firstlogin.ps1 reports its progress through
+	noProgressLog bool
+}
+
+// generateFirstBootDomainXML creates the libvirt domain XML for Windows installation
+func generateFirstBootDomainXML(vmdir string, cfg firstBootDomainConfig, domainName ...string) (string, error) {
+	spec, err := firstBootSpec(vmdir, cfg, domainName...)
 	if err != nil {
 		return "", err
 	}
+	return spec.libvirtDomainXML()
+}
 
-	return xml.Header + string(xmlData), nil
+// firstBootWatchdogModel returns the watchdog device configured in [firstboot], empty for none
+func firstBootWatchdogModel() string {
+	switch model := internal.BVMConfig.FirstbootWatchdog; model {
+	case "none":
+		return ""
+	case "auto", "":
+		// Neither watchdog is available to Windows on ARM, the disk I/O check has to catch hangs there
+		if runtime.GOARCH == "amd64" {
+			return "i6300esb"
+		}
+		return ""
+	case "itco":
+		if runtime.GOARCH != "amd64" {
+			internal.Warning("The itco watchdog only exists on x86_64, not adding a watchdog")
+			return ""
+		}
+		return model
+	default:
+		return model
+	}
 }
 
 // getCPUCores determines optimal CPU cores, handling big.LITTLE architectures
@@ -727,140 +422,246 @@ func getCPUCores() int {
 	return runtime.NumCPU()
 }
 
-// detectWindowsEditionAndKey detects the Windows edition from ISO and returns appropriate KMS client key
-func detectWindowsEditionAndKey(vmdir string) (string, error) {
-	// Official Microsoft KMS Client Setup Keys
-	// https://docs.microsoft.com/en-us/windows-server/get-started/kms-client-activation-keys
-	editionKeys := map[string]string{
-		// Windows 11
-		"Windows 11 Pro":                    "W269N-WFGWX-YVC9B-4J6C9-T83GX",
-		"Windows 11 Pro N":                  "MH37W-N47XK-V7XM9-C7227-GCQG9",
-		"Windows 11 Pro for Workstations":   "NRG8B-VKK3Q-CXVCJ-9G2XF-6Q84J",
-		"Windows 11 Pro for Workstations N": "9FNHH-K3HBT-3W4TD-6383H-6XYWF",
-		"Windows 11 Pro Education":          "6TP4R-GNPTD-KYYHQ-7B7DP-J447Y",
-		"Windows 11 Pro Education N":        "YVWGF-BXNMC-HTQYQ-CPQ99-66QFC",
-		"Windows 11 Education":              "NW6C2-QMPVW-D7KKK-3GKT6-VCFB2",
-		"Windows 11 Education N":            "2WH4N-8QGBV-H22JP-CT43Q-MDWWJ",
-		"Windows 11 Enterprise":             "NPPR9-FWDCX-D2C8J-H872K-2YT43",
-		"Windows 11 Enterprise N":           "DPH2V-TTNVB-4X9Q3-TJR4H-KHJW4",
-		"Windows 11 Enterprise G":           "YYVX9-NTFWV-6MDM3-9PT4T-4M68B",
-		"Windows 11 Enterprise G N":         "44RPN-FTY23-9VTTB-MP9BX-T84FV",
-
-		// Windows 10
-		"Windows 10 Pro":                    "W269N-WFGWX-YVC9B-4J6C9-T83GX",
-		"Windows 10 Pro N":                  "MH37W-N47XK-V7XM9-C7227-GCQG9",
-		"Windows 10 Pro for Workstations":   "NRG8B-VKK3Q-CXVCJ-9G2XF-6Q84J",
-		"Windows 10 Pro for Workstations N": "9FNHH-K3HBT-3W4TD-6383H-6XYWF",
-		"Windows 10 Pro Education":          "6TP4R-GNPTD-KYYHQ-7B7DP-J447Y",
-		"Windows 10 Pro Education N":        "YVWGF-BXNMC-HTQYQ-CPQ99-66QFC",
-		"Windows 10 Education":              "NW6C2-QMPVW-D7KKK-3GKT6-VCFB2",
-		"Windows 10 Education N":            "2WH4N-8QGBV-H22JP-CT43Q-MDWWJ",
-		"Windows 10 Enterprise":             "NPPR9-FWDCX-D2C8J-H872K-2YT43",
-		"Windows 10 Enterprise N":           "DPH2V-TTNVB-4X9Q3-TJR4H-KHJW4",
-		"Windows 10 Enterprise G":           "YYVX9-NTFWV-6MDM3-9PT4T-4M68B",
-		"Windows 10 Enterprise G N":         "44RPN-FTY23-9VTTB-MP9BX-T84FV",
-		"Windows 10 Enterprise LTSC 2019":   "M7XTQ-FN8P6-TTKYV-9D4CC-J462D",
-		"Windows 10 Enterprise LTSC 2021":   "M7XTQ-FN8P6-TTKYV-9D4CC-J462D",
-
-		// Windows Server editions (in case someone uses those)
-		"Windows Server 2019 Standard":   "N69G4-B89J2-4G8F4-WWYCC-J464C",
-		"Windows Server 2019 Datacenter": "WMDGN-G9PQG-XVVXX-R3X43-63DFG",
-		"Windows Server 2022 Standard":   "VDYBN-27WPP-V4HQT-9VMD4-VMK7H",
-		"Windows Server 2022 Datacenter": "WX4NM-KYWYW-QJJR4-XV3QB-6VM33",
-	}
+// monitorFirstBootProgress follows the installation through its phases until the VM shuts down.
+// Phases are detected from guest reboots and the progress sent by firstlogin.ps1, and with an inspection from
+// disk writes and the guest agent too. Crashes and a firing watchdog are returned as an installFailure so the
+// attempt can be retried. An inspection also snapshots the disk whenever the guest reboots into a new phase,
+// fails a guest without disk I/O for too long and, with --capture, takes a screenshot every screenshotInterval
+// and when the attempt fails. inspection is nil for hypervisors that can't look inside the VM.
+func monitorFirstBootProgress(hv Hypervisor, name string, inspection firstBootInspection, vmdir string, recovery *firstBootRecovery, from installPhase, capture *firstBootCapture) error {
+	internal.Status("Monitoring installation progress...")
 
-	installerISO := filepath.Join(vmdir, "installer.iso")
-	if _, err := os.Stat(installerISO); os.IsNotExist(err) {
-		return "", fmt.Errorf("installer.iso not found in %s", vmdir)
+	started := time.Now()
+	tracker := newPhaseTracker(vmdir, started)
+	tracker.resume(from)
+
+	updates := make(chan firstBootUpdate, 16)
+	viewDone := make(chan struct{})
+	go func() {
+		showFirstBootProgress(updates, started, tracker.timings)
+		close(viewDone)
+	}()
+
+	// VM events and guest progress arrive on other goroutines, the tracker is only touched by the loop below
+	var vmEvents <-chan vmEvent
+	lifecycle := false
+	if source, ok := hv.(vmEventSource); ok {
+		if watcher, err := source.WatchEvents(name); err != nil {
+			internal.Debug("No VM events: " + err.Error())
+		} else {
+			defer watcher.Close()
+			vmEvents = watcher.Events()
+			lifecycle = watcher.Lifecycle()
+		}
 	}
+	events := make(chan provision.ProgressEvent, 64)
 
-	// Try to detect Windows edition from ISO
-	// First try install.wim, then install.esd
-	mountPoint := "/tmp/bvm_iso_detect"
-	os.MkdirAll(mountPoint, 0755)
-	defer os.RemoveAll(mountPoint)
+	stopTail := make(chan struct{})
+	tailDone := make(chan struct{})
+	go func() {
+		tailFirstLoginProgress(filepath.Join(vmdir, firstLoginProgressFile), stopTail, func(event provision.ProgressEvent) {
+			select {
+			case events <- event:
+			default:
+				internal.Debug("Dropped first login progress: " + event.Message)
+			}
+		})
+		close(tailDone)
+	}()
+
+	sendEvent := func(event provision.ProgressEvent) {
+		tracker.progressEvent(event, time.Now())
+		update := tracker.snapshot(time.Now())
+		update.event = &event
+		if event.Kind == provision.ProgressDelivery {
+			update.warning = checkAnswerFileDelivery(vmdir, recovery.delivery(), event.Message)
+		}
+		updates <- update
+	}
 
-	// Mount ISO
-	cmd := exec.Command("sudo", "mount", "-r", installerISO, mountPoint)
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to mount ISO: %v", err)
+	// finish stops the helpers, passes on the last progress and waits for the view to close
+	finish := func(err error) error {
+		// The screen at the moment of failure is the most useful one
+		if err != nil && capture != nil && inspection != nil {
+			if shotErr := inspection.Screenshot(time.Now()); shotErr != nil {
+				internal.Debug("Screenshot failed: " + shotErr.Error())
+			}
+		}
+		close(stopTail)
+		<-tailDone
+		for drained := false; !drained; {
+			select {
+			case event := <-events:
+				sendEvent(event)
+			default:
+				drained = true
+			}
+		}
+		close(updates)
+		<-viewDone
+		return err
 	}
-	defer exec.Command("sudo", "umount", mountPoint).Run()
 
-	// Check for install.wim first, then install.esd
-	var wimFile string
-	installWim := filepath.Join(mountPoint, "sources", "install.wim")
-	installEsd := filepath.Join(mountPoint, "sources", "install.esd")
+	// completed records the phase timings once the guest has shut itself down
+	completed := func(now time.Time) error {
+		tracker.finish(vmdir, now)
+		err := finish(nil)
+		internal.Status(fmt.Sprintf("Installation completed after %s - VM has shut down", formatDuration(now.Sub(started))))
+		return err
+	}
 
-	if _, err := os.Stat(installWim); err == nil {
-		wimFile = installWim
-	} else if _, err := os.Stat(installEsd); err == nil {
-		wimFile = installEsd
-	} else {
-		return "", fmt.Errorf("neither install.wim nor install.esd found in ISO")
+	// checkState polls the VM state, used when the events don't tell when the VM stops
+	checkState := func(now time.Time) (bool, error) {
+		state, err := hv.State(name)
+		if err != nil {
+			return true, finish(fmt.Errorf("failed to get VM state: %v", err))
+		}
+		switch state {
+		case vmShutoff:
+			return true, completed(now)
+		case vmCrashed:
+			return true, finish(&installFailure{phase: tracker.phase, reason: "VM crashed"})
+		case vmPaused:
+			// Nothing in firstboot pauses the VM, the watchdog fired or QEMU hit a disk error
+			return true, finish(&installFailure{phase: tracker.phase, reason: "VM paused by the watchdog or a disk error"})
+		}
+		return false, nil
 	}
 
-	// Use wiminfo to get Windows edition
-	cmd = exec.Command("wiminfo", wimFile)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to run wiminfo: %v", err)
+	// The VM may have stopped before its events were watched
+	if done, err := checkState(time.Now()); done {
+		return err
 	}
 
-	// Parse wiminfo output to find Windows edition name
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "Name:") {
-			editionName := strings.TrimSpace(strings.TrimPrefix(line, "Name:"))
-			fmt.Printf("Detected Windows edition: %s\n", editionName)
+	var lastWritten int64 = -1
+	var lastSample, lastAgentCheck time.Time
 
-			// Look up the product key for this edition
-			if key, exists := editionKeys[editionName]; exists {
-				fmt.Printf("Using KMS client key for %s: %s\n", editionName, key)
-				return key, nil
-			} else {
-				fmt.Printf("Warning: No specific key found for %s, using Windows 10/11 Pro key as fallback\n", editionName)
-				return "W269N-WFGWX-YVC9B-4J6C9-T83GX", nil // Fallback to Pro key
+	// A guest that neither reads nor writes its disk for this long is considered stuck
+	stallTimeout := time.Duration(internal.BVMConfig.FirstbootStallTimeout) * time.Minute
+	var lastIO int64 = -1
+	lastIOChange := started
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-vmEvents:
+			if !ok {
+				// The hypervisor process exited, the next state poll tells how
+				vmEvents = nil
+				continue
+			}
+			now := time.Now()
+			var snapshotErr error
+			if event.kind == vmEventReboot && tracker.reboot(now) && inspection != nil {
+				snapshotErr = inspection.Snapshot(recovery, tracker.phase)
 			}
+			update := tracker.snapshot(now)
+			update.vmEvent = &event
+			if snapshotErr != nil {
+				update.warning = "Failed to snapshot the disk, a retry will start from an earlier phase: " + snapshotErr.Error()
+			}
+			updates <- update
+
+			switch event.kind {
+			case vmEventShutdown:
+				return completed(now)
+			case vmEventFailed:
+				return finish(&installFailure{phase: tracker.phase, reason: "VM stopped unexpectedly"})
+			case vmEventStopped:
+				// Destroyed from outside, most likely on purpose
+				return finish(fmt.Errorf("VM stopped during installation: %s", event))
+			case vmEventCrashed:
+				return finish(&installFailure{phase: tracker.phase, reason: "VM crashed"})
+			case vmEventWatchdog:
+				return finish(&installFailure{phase: tracker.phase, reason: "watchdog fired"})
+			case vmEventDiskError:
+				if event.paused {
+					// The guest won't get any further on its own
+					return finish(fmt.Errorf("VM paused after a disk I/O error: %s", event))
+				}
+			}
+			continue
+		case event := <-events:
+			sendEvent(event)
+			continue
+		case <-ticker.C:
 		}
-	}
 
-	return "", fmt.Errorf("could not detect Windows edition from ISO")
-}
+		now := time.Now()
 
-// monitorFirstBootProgress monitors the installation process
-func monitorFirstBootProgress(domain *libvirt.Domain, vmdir string) error {
-	internal.Status("Monitoring installation progress...")
+		if !lifecycle {
+			if done, err := checkState(now); done {
+				return err
+			}
+		}
 
-	for {
-		// Check domain state
-		state, _, err := domain.GetState()
-		if err != nil {
-			return fmt.Errorf("failed to get domain state: %v", err)
+		if inspection == nil {
+			updates <- tracker.snapshot(now)
+			continue
 		}
 
-		switch state {
-		case libvirt.DOMAIN_SHUTOFF:
-			internal.Status("Installation completed - VM has shut down")
-			return nil
-		case libvirt.DOMAIN_CRASHED:
-			return fmt.Errorf("VM crashed during installation")
-		case libvirt.DOMAIN_RUNNING:
-			// Continue monitoring
-		default:
-			internal.Debug(fmt.Sprintf("Domain state: %d", state))
+		// Windows Setup writes heavily while copying files, the rate is shown next to the phase
+		if read, written, err := inspection.DiskIO(); err == nil {
+			if lastWritten >= 0 {
+				tracker.writeRate = float64(written-lastWritten) / now.Sub(lastSample).Seconds()
+			}
+			lastWritten = written
+			lastSample = now
+
+			if total := read + written; total != lastIO {
+				lastIO = total
+				lastIOChange = now
+			} else if stallTimeout > 0 && now.Sub(lastIOChange) >= stallTimeout {
+				return finish(&installFailure{phase: tracker.phase, reason: fmt.Sprintf("no disk I/O for %s", formatDuration(now.Sub(lastIOChange)))})
+			}
+		}
+
+		if capture != nil && capture.screenshotDue(now) {
+			if err := inspection.Screenshot(now); err != nil {
+				internal.Debug("Screenshot failed: " + err.Error())
+			}
 		}
 
-		// Wait before next check
-		time.Sleep(30 * time.Second)
+		// The guest agent is installed by firstlogin.ps1, once it answers the first login has started
+		if tracker.phase < phaseFirstLogin && now.Sub(lastAgentCheck) >= 30*time.Second {
+			lastAgentCheck = now
+			if inspection.AgentRunning() {
+				tracker.advance(phaseFirstLogin, now)
+			}
+		}
+
+		updates <- tracker.snapshot(now)
+	}
+}
+
+// checkAnswerFileDelivery records the delivery method the guest reported and returns a warning if it is not the expected one
+func checkAnswerFileDelivery(vmdir string, expected unattend.DeliveryMethod, reported string) string {
+	method, err := unattend.ParseDeliveryMethod(reported)
+	if err != nil {
+		return "Guest reported an unknown answer file delivery: " + err.Error()
+	}
+	if err := internal.RecordAnswerFileDelivery(vmdir, method); err != nil {
+		return err.Error()
 	}
+	if method != expected {
+		return fmt.Sprintf("Windows Setup read the answer file delivered by %s, but %s was attached", method, expected)
+	}
+	return ""
 }
 
 // postFirstBootCleanup handles post-installation tasks
 func postFirstBootCleanup(vmdir string) error {
 	internal.Status("Running post-installation cleanup...")
 
+	// Report packages that failed to install during the first login
+	if len(internal.BVMConfig.ProvisionWingetPackages) > 0 || len(internal.BVMConfig.ProvisionChocoPackages) > 0 {
+		if err := reportPackageResults(vmdir); err != nil {
+			internal.Warning("Failed to read package installation results: " + err.Error())
+		}
+	}
+
 	// Mount disk and remove Microsoft Defender if debloat is enabled
 	if internal.BVMConfig.Debloat {
 		if err := removeMicrosoftDefender(vmdir); err != nil {
@@ -870,42 +671,14 @@ func postFirstBootCleanup(vmdir string) error {
 		}
 	}
 
-	// Update GUI steps completion
-	stepsFile := filepath.Join(vmdir, "gui-steps-complete")
-	if err := os.WriteFile(stepsFile, []byte("5"), 0644); err != nil {
-		internal.Warning("Failed to update GUI steps completion: " + err.Error())
+	if err := vmstate.Record(vmdir, vmstate.Installed, vmstate.StepFirstboot, "disk.qcow2", firstBootRecoveryFile, firstBootTimingsFile); err != nil {
+		internal.Warning("Failed to update state.json: " + err.Error())
 	}
 
 	internal.StatusGreen("You should now be ready for the next step: bvm boot " + vmdir)
 	return nil
 }
 
-// getSpicePort retrieves the SPICE port from a running domain
-func getSpicePort(domain *libvirt.Domain) (int, error) {
-	xmlDesc, err := domain.GetXMLDesc(0)
-	if err != nil {
-		return 0, err
-	}
-
-	// Parse XML to find SPICE port - simplified approach
-	// In practice, you'd want to use proper XML parsing
-	lines := strings.Split(xmlDesc, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "graphics type='spice'") && strings.Contains(line, "port=") {
-			// Extract port number from the line
-			portStart := strings.Index(line, "port='") + 6
-			portEnd := strings.Index(line[portStart:], "'")
-			if portEnd > 0 {
-				port, err := strconv.Atoi(line[portStart : portStart+portEnd])
-				if err == nil {
-					return port, nil
-				}
-			}
-		}
-	}
-	return 5900, fmt.Errorf("could not find SPICE port in domain XML")
-}
-
 // launchSpiceViewer launches a SPICE viewer to connect to the VM
 func launchSpiceViewer(port int) {
 	internal.Status("Launching SPICE viewer...")
@@ -932,6 +705,47 @@ func launchSpiceViewer(port int) {
 	internal.Status(fmt.Sprintf("You can manually connect using: remote-viewer spice://127.0.0.1:%d", port))
 }
 
+// reportPackageResults mounts the disk and reports the package results logged by firstlogin.ps1
+func reportPackageResults(vmdir string) error {
+	diskPath := filepath.Join(vmdir, "disk.qcow2")
+
+	if err := internal.MountQcow2(diskPath); err != nil {
+		return fmt.Errorf("failed to mount disk: %v", err)
+	}
+	defer internal.UnmountQcow2("")
+
+	mountPoint := internal.GetMountPoint()
+	if mountPoint == "" {
+		return fmt.Errorf("failed to get mount point")
+	}
+
+	log, err := os.ReadFile(filepath.Join(mountPoint, provision.LogFile))
+	if err != nil {
+		return fmt.Errorf("failed to read first login log: %v", err)
+	}
+
+	results := provision.ParsePackageResults(log)
+	if len(results) == 0 {
+		return fmt.Errorf("no package results found in the first login log")
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Failed() {
+			failed++
+			internal.ErrorNoExit(fmt.Sprintf("Package %s failed to install (%s): %s", result.ID, result.Source, result.Detail))
+		} else {
+			internal.Debug(fmt.Sprintf("Package %s installed from %s", result.ID, result.Source))
+		}
+	}
+	if failed > 0 {
+		internal.Warning(fmt.Sprintf("%d of %d packages failed to install, see C:\\Windows\\Temp\\firstlogin_log.txt in the VM for details", failed, len(results)))
+	} else {
+		internal.StatusGreen(fmt.Sprintf("All %d packages installed successfully", len(results)))
+	}
+	return nil
+}
+
 // removeMicrosoftDefender mounts the disk and removes Defender files
 func removeMicrosoftDefender(vmdir string) error {
 	diskPath := filepath.Join(vmdir, "disk.qcow2")
@@ -1009,8 +823,8 @@ func cleanupSingleDomain(domain *libvirt.Domain, domainName string) {
 		// Continue with cleanup anyway
 	}
 
-	// Destroy the domain if it's still running
-	if err == nil && state == libvirt.DOMAIN_RUNNING {
+	// Destroy the domain if it's still running, or paused by the watchdog
+	if err == nil && state != libvirt.DOMAIN_SHUTOFF {
 		internal.Status("Stopping domain " + domainName + "...")
 		if err := domain.Destroy(); err != nil {
 			internal.Warning("Failed to stop domain during cleanup: " + err.Error())
@@ -1036,153 +850,3 @@ func cleanupSingleDomain(domain *libvirt.Domain, domainName string) {
 
 	internal.Status("Domain " + domainName + " cleaned up successfully")
 }
-
-// createBootDriveAutounattend creates autounattend.xml directly on Windows installer boot drive
-// This helps ensure newer Windows Setup versions can find the file
-func createBootDriveAutounattend(vmdir string) error {
-	internal.Status("Creating enhanced autounattend.xml for newer Windows Setup...")
-
-	// Read the existing autounattend.xml
-	unattendedPath := filepath.Join(vmdir, "unattended", "autounattend.xml")
-	xmlContent, err := os.ReadFile(unattendedPath)
-	if err != nil {
-		return fmt.Errorf("failed to read autounattend.xml: %v", err)
-	}
-
-	// Create a temporary directory to mount the installer ISO
-	tempMount, err := os.MkdirTemp("", "bvm-iso-modify-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temp directory: %v", err)
-	}
-	defer os.RemoveAll(tempMount)
-
-	installerISO := filepath.Join(vmdir, "installer.iso")
-
-	// Create a working copy of the installer ISO
-	modifiedISO := filepath.Join(vmdir, "installer-modified.iso")
-	internal.Status("Creating modified installer ISO with embedded autounattend.xml...")
-
-	// Extract the ISO to temporary directory
-	cmd := exec.Command("7z", "x", installerISO, "-o"+tempMount, "-y")
-	if err := cmd.Run(); err != nil {
-		// Fallback to mount method
-		cmd = exec.Command("sudo", "mount", "-r", installerISO, tempMount)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to extract/mount installer ISO: %v", err)
-		}
-		defer exec.Command("sudo", "umount", tempMount).Run()
-
-		// Copy ISO contents to a writable directory
-		tempWork, err := os.MkdirTemp("", "bvm-iso-work-*")
-		if err != nil {
-			return fmt.Errorf("failed to create work directory: %v", err)
-		}
-		defer os.RemoveAll(tempWork)
-
-		cmd = exec.Command("cp", "-r", tempMount+"/.", tempWork)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to copy ISO contents: %v", err)
-		}
-		tempMount = tempWork
-	}
-
-	// Place autounattend.xml in multiple locations for maximum compatibility
-	locations := []string{
-		"autounattend.xml",             // Root of ISO
-		"sources/autounattend.xml",     // sources directory
-		"$OEM$/$1/autounattend.xml",    // OEM folder
-		"$OEM$/$$/$1/autounattend.xml", // Alternative OEM location
-	}
-
-	for _, location := range locations {
-		fullPath := filepath.Join(tempMount, location)
-
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
-			internal.Warning("Failed to create directory for " + location + ": " + err.Error())
-			continue
-		}
-
-		// Write the autounattend.xml file
-		if err := os.WriteFile(fullPath, xmlContent, 0644); err != nil {
-			internal.Warning("Failed to write autounattend.xml to " + location + ": " + err.Error())
-		} else {
-			internal.Debug("Added autounattend.xml to " + location)
-		}
-	}
-
-	// Create new ISO with embedded autounattend.xml
-	cmd = exec.Command("genisoimage", "-o", modifiedISO, "-b", "boot/etfsboot.com", "-no-emul-boot",
-		"-boot-load-size", "8", "-boot-info-table", "-iso-level", "2", "-udf", "-joliet",
-		"-D", "-N", "-relaxed-filenames", "-allow-leading-dots", "-allow-multidot",
-		"-V", "BVM_WIN11_SETUP", tempMount)
-
-	if err := cmd.Run(); err != nil {
-		internal.Warning("Failed to create modified ISO, using original: " + err.Error())
-		return nil // Don't fail the entire process
-	}
-
-	// Replace original with modified (backup original first)
-	backupISO := filepath.Join(vmdir, "installer-original.iso")
-	if err := os.Rename(installerISO, backupISO); err != nil {
-		internal.Warning("Failed to backup original ISO: " + err.Error())
-		return nil
-	}
-
-	if err := os.Rename(modifiedISO, installerISO); err != nil {
-		// Restore original if move fails
-		os.Rename(backupISO, installerISO)
-		return fmt.Errorf("failed to replace installer ISO: %v", err)
-	}
-
-	internal.StatusGreen("Successfully created enhanced installer ISO with embedded autounattend.xml")
-	return nil
-}
-
-// createAutounattendFloppy creates a floppy disk image with autounattend.xml
-// This provides an additional method for Windows Setup to find the unattended file
-func createAutounattendFloppy(vmdir string) error {
-	internal.Status("Creating autounattend.xml floppy disk as additional fallback...")
-
-	floppyPath := filepath.Join(vmdir, "autounattend.img")
-	unattendedPath := filepath.Join(vmdir, "unattended", "autounattend.xml")
-
-	// Create a 1.44MB floppy disk image
-	cmd := exec.Command("dd", "if=/dev/zero", "of="+floppyPath, "bs=1024", "count=1440")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create floppy image: %v", err)
-	}
-
-	// Format as FAT12 filesystem
-	cmd = exec.Command("mkfs.fat", "-F", "12", "-n", "AUTOUNATTEND", floppyPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to format floppy image: %v", err)
-	}
-
-	// Mount the floppy image temporarily
-	tempMount, err := os.MkdirTemp("", "bvm-floppy-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temp mount point: %v", err)
-	}
-	defer os.RemoveAll(tempMount)
-
-	// Mount the floppy
-	cmd = exec.Command("sudo", "mount", "-o", "loop", floppyPath, tempMount)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to mount floppy image: %v", err)
-	}
-	defer exec.Command("sudo", "umount", tempMount).Run()
-
-	// Copy autounattend.xml to the floppy
-	cmd = exec.Command("sudo", "cp", unattendedPath, filepath.Join(tempMount, "autounattend.xml"))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy autounattend.xml to floppy: %v", err)
-	}
-
-	// Set proper permissions
-	cmd = exec.Command("sudo", "chmod", "644", filepath.Join(tempMount, "autounattend.xml"))
-	cmd.Run() // Ignore errors for this
-
-	internal.StatusGreen("Created autounattend floppy disk: " + floppyPath)
-	return nil
-}
@@ -0,0 +1,294 @@
+package cli
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/registry"
+	"github.com/pi-apps-go/bvm-go/pkg/vmstate"
+)
+
+// vmInfo is what bvm list and manage-vms-cli show about a registered VM
+type vmInfo struct {
+	registry.VM
+	// State is running, missing, or how far the setup got
+	State string
+	// MemoryGiB is vm_mem of the VM, 0 when bvm picks it from the RAM of the host
+	MemoryGiB int
+	RdpPort   int
+	// DiskUsage is what the files of the VM directory take up on disk, in bytes
+	DiskUsage int64
+}
+
+// setupState describes how far the setup of a VM directory got, from its state.json
+func setupState(vmdir string) string {
+	state, err := vmstate.Load(vmdir)
+	if err != nil {
+		return "unknown"
+	}
+	if state.State == vmstate.Failed {
+		return "failed (" + state.FailedStep + ")"
+	}
+	return string(state.State)
+}
+
+// dirDiskUsage adds up the blocks the files in a directory use, disk images are sparse so their size would mislead
+func dirDiskUsage(dir string) int64 {
+	var usage int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			usage += stat.Blocks * 512
+		} else {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return usage
+}
+
+// formatBytes formats a size in bytes for a table
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.0f MiB", float64(size)/(1<<20))
+	default:
+		return fmt.Sprintf("%d KiB", size/1024)
+	}
+}
+
+// vmRunningCheck returns a function that reports whether the VM of a VM directory runs, and one to close what it uses.
+// Xen needs root to list guests, so VMs on Xen are never reported as running.
+func vmRunningCheck() (func(vmdir string) bool, func()) {
+	switch internal.BVMConfig.Virtualization {
+	case "qemu-direct":
+		hv := newQemuHypervisor()
+		return func(vmdir string) bool {
+			for _, name := range qemuVMNames(vmdir) {
+				if state, err := hv.State(name); err == nil && state != vmShutoff {
+					return true
+				}
+			}
+			return false
+		}, func() {}
+	case "xen":
+		return func(string) bool { return false }, func() {}
+	}
+
+	conn, err := connectLibvirt()
+	if err != nil {
+		internal.Debug("Not checking which VMs run: " + err.Error())
+		return func(string) bool { return false }, func() {}
+	}
+	return func(vmdir string) bool {
+		domains, err := vmDomains(conn, vmdir)
+		if err != nil {
+			return false
+		}
+		for _, domain := range domains {
+			domain.Free()
+		}
+		return len(domains) > 0
+	}, func() { conn.Close() }
+}
+
+// listVMs reads the registry and looks at every VM directory in it
+func listVMs() ([]vmInfo, error) {
+	vmRegistry, err := registry.LoadDefault()
+	if err != nil {
+		return nil, err
+	}
+	running, closeCheck := vmRunningCheck()
+	defer closeCheck()
+
+	var vms []vmInfo
+	for _, vm := range vmRegistry.VMs {
+		info := vmInfo{VM: vm, RdpPort: 3389}
+		if _, err := os.Stat(vm.Path); err != nil {
+			info.State = "missing"
+			vms = append(vms, info)
+			continue
+		}
+
+		// Every VM directory has its own copy of bvm-config.toml
+		var config internal.TOMLConfig
+		if _, err := toml.DecodeFile(filepath.Join(vm.Path, "bvm-config.toml"), &config); err != nil {
+			internal.Debug(fmt.Sprintf("Failed to read the config of %s: %v", vm.Name, err))
+		}
+		info.MemoryGiB = config.Config.VMMem.VMMem
+		if config.Config.RdpPort.RdpPort != 0 {
+			info.RdpPort = config.Config.RdpPort.RdpPort
+		}
+		info.DiskUsage = dirDiskUsage(vm.Path)
+		if running(vm.Path) {
+			info.State = "running"
+		} else {
+			info.State = setupState(vm.Path)
+		}
+		vms = append(vms, info)
+	}
+	return vms, nil
+}
+
+// ListVMs prints the VMs of the registry
+func ListVMs() error {
+	vms, err := listVMs()
+	if err != nil {
+		return err
+	}
+	if len(vms) == 0 {
+		internal.Status("No VMs yet. Create one with 'bvm new-vm ~/win11', or add an existing VM directory in 'bvm manage-vms-cli'.")
+		return nil
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tPATH\tSTATE\tRAM\tDISK\tRDP PORT")
+	for _, vm := range vms {
+		memory := "auto"
+		if vm.MemoryGiB > 0 {
+			memory = fmt.Sprintf("%d GiB", vm.MemoryGiB)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\n", vm.Name, vm.Path, vm.State, memory, formatBytes(vm.DiskUsage), vm.RdpPort)
+	}
+	return table.Flush()
+}
+
+// addVM registers an existing VM directory
+func addVM(path string) (*registry.VM, error) {
+	if _, err := os.Stat(filepath.Join(path, "bvm-config.toml")); err != nil {
+		return nil, fmt.Errorf("%s is not a VM directory, it has no bvm-config.toml", path)
+	}
+	return registry.Register(path)
+}
+
+// renameVM changes the name of a VM in the registry, the directory is not moved
+func renameVM(name string, newName string) error {
+	vmRegistry, err := registry.LoadDefault()
+	if err != nil {
+		return err
+	}
+	if err := vmRegistry.Rename(name, strings.TrimSpace(newName)); err != nil {
+		return err
+	}
+	return vmRegistry.Save()
+}
+
+// deleteVM removes a VM from the registry, and its directory too if removeFiles is set
+func deleteVM(name string, removeFiles bool) error {
+	vmRegistry, err := registry.LoadDefault()
+	if err != nil {
+		return err
+	}
+	vm := vmRegistry.Find(name)
+	if vm == nil {
+		return fmt.Errorf("no VM is called %s", name)
+	}
+	path := vm.Path
+
+	if _, err := os.Stat(path); removeFiles && err == nil {
+		running, closeCheck := vmRunningCheck()
+		isRunning := running(path)
+		closeCheck()
+		if isRunning {
+			return fmt.Errorf("%s is running, shut it down first", name)
+		}
+		// Only ever remove what looks like a VM directory
+		if _, err := os.Stat(filepath.Join(path, "bvm-config.toml")); err != nil {
+			return fmt.Errorf("%s has no bvm-config.toml, not removing it", path)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+	}
+
+	if err := vmRegistry.Remove(name); err != nil {
+		return err
+	}
+	return vmRegistry.Save()
+}
+
+// rdpPortPattern finds the rdp_port setting in bvm-config.toml
+var rdpPortPattern = regexp.MustCompile(`(?m)^(\s*rdp_port\s*=\s*)\d+`)
+
+// cloneVM copies a VM directory and registers the copy. The copy gets an RDP port no other VM uses, so both can
+// run at once. Copies are reflinks on filesystems that have them, like btrfs.
+func cloneVM(name string, newPath string) (*registry.VM, error) {
+	vmRegistry, err := registry.LoadDefault()
+	if err != nil {
+		return nil, err
+	}
+	vm := vmRegistry.Find(name)
+	if vm == nil {
+		return nil, fmt.Errorf("no VM is called %s", name)
+	}
+	absNewPath, err := filepath.Abs(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %s: %v", newPath, err)
+	}
+	if _, err := os.Stat(absNewPath); err == nil {
+		return nil, fmt.Errorf("%s already exists", absNewPath)
+	}
+
+	running, closeCheck := vmRunningCheck()
+	isRunning := running(vm.Path)
+	closeCheck()
+	if isRunning {
+		return nil, fmt.Errorf("%s is running, shut it down first so its disk is consistent", name)
+	}
+
+	if output, err := exec.Command("cp", "-a", "--reflink=auto", vm.Path, absNewPath).CombinedOutput(); err != nil {
+		os.RemoveAll(absNewPath)
+		return nil, fmt.Errorf("failed to copy %s: %v\n%s", vm.Path, err, strings.TrimSpace(string(output)))
+	}
+
+	vms, err := listVMs()
+	if err != nil {
+		return nil, err
+	}
+	port := 3389
+	for _, other := range vms {
+		if other.RdpPort >= port {
+			port = other.RdpPort + 1
+		}
+	}
+	configPath := filepath.Join(absNewPath, "bvm-config.toml")
+	if config, err := os.ReadFile(configPath); err == nil && rdpPortPattern.Match(config) {
+		config = rdpPortPattern.ReplaceAll(config, []byte("${1}"+strconv.Itoa(port)))
+		if err := os.WriteFile(configPath, config, 0644); err != nil {
+			internal.Warning("Failed to change the RDP port of the copy: " + err.Error())
+		}
+	}
+
+	return registry.Register(absNewPath)
+}
+
+// editorCommand opens the bvm-config.toml of a VM in $VISUAL or $EDITOR, nano if neither is set
+func editorCommand(vmdir string) *exec.Cmd {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "nano"
+	}
+	fields := strings.Fields(editor)
+	return exec.Command(fields[0], append(fields[1:], filepath.Join(vmdir, "bvm-config.toml"))...)
+}
@@ -0,0 +1,422 @@
+package cli
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/pi-apps-go/bvm-go/internal"
+	"github.com/pi-apps-go/bvm-go/pkg/provision"
+	"github.com/pi-apps-go/bvm-go/pkg/unattend"
+	"github.com/pi-apps-go/bvm-go/pkg/usb"
+)
+
+// vmSpec describes a VM independently of the hypervisor that runs it.
+// Every Hypervisor turns it into its own configuration, libvirt into domain XML through libvirtDomain.
+type vmSpec struct {
+	Name string
+	// Dir is the VM directory, domain-overrides.xml and the files a hypervisor keeps for the VM are there
+	Dir string
+	// Arch is the QEMU architecture, "aarch64" or "x86_64"
+	Arch     string
+	Machine  string
+	Emulator string
+	// Firmware is the UEFI code image
+	Firmware  string
+	MemoryGiB int
+	CPUs      int
+	Disks     []vmDisk
+	// Graphics adds a SPICE server listening on localhost
+	Graphics bool
+	// SerialLog receives the serial console if set
+	SerialLog string
+	// ProgressLog receives what firstlogin.ps1 writes to provision.ProgressChannel if set
+	ProgressLog string
+	// WatchdogModel is empty for no watchdog, the guest is paused when it fires
+	WatchdogModel string
+	// FreePageReporting lets the guest hand memory it freed back to the host
+	FreePageReporting bool
+	// DeflateOnOOM lets a guest running out of memory take it back from the balloon
+	DeflateOnOOM bool
+	// USBDevices are host devices passed through to the guest
+	USBDevices []usb.Selector
+	// RDPPort is forwarded from localhost to RDP in the guest, 0 for none
+	RDPPort int
+}
+
+// vmDisk is a disk, CD-ROM or floppy of a vmSpec
+type vmDisk struct {
+	Path string
+	// Format is "qcow2" or "raw"
+	Format string
+	// Device is "disk", "cdrom" or "floppy"
+	Device string
+	// Bus is "virtio", "ide", "sata", "usb" or "fdc"
+	Bus string
+	// Target is the libvirt device name, like vda or sdb
+	Target string
+	// Boot marks the drive the firmware boots from first
+	Boot bool
+}
+
+// newVMSpec describes the machine of a VM on this host, without a name or drives
+func newVMSpec(vmdir string) (*vmSpec, error) {
+	// Convert vmdir to absolute path for libvirt
+	absVmdir, err := filepath.Abs(vmdir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %s: %v", vmdir, err)
+	}
+
+	spec := &vmSpec{
+		Dir:       absVmdir,
+		MemoryGiB: internal.BVMConfig.VMMem,
+	}
+
+	// Determine CPU architecture and cores
+	switch runtime.GOARCH {
+	case "arm64":
+		spec.Arch = "aarch64"
+		spec.Machine = "virt"
+		spec.Emulator = "/usr/bin/qemu-system-aarch64"
+		spec.Firmware = "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"
+		// Handle big.LITTLE CPU optimization
+		spec.CPUs = getCPUCores()
+	case "amd64":
+		spec.Arch = "x86_64"
+		spec.Machine = "q35"
+		spec.Emulator = "/usr/bin/qemu-system-x86_64"
+		spec.Firmware = "/usr/share/OVMF/OVMF_CODE_4M.fd"
+		spec.CPUs = runtime.NumCPU()
+	default:
+		return nil, fmt.Errorf("unsupported architecture: %s", runtime.GOARCH)
+	}
+	return spec, nil
+}
+
+// bootSpec describes the VM Windows runs in after firstboot installed it
+func bootSpec(vmdir string) (*vmSpec, error) {
+	spec, err := newVMSpec(vmdir)
+	if err != nil {
+		return nil, err
+	}
+	spec.Name = fmt.Sprintf("bvm-%s", filepath.Base(spec.Dir))
+	spec.Graphics = true
+	spec.Disks = []vmDisk{{Path: filepath.Join(spec.Dir, "disk.qcow2"), Format: "qcow2", Device: "disk", Bus: "virtio", Target: "vda"}}
+
+	// An idle Windows needs far less than vm_mem, so what it frees goes back to Linux right away.
+	// The balloon gives way before Windows runs out of memory, free_ram_goal can take too much on a busy host.
+	spec.FreePageReporting = true
+	spec.DeflateOnOOM = true
+	spec.RDPPort = internal.BVMConfig.RdpPort
+
+	if spec.USBDevices, err = configUSBDevices(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// firstBootSpec describes the VM Windows is installed in
+func firstBootSpec(vmdir string, cfg firstBootDomainConfig, domainName ...string) (*vmSpec, error) {
+	spec, err := newVMSpec(vmdir)
+	if err != nil {
+		return nil, err
+	}
+	absVmdir := spec.Dir
+	spec.Graphics = !cfg.noGraphics
+	spec.SerialLog = cfg.serialLog
+
+	// Determine domain name
+	if len(domainName) > 0 && domainName[0] != "" {
+		spec.Name = domainName[0]
+	} else {
+		spec.Name = fmt.Sprintf("bvm-firstboot-%s", filepath.Base(vmdir))
+	}
+
+	// Add main disk
+	diskPath := cfg.diskPath
+	if diskPath == "" {
+		diskPath = filepath.Join(absVmdir, "disk.qcow2")
+	}
+	spec.Disks = append(spec.Disks, vmDisk{Path: diskPath, Format: "qcow2", Device: "disk", Bus: "virtio", Target: "vda"})
+
+	// Add installer ISO as IDE CD-ROM (more reliable for older Windows Setup)
+	installerISO := cfg.installerISO
+	if installerISO == "" {
+		installerISO = filepath.Join(absVmdir, "installer.iso")
+	}
+	if cfg.answerMethod == unattend.DeliveryInstallerISO {
+		installerISO = cfg.answerMedium
+	}
+	spec.Disks = append(spec.Disks, vmDisk{Path: installerISO, Format: "raw", Device: "cdrom", Bus: "ide", Target: "hda", Boot: true})
+
+	// unattended.iso carries the drivers and first login scripts, but no answer file
+	unattendedISO := cfg.unattendedISO
+	if unattendedISO == "" {
+		unattendedISO = filepath.Join(absVmdir, "unattended.iso")
+	}
+	cdromBus := "sata"
+	if runtime.GOARCH != "amd64" {
+		cdromBus = "usb"
+	}
+	spec.Disks = append(spec.Disks, vmDisk{Path: unattendedISO, Format: "raw", Device: "cdrom", Bus: cdromBus, Target: "sda"})
+
+	// Attach the medium of the delivery method, installer-iso is already in place
+	switch cfg.answerMethod {
+	case unattend.DeliveryCDROM:
+		spec.Disks = append(spec.Disks, vmDisk{Path: cfg.answerMedium, Format: "raw", Device: "cdrom", Bus: cdromBus, Target: "sdb"})
+	case unattend.DeliveryFloppy:
+		spec.Disks = append(spec.Disks, vmDisk{Path: cfg.answerMedium, Format: "raw", Device: "floppy", Bus: "fdc", Target: "fda"})
+	}
+	internal.Debug(fmt.Sprintf("Added %s as answer file medium (%s)", cfg.answerMedium, cfg.answerMethod))
+
+	if !cfg.noProgressLog {
+		spec.ProgressLog = filepath.Join(absVmdir, firstLoginProgressFile)
+	}
+
+	// Add a watchdog so a hung guest is noticed, firstboot retries the installation when it fires
+	spec.WatchdogModel = firstBootWatchdogModel()
+
+	// Devices from usb_passthrough are there from the start, like in bvm boot, so Windows Setup sees them
+	if spec.USBDevices, err = configUSBDevices(); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// libvirtDomain renders the spec as a libvirt domain
+func (spec *vmSpec) libvirtDomain() LibvirtDomainXML {
+	// Build the domain configuration
+	domain := LibvirtDomainXML{
+		Type: "kvm",
+		Name: spec.Name,
+		Memory: Memory{
+			Unit:  "GiB",
+			Value: strconv.Itoa(spec.MemoryGiB),
+		},
+		CurrentMemory: Memory{
+			Unit:  "GiB",
+			Value: strconv.Itoa(spec.MemoryGiB),
+		},
+		VCPU: VCPU{
+			Placement: "static",
+			Value:     strconv.Itoa(spec.CPUs),
+		},
+		OS: OS{
+			Type: OSType{
+				Arch:    spec.Arch,
+				Machine: spec.Machine,
+				Value:   "hvm",
+			},
+			Boot: []Boot{
+				{Dev: "cdrom"},
+				{Dev: "hd"},
+			},
+			// Let libvirt handle NVRAM automatically instead of specifying a fixed path
+			Firmware: "efi",
+			Loader: &Loader{
+				ReadOnly: "yes",
+				Type:     "pflash",
+				Value:    spec.Firmware,
+			},
+		},
+		Features: Features{
+			ACPI: struct{}{},
+			APIC: struct{}{},
+		},
+		CPU: CPU{
+			Mode:  "host-passthrough",
+			Check: "none",
+		},
+		Clock: Clock{
+			Offset: "localtime",
+			Timer: []Timer{
+				{Name: "rtc", Tickpolicy: "catchup"},
+				{Name: "pit", Tickpolicy: "delay"},
+				{Name: "hpet", Present: "no"},
+			},
+		},
+		OnPoweroff: "destroy",
+		OnReboot:   "restart",
+		OnCrash:    "restart",
+		Devices: Devices{
+			Emulator: spec.Emulator,
+		},
+	}
+	if spec.Arch == "aarch64" {
+		domain.Features.GIC = &GIC{Version: "2"}
+	}
+
+	for _, disk := range spec.Disks {
+		driver := &DiskDriver{Name: "qemu", Type: disk.Format}
+		if disk.Device == "disk" {
+			driver.Cache = "none"
+			driver.IO = "threads"
+			driver.Discard = "unmap"
+		}
+		libvirtDisk := Disk{
+			Type:   "file",
+			Device: disk.Device,
+			Driver: driver,
+			Source: &DiskSource{File: disk.Path},
+			Target: DiskTarget{Dev: disk.Target, Bus: disk.Bus},
+		}
+		if disk.Boot {
+			libvirtDisk.Boot = &Boot{Dev: disk.Device}
+		}
+		domain.Devices.Disks = append(domain.Devices.Disks, libvirtDisk)
+	}
+
+	// Add controllers - support both IDE and SATA for maximum compatibility
+	pciModel := "pcie-root"
+	if spec.Arch != "x86_64" {
+		pciModel = "pci-root"
+	}
+	domain.Devices.Controllers = []Controller{
+		{Type: "usb", Index: "0", Model: "qemu-xhci"},
+		{Type: "pci", Index: "0", Model: pciModel},
+		{Type: "ide", Index: "0"},                        // IDE controller for legacy compatibility
+		{Type: "sata", Index: "0"},                       // SATA controller for modern drives
+		{Type: "scsi", Index: "0", Model: "virtio-scsi"}, // SCSI controller for additional drives
+		{Type: "fdc", Index: "0"},                        // Floppy disk controller
+	}
+
+	// Add network interface, user-mode networking only forwards ports with the passt backend
+	network := Interface{
+		Type:  "user",
+		Model: &InterfaceModel{Type: "virtio"},
+	}
+	if spec.RDPPort != 0 {
+		network.Backend = &InterfaceBackend{Type: "passt"}
+		network.PortForwards = []PortForward{{
+			Proto:   "tcp",
+			Address: "127.0.0.1",
+			Ranges:  []PortRange{{Start: strconv.Itoa(spec.RDPPort), To: "3389"}},
+		}}
+	}
+	domain.Devices.Interfaces = []Interface{network}
+
+	// Add graphics (GTK for direct window display)
+	if spec.Graphics {
+		domain.Devices.Graphics = []Graphics{
+			{
+				Type:     "spice",
+				Port:     "-1",
+				AutoPort: "yes",
+				Listen:   "127.0.0.1",
+			},
+		}
+	}
+
+	for _, selector := range spec.USBDevices {
+		domain.Devices.Hostdevs = append(domain.Devices.Hostdevs, usbHostdev(selector))
+	}
+
+	// Add video device
+	domain.Devices.Videos = []Video{
+		{
+			Model: VideoModel{
+				Type:    "virtio",
+				VRam:    "16384",
+				Heads:   "1",
+				Primary: "yes",
+			},
+		},
+	}
+
+	// Add input devices
+	domain.Devices.Inputs = []Input{
+		{Type: "keyboard", Bus: "usb"},
+		{Type: "tablet", Bus: "usb"},
+	}
+
+	// Add channels for the QEMU guest agent, for firstlogin.ps1 to report its progress and for SPICE
+	domain.Devices.Channels = []Channel{
+		{
+			// libvirt picks the socket path, firstboot only uses it to ping the guest agent
+			Type: "unix",
+			Target: &ChannelTarget{
+				Type: "virtio",
+				Name: "org.qemu.guest_agent.0",
+			},
+		},
+	}
+	if spec.ProgressLog != "" {
+		domain.Devices.Channels = append(domain.Devices.Channels, Channel{
+			Type: "file",
+			Source: &ChannelSource{
+				Path: spec.ProgressLog,
+			},
+			Target: &ChannelTarget{
+				Type: "virtio",
+				Name: provision.ProgressChannel,
+			},
+		})
+	}
+	// The SPICE agent channel needs a SPICE server
+	if spec.Graphics {
+		domain.Devices.Channels = append(domain.Devices.Channels, Channel{
+			Type: "spicevmc",
+			Target: &ChannelTarget{
+				Type: "virtio",
+				Name: "com.redhat.spice.0",
+			},
+		})
+	}
+
+	// Record the serial console, it shows the firmware and boot loader output
+	if spec.SerialLog != "" {
+		domain.Devices.Serials = []Serial{
+			{
+				Type:   "file",
+				Source: &SerialSource{Path: spec.SerialLog},
+				Target: &SerialTarget{Port: "0"},
+			},
+		}
+	}
+
+	// Add RNG device
+	domain.Devices.RNGs = []RNG{
+		{
+			Model: "virtio",
+			Backend: RNGBackend{
+				Model: "random",
+				Value: "/dev/urandom",
+			},
+		},
+	}
+
+	// Add sound device (commented out due to audio backend issues in libvirt)
+	// domain.Devices.Sounds = []Sound{
+	//	{Model: "ich9"},
+	// }
+
+	if spec.WatchdogModel != "" {
+		domain.Devices.Watchdog = &Watchdog{Model: spec.WatchdogModel, Action: "pause"}
+	}
+
+	// Add memory balloon
+	domain.Devices.MemBalloon = &MemBalloon{
+		Model: "virtio",
+		Stats: &MemBalloonStats{Period: strconv.Itoa(balloonStatsPeriod)},
+	}
+	if spec.FreePageReporting {
+		domain.Devices.MemBalloon.FreePageReporting = "on"
+	}
+	if spec.DeflateOnOOM {
+		domain.Devices.MemBalloon.AutoDeflate = "on"
+	}
+
+	return domain
+}
+
+// libvirtDomainXML renders the spec as libvirt domain XML
+func (spec *vmSpec) libvirtDomainXML() (string, error) {
+	xmlData, err := xml.MarshalIndent(spec.libvirtDomain(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(xmlData), nil
+}
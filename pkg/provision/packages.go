@@ -0,0 +1,186 @@
+package provision
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// PackageResultPrefix starts the line firstlogin.ps1 logs for every package it tried to install
+const PackageResultPrefix = "BVM-PACKAGE-RESULT|"
+
+// Package is a package to install on first login
+type Package struct {
+	// ID is the winget package ID or Chocolatey package name
+	ID string
+	// Manager is "winget" or "choco"
+	Manager string
+	// OfflineInstaller is the file name in unattended/packages/ to use if the package manager fails, empty for none
+	OfflineInstaller string
+	// OfflineArgs are the arguments passed to an .exe offline installer
+	OfflineArgs string
+}
+
+// PackageResult is the outcome of installing one package, parsed back from the first login log
+type PackageResult struct {
+	ID string
+	// Status is "ok" or "failed"
+	Status string
+	// Source is where the package was installed from: "winget", "choco", "offline" or "none"
+	Source string
+	Detail string
+}
+
+// Failed reports whether the package did not get installed
+func (r PackageResult) Failed() bool {
+	return r.Status != "ok"
+}
+
+// ParsePackageResults extracts the package results from the first login log.
+// The log may be written as UTF-8 or UTF-16 depending on the PowerShell version.
+func ParsePackageResults(log []byte) []PackageResult {
+	var results []PackageResult
+	for _, line := range strings.Split(decodeLog(log), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, PackageResultPrefix) {
+			continue
+		}
+		fields := strings.SplitN(strings.TrimPrefix(line, PackageResultPrefix), "|", 4)
+		if len(fields) < 3 {
+			continue
+		}
+		result := PackageResult{ID: fields[0], Status: fields[1], Source: fields[2]}
+		if len(fields) == 4 {
+			result.Detail = fields[3]
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// decodeLog converts a log file to a string, stripping byte order marks
+func decodeLog(log []byte) string {
+	switch {
+	case bytes.HasPrefix(log, []byte{0xff, 0xfe}):
+		log = log[2:]
+		units := make([]uint16, len(log)/2)
+		for i := range units {
+			units[i] = uint16(log[2*i]) | uint16(log[2*i+1])<<8
+		}
+		return string(utf16.Decode(units))
+	case bytes.HasPrefix(log, []byte{0xef, 0xbb, 0xbf}):
+		return string(log[3:])
+	}
+	return string(log)
+}
+
+// renderPackages installs every package through its package manager, falling back to the offline installer
+func renderPackages(cfg Config) string {
+	if len(cfg.Packages) == 0 {
+		return ""
+	}
+
+	var wantWinget, wantChoco bool
+	var calls strings.Builder
+	for _, pkg := range cfg.Packages {
+		switch pkg.Manager {
+		case "winget":
+			wantWinget = true
+		case "choco":
+			wantChoco = true
+		}
+		fmt.Fprintf(&calls, "Install-BVMPackage -Id %s -Manager %s -Offline %s -OfflineArgs %s\n",
+			psQuote(pkg.ID), psQuote(pkg.Manager), psQuote(pkg.OfflineInstaller), psQuote(pkg.OfflineArgs))
+	}
+
+	var script strings.Builder
+	script.WriteString(`$PackagesDir = Join-Path $PSScriptRoot 'packages'
+
+# Results are logged as BVM-PACKAGE-RESULT|id|ok or failed|source|detail so bvm firstboot can report them
+function Install-BVMPackage {
+    param (
+        [string]$Id,
+        [string]$Manager,
+        [string]$Offline,
+        [string]$OfflineArgs
+    )
+    Write-Output "` + "`" + `n========== Installing package: $Id ($Manager) =========="
+    $Source = "none"
+    $ExitCode = -1
+    if ($Manager -eq "winget" -and (Get-Command winget -ErrorAction SilentlyContinue)) {
+        winget install --id $Id --exact --silent --accept-package-agreements --accept-source-agreements 2>&1
+        $ExitCode = $LASTEXITCODE
+        $Source = "winget"
+        # 0x8A150061 means the package is already installed
+        if ($ExitCode -eq -1978335135) { $ExitCode = 0 }
+    } elseif ($Manager -eq "choco" -and (Get-Command choco -ErrorAction SilentlyContinue)) {
+        choco install $Id -y --no-progress 2>&1
+        $ExitCode = $LASTEXITCODE
+        $Source = "choco"
+    }
+    if ($ExitCode -ne 0 -and $ExitCode -ne 3010 -and $Offline -ne "") {
+        $Installer = Join-Path $PackagesDir $Offline
+        Write-Output "Falling back to offline installer $Installer"
+        try {
+            if ($Installer -like "*.msi") {
+                $Process = Start-Process msiexec.exe -ArgumentList "/i ` + "`" + `"$Installer` + "`" + `" /qn /norestart" -Wait -PassThru
+            } else {
+                $Process = Start-Process $Installer -ArgumentList $OfflineArgs -Wait -PassThru
+            }
+            $ExitCode = $Process.ExitCode
+        } catch {
+            Write-Output "ERROR: $_"
+            $ExitCode = -1
+        }
+        $Source = "offline"
+    }
+    if ($Source -eq "none") {
+        Write-Output "BVM-PACKAGE-RESULT|$Id|failed|none|$Manager is not available and there is no offline installer"
+        Send-BVMProgress "ERROR" "Package $Id failed to install: $Manager is not available and there is no offline installer"
+    } elseif ($ExitCode -eq 0 -or $ExitCode -eq 3010) {
+        Write-Output "BVM-PACKAGE-RESULT|$Id|ok|$Source|"
+        Send-BVMProgress "LOG" "Package $Id installed from $Source"
+    } else {
+        Write-Output "BVM-PACKAGE-RESULT|$Id|failed|$Source|exit code $ExitCode"
+        Send-BVMProgress "ERROR" "Package $Id failed to install from $Source with exit code $ExitCode"
+    }
+}
+`)
+
+	if wantWinget {
+		script.WriteString(`
+# winget only shows up once App Installer has registered for the new user, give it a few minutes
+for ($i = 0; $i -lt 18 -and -not (Get-Command winget -ErrorAction SilentlyContinue); $i++) {
+    Start-Sleep -Seconds 10
+}
+if (-not (Get-Command winget -ErrorAction SilentlyContinue)) {
+    Write-Output "WARNING: winget is not available, only offline installers will be used for winget packages"
+}
+`)
+	}
+	if wantChoco {
+		script.WriteString(`
+if (-not (Get-Command choco -ErrorAction SilentlyContinue)) {
+    Write-Output "Installing Chocolatey..."
+    try {
+        [System.Net.ServicePointManager]::SecurityProtocol = [System.Net.ServicePointManager]::SecurityProtocol -bor 3072
+        Invoke-Expression ((New-Object System.Net.WebClient).DownloadString('https://community.chocolatey.org/install.ps1'))
+        $env:Path += ";$env:ProgramData\chocolatey\bin"
+    } catch {
+        Write-Output "WARNING: Failed to install Chocolatey, only offline installers will be used for choco packages: $_"
+    }
+}
+`)
+	}
+
+	script.WriteString("\n")
+	script.WriteString(calls.String())
+	return script.String()
+}
+
+// IsOfflineInstaller reports whether a file in unattended/packages/ can be used as an offline installer
+func IsOfflineInstaller(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".msi") || strings.HasSuffix(lower, ".exe")
+}
@@ -0,0 +1,158 @@
+package provision
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// firstLoginLog is part of a first login transcript with two packages installed and one failed
+const firstLoginLog = "**********************\r\n" +
+	"Windows PowerShell transcript start\r\n" +
+	"**********************\r\n" +
+	"\r\n========== Installing package: 7zip.7zip (winget) ==========\r\n" +
+	"BVM-PACKAGE-RESULT|7zip.7zip|ok|winget|\r\n" +
+	"\r\n========== Installing package: Mozilla.Firefox (winget) ==========\r\n" +
+	"Falling back to offline installer E:\\packages\\Mozilla.Firefox.exe\r\n" +
+	"BVM-PACKAGE-RESULT|Mozilla.Firefox|ok|offline|\r\n" +
+	"\r\n========== Installing package: vlc (choco) ==========\r\n" +
+	"BVM-PACKAGE-RESULT|vlc|failed|choco|exit code 1603\r\n"
+
+var firstLoginResults = []PackageResult{
+	{ID: "7zip.7zip", Status: "ok", Source: "winget"},
+	{ID: "Mozilla.Firefox", Status: "ok", Source: "offline"},
+	{ID: "vlc", Status: "failed", Source: "choco", Detail: "exit code 1603"},
+}
+
+// utf16LE encodes s the way Windows PowerShell writes Unicode files, with a byte order mark
+func utf16LE(s string) []byte {
+	encoded := []byte{0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		encoded = append(encoded, byte(unit), byte(unit>>8))
+	}
+	return encoded
+}
+
+func TestParsePackageResults(t *testing.T) {
+	tests := []struct {
+		name string
+		log  []byte
+		want []PackageResult
+	}{
+		{
+			name: "UTF-8",
+			log:  []byte(firstLoginLog),
+			want: firstLoginResults,
+		},
+		{
+			name: "UTF-8 with BOM",
+			log:  append([]byte{0xef, 0xbb, 0xbf}, firstLoginLog...),
+			want: firstLoginResults,
+		},
+		{
+			name: "UTF-16LE with BOM",
+			log:  utf16LE(firstLoginLog),
+			want: firstLoginResults,
+		},
+		{
+			name: "package without a result line",
+			log: []byte("========== Installing package: 7zip.7zip (winget) ==========\n" +
+				"BVM-PACKAGE-RESULT|7zip.7zip|ok|winget|\n" +
+				"========== Installing package: Git.Git (winget) ==========\n"),
+			want: firstLoginResults[:1],
+		},
+		{
+			name: "malformed result lines",
+			log: []byte("BVM-PACKAGE-RESULT|Git.Git|ok\n" +
+				"BVM-PACKAGE-RESULT|\n" +
+				"BVM-PACKAGE-RESULT Git.Git ok winget\n" +
+				"Output: BVM-PACKAGE-RESULT|Git.Git|ok|winget|\n" +
+				"BVM-PACKAGE-RESULT|vlc|failed|none|choco is not available | no offline installer\n"),
+			want: []PackageResult{
+				{ID: "vlc", Status: "failed", Source: "none", Detail: "choco is not available | no offline installer"},
+			},
+		},
+		{
+			name: "result without detail field",
+			log:  []byte("BVM-PACKAGE-RESULT|Git.Git|ok|winget\n"),
+			want: []PackageResult{{ID: "Git.Git", Status: "ok", Source: "winget"}},
+		},
+		{
+			name: "empty log",
+			log:  nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results := ParsePackageResults(test.log)
+			if !reflect.DeepEqual(results, test.want) {
+				t.Errorf("ParsePackageResults() = %+v\nwant %+v", results, test.want)
+			}
+		})
+	}
+}
+
+func TestPackageResultFailed(t *testing.T) {
+	for _, result := range firstLoginResults {
+		if failed := result.Failed(); failed != (result.ID == "vlc") {
+			t.Errorf("%s Failed() = %v", result.ID, failed)
+		}
+	}
+}
+
+func TestRenderPackages(t *testing.T) {
+	if script := renderPackages(Config{}); script != "" {
+		t.Errorf("renderPackages() without packages = %q, want nothing", script)
+	}
+
+	script := renderPackages(Config{Packages: []Package{
+		{ID: "7zip.7zip", Manager: "winget", OfflineInstaller: "7zip.7zip.msi"},
+		{ID: "Mozilla.Firefox", Manager: "winget", OfflineInstaller: "Mozilla.Firefox.exe", OfflineArgs: "-ms"},
+		{ID: "Bob's.Tool", Manager: "winget"},
+	}})
+	for _, want := range []string{
+		// winget is tried first and its exit code decides whether the offline installer runs
+		`if ($Manager -eq "winget" -and (Get-Command winget -ErrorAction SilentlyContinue)) {`,
+		`if ($ExitCode -ne 0 -and $ExitCode -ne 3010 -and $Offline -ne "") {`,
+		`Write-Output "Falling back to offline installer $Installer"`,
+		`$Process = Start-Process msiexec.exe -ArgumentList "/i ` + "`" + `"$Installer` + "`" + `" /qn /norestart" -Wait -PassThru`,
+		`$Process = Start-Process $Installer -ArgumentList $OfflineArgs -Wait -PassThru`,
+		`$Source = "offline"`,
+		`Write-Output "BVM-PACKAGE-RESULT|$Id|failed|none|$Manager is not available and there is no offline installer"`,
+		`Write-Output "WARNING: winget is not available, only offline installers will be used for winget packages"`,
+		"Install-BVMPackage -Id '7zip.7zip' -Manager 'winget' -Offline '7zip.7zip.msi' -OfflineArgs ''\n",
+		"Install-BVMPackage -Id 'Mozilla.Firefox' -Manager 'winget' -Offline 'Mozilla.Firefox.exe' -OfflineArgs '-ms'\n",
+		"Install-BVMPackage -Id 'Bob''s.Tool' -Manager 'winget' -Offline '' -OfflineArgs ''\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("renderPackages() has no %s", want)
+		}
+	}
+	if strings.Contains(script, "Installing Chocolatey") {
+		t.Error("renderPackages() installs Chocolatey without choco packages")
+	}
+
+	script = renderPackages(Config{Packages: []Package{{ID: "vlc", Manager: "choco"}}})
+	if !strings.Contains(script, "Installing Chocolatey") {
+		t.Error("renderPackages() doesn't install Chocolatey for choco packages")
+	}
+	if strings.Contains(script, "winget is not available") {
+		t.Error("renderPackages() waits for winget without winget packages")
+	}
+}
+
+func TestIsOfflineInstaller(t *testing.T) {
+	tests := map[string]bool{
+		"7zip.7zip.msi":        true,
+		"Mozilla.Firefox.EXE":  true,
+		"Mozilla.Firefox.args": false,
+		"vlc.zip":              false,
+		"msi":                  false,
+	}
+	for name, want := range tests {
+		if got := IsOfflineInstaller(name); got != want {
+			t.Errorf("IsOfflineInstaller(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package provision
+
+import "strings"
+
+// ProgressChannel is the name of the virtio-serial port firstlogin.ps1 sends its progress to
+const ProgressChannel = "org.bvm.firstlogin.0"
+
+// Kinds of progress lines sent by firstlogin.ps1
+const (
+	ProgressStep  = "STEP"
+	ProgressLog   = "LOG"
+	ProgressError = "ERROR"
+	ProgressDone  = "DONE"
+	// ProgressDelivery carries the answer file delivery method Windows Setup used
+	ProgressDelivery = "DELIVERY"
+)
+
+// ProgressEvent is one line sent by firstlogin.ps1 over the progress channel
+type ProgressEvent struct {
+	// Kind is one of ProgressStep, ProgressLog, ProgressError, ProgressDone or ProgressDelivery
+	Kind string
+	// Step is the name of the step that started, only set for ProgressStep
+	Step    string
+	Message string
+}
+
+// ParseProgressLine parses a BVM|kind|message line, returning false for anything else
+func ParseProgressLine(line string) (ProgressEvent, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	fields := strings.SplitN(line, "|", 3)
+	if len(fields) < 2 || fields[0] != "BVM" {
+		return ProgressEvent{}, false
+	}
+
+	event := ProgressEvent{Kind: fields[1]}
+	if len(fields) == 3 {
+		event.Message = fields[2]
+	}
+	switch event.Kind {
+	case ProgressStep:
+		// Steps are sent as name|description
+		event.Step, event.Message, _ = strings.Cut(event.Message, "|")
+	case ProgressLog, ProgressError, ProgressDone, ProgressDelivery:
+	default:
+		return ProgressEvent{}, false
+	}
+	return event, true
+}
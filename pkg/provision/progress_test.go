@@ -0,0 +1,33 @@
+package provision
+
+import "testing"
+
+func TestParseProgressLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ProgressEvent
+		ok   bool
+	}{
+		{line: "BVM|STEP|rdp|Enable RDP and allow it through the firewall\r\n", want: ProgressEvent{Kind: ProgressStep, Step: "rdp", Message: "Enable RDP and allow it through the firewall"}, ok: true},
+		{line: "BVM|STEP|activation", want: ProgressEvent{Kind: ProgressStep, Step: "activation"}, ok: true},
+		{line: "BVM|LOG|Package 7zip.7zip installed from winget\n", want: ProgressEvent{Kind: ProgressLog, Message: "Package 7zip.7zip installed from winget"}, ok: true},
+		{line: "BVM|ERROR|Package vlc failed | exit code 1603", want: ProgressEvent{Kind: ProgressError, Message: "Package vlc failed | exit code 1603"}, ok: true},
+		{line: "BVM|DONE|First login provisioning finished", want: ProgressEvent{Kind: ProgressDone, Message: "First login provisioning finished"}, ok: true},
+		{line: "BVM|DONE", want: ProgressEvent{Kind: ProgressDone}, ok: true},
+		{line: "BVM|DELIVERY|cdrom", want: ProgressEvent{Kind: ProgressDelivery, Message: "cdrom"}, ok: true},
+		{line: "BVM|PING|hello"},
+		{line: "BVM|step|rdp|lower case kind"},
+		{line: "BVM"},
+		{line: "bvm|LOG|lower case prefix"},
+		{line: "Windows PowerShell transcript start"},
+		{line: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			event, ok := ParseProgressLine(test.line)
+			if event != test.want || ok != test.ok {
+				t.Errorf("ParseProgressLine(%q) = %+v, %v, want %+v, %v", test.line, event, ok, test.want, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Package provision assembles the firstlogin.ps1 script that sets up Windows on its first login.
+//
+// The script is built from named steps kept in a registry, so the steps that run (and their order)
+// can be chosen from the [provision] section of bvm-config.toml instead of editing a PowerShell file.
+package provision
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+)
+
+//go:embed scripts/header.ps1
+var header string
+
+//go:embed scripts/footer.ps1
+var footer string
+
+// LogFile is where firstlogin.ps1 writes its transcript, relative to the root of the Windows partition
+const LogFile = "Windows/Temp/firstlogin_log.txt"
+
+// Config holds everything the steps need to render their part of the script
+type Config struct {
+	// Steps lists the steps to run in order, leave it empty to run every default step
+	Steps []string
+	// SkipSteps removes steps from the list above
+	SkipSteps []string
+	// ActivationKey is the KMS client key of the installed edition, empty skips activation
+	ActivationKey string
+	// Debloat runs the Win11Debloat script
+	Debloat bool
+	// DarkMode switches the system and apps to the dark theme, otherwise the light theme is used
+	DarkMode bool
+	// Wallpaper is a path inside the guest to use as the desktop wallpaper
+	Wallpaper string
+	// Packages lists the winget and Chocolatey packages to install
+	Packages []Package
+	// UserScripts lists the file names found in unattended/scripts/, run in this order
+	UserScripts []string
+}
+
+// Step is a single provisioning step
+type Step struct {
+	// Name is used to select the step in bvm-config.toml
+	Name string
+	// Description is shown by bvm list-provision-steps
+	Description string
+	// Default steps run when no step list is configured
+	Default bool
+	// Render returns the PowerShell for this step, an empty string leaves the step out
+	Render func(cfg Config) string
+}
+
+var (
+	registry = map[string]Step{}
+	// order keeps the registration order, which is the order default steps run in
+	order []string
+)
+
+// Register adds a step to the registry. Registering a name twice panics.
+func Register(step Step) {
+	if _, exists := registry[step.Name]; exists {
+		panic("provision: step registered twice: " + step.Name)
+	}
+	registry[step.Name] = step
+	order = append(order, step.Name)
+}
+
+// Steps returns every registered step in registration order
+func Steps() []Step {
+	steps := make([]Step, 0, len(order))
+	for _, name := range order {
+		steps = append(steps, registry[name])
+	}
+	return steps
+}
+
+// Lookup finds a registered step by name
+func Lookup(name string) (Step, bool) {
+	step, ok := registry[name]
+	return step, ok
+}
+
+// Resolve returns the steps selected by the configuration, in the order they will run
+func Resolve(cfg Config) ([]Step, error) {
+	names := cfg.Steps
+	if len(names) == 0 {
+		for _, name := range order {
+			if registry[name].Default {
+				names = append(names, name)
+			}
+		}
+	}
+
+	skip := map[string]bool{}
+	for _, name := range cfg.SkipSteps {
+		if _, ok := registry[name]; !ok {
+			return nil, fmt.Errorf("unknown provisioning step in skip_steps: %s", name)
+		}
+		skip[name] = true
+	}
+
+	var steps []Step
+	seen := map[string]bool{}
+	for _, name := range names {
+		step, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown provisioning step: %s", name)
+		}
+		if skip[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Assemble builds firstlogin.ps1 from the selected steps
+func Assemble(cfg Config) ([]byte, error) {
+	steps, err := Resolve(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var script strings.Builder
+	script.WriteString(strings.ReplaceAll(header, "%BVM_PROGRESS_CHANNEL%", ProgressChannel))
+	for _, step := range steps {
+		body := step.Render(cfg)
+		if body == "" {
+			continue
+		}
+		fmt.Fprintf(&script, "\n# Step: %s - %s\n", step.Name, step.Description)
+		fmt.Fprintf(&script, "Send-BVMProgress \"STEP\" %s\n", psQuote(step.Name+"|"+step.Description))
+		script.WriteString(strings.TrimRight(body, "\n"))
+		script.WriteString("\n")
+	}
+	script.WriteString(footer)
+	return []byte(script.String()), nil
+}
+
+// psQuote quotes a value as a single-quoted PowerShell string
+func psQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,184 @@
+package provision
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// stepNames returns the names of steps in order
+func stepNames(steps []Step) []string {
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func TestResolve(t *testing.T) {
+	var defaults []string
+	for _, step := range Steps() {
+		if step.Default {
+			defaults = append(defaults, step.Name)
+		}
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string
+		err  string
+	}{
+		{
+			name: "default steps in registration order",
+			want: defaults,
+		},
+		{
+			name: "configured order",
+			cfg:  Config{Steps: []string{"shutdown", "rdp", "activation"}},
+			want: []string{"shutdown", "rdp", "activation"},
+		},
+		{
+			name: "skipped steps",
+			cfg:  Config{Steps: []string{"rdp", "debloat", "activation", "shutdown"}, SkipSteps: []string{"debloat", "shutdown"}},
+			want: []string{"rdp", "activation"},
+		},
+		{
+			name: "skipped default steps",
+			cfg:  Config{SkipSteps: defaults[1:]},
+			want: defaults[:1],
+		},
+		{
+			name: "steps listed twice run once",
+			cfg:  Config{Steps: []string{"rdp", "activation", "rdp", "activation", "shutdown"}},
+			want: []string{"rdp", "activation", "shutdown"},
+		},
+		{
+			name: "skipping a step that is not listed",
+			cfg:  Config{Steps: []string{"rdp"}, SkipSteps: []string{"debloat"}},
+			want: []string{"rdp"},
+		},
+		{
+			name: "unknown step",
+			cfg:  Config{Steps: []string{"rdp", "install-office"}},
+			err:  "unknown provisioning step: install-office",
+		},
+		{
+			name: "unknown skipped step",
+			cfg:  Config{SkipSteps: []string{"hibernation"}},
+			err:  "unknown provisioning step in skip_steps: hibernation",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			steps, err := Resolve(test.cfg)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("Resolve() = %v, want error %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() failed: %v", err)
+			}
+			if got := stepNames(steps); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("Resolve() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	before := len(Steps())
+	defer func() {
+		if recovered := recover(); recovered != "provision: step registered twice: rdp" {
+			t.Errorf("Register() of a known step recovered %v, want a panic", recovered)
+		}
+		if after := len(Steps()); after != before {
+			t.Errorf("registry has %d steps after the failed Register(), want %d", after, before)
+		}
+	}()
+	Register(Step{Name: "rdp", Render: static("")})
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{
+			name: "firstlogin",
+			cfg: Config{
+				Steps:         []string{"disable-hibernation", "theme", "wallpaper", "activation", "user-scripts", "debloat", "shutdown"},
+				ActivationKey: "W269N-WFGWX-YVC9B-4J6C9-T83GX",
+				DarkMode:      true,
+				Wallpaper:     `C:\Users\bvm\Pictures\bvm's wallpaper.png`,
+				UserScripts:   []string{"10-apps.ps1", "20-drivers.cmd", "30-cleanup.bat"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Assemble(test.cfg)
+			if err != nil {
+				t.Fatalf("Assemble() failed: %v", err)
+			}
+
+			golden := filepath.Join("testdata", test.name+".ps1")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file, run go test -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Assemble() differs from %s, run go test -update if the change is intended:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestAssembleLeavesOutEmptySteps(t *testing.T) {
+	// Debloat is off, there is no wallpaper and unattended/scripts/ is empty
+	script, err := Assemble(Config{Steps: []string{"wallpaper", "user-scripts", "debloat", "shutdown"}})
+	if err != nil {
+		t.Fatalf("Assemble() failed: %v", err)
+	}
+	for _, name := range []string{"wallpaper", "user-scripts", "debloat"} {
+		if bytes.Contains(script, []byte("# Step: "+name+" ")) {
+			t.Errorf("Assemble() has a %s step without anything to do", name)
+		}
+	}
+	if !bytes.Contains(script, []byte("# Step: shutdown ")) {
+		t.Error("Assemble() left out the shutdown step")
+	}
+	if bytes.Contains(script, []byte("%BVM_PROGRESS_CHANNEL%")) || !bytes.Contains(script, []byte(ProgressChannel)) {
+		t.Errorf("Assemble() didn't put the progress channel %s into the header", ProgressChannel)
+	}
+}
+
+func TestIsUserScript(t *testing.T) {
+	tests := map[string]bool{
+		"setup.ps1":    true,
+		"Setup.PS1":    true,
+		"drivers.cmd":  true,
+		"cleanup.bat":  true,
+		"notes.txt":    false,
+		"installer.sh": false,
+		"ps1":          false,
+		"setup.ps1.gz": false,
+	}
+	for name, want := range tests {
+		if got := IsUserScript(name); got != want {
+			t.Errorf("IsUserScript(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
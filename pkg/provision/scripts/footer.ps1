@@ -0,0 +1,8 @@
+
+Send-BVMProgress "DONE" "First login provisioning finished"
+if ($BVMPort -ne $null) {
+    $BVMPort.Close()
+}
+
+# Stop logging
+Stop-Transcript
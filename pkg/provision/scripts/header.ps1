@@ -0,0 +1,80 @@
+# Generated by BVM from the [provision] section of bvm-config.toml. Changes to this file are lost on the next prepare.
+
+# Define log file path
+$LogFile = "C:\Windows\Temp\firstlogin_log.txt"
+
+# Start logging
+Start-Transcript -Path $LogFile -Append
+
+# Progress is also sent to the host over a virtio-serial port, so bvm firstboot can show it live
+$BVMPort = $null
+try {
+    Add-Type -TypeDefinition @"
+using System;
+using System.IO;
+using System.Runtime.InteropServices;
+using Microsoft.Win32.SafeHandles;
+
+public static class BVMSerial {
+    [DllImport("kernel32.dll", SetLastError = true, CharSet = CharSet.Unicode)]
+    static extern SafeFileHandle CreateFile(string name, uint access, uint share, IntPtr security, uint creation, uint flags, IntPtr template);
+
+    public static FileStream Open(string name) {
+        // GENERIC_WRITE, OPEN_EXISTING
+        SafeFileHandle handle = CreateFile(name, 0x40000000, 0, IntPtr.Zero, 3, 0, IntPtr.Zero);
+        if (handle.IsInvalid) {
+            throw new IOException("CreateFile failed with error " + Marshal.GetLastWin32Error());
+        }
+        return new FileStream(handle, FileAccess.Write);
+    }
+}
+"@
+    $BVMPort = [BVMSerial]::Open("\\.\Global\%BVM_PROGRESS_CHANNEL%")
+} catch {
+    Write-Output "WARNING: Could not open the BVM progress port, progress is only written to $LogFile"
+}
+
+# Function to send a progress line to the host
+function Send-BVMProgress {
+    param (
+        [string]$Kind,
+        [string]$Message
+    )
+    if ($BVMPort -eq $null) {
+        return
+    }
+    try {
+        $Bytes = [System.Text.Encoding]::UTF8.GetBytes("BVM|$Kind|$Message`n")
+        $BVMPort.Write($Bytes, 0, $Bytes.Length)
+        $BVMPort.Flush()
+    } catch {
+        # The host not listening should never stop provisioning
+    }
+}
+
+# Function to log and execute commands
+function Execute-Command {
+    param (
+        [string]$Command
+    )
+    Write-Output "`n========== Executing: $Command =========="
+    $Output = Invoke-Expression $Command 2>&1
+    $Output
+    if ($LASTEXITCODE -ne 0) {
+        Write-Output "ERROR: Command failed with exit code $LASTEXITCODE"
+        Send-BVMProgress "ERROR" "$Command failed with exit code $LASTEXITCODE"
+    }
+    Write-Output "========== End of Output ==========`n"
+}
+
+Write-Output "BVM setting up this Virtual Machine... please do not close this window! This VM will shutdown once done."
+Send-BVMProgress "LOG" "First login provisioning started"
+
+# The specialize pass records which medium the answer file was delivered by, see unattend.DeliveryRegistryKey
+$Delivery = (Get-ItemProperty -Path 'HKLM:\SOFTWARE\BVM' -Name AnswerFileDelivery -ErrorAction SilentlyContinue).AnswerFileDelivery
+if ($Delivery) {
+    Write-Output "Answer file was delivered by: $Delivery"
+    Send-BVMProgress "DELIVERY" "$Delivery"
+}
+
+Start-Sleep -Seconds 5
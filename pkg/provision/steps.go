@@ -0,0 +1,178 @@
+package provision
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The built-in steps, registered in the order they run by default
+func init() {
+	Register(Step{
+		Name:        "disable-hibernation",
+		Description: "Disable hibernation",
+		Default:     true,
+		Render:      static(`Execute-Command "powercfg -H OFF"`),
+	})
+	Register(Step{
+		Name:        "disable-recovery",
+		Description: "Disable the recovery environment partition",
+		Default:     true,
+		Render:      static(`Execute-Command "reagentc /disable"`),
+	})
+	Register(Step{
+		Name:        "guest-agent",
+		Description: "Install the QEMU guest agent",
+		Default:     true,
+		Render:      static(`Execute-Command 'msiexec /i E:\guest-agent\qemu-ga-x86_64.msi /quiet /passive /qn'`),
+	})
+	Register(Step{
+		Name:        "rounded-corners",
+		Description: "Enable rounded corners",
+		Default:     true,
+		Render:      static(`Execute-Command 'reg add HKLM\SOFTWARE\Microsoft\Windows\Dwm /v ForceEffectMode /t REG_DWORD /d 2 /f'`),
+	})
+	Register(Step{
+		Name:        "rdp",
+		Description: "Enable RDP and allow it through the firewall",
+		Default:     true,
+		Render: static(`Execute-Command 'reg add "HKLM\SYSTEM\CurrentControlSet\Control\Terminal Server" /v fDenyTSConnections /t REG_DWORD /d 0 /f'
+Execute-Command 'reg add "HKLM\SYSTEM\CurrentControlSet\Control\Terminal Server\WinStations\RDP-Tcp" /v UserAuthentication /t REG_DWORD /d 0 /f'
+
+# Allow incoming RDP connections through the firewall
+Execute-Command 'netsh advfirewall firewall add rule name="Open Port 3389" dir=in action=allow protocol=TCP localport=3389'
+
+# Configure and start Remote Desktop Service
+Execute-Command 'sc config TermService start=auto'
+Execute-Command 'net start TermService'`),
+	})
+	Register(Step{
+		Name:        "no-password-expiry",
+		Description: "Prevent the password from expiring after 42 days",
+		Default:     true,
+		Render:      static(`Execute-Command 'net accounts /maxpwage:unlimited'`),
+	})
+	Register(Step{
+		Name:        "allow-unsupported-upgrades",
+		Description: "Allow Windows upgrades with unsupported TPM or CPU",
+		Default:     true,
+		Render:      static(`Execute-Command 'reg add HKLM\SYSTEM\Setup\MoSetup /v AllowUpgradesWithUnsupportedTPMOrCPU /t REG_DWORD /d 0x00000001 /f'`),
+	})
+	Register(Step{
+		Name:        "theme",
+		Description: "Switch system and apps to the dark or light theme (dark_mode)",
+		Default:     true,
+		Render:      renderTheme,
+	})
+	Register(Step{
+		Name:        "wallpaper",
+		Description: "Set the desktop wallpaper (wallpaper)",
+		Default:     true,
+		Render:      renderWallpaper,
+	})
+	Register(Step{
+		Name:        "activation",
+		Description: "Install the KMS client key of the detected edition",
+		Default:     true,
+		Render:      renderActivation,
+	})
+	Register(Step{
+		Name:        "packages",
+		Description: "Install packages with winget or Chocolatey, or their offline installers ([provision.packages])",
+		Default:     true,
+		Render:      renderPackages,
+	})
+	Register(Step{
+		Name:        "user-scripts",
+		Description: "Run the scripts placed in unattended/scripts/",
+		Default:     true,
+		Render:      renderUserScripts,
+	})
+	Register(Step{
+		Name:        "debloat",
+		Description: "Run the Win11Debloat script (debloat)",
+		Default:     true,
+		Render:      renderDebloat,
+	})
+	Register(Step{
+		Name:        "shutdown",
+		Description: "Shut down the VM once setup is done",
+		Default:     true,
+		Render:      static(`Execute-Command 'shutdown.exe -s -t 60 -c "First-run setup complete. This VM will SHUTDOWN in 60 seconds"'`),
+	})
+}
+
+// static returns a Render function for a step that doesn't depend on the configuration
+func static(script string) func(Config) string {
+	return func(Config) string {
+		return script
+	}
+}
+
+func renderTheme(cfg Config) string {
+	lightTheme := 1
+	if cfg.DarkMode {
+		lightTheme = 0
+	}
+	return fmt.Sprintf(`Execute-Command 'reg add HKCU\SOFTWARE\Microsoft\Windows\CurrentVersion\Themes\Personalize /v SystemUsesLightTheme /t REG_DWORD /d %[1]d /f'
+Execute-Command 'reg add HKCU\SOFTWARE\Microsoft\Windows\CurrentVersion\Themes\Personalize /v AppsUseLightTheme /t REG_DWORD /d %[1]d /f'`, lightTheme)
+}
+
+func renderWallpaper(cfg Config) string {
+	if cfg.Wallpaper == "" {
+		return ""
+	}
+	return fmt.Sprintf(`$Wallpaper = %s
+Execute-Command "reg add `+"`"+`"HKCU\Control Panel\Desktop`+"`"+`" /v Wallpaper /t REG_SZ /d `+"`"+`"$Wallpaper`+"`"+`" /f"`, psQuote(cfg.Wallpaper))
+}
+
+func renderActivation(cfg Config) string {
+	if cfg.ActivationKey == "" {
+		return `Write-Output "WARNING: Windows edition was not detected, skipping activation"`
+	}
+	return fmt.Sprintf(`Execute-Command "slmgr /ipk %s"`, cfg.ActivationKey)
+}
+
+func renderUserScripts(cfg Config) string {
+	if len(cfg.UserScripts) == 0 {
+		return ""
+	}
+	var script strings.Builder
+	script.WriteString("$ScriptsDir = Join-Path $PSScriptRoot 'scripts'\n")
+	for _, name := range cfg.UserScripts {
+		fmt.Fprintf(&script, "$UserScript = Join-Path $ScriptsDir %s\n", psQuote(name))
+		script.WriteString("Write-Output \"Running user script $UserScript\"\n")
+		if strings.ToLower(path.Ext(name)) == ".ps1" {
+			script.WriteString("powershell.exe -ExecutionPolicy Bypass -NoProfile -File $UserScript\n")
+		} else {
+			script.WriteString("cmd.exe /c $UserScript\n")
+		}
+		script.WriteString("if ($LASTEXITCODE -ne 0) {\n    Write-Output \"ERROR: User script $UserScript failed with exit code $LASTEXITCODE\"\n}\n")
+	}
+	return script.String()
+}
+
+func renderDebloat(cfg Config) string {
+	if !cfg.Debloat {
+		return ""
+	}
+	return `$DebloatScript = "E:\Win11Debloat\Win11Debloat.ps1"
+if (Test-Path $DebloatScript) {
+    Write-Output "Executing Debloat Script..."
+    powershell.exe -ExecutionPolicy Bypass -NoProfile -File $DebloatScript -RunDefaults -Silent
+    if ($LASTEXITCODE -ne 0) {
+        Write-Output "ERROR: Debloat script failed with exit code $LASTEXITCODE"
+    }
+} else {
+    Write-Output "WARNING: Debloat script not found at $DebloatScript"
+}`
+}
+
+// IsUserScript reports whether a file in unattended/scripts/ can be run by the user-scripts step
+func IsUserScript(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".ps1", ".cmd", ".bat":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,258 @@
+// Package qmp is a client for the QEMU Machine Protocol, the JSON protocol a running QEMU is controlled through.
+//
+// A Client negotiates the capabilities when it connects, then runs commands and receives the asynchronous events
+// QEMU sends in between. Replies are matched to commands by id, so commands may run from several goroutines.
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long Execute waits for a reply
+const DefaultTimeout = 10 * time.Second
+
+// eventBuffer is how many events are kept for a slow reader, newer events are dropped when it is full
+const eventBuffer = 64
+
+// Greeting is what QEMU sends when a client connects
+type Greeting struct {
+	QMP struct {
+		Version struct {
+			QEMU struct {
+				Major int `json:"major"`
+				Minor int `json:"minor"`
+				Micro int `json:"micro"`
+			} `json:"qemu"`
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Version returns the QEMU version, like 8.2.2
+func (g Greeting) Version() string {
+	v := g.QMP.Version.QEMU
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Micro)
+}
+
+// Event is an asynchronous event, like SHUTDOWN, RESET or WATCHDOG
+type Event struct {
+	Name string
+	Data json.RawMessage
+	// Time is when QEMU emitted the event
+	Time time.Time
+}
+
+// Error is an error reply of QEMU to a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return e.Desc
+}
+
+// message is anything QEMU sends after the greeting: a reply or an event
+type message struct {
+	ID        json.RawMessage `json:"id"`
+	Return    json.RawMessage `json:"return"`
+	Error     *Error          `json:"error"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Client is a connection to a QMP socket
+type Client struct {
+	Greeting Greeting
+	// Timeout is how long Execute waits for a reply, DefaultTimeout unless changed
+	Timeout time.Duration
+
+	conn    net.Conn
+	encoder *json.Encoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[string]chan message
+	// err is why the connection ended, set before done is closed
+	err    error
+	events chan Event
+	done   chan struct{}
+}
+
+// Dial connects to the QMP socket at path and negotiates the capabilities.
+// timeout applies to connecting and to the greeting.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", path, err)
+	}
+	client, err := NewClient(conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient runs QMP over an existing connection, it reads the greeting and negotiates the capabilities
+func NewClient(conn net.Conn, timeout time.Duration) (*Client, error) {
+	c := &Client{
+		Timeout: DefaultTimeout,
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		pending: map[string]chan message{},
+		events:  make(chan Event, eventBuffer),
+		done:    make(chan struct{}),
+	}
+
+	decoder := json.NewDecoder(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if err := decoder.Decode(&c.Greeting); err != nil {
+		return nil, fmt.Errorf("failed to read QMP greeting: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	go c.read(decoder)
+
+	// Commands other than qmp_capabilities are refused until the capabilities are negotiated
+	if _, err := c.ExecuteTimeout("qmp_capabilities", nil, timeout); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to negotiate QMP capabilities: %v", err)
+	}
+	return c, nil
+}
+
+// read passes replies to the waiting commands and events to Events until the connection ends
+func (c *Client) read(decoder *json.Decoder) {
+	var err error
+	for {
+		var msg message
+		if err = decoder.Decode(&msg); err != nil {
+			break
+		}
+
+		if msg.Event != "" {
+			event := Event{
+				Name: msg.Event,
+				Data: msg.Data,
+				Time: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000),
+			}
+			select {
+			case c.events <- event:
+			default:
+				// Nobody reads the events, a full buffer must not block replies
+			}
+			continue
+		}
+
+		var id string
+		json.Unmarshal(msg.ID, &id)
+		c.mu.Lock()
+		reply, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			reply <- msg
+		}
+	}
+
+	c.mu.Lock()
+	c.err = fmt.Errorf("QMP connection closed: %v", err)
+	c.mu.Unlock()
+	close(c.events)
+	close(c.done)
+}
+
+// Execute runs a command and returns the JSON it returned.
+// arguments is marshalled to the arguments object of the command, nil for none.
+func (c *Client) Execute(command string, arguments any) (json.RawMessage, error) {
+	return c.ExecuteTimeout(command, arguments, c.Timeout)
+}
+
+// ExecuteTimeout runs a command like Execute, waiting at most timeout for the reply
+func (c *Client) ExecuteTimeout(command string, arguments any, timeout time.Duration) (json.RawMessage, error) {
+	reply := make(chan message, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	id := "bvm-" + strconv.FormatUint(c.nextID, 10)
+	c.pending[id] = reply
+
+	request := map[string]any{"execute": command, "id": id}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := c.encoder.Encode(request)
+	if err != nil {
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s: %v", command, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-reply:
+		if msg.Error != nil {
+			return nil, fmt.Errorf("%s failed: %w", command, msg.Error)
+		}
+		return msg.Return, nil
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, fmt.Errorf("%s: %v", command, c.err)
+	case <-timer.C:
+		// A late reply is dropped by read
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%s timed out after %s", command, timeout)
+	}
+}
+
+// Run executes a command and unmarshals what it returned into result, which may be nil
+func (c *Client) Run(command string, arguments any, result any) error {
+	raw, err := c.Execute(command, arguments)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("failed to parse reply to %s: %v", command, err)
+	}
+	return nil
+}
+
+// Events returns the asynchronous events. The channel is closed when the connection ends.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Done is closed when the connection ends, for example because QEMU quit
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,392 @@
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const greeting = `{"QMP": {"version": {"qemu": {"micro": 2, "minor": 2, "major": 8}, "package": "Debian 1:8.2.2+ds-0ubuntu1"}, "capabilities": ["oob"]}}`
+
+// fakeQMP is the QEMU end of a QMP connection
+type fakeQMP struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder *json.Decoder
+	encoder *json.Encoder
+}
+
+// request is a command as QEMU receives it
+type request struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments"`
+	ID        json.RawMessage `json:"id"`
+}
+
+// newFakeQMP speaks QMP as QEMU on conn
+func newFakeQMP(t *testing.T, conn net.Conn) *fakeQMP {
+	return &fakeQMP{t: t, conn: conn, decoder: json.NewDecoder(conn), encoder: json.NewEncoder(conn)}
+}
+
+// receive reads the next command, ok is false once the client has gone
+func (s *fakeQMP) receive() (req request, ok bool) {
+	if err := s.decoder.Decode(&req); err != nil {
+		return request{}, false
+	}
+	return req, true
+}
+
+// send writes a JSON message as it is
+func (s *fakeQMP) send(msg string) {
+	if _, err := fmt.Fprintln(s.conn, msg); err != nil {
+		s.t.Errorf("failed to send %s: %v", msg, err)
+	}
+}
+
+// reply answers a command with result
+func (s *fakeQMP) reply(req request, result any) {
+	if err := s.encoder.Encode(map[string]any{"return": result, "id": req.ID}); err != nil {
+		s.t.Errorf("failed to reply to %s: %v", req.Execute, err)
+	}
+}
+
+// event sends an asynchronous event
+func (s *fakeQMP) event(name string, data string) {
+	s.send(fmt.Sprintf(`{"event": %q, "data": %s, "timestamp": {"seconds": 1700000000, "microseconds": 250000}}`, name, data))
+}
+
+// negotiate greets the client and accepts qmp_capabilities, ok is false if the client sent something else
+func (s *fakeQMP) negotiate() bool {
+	s.send(greeting)
+	req, ok := s.receive()
+	if !ok || req.Execute != "qmp_capabilities" {
+		s.t.Errorf("first command = %q, want qmp_capabilities", req.Execute)
+		return false
+	}
+	s.reply(req, struct{}{})
+	return true
+}
+
+// serveQMP listens on a unix socket in a temporary directory and runs serve for the first client
+func serveQMP(t *testing.T, serve func(s *fakeQMP)) string {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", path, err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(newFakeQMP(t, conn))
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-served
+	})
+	return path
+}
+
+// dial connects to a fake server, the client is closed when the test ends
+func dial(t *testing.T, path string) *Client {
+	client, err := Dial(path, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestDial(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		if s.negotiate() {
+			s.receive()
+		}
+	})
+	client := dial(t, path)
+
+	if version := client.Greeting.Version(); version != "8.2.2" {
+		t.Errorf("Version() = %s, want 8.2.2", version)
+	}
+	if caps := client.Greeting.QMP.Capabilities; len(caps) != 1 || caps[0] != "oob" {
+		t.Errorf("capabilities = %v, want [oob]", caps)
+	}
+}
+
+func TestDialCapabilitiesRefused(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		s.send(greeting)
+		if req, ok := s.receive(); ok {
+			s.send(fmt.Sprintf(`{"error": {"class": "CommandNotFound", "desc": "Capabilities negotiation is already complete"}, "id": %s}`, req.ID))
+		}
+		s.receive()
+	})
+	_, err := Dial(path, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "failed to negotiate QMP capabilities") {
+		t.Errorf("Dial() = %v, want a capabilities error", err)
+	}
+}
+
+func TestDialNoGreeting(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		// Hold the connection without greeting until the client gives up
+		s.receive()
+	})
+	start := time.Now()
+	_, err := Dial(path, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "failed to read QMP greeting") {
+		t.Errorf("Dial() = %v, want a greeting error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Dial() took %s with a timeout of 100ms", elapsed)
+	}
+}
+
+func TestExecuteConcurrent(t *testing.T) {
+	const commands = 20
+	path := serveQMP(t, func(s *fakeQMP) {
+		if !s.negotiate() {
+			return
+		}
+		// Collect every command first and answer them in reverse, so each reply has to be matched by id
+		var reqs []request
+		ids := map[string]bool{}
+		for len(reqs) < commands {
+			req, ok := s.receive()
+			if !ok {
+				return
+			}
+			if ids[string(req.ID)] {
+				s.t.Errorf("id %s was used twice", req.ID)
+			}
+			ids[string(req.ID)] = true
+			reqs = append(reqs, req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			s.reply(reqs[i], reqs[i].Arguments)
+		}
+		s.receive()
+	})
+	client := dial(t, path)
+
+	var wg sync.WaitGroup
+	for i := 0; i < commands; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var result struct {
+				N int `json:"n"`
+			}
+			if err := client.Run("echo", map[string]int{"n": n}, &result); err != nil {
+				t.Errorf("Run(echo %d) failed: %v", n, err)
+			} else if result.N != n {
+				t.Errorf("Run(echo %d) got the reply to echo %d", n, result.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestExecuteError(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		if !s.negotiate() {
+			return
+		}
+		if req, ok := s.receive(); ok {
+			s.send(fmt.Sprintf(`{"error": {"class": "DeviceNotFound", "desc": "Device 'usb1' not found"}, "id": %s}`, req.ID))
+		}
+		s.receive()
+	})
+	client := dial(t, path)
+
+	_, err := client.Execute("device_del", map[string]string{"id": "usb1"})
+	var qmpErr *Error
+	if !errors.As(err, &qmpErr) || qmpErr.Class != "DeviceNotFound" {
+		t.Fatalf("Execute() = %v, want a DeviceNotFound error", err)
+	}
+	if err.Error() != "device_del failed: Device 'usb1' not found" {
+		t.Errorf("Execute() error = %q", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		if !s.negotiate() {
+			return
+		}
+		s.event("RESET", `{"guest": true, "reason": "guest-reset"}`)
+		req, ok := s.receive()
+		if !ok {
+			return
+		}
+		// An event between a command and its reply must not be taken for the reply
+		s.event("WATCHDOG", `{"action": "pause"}`)
+		s.reply(req, map[string]string{"status": "paused"})
+		s.receive()
+	})
+	client := dial(t, path)
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := client.Run("query-status", nil, &status); err != nil || status.Status != "paused" {
+		t.Fatalf("Run(query-status) = %q, %v, want paused", status.Status, err)
+	}
+
+	want := []struct {
+		name string
+		data string
+	}{
+		{"RESET", `{"guest": true, "reason": "guest-reset"}`},
+		{"WATCHDOG", `{"action": "pause"}`},
+	}
+	for _, w := range want {
+		select {
+		case event := <-client.Events():
+			if event.Name != w.name {
+				t.Errorf("event = %s, want %s", event.Name, w.name)
+			}
+			if string(event.Data) != w.data {
+				t.Errorf("%s data = %s, want %s", event.Name, event.Data, w.data)
+			}
+			if wantTime := time.Unix(1700000000, 250000000); !event.Time.Equal(wantTime) {
+				t.Errorf("%s time = %s, want %s", event.Name, event.Time, wantTime)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", w.name)
+		}
+	}
+}
+
+func TestEventsDoNotBlockReplies(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		if !s.negotiate() {
+			return
+		}
+		req, ok := s.receive()
+		if !ok {
+			return
+		}
+		for i := 0; i < eventBuffer+10; i++ {
+			s.event("BALLOON_CHANGE", fmt.Sprintf(`{"actual": %d}`, i))
+		}
+		s.reply(req, struct{}{})
+		s.receive()
+	})
+	client := dial(t, path)
+
+	// Nobody reads the events, the reply has to come through anyway
+	if _, err := client.Execute("balloon", map[string]int{"value": 1 << 30}); err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if queued := len(client.Events()); queued != eventBuffer {
+		t.Errorf("%d events queued, want %d", queued, eventBuffer)
+	}
+	// The oldest events are kept
+	if event := <-client.Events(); string(event.Data) != `{"actual": 0}` {
+		t.Errorf("first event data = %s, want the first event sent", event.Data)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		if !s.negotiate() {
+			return
+		}
+		slow, ok := s.receive()
+		if !ok {
+			return
+		}
+		// The next command only comes once the client gave up on the first, its late reply has to be dropped
+		next, ok := s.receive()
+		if !ok {
+			return
+		}
+		s.reply(slow, "late")
+		s.reply(next, "next")
+		s.receive()
+	})
+	client := dial(t, path)
+
+	start := time.Now()
+	_, err := client.ExecuteTimeout("query-slow", nil, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "query-slow timed out after 50ms") {
+		t.Fatalf("ExecuteTimeout() = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ExecuteTimeout() returned after %s, want about 50ms", elapsed)
+	}
+
+	var result string
+	if err := client.Run("query-next", nil, &result); err != nil || result != "next" {
+		t.Errorf("Run() after a timeout = %q, %v, want next", result, err)
+	}
+}
+
+func TestServerClosesMidCommand(t *testing.T) {
+	path := serveQMP(t, func(s *fakeQMP) {
+		if !s.negotiate() {
+			return
+		}
+		// QEMU quits while the command runs
+		s.receive()
+	})
+	client := dial(t, path)
+
+	_, err := client.Execute("system_powerdown", nil)
+	if err == nil || !strings.Contains(err.Error(), "QMP connection closed") {
+		t.Fatalf("Execute() = %v, want the connection to be closed", err)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done() wasn't closed")
+	}
+	if _, open := <-client.Events(); open {
+		t.Error("Events() wasn't closed")
+	}
+
+	// Later commands fail right away
+	start := time.Now()
+	if _, err := client.Execute("query-status", nil); err == nil || !strings.Contains(err.Error(), "QMP connection closed") {
+		t.Errorf("Execute() after the connection closed = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Execute() after the connection closed took %s", elapsed)
+	}
+}
+
+func TestNewClientOverPipe(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		s := newFakeQMP(t, serverConn)
+		if s.negotiate() {
+			if req, ok := s.receive(); ok {
+				s.reply(req, map[string]bool{"running": true})
+			}
+		}
+	}()
+
+	client, err := NewClient(clientConn, time.Second)
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+	var status struct {
+		Running bool `json:"running"`
+	}
+	if err := client.Run("query-status", nil, &status); err != nil || !status.Running {
+		t.Errorf("Run(query-status) = %+v, %v, want running", status, err)
+	}
+}
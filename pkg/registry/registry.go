@@ -0,0 +1,155 @@
+// Package registry keeps the list of VM directories bvm knows about, in $XDG_CONFIG_HOME/bvm-go/vms.toml.
+//
+// bvm new-vm adds the directories it creates. Everything about a VM other than its name and where it is
+// stays in the VM directory, so a VM directory that was moved only needs its path updated here.
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// VM is a VM directory in the registry
+type VM struct {
+	// Name is unique in the registry, the directory name unless that was taken
+	Name    string    `toml:"name"`
+	Path    string    `toml:"path"`
+	Created time.Time `toml:"created"`
+}
+
+// Registry is the list of VMs, loaded from and saved to a file
+type Registry struct {
+	VMs  []VM `toml:"vm"`
+	path string
+}
+
+// DefaultPath is vms.toml in the bvm-go directory of the user configuration directory
+func DefaultPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the configuration directory: %v", err)
+	}
+	return filepath.Join(configDir, "bvm-go", "vms.toml"), nil
+}
+
+// Load reads a registry, a file that doesn't exist yet is an empty registry
+func Load(path string) (*Registry, error) {
+	registry := &Registry{path: path}
+	if _, err := toml.DecodeFile(path, registry); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return registry, nil
+}
+
+// LoadDefault reads the registry at DefaultPath
+func LoadDefault() (*Registry, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	return Load(path)
+}
+
+// Save writes the registry back to the file it was loaded from, replacing it at once so it is never half written
+func (r *Registry) Save() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(r.path), err)
+	}
+	temp, err := os.CreateTemp(filepath.Dir(r.path), ".vms-*.toml")
+	if err != nil {
+		return fmt.Errorf("failed to save the VM list: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	fmt.Fprintln(temp, "# VM directories bvm knows about, written by bvm new-vm and bvm manage-vms-cli")
+	if err := toml.NewEncoder(temp).Encode(r); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save the VM list: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save the VM list: %v", err)
+	}
+	if err := os.Rename(temp.Name(), r.path); err != nil {
+		return fmt.Errorf("failed to save the VM list: %v", err)
+	}
+	return nil
+}
+
+// Find returns the VM with a name or a path, nil if there is none
+func (r *Registry) Find(nameOrPath string) *VM {
+	absPath, _ := filepath.Abs(nameOrPath)
+	for i := range r.VMs {
+		if r.VMs[i].Name == nameOrPath || r.VMs[i].Path == absPath {
+			return &r.VMs[i]
+		}
+	}
+	return nil
+}
+
+// Add registers a VM directory under the name of the directory, with a number appended if that is taken.
+// A directory that is already registered keeps its name.
+func (r *Registry) Add(path string) (*VM, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %s: %v", path, err)
+	}
+	for i := range r.VMs {
+		if r.VMs[i].Path == absPath {
+			return &r.VMs[i], nil
+		}
+	}
+
+	base := filepath.Base(absPath)
+	name := base
+	for n := 2; r.Find(name) != nil; n++ {
+		name = base + "-" + strconv.Itoa(n)
+	}
+	r.VMs = append(r.VMs, VM{Name: name, Path: absPath, Created: time.Now().Truncate(time.Second)})
+	return &r.VMs[len(r.VMs)-1], nil
+}
+
+// Remove unregisters a VM, the directory is left alone
+func (r *Registry) Remove(name string) error {
+	for i := range r.VMs {
+		if r.VMs[i].Name == name {
+			r.VMs = append(r.VMs[:i], r.VMs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no VM is called %s", name)
+}
+
+// Rename changes the name of a VM, the directory keeps its name
+func (r *Registry) Rename(name string, newName string) error {
+	vm := r.Find(name)
+	if vm == nil {
+		return fmt.Errorf("no VM is called %s", name)
+	}
+	if newName == "" {
+		return fmt.Errorf("the new name is empty")
+	}
+	if other := r.Find(newName); other != nil && other != vm {
+		return fmt.Errorf("%s is already the name of the VM in %s", newName, other.Path)
+	}
+	vm.Name = newName
+	return nil
+}
+
+// Register adds a VM directory to the default registry
+func Register(path string) (*VM, error) {
+	registry, err := LoadDefault()
+	if err != nil {
+		return nil, err
+	}
+	vm, err := registry.Add(path)
+	if err != nil {
+		return nil, err
+	}
+	added := *vm
+	return &added, registry.Save()
+}
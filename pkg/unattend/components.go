@@ -0,0 +1,270 @@
+package unattend
+
+// ComponentInfo holds the attributes every answer file component carries
+type ComponentInfo struct {
+	Name                  string `xml:"name,attr"`
+	ProcessorArchitecture string `xml:"processorArchitecture,attr"`
+	PublicKeyToken        string `xml:"publicKeyToken,attr"`
+	Language              string `xml:"language,attr"`
+	VersionScope          string `xml:"versionScope,attr"`
+}
+
+// newComponentInfo returns the attributes for a Microsoft component built for the given architecture
+func newComponentInfo(name string, arch string) ComponentInfo {
+	return ComponentInfo{
+		Name:                  name,
+		ProcessorArchitecture: arch,
+		PublicKeyToken:        "31bf3856ad364e35",
+		Language:              "neutral",
+		VersionScope:          "nonSxS",
+	}
+}
+
+// windowsPE pass
+
+// InternationalCoreWinPE is the Microsoft-Windows-International-Core-WinPE component
+type InternationalCoreWinPE struct {
+	ComponentInfo
+	SetupUILanguage SetupUILanguage `xml:"SetupUILanguage"`
+	InputLocale     string          `xml:"InputLocale"`
+	SystemLocale    string          `xml:"SystemLocale"`
+	UILanguage      string          `xml:"UILanguage"`
+	UserLocale      string          `xml:"UserLocale"`
+}
+
+type SetupUILanguage struct {
+	UILanguage string `xml:"UILanguage"`
+}
+
+// Setup is the Microsoft-Windows-Setup component
+type Setup struct {
+	ComponentInfo
+	Diagnostics       Diagnostics       `xml:"Diagnostics"`
+	DiskConfiguration DiskConfiguration `xml:"DiskConfiguration"`
+	DynamicUpdate     DynamicUpdate     `xml:"DynamicUpdate"`
+	ImageInstall      ImageInstall      `xml:"ImageInstall"`
+	RunSynchronous    RunSynchronous    `xml:"RunSynchronous"`
+	UpgradeData       UpgradeData       `xml:"UpgradeData"`
+	UserData          UserData          `xml:"UserData"`
+}
+
+type Diagnostics struct {
+	OptIn bool `xml:"OptIn"`
+}
+
+type DiskConfiguration struct {
+	Disks []Disk `xml:"Disk"`
+}
+
+type Disk struct {
+	Action           string            `xml:"wcm:action,attr"`
+	DiskID           int               `xml:"DiskID"`
+	WillWipeDisk     bool              `xml:"WillWipeDisk"`
+	CreatePartitions []CreatePartition `xml:"CreatePartitions>CreatePartition"`
+	ModifyPartitions []ModifyPartition `xml:"ModifyPartitions>ModifyPartition"`
+}
+
+type CreatePartition struct {
+	Action string `xml:"wcm:action,attr"`
+	Order  int    `xml:"Order"`
+	Type   string `xml:"Type"`
+	Size   int    `xml:"Size,omitempty"`
+	Extend bool   `xml:"Extend,omitempty"`
+}
+
+type ModifyPartition struct {
+	Action      string `xml:"wcm:action,attr"`
+	Order       int    `xml:"Order"`
+	PartitionID int    `xml:"PartitionID"`
+	Label       string `xml:"Label,omitempty"`
+	Letter      string `xml:"Letter,omitempty"`
+	Format      string `xml:"Format,omitempty"`
+	TypeID      string `xml:"TypeID,omitempty"`
+}
+
+type DynamicUpdate struct {
+	Enable     bool   `xml:"Enable"`
+	WillShowUI string `xml:"WillShowUI"`
+}
+
+type ImageInstall struct {
+	OSImage OSImage `xml:"OSImage"`
+}
+
+type OSImage struct {
+	InstallTo                   InstallTo `xml:"InstallTo"`
+	InstallToAvailablePartition bool      `xml:"InstallToAvailablePartition"`
+}
+
+type InstallTo struct {
+	DiskID      int `xml:"DiskID"`
+	PartitionID int `xml:"PartitionID"`
+}
+
+type RunSynchronous struct {
+	Commands []RunSynchronousCommand `xml:"RunSynchronousCommand"`
+}
+
+type RunSynchronousCommand struct {
+	Action string `xml:"wcm:action,attr"`
+	Order  int    `xml:"Order"`
+	Path   string `xml:"Path"`
+}
+
+type UpgradeData struct {
+	Upgrade    bool   `xml:"Upgrade"`
+	WillShowUI string `xml:"WillShowUI"`
+}
+
+type UserData struct {
+	AcceptEula   bool             `xml:"AcceptEula"`
+	FullName     string           `xml:"FullName"`
+	Organization string           `xml:"Organization"`
+	ProductKey   *SetupProductKey `xml:"ProductKey,omitempty"`
+}
+
+type SetupProductKey struct {
+	Key        string `xml:"Key"`
+	WillShowUI string `xml:"WillShowUI"`
+}
+
+// PnpCustomizationsWinPE is the Microsoft-Windows-PnpCustomizationsWinPE component
+type PnpCustomizationsWinPE struct {
+	ComponentInfo
+	DriverPaths []PathAndCredentials `xml:"DriverPaths>PathAndCredentials"`
+}
+
+type PathAndCredentials struct {
+	Action   string `xml:"wcm:action,attr"`
+	KeyValue string `xml:"wcm:keyValue,attr"`
+	Path     string `xml:"Path"`
+}
+
+// offlineServicing, generalize and specialize passes
+
+// LUASettings is the Microsoft-Windows-LUA-Settings component
+type LUASettings struct {
+	ComponentInfo
+	EnableLUA bool `xml:"EnableLUA"`
+}
+
+// PnPSysprep is the Microsoft-Windows-PnPSysprep component
+type PnPSysprep struct {
+	ComponentInfo
+	PersistAllDeviceInstalls bool `xml:"PersistAllDeviceInstalls"`
+}
+
+// SecuritySPP is the Microsoft-Windows-Security-SPP component
+type SecuritySPP struct {
+	ComponentInfo
+	SkipRearm int `xml:"SkipRearm"`
+}
+
+// SecuritySPPUX is the Microsoft-Windows-Security-SPP-UX component
+type SecuritySPPUX struct {
+	ComponentInfo
+	SkipAutoActivation bool `xml:"SkipAutoActivation"`
+}
+
+// SQMApi is the Microsoft-Windows-SQMApi component
+type SQMApi struct {
+	ComponentInfo
+	CEIPEnabled int `xml:"CEIPEnabled"`
+}
+
+// Deployment is the Microsoft-Windows-Deployment component
+type Deployment struct {
+	ComponentInfo
+	RunSynchronous RunSynchronous `xml:"RunSynchronous"`
+}
+
+// ShellSetupSpecialize is the Microsoft-Windows-Shell-Setup component as used in the offlineServicing and specialize passes
+type ShellSetupSpecialize struct {
+	ComponentInfo
+	ComputerName   string          `xml:"ComputerName"`
+	OEMInformation *OEMInformation `xml:"OEMInformation,omitempty"`
+	OEMName        string          `xml:"OEMName,omitempty"`
+	ProductKey     string          `xml:"ProductKey,omitempty"`
+	TimeZone       string          `xml:"TimeZone,omitempty"`
+}
+
+type OEMInformation struct {
+	Manufacturer    string `xml:"Manufacturer"`
+	Model           string `xml:"Model"`
+	SupportHours    string `xml:"SupportHours"`
+	SupportPhone    string `xml:"SupportPhone"`
+	SupportProvider string `xml:"SupportProvider"`
+	SupportURL      string `xml:"SupportURL"`
+}
+
+// oobeSystem pass
+
+// InternationalCore is the Microsoft-Windows-International-Core component
+type InternationalCore struct {
+	ComponentInfo
+	InputLocale  string `xml:"InputLocale"`
+	SystemLocale string `xml:"SystemLocale"`
+	UILanguage   string `xml:"UILanguage"`
+	UserLocale   string `xml:"UserLocale"`
+}
+
+// ShellSetupOOBE is the Microsoft-Windows-Shell-Setup component as used in the oobeSystem pass
+type ShellSetupOOBE struct {
+	ComponentInfo
+	AutoLogon                  AutoLogon            `xml:"AutoLogon"`
+	DisableAutoDaylightTimeSet bool                 `xml:"DisableAutoDaylightTimeSet"`
+	OOBE                       OOBE                 `xml:"OOBE"`
+	UserAccounts               UserAccounts         `xml:"UserAccounts"`
+	RegisteredOrganization     string               `xml:"RegisteredOrganization"`
+	RegisteredOwner            string               `xml:"RegisteredOwner"`
+	TimeZone                   string               `xml:"TimeZone,omitempty"`
+	FirstLogonCommands         []SynchronousCommand `xml:"FirstLogonCommands>SynchronousCommand"`
+}
+
+type AutoLogon struct {
+	Password Password `xml:"Password"`
+	Enabled  bool     `xml:"Enabled"`
+	Username string   `xml:"Username"`
+}
+
+type Password struct {
+	Value     string `xml:"Value"`
+	PlainText bool   `xml:"PlainText"`
+}
+
+type OOBE struct {
+	HideEULAPage              bool                `xml:"HideEULAPage"`
+	HideLocalAccountScreen    bool                `xml:"HideLocalAccountScreen"`
+	HideOEMRegistrationScreen bool                `xml:"HideOEMRegistrationScreen"`
+	HideOnlineAccountScreens  bool                `xml:"HideOnlineAccountScreens"`
+	HideWirelessSetupInOOBE   bool                `xml:"HideWirelessSetupInOOBE"`
+	NetworkLocation           string              `xml:"NetworkLocation"`
+	ProtectYourPC             int                 `xml:"ProtectYourPC"`
+	SkipUserOOBE              bool                `xml:"SkipUserOOBE"`
+	SkipMachineOOBE           bool                `xml:"SkipMachineOOBE"`
+	VMModeOptimizations       VMModeOptimizations `xml:"VMModeOptimizations"`
+}
+
+type VMModeOptimizations struct {
+	SkipWinREInitialization bool `xml:"SkipWinREInitialization"`
+}
+
+type UserAccounts struct {
+	LocalAccounts []LocalAccount `xml:"LocalAccounts>LocalAccount"`
+}
+
+type LocalAccount struct {
+	Action      string   `xml:"wcm:action,attr"`
+	Password    Password `xml:"Password"`
+	Description string   `xml:"Description"`
+	DisplayName string   `xml:"DisplayName"`
+	Group       string   `xml:"Group"`
+	Name        string   `xml:"Name"`
+}
+
+type SynchronousCommand struct {
+	Action      string `xml:"wcm:action,attr"`
+	CommandLine string `xml:"CommandLine"`
+	Description string `xml:"Description"`
+	Order       int    `xml:"Order"`
+}
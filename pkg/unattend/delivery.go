@@ -0,0 +1,75 @@
+package unattend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeliveryMethod is the way autounattend.xml is handed to Windows Setup.
+//
+// Exactly one method is used per firstboot attempt, so the answer file is never found twice and the
+// guest can report which one Setup picked up, see DeliveryRegistryKey.
+type DeliveryMethod string
+
+const (
+	// DeliveryCDROM puts the answer file on a small ISO attached as one extra CD-ROM drive
+	DeliveryCDROM DeliveryMethod = "cdrom"
+	// DeliveryFloppy puts the answer file on a floppy image, only x86 machines have a floppy controller
+	DeliveryFloppy DeliveryMethod = "floppy"
+	// DeliveryInstallerISO embeds the answer file in a copy of installer.iso, which is only rebuilt when the answer file changes
+	DeliveryInstallerISO DeliveryMethod = "installer-iso"
+)
+
+// DeliveryRegistryKey and DeliveryRegistryValue are written by the specialize pass with the delivery method
+// the answer file was rendered for, so the guest can tell which medium Setup read it from
+const (
+	DeliveryRegistryKey   = `HKLM\SOFTWARE\BVM`
+	DeliveryRegistryValue = "AnswerFileDelivery"
+)
+
+// DeliveryMethods lists every delivery method
+func DeliveryMethods() []DeliveryMethod {
+	return []DeliveryMethod{DeliveryCDROM, DeliveryFloppy, DeliveryInstallerISO}
+}
+
+// ParseDeliveryMethod checks a delivery method name from bvm-config.toml
+func ParseDeliveryMethod(name string) (DeliveryMethod, error) {
+	for _, method := range DeliveryMethods() {
+		if string(method) == strings.ToLower(strings.TrimSpace(name)) {
+			return method, nil
+		}
+	}
+	return "", fmt.Errorf("unknown answer file delivery method %q", name)
+}
+
+// Supported reports whether the method works on the given Windows processor architecture
+func (m DeliveryMethod) Supported(arch string) bool {
+	if m == DeliveryFloppy {
+		return arch == "amd64" || arch == "x86"
+	}
+	return true
+}
+
+// BuildWindows10ARM is Windows 10 version 1709, the first release of Windows for ARM. Older ARM builds, like the
+// leaked ARMv7 build 15035, are pre-releases.
+const BuildWindows10ARM = 16299
+
+// DefaultDeliveryOrder returns the delivery methods to try for a Windows build, best first. A build of 0 is unknown.
+//
+// All Windows 10 and 11 releases search the root of removable drives for autounattend.xml, so the small
+// CD-ROM is tried first and rebuilding the installer ISO, which is slow, comes last. Setup of the ARM
+// pre-releases is only known to pick up the answer file from the installer drive, so it goes first there.
+func DefaultDeliveryOrder(build int, arch string) []DeliveryMethod {
+	methods := []DeliveryMethod{DeliveryCDROM, DeliveryFloppy, DeliveryInstallerISO}
+	if (arch == "arm" || arch == "arm64") && build > 0 && build < BuildWindows10ARM {
+		methods = []DeliveryMethod{DeliveryInstallerISO, DeliveryCDROM}
+	}
+
+	var order []DeliveryMethod
+	for _, method := range methods {
+		if method.Supported(arch) {
+			order = append(order, method)
+		}
+	}
+	return order
+}
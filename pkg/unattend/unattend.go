@@ -0,0 +1,402 @@
+// Package unattend generates the autounattend.xml answer file used by Windows Setup during firstboot.
+//
+// The answer file is built from typed Go structs instead of a static XML template,
+// so user settings from bvm-config.toml can be injected without patching XML text.
+// For documentation on components:
+// https://docs.microsoft.com/en-us/windows-hardware/customize/desktop/unattend/
+package unattend
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Unattend is the root element of an answer file
+type Unattend struct {
+	XMLName  xml.Name   `xml:"unattend"`
+	XMLNS    string     `xml:"xmlns,attr"`
+	XMLNSWcm string     `xml:"xmlns:wcm,attr"`
+	XMLNSXsi string     `xml:"xmlns:xsi,attr"`
+	Settings []Settings `xml:"settings"`
+}
+
+// Settings holds the components applied during one configuration pass
+type Settings struct {
+	Pass       string `xml:"pass,attr"`
+	Components []any  `xml:"component"`
+}
+
+// Locale holds the language settings applied to Windows Setup and the installed system
+type Locale struct {
+	UILanguage   string
+	InputLocale  string
+	SystemLocale string
+	UserLocale   string
+}
+
+// Config holds the settings the answer file is generated from
+type Config struct {
+	// Arch is the Windows processor architecture: arm64, amd64, arm or x86
+	Arch string
+	// Username and Password of the local administrator account that is logged in automatically
+	Username string
+	Password string
+	// ComputerName of the VM, "*" or empty lets Windows pick a random name
+	ComputerName string
+	// ProductKey is the generic install key that selects the Windows edition
+	ProductKey string
+	// Locale applied during setup and to the installed system
+	Locale Locale
+	// TimeZone is the Windows time zone ID, for example "W. Europe Standard Time". Empty keeps the Windows default.
+	TimeZone string
+	// Delivery is the method this copy of the answer file is delivered by, recorded in the registry during specialize
+	Delivery DeliveryMethod
+}
+
+const (
+	organization = "BVM Project"
+	hideSetupUI  = "Never"
+)
+
+// languageTag matches the language names Windows uses for locales, like "en-us" or "sr-latn-rs"
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// inputLocaleID matches an input locale given as language ID and keyboard layout, like "0409:00000409"
+var inputLocaleID = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{8}$`)
+
+// driverDirs lists the VirtIO driver folders copied to the unattended directory
+var driverDirs = []string{"vioinput", "viostor", "NetKVM", "vioscsi", "vioserial", "viogpudo", "viorng", "Balloon"}
+
+// Render generates the answer file for cfg and returns it as indented XML including the XML header
+func Render(cfg Config) ([]byte, error) {
+	answerFile, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return answerFile.Marshal()
+}
+
+// Marshal encodes the answer file as indented XML including the XML header
+func (u *Unattend) Marshal() ([]byte, error) {
+	xmlData, err := xml.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(xmlData, '\n')...), nil
+}
+
+// New builds the answer file for cfg
+func New(cfg Config) (*Unattend, error) {
+	if err := validate(&cfg); err != nil {
+		return nil, err
+	}
+
+	return &Unattend{
+		XMLNS:    "urn:schemas-microsoft-com:unattend",
+		XMLNSWcm: "http://schemas.microsoft.com/WMIConfig/2002/State",
+		XMLNSXsi: "http://www.w3.org/2001/XMLSchema-instance",
+		Settings: []Settings{
+			offlineServicingPass(cfg),
+			generalizePass(cfg),
+			specializePass(cfg),
+			windowsPEPass(cfg),
+			oobeSystemPass(cfg),
+		},
+	}, nil
+}
+
+// validate checks cfg and fills in defaults
+func validate(cfg *Config) error {
+	switch cfg.Arch {
+	case "arm64", "amd64", "arm", "x86":
+	case "":
+		return fmt.Errorf("processor architecture not set")
+	default:
+		return fmt.Errorf("unsupported processor architecture: %s", cfg.Arch)
+	}
+
+	if cfg.Username == "" {
+		return fmt.Errorf("username not set")
+	}
+	// Windows user names cannot contain these characters
+	if strings.ContainsAny(cfg.Username, `"/\[]:;|=,+*?<>@`) {
+		return fmt.Errorf("username %q contains characters Windows does not allow", cfg.Username)
+	}
+
+	if err := validateLocale(cfg.Locale); err != nil {
+		return err
+	}
+
+	if cfg.Delivery != "" {
+		if _, err := ParseDeliveryMethod(string(cfg.Delivery)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ComputerName == "" {
+		cfg.ComputerName = "*"
+	}
+	// NetBIOS names are limited to 15 characters
+	if cfg.ComputerName != "*" && len(cfg.ComputerName) > 15 {
+		return fmt.Errorf("computer name %q is longer than 15 characters", cfg.ComputerName)
+	}
+	return nil
+}
+
+// validateLocale checks the locale names, Windows Setup stops with an error on names it doesn't know
+func validateLocale(locale Locale) error {
+	if locale == (Locale{}) {
+		return nil
+	}
+	// The locale components are only added with a display language
+	if locale.UILanguage == "" {
+		return fmt.Errorf("locale has no UI language")
+	}
+	for _, name := range []string{locale.UILanguage, locale.SystemLocale, locale.UserLocale} {
+		if name != "" && !languageTag.MatchString(name) {
+			return fmt.Errorf("invalid locale %q", name)
+		}
+	}
+	// Input locales are a list like "0407:00000407;0409:00000409", language names are allowed too
+	if locale.InputLocale != "" {
+		for _, name := range strings.Split(locale.InputLocale, ";") {
+			if !inputLocaleID.MatchString(name) && !languageTag.MatchString(name) {
+				return fmt.Errorf("invalid input locale %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+func offlineServicingPass(cfg Config) Settings {
+	return Settings{
+		Pass: "offlineServicing",
+		Components: []any{
+			LUASettings{
+				ComponentInfo: newComponentInfo("Microsoft-Windows-LUA-Settings", cfg.Arch),
+				EnableLUA:     false,
+			},
+			ShellSetupSpecialize{
+				ComponentInfo: newComponentInfo("Microsoft-Windows-Shell-Setup", cfg.Arch),
+				ComputerName:  cfg.ComputerName,
+			},
+		},
+	}
+}
+
+func generalizePass(cfg Config) Settings {
+	return Settings{
+		Pass: "generalize",
+		Components: []any{
+			PnPSysprep{
+				ComponentInfo:            newComponentInfo("Microsoft-Windows-PnPSysprep", cfg.Arch),
+				PersistAllDeviceInstalls: true,
+			},
+			SecuritySPP{
+				ComponentInfo: newComponentInfo("Microsoft-Windows-Security-SPP", cfg.Arch),
+				SkipRearm:     1,
+			},
+		},
+	}
+}
+
+func specializePass(cfg Config) Settings {
+	settings := Settings{
+		Pass: "specialize",
+		Components: []any{
+			SecuritySPPUX{
+				ComponentInfo:      newComponentInfo("Microsoft-Windows-Security-SPP-UX", cfg.Arch),
+				SkipAutoActivation: true,
+			},
+			ShellSetupSpecialize{
+				ComponentInfo: newComponentInfo("Microsoft-Windows-Shell-Setup", cfg.Arch),
+				ComputerName:  cfg.ComputerName,
+				OEMInformation: &OEMInformation{
+					Manufacturer:    organization,
+					Model:           cfg.Username,
+					SupportHours:    "24/7",
+					SupportProvider: organization,
+					SupportURL:      "https://github.com/pi-apps-go/bvm-go/issues",
+				},
+				OEMName:    organization,
+				ProductKey: cfg.ProductKey,
+				TimeZone:   cfg.TimeZone,
+			},
+			SQMApi{
+				ComponentInfo: newComponentInfo("Microsoft-Windows-SQMApi", cfg.Arch),
+				CEIPEnabled:   0,
+			},
+		},
+	}
+
+	if cfg.Delivery != "" {
+		settings.Components = append(settings.Components, Deployment{
+			ComponentInfo: newComponentInfo("Microsoft-Windows-Deployment", cfg.Arch),
+			RunSynchronous: RunSynchronous{Commands: []RunSynchronousCommand{{
+				Action: "add",
+				Order:  1,
+				Path:   fmt.Sprintf(`reg add %s /v %s /t REG_SZ /d %s /f`, DeliveryRegistryKey, DeliveryRegistryValue, cfg.Delivery),
+			}}},
+		})
+	}
+	return settings
+}
+
+func windowsPEPass(cfg Config) Settings {
+	var components []any
+
+	if cfg.Locale.UILanguage != "" {
+		components = append(components, InternationalCoreWinPE{
+			ComponentInfo:   newComponentInfo("Microsoft-Windows-International-Core-WinPE", cfg.Arch),
+			SetupUILanguage: SetupUILanguage{UILanguage: cfg.Locale.UILanguage},
+			InputLocale:     cfg.Locale.InputLocale,
+			SystemLocale:    cfg.Locale.SystemLocale,
+			UILanguage:      cfg.Locale.UILanguage,
+			UserLocale:      cfg.Locale.UserLocale,
+		})
+	}
+
+	// Windows Setup refuses to install on unsupported hardware unless these checks are bypassed
+	var bypassCommands []RunSynchronousCommand
+	for i, check := range []string{"BypassCPUCheck", "BypassRAMCheck", "BypassSecureBootCheck", "BypassTPMCheck"} {
+		bypassCommands = append(bypassCommands, RunSynchronousCommand{
+			Action: "add",
+			Order:  i + 1,
+			Path:   `reg add HKLM\System\Setup\LabConfig /v ` + check + ` /t REG_DWORD /d 0x00000001 /f`,
+		})
+	}
+
+	var productKey *SetupProductKey
+	if cfg.ProductKey != "" {
+		productKey = &SetupProductKey{Key: cfg.ProductKey, WillShowUI: hideSetupUI}
+	}
+
+	components = append(components, Setup{
+		ComponentInfo: newComponentInfo("Microsoft-Windows-Setup", cfg.Arch),
+		Diagnostics:   Diagnostics{OptIn: false},
+		DiskConfiguration: DiskConfiguration{
+			Disks: []Disk{{
+				Action:       "add",
+				DiskID:       0,
+				WillWipeDisk: true,
+				CreatePartitions: []CreatePartition{
+					{Action: "add", Order: 1, Type: "Primary", Size: 256}, // Windows RE Tools partition
+					{Action: "add", Order: 2, Type: "EFI", Size: 128},     // System partition (ESP)
+					{Action: "add", Order: 3, Type: "MSR", Size: 128},     // Microsoft reserved partition (MSR)
+					{Action: "add", Order: 4, Type: "Primary", Extend: true},
+				},
+				ModifyPartitions: []ModifyPartition{
+					{Action: "add", Order: 1, PartitionID: 1, Label: "WINRE", Format: "NTFS", TypeID: "DE94BBA4-06D1-4D40-A16A-BFD50179D6AC"},
+					{Action: "add", Order: 2, PartitionID: 2, Label: "System", Format: "FAT32"},
+					{Action: "add", Order: 3, PartitionID: 3}, // MSR partition does not need to be modified
+					{Action: "add", Order: 4, PartitionID: 4, Label: "Windows", Letter: "C", Format: "NTFS"},
+				},
+			}},
+		},
+		DynamicUpdate: DynamicUpdate{Enable: true, WillShowUI: hideSetupUI},
+		ImageInstall: ImageInstall{
+			OSImage: OSImage{
+				InstallTo:                   InstallTo{DiskID: 0, PartitionID: 4},
+				InstallToAvailablePartition: false,
+			},
+		},
+		RunSynchronous: RunSynchronous{Commands: bypassCommands},
+		UpgradeData:    UpgradeData{Upgrade: false, WillShowUI: hideSetupUI},
+		UserData: UserData{
+			AcceptEula:   true,
+			FullName:     cfg.Username,
+			Organization: organization,
+			ProductKey:   productKey,
+		},
+	})
+
+	// This makes the VirtIO drivers available to Windows.
+	// Multiple drive letters are specified to handle different configurations.
+	// https://github.com/virtio-win/virtio-win-pkg-scripts/blob/master/README.md
+	var driverPaths []PathAndCredentials
+	for _, driver := range driverDirs {
+		for _, letter := range []string{"D", "E", "F"} {
+			driverPaths = append(driverPaths, PathAndCredentials{
+				Action:   "add",
+				KeyValue: strconv.Itoa(len(driverPaths) + 1),
+				Path:     letter + `:\` + driver,
+			})
+		}
+	}
+	components = append(components, PnpCustomizationsWinPE{
+		ComponentInfo: newComponentInfo("Microsoft-Windows-PnpCustomizationsWinPE", cfg.Arch),
+		DriverPaths:   driverPaths,
+	})
+
+	return Settings{Pass: "windowsPE", Components: components}
+}
+
+func oobeSystemPass(cfg Config) Settings {
+	var components []any
+
+	if cfg.Locale.UILanguage != "" {
+		components = append(components, InternationalCore{
+			ComponentInfo: newComponentInfo("Microsoft-Windows-International-Core", cfg.Arch),
+			InputLocale:   cfg.Locale.InputLocale,
+			SystemLocale:  cfg.Locale.SystemLocale,
+			UILanguage:    cfg.Locale.UILanguage,
+			UserLocale:    cfg.Locale.UserLocale,
+		})
+	}
+
+	password := Password{Value: cfg.Password, PlainText: true}
+
+	components = append(components, ShellSetupOOBE{
+		ComponentInfo: newComponentInfo("Microsoft-Windows-Shell-Setup", cfg.Arch),
+		AutoLogon: AutoLogon{
+			Password: password,
+			Enabled:  true,
+			Username: cfg.Username,
+		},
+		DisableAutoDaylightTimeSet: false,
+		OOBE: OOBE{
+			HideEULAPage:              true,
+			HideLocalAccountScreen:    true,
+			HideOEMRegistrationScreen: true,
+			HideOnlineAccountScreens:  true,
+			HideWirelessSetupInOOBE:   true,
+			NetworkLocation:           "Home",
+			ProtectYourPC:             3,
+			SkipUserOOBE:              true,
+			SkipMachineOOBE:           true,
+			VMModeOptimizations:       VMModeOptimizations{SkipWinREInitialization: true},
+		},
+		UserAccounts: UserAccounts{
+			LocalAccounts: []LocalAccount{{
+				Action:      "add",
+				Password:    password,
+				Description: cfg.Username,
+				DisplayName: cfg.Username,
+				Group:       "Administrators",
+				Name:        cfg.Username,
+			}},
+		},
+		RegisteredOrganization: organization,
+		RegisteredOwner:        cfg.Username,
+		TimeZone:               cfg.TimeZone,
+		FirstLogonCommands: []SynchronousCommand{
+			{
+				Action:      "add",
+				CommandLine: `cmd /c "for %%i in (D E F G H I J K L M N O P Q R S T U V W X Y Z) do if exist %%i:\firstlogin.ps1 (powershell -ExecutionPolicy Bypass -WindowStyle Hidden -NoProfile -File "%%i:\firstlogin.ps1" && goto :done) & :done"`,
+				Description: "First logon script with drive letter detection",
+				Order:       1,
+			},
+			{
+				Action:      "add",
+				CommandLine: `powershell -ExecutionPolicy Bypass -WindowStyle Hidden -Command "Get-WmiObject -Class Win32_LogicalDisk | Where-Object {$_.DriveType -eq 5} | ForEach-Object { $script = Join-Path $_.DeviceID '\firstlogin.ps1'; if (Test-Path $script) { & $script; break } }"`,
+				Description: "PowerShell fallback for first logon script",
+				Order:       2,
+			},
+		},
+	})
+
+	return Settings{Pass: "oobeSystem", Components: components}
+}
@@ -0,0 +1,205 @@
+package unattend
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{
+			name: "arm64-en-us-cdrom",
+			cfg: Config{
+				Arch:       "arm64",
+				Username:   "bvm",
+				Password:   "bvm",
+				ProductKey: "VK7JG-NPHTM-C97JM-9MPGT-3V66T",
+				Locale: Locale{
+					UILanguage:   "en-us",
+					InputLocale:  "0409:00000409",
+					SystemLocale: "en-us",
+					UserLocale:   "en-us",
+				},
+				Delivery: DeliveryCDROM,
+			},
+		},
+		{
+			name: "amd64-de-de-floppy",
+			cfg: Config{
+				Arch:         "amd64",
+				Username:     "Anna",
+				Password:     "secret & <escaped>",
+				ComputerName: "WIN-DESKTOP",
+				ProductKey:   "YTMG3-N6DKC-DKB77-7M9GH-8HVX7",
+				Locale: Locale{
+					UILanguage:   "de-de",
+					InputLocale:  "0407:00000407;0409:00000409",
+					SystemLocale: "de-de",
+					UserLocale:   "de-de",
+				},
+				TimeZone: "W. Europe Standard Time",
+				Delivery: DeliveryFloppy,
+			},
+		},
+		{
+			name: "arm64-ja-jp-installer-iso",
+			cfg: Config{
+				Arch:     "arm64",
+				Username: "bvm",
+				Locale: Locale{
+					UILanguage:   "ja-jp",
+					InputLocale:  "0411:00000411",
+					SystemLocale: "ja-jp",
+					UserLocale:   "ja-jp",
+				},
+				TimeZone: "Tokyo Standard Time",
+				Delivery: DeliveryInstallerISO,
+			},
+		},
+		{
+			// Without a locale, product key or delivery method the optional components are left out
+			name: "x86-minimal",
+			cfg: Config{
+				Arch:     "x86",
+				Username: "bvm",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Render(test.cfg)
+			if err != nil {
+				t.Fatalf("Render() failed: %v", err)
+			}
+
+			golden := filepath.Join("testdata", test.name+".xml")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file, run go test -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Render() differs from %s, run go test -update if the change is intended:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestRenderValidation(t *testing.T) {
+	valid := Config{
+		Arch:     "arm64",
+		Username: "bvm",
+		Locale: Locale{
+			UILanguage:   "en-us",
+			InputLocale:  "0409:00000409",
+			SystemLocale: "en-us",
+			UserLocale:   "en-us",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   string
+	}{
+		{"no architecture", func(cfg *Config) { cfg.Arch = "" }, "processor architecture not set"},
+		{"unknown architecture", func(cfg *Config) { cfg.Arch = "riscv64" }, "unsupported processor architecture: riscv64"},
+		{"empty user", func(cfg *Config) { cfg.Username = "" }, "username not set"},
+		{"user with forbidden characters", func(cfg *Config) { cfg.Username = `DOMAIN\bvm` }, "contains characters Windows does not allow"},
+		{"bad UI language", func(cfg *Config) { cfg.Locale.UILanguage = "English" }, `invalid locale "English"`},
+		{"bad system locale", func(cfg *Config) { cfg.Locale.SystemLocale = "en_US.UTF-8" }, `invalid locale "en_US.UTF-8"`},
+		{"bad user locale", func(cfg *Config) { cfg.Locale.UserLocale = "e" }, `invalid locale "e"`},
+		{"bad input locale", func(cfg *Config) { cfg.Locale.InputLocale = "0409:00000409;0409-us" }, `invalid input locale "0409-us"`},
+		{"empty input locale in the list", func(cfg *Config) { cfg.Locale.InputLocale = "0409:00000409;" }, `invalid input locale ""`},
+		{"locale without UI language", func(cfg *Config) { cfg.Locale.UILanguage = "" }, "locale has no UI language"},
+		{"unknown delivery method", func(cfg *Config) { cfg.Delivery = "usb" }, `unknown answer file delivery method "usb"`},
+		{"long computer name", func(cfg *Config) { cfg.ComputerName = "BVM-WINDOWS-DESKTOP" }, "longer than 15 characters"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid
+			test.modify(&cfg)
+			_, err := Render(cfg)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Render() = %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := Render(valid); err != nil {
+		t.Errorf("Render() of a valid config failed: %v", err)
+	}
+	// Language names are valid input locales too
+	cfg := valid
+	cfg.Locale.InputLocale = "sr-latn-rs;0409:00000409"
+	if _, err := Render(cfg); err != nil {
+		t.Errorf("Render() with a language name as input locale failed: %v", err)
+	}
+}
+
+func TestDefaultDeliveryOrder(t *testing.T) {
+	var (
+		withFloppy    = []DeliveryMethod{DeliveryCDROM, DeliveryFloppy, DeliveryInstallerISO}
+		withoutFloppy = []DeliveryMethod{DeliveryCDROM, DeliveryInstallerISO}
+		installerISO  = []DeliveryMethod{DeliveryInstallerISO, DeliveryCDROM}
+	)
+	tests := []struct {
+		version string
+		build   int
+		arch    string
+		want    []DeliveryMethod
+	}{
+		{"unknown", 0, "arm64", withoutFloppy},
+		{"unknown", 0, "arm", withoutFloppy},
+		{"unknown", 0, "amd64", withFloppy},
+		{"unknown", 0, "x86", withFloppy},
+		{"Windows 10 ARMv7 preview", 15035, "arm", installerISO},
+		{"Windows 10 ARM64 preview", 15063, "arm64", installerISO},
+		{"Windows 10 1703", 15063, "amd64", withFloppy},
+		{"Windows 10 1703", 15063, "x86", withFloppy},
+		{"Windows 10 1709", 16299, "arm64", withoutFloppy},
+		{"Windows 10 22H2", 19045, "arm64", withoutFloppy},
+		{"Windows 10 22H2", 19045, "amd64", withFloppy},
+		{"Windows 10 22H2", 19045, "x86", withFloppy},
+		{"Windows 11 23H2", 22631, "arm64", withoutFloppy},
+		{"Windows 11 23H2", 22631, "amd64", withFloppy},
+		{"Windows 11 24H2", 26100, "arm64", withoutFloppy},
+		{"Windows 11 24H2", 26100, "amd64", withFloppy},
+	}
+	for _, test := range tests {
+		got := DefaultDeliveryOrder(test.build, test.arch)
+		if strings.Join(deliveryNames(got), ",") != strings.Join(deliveryNames(test.want), ",") {
+			t.Errorf("DefaultDeliveryOrder(%d, %q) for %s = %v, want %v", test.build, test.arch, test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseDeliveryMethod(t *testing.T) {
+	if method, err := ParseDeliveryMethod(" Installer-ISO "); err != nil || method != DeliveryInstallerISO {
+		t.Errorf("ParseDeliveryMethod(\" Installer-ISO \") = %q, %v, want %q", method, err, DeliveryInstallerISO)
+	}
+	if _, err := ParseDeliveryMethod("network"); err == nil {
+		t.Error("ParseDeliveryMethod(\"network\") succeeded")
+	}
+}
+
+func deliveryNames(methods []DeliveryMethod) []string {
+	var names []string
+	for _, method := range methods {
+		names = append(names, string(method))
+	}
+	return names
+}
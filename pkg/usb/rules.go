@@ -0,0 +1,109 @@
+package usb
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// classNames are the USB classes usb_autoforward accepts by name, from the class codes of usb.org
+var classNames = map[string]string{
+	"audio":        "01",
+	"comm":         "02",
+	"hid":          "03",
+	"image":        "06",
+	"printer":      "07",
+	"mass-storage": "08",
+	"cdc-data":     "0a",
+	"smart-card":   "0b",
+	"video":        "0e",
+	"wireless":     "e0",
+	"vendor":       "ff",
+}
+
+// ClassNames lists the class names rules accept
+func ClassNames() []string {
+	names := make([]string, 0, len(classNames))
+	for name := range classNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rule picks devices to forward as they are plugged in: a Selector, vendor:product with * for either ID like
+// 05dc:*, or class:<name or hex code> like class:mass-storage, which also matches the class of any interface
+type Rule struct {
+	Selector
+	// Class is a two digit hex class code, "" for rules by ID
+	Class string
+}
+
+// ParseRule parses a rule of usb_autoforward or a selector of usb_passthrough
+func ParseRule(value string) (Rule, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if class, found := strings.CutPrefix(value, "class:"); found {
+		if code, ok := classNames[class]; ok {
+			return Rule{Class: code}, nil
+		}
+		if code, err := strconv.ParseUint(class, 16, 8); err == nil {
+			return Rule{Class: fmt.Sprintf("%02x", code)}, nil
+		}
+		return Rule{}, fmt.Errorf("unknown USB class %q, use a hex class code or one of %s", class, strings.Join(ClassNames(), ", "))
+	}
+
+	vendor, product, found := strings.Cut(value, ":")
+	if found && (vendor == "*" || product == "*") {
+		if (vendor != "*" && !isHexID(vendor)) || (product != "*" && !isHexID(product)) {
+			return Rule{}, fmt.Errorf("invalid USB rule %q, use four hex digits or * for the vendor and the product like 05dc:*", value)
+		}
+		return Rule{Selector: Selector{VendorID: vendor, ProductID: product}}, nil
+	}
+
+	selector, err := ParseSelector(value)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{Selector: selector}, nil
+}
+
+// ParseRules parses a space separated list of rules
+func ParseRules(value string) ([]Rule, error) {
+	var rules []Rule
+	for _, field := range strings.Fields(value) {
+		rule, err := ParseRule(field)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r Rule) String() string {
+	if r.Class != "" {
+		for name, code := range classNames {
+			if code == r.Class {
+				return "class:" + name
+			}
+		}
+		return "class:" + r.Class
+	}
+	return r.Selector.String()
+}
+
+// Matches reports whether a rule picks a device. Hubs are never picked, they would take the devices behind them along.
+func (r Rule) Matches(d Device) bool {
+	switch {
+	case d.Hub:
+		return false
+	case r.Class != "":
+		return d.Class == r.Class || slices.Contains(d.InterfaceClasses, r.Class)
+	case r.ByID():
+		return (r.VendorID == "*" || r.VendorID == d.VendorID) && (r.ProductID == "*" || r.ProductID == d.ProductID)
+	default:
+		return r.Selector.Matches(d)
+	}
+}
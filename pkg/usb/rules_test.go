@@ -0,0 +1,102 @@
+package usb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Rule
+		err   string
+	}{
+		{value: "class:mass-storage", want: Rule{Class: "08"}},
+		{value: "CLASS:HID", want: Rule{Class: "03"}},
+		{value: "class:smart-card", want: Rule{Class: "0b"}},
+		{value: "class:e0", want: Rule{Class: "e0"}},
+		{value: "class:3", want: Rule{Class: "03"}},
+		{value: "class:EF", want: Rule{Class: "ef"}},
+		{value: "class:floppy", err: "unknown USB class"},
+		{value: "class:100", err: "unknown USB class"},
+		{value: "class:", err: "unknown USB class"},
+		{value: "05dc:*", want: Rule{Selector: Selector{VendorID: "05dc", ProductID: "*"}}},
+		{value: "*:A720", want: Rule{Selector: Selector{VendorID: "*", ProductID: "a720"}}},
+		{value: "*:*", want: Rule{Selector: Selector{VendorID: "*", ProductID: "*"}}},
+		{value: "5dc:*", err: "use four hex digits or *"},
+		{value: "*:a72g", err: "use four hex digits or *"},
+		{value: "05dc:a720", want: Rule{Selector: Selector{VendorID: "05dc", ProductID: "a720"}}},
+		{value: "1.5", want: Rule{Selector: Selector{Bus: 1, Address: 5}}},
+		{value: "1.*", err: "bus.device like 1.5"},
+		{value: "", err: "bus.device like 1.5"},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			rule, err := ParseRule(test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("ParseRule(%q) = %+v, %v, want an error with %q", test.value, rule, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRule(%q) failed: %v", test.value, err)
+			}
+			if rule != test.want {
+				t.Errorf("ParseRule(%q) = %+v, want %+v", test.value, rule, test.want)
+			}
+			// bvm prints rules with String, that has to parse back to the same rule
+			if again, err := ParseRule(rule.String()); err != nil || again != rule {
+				t.Errorf("ParseRule(%q) = %+v, %v, want the rule back", rule.String(), again, err)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	devices := []Device{
+		{Port: "1-1", Bus: 1, Address: 2, VendorID: "2109", ProductID: "3431", Class: "09", InterfaceClasses: []string{"09"}, Hub: true},
+		{Port: "1-1.2", Bus: 1, Address: 5, VendorID: "0781", ProductID: "5583", Class: "00", InterfaceClasses: []string{"08"}},
+		{Port: "1-1.3", Bus: 1, Address: 6, VendorID: "2e8a", ProductID: "000a", Class: "ef", InterfaceClasses: []string{"02", "0a", "ff"}},
+		{Port: "1-1.4", Bus: 1, Address: 7, VendorID: "046d", ProductID: "c31c", Class: "00", InterfaceClasses: []string{"03", "03"}},
+		{Port: "3-1", Bus: 3, Address: 2, VendorID: "0781", ProductID: "5567", Class: "00", InterfaceClasses: []string{"08"}},
+	}
+
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{rule: "class:mass-storage", want: "1-1.2 3-1"},
+		{rule: "class:hid", want: "1-1.4"},
+		{rule: "class:cdc-data", want: "1-1.3"},
+		{rule: "class:ef", want: "1-1.3"},
+		{rule: "class:vendor", want: "1-1.3"},
+		{rule: "class:09", want: ""},
+		{rule: "class:audio", want: ""},
+		{rule: "0781:*", want: "1-1.2 3-1"},
+		{rule: "*:000a", want: "1-1.3"},
+		{rule: "*:*", want: "1-1.2 1-1.3 1-1.4 3-1"},
+		{rule: "2109:*", want: ""},
+		{rule: "2109:3431", want: ""},
+		{rule: "0781:5567", want: "3-1"},
+		{rule: "1.5", want: "1-1.2"},
+		{rule: "1.2", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.rule, func(t *testing.T) {
+			rule, err := ParseRule(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var matched []string
+			for _, device := range devices {
+				if rule.Matches(device) {
+					matched = append(matched, device.Port)
+				}
+			}
+			if got := strings.Join(matched, " "); got != test.want {
+				t.Errorf("%s matches %q, want %q", test.rule, got, test.want)
+			}
+		})
+	}
+}
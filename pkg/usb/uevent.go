@@ -0,0 +1,128 @@
+package usb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sysfsRoot is where DEVPATH of a uevent is found, tests point it at a fake sysfs tree
+var sysfsRoot = "/sys"
+
+// Uevent is a message of the kernel about a device, its variables like ACTION, DEVPATH and SUBSYSTEM
+type Uevent map[string]string
+
+// ParseUevent parses a kernel uevent, a header like add@/devices/... followed by KEY=value strings.
+// ok is false for messages udevd sends to the same group, they start with libudev.
+func ParseUevent(message []byte) (uevent Uevent, ok bool) {
+	parts := bytes.Split(message, []byte{0})
+	if len(parts) == 0 || !bytes.Contains(parts[0], []byte("@")) {
+		return nil, false
+	}
+	uevent = Uevent{}
+	for _, part := range parts[1:] {
+		if key, value, found := strings.Cut(string(part), "="); found {
+			uevent[key] = value
+		}
+	}
+	return uevent, uevent["ACTION"] != ""
+}
+
+// Event is a USB device plugged in or unplugged
+type Event struct {
+	// Add is true when the device was plugged in, false when it was unplugged
+	Add    bool
+	Device Device
+}
+
+// DeviceEvent turns a uevent into an Event, ok is false for uevents that are not about a USB device coming or going.
+//
+// A device is reported when the kernel bound it, the interfaces and their classes are in sysfs by then. An
+// unplugged device is gone from sysfs, so it is described by what the uevent carries.
+func DeviceEvent(uevent Uevent) (event Event, ok bool) {
+	if uevent["SUBSYSTEM"] != "usb" || uevent["DEVTYPE"] != "usb_device" {
+		return Event{}, false
+	}
+	switch uevent["ACTION"] {
+	case "bind":
+		device, err := ReadDevice(filepath.Join(sysfsRoot, uevent["DEVPATH"]))
+		if err != nil {
+			device = ueventDevice(uevent)
+		}
+		return Event{Add: true, Device: device}, true
+	case "remove":
+		return Event{Add: false, Device: ueventDevice(uevent)}, true
+	}
+	return Event{}, false
+}
+
+// ueventDevice describes a device by its uevent: PRODUCT is vendor/product/version in hex without leading zeros,
+// TYPE is class/subclass/protocol in decimal
+func ueventDevice(uevent Uevent) Device {
+	device := Device{Port: filepath.Base(uevent["DEVPATH"])}
+	device.Bus, _ = strconv.Atoi(uevent["BUSNUM"])
+	device.Address, _ = strconv.Atoi(uevent["DEVNUM"])
+	product := strings.Split(uevent["PRODUCT"], "/")
+	if len(product) >= 2 {
+		vendor, _ := strconv.ParseUint(product[0], 16, 16)
+		id, _ := strconv.ParseUint(product[1], 16, 16)
+		device.VendorID = fmt.Sprintf("%04x", vendor)
+		device.ProductID = fmt.Sprintf("%04x", id)
+	}
+	if class, _, found := strings.Cut(uevent["TYPE"], "/"); found {
+		code, _ := strconv.ParseUint(class, 10, 8)
+		device.Class = fmt.Sprintf("%02x", code)
+		device.Hub = device.Class == "09"
+	}
+	return device
+}
+
+// Monitor receives kernel uevents from netlink
+type Monitor struct {
+	file *os.File
+}
+
+// NewMonitor joins the group of kernel uevents, that doesn't need root
+func NewMonitor() (*Monitor, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uevent socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to listen for uevents: %v", err)
+	}
+	// A non-blocking file goes through the runtime poller, so Close interrupts Receive
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Monitor{file: os.NewFile(uintptr(fd), "uevent")}, nil
+}
+
+// Receive waits for the next uevent. Messages that are not kernel uevents are skipped.
+func (m *Monitor) Receive() (Uevent, error) {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := m.file.Read(buffer)
+		if errors.Is(err, syscall.ENOBUFS) {
+			// Too many uevents at once, the ones that didn't fit are lost
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if uevent, ok := ParseUevent(buffer[:n]); ok {
+			return uevent, nil
+		}
+	}
+}
+
+func (m *Monitor) Close() error {
+	return m.file.Close()
+}
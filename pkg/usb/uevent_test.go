@@ -0,0 +1,130 @@
+package usb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// picoPath is the DEVPATH of a Pico plugged into a hub of a Raspberry Pi 4
+const picoPath = "/devices/platform/scb/fd500000.pcie/pci0000:00/0000:00:00.0/0000:01:00.0/usb1/1-1/1-1.3"
+
+// Uevents captured from the netlink socket while a Pico was plugged in and unplugged
+var (
+	picoAdd = []byte("add@" + picoPath + "\x00ACTION=add\x00DEVPATH=" + picoPath + "\x00SUBSYSTEM=usb\x00MAJOR=189\x00MINOR=5\x00" +
+		"DEVNAME=bus/usb/001/006\x00DEVTYPE=usb_device\x00PRODUCT=2e8a/a/100\x00TYPE=239/2/1\x00BUSNUM=001\x00DEVNUM=006\x00SEQNUM=3981\x00")
+	picoBind = []byte("bind@" + picoPath + "\x00ACTION=bind\x00DEVPATH=" + picoPath + "\x00SUBSYSTEM=usb\x00MAJOR=189\x00MINOR=5\x00" +
+		"DEVNAME=bus/usb/001/006\x00DEVTYPE=usb_device\x00DRIVER=usb\x00PRODUCT=2e8a/a/100\x00TYPE=239/2/1\x00BUSNUM=001\x00DEVNUM=006\x00SEQNUM=3990\x00")
+	picoRemove = []byte("remove@" + picoPath + "\x00ACTION=remove\x00DEVPATH=" + picoPath + "\x00SUBSYSTEM=usb\x00MAJOR=189\x00MINOR=5\x00" +
+		"DEVNAME=bus/usb/001/006\x00DEVTYPE=usb_device\x00PRODUCT=2e8a/a/100\x00TYPE=239/2/1\x00BUSNUM=001\x00DEVNUM=006\x00SEQNUM=4012\x00")
+	picoInterfaceBind = []byte("bind@" + picoPath + "/1-1.3:1.0\x00ACTION=bind\x00DEVPATH=" + picoPath + "/1-1.3:1.0\x00SUBSYSTEM=usb\x00" +
+		"DEVTYPE=usb_interface\x00DRIVER=cdc_acm\x00PRODUCT=2e8a/a/100\x00TYPE=239/2/1\x00INTERFACE=2/2/0\x00" +
+		"MODALIAS=usb:v2E8Ap000Ad0100dcEFdsc02dp01ic02isc02ip00in00\x00SEQNUM=3988\x00")
+	picoTTYAdd = []byte("add@" + picoPath + "/1-1.3:1.0/tty/ttyACM0\x00ACTION=add\x00DEVPATH=" + picoPath + "/1-1.3:1.0/tty/ttyACM0\x00" +
+		"SUBSYSTEM=tty\x00MAJOR=166\x00MINOR=0\x00DEVNAME=ttyACM0\x00SEQNUM=3989\x00")
+	hubRemove = []byte("remove@/devices/platform/scb/fd500000.pcie/pci0000:00/0000:00:00.0/0000:01:00.0/usb1/1-1\x00ACTION=remove\x00" +
+		"DEVPATH=/devices/platform/scb/fd500000.pcie/pci0000:00/0000:00:00.0/0000:01:00.0/usb1/1-1\x00SUBSYSTEM=usb\x00MAJOR=189\x00MINOR=1\x00" +
+		"DEVNAME=bus/usb/001/002\x00DEVTYPE=usb_device\x00PRODUCT=2109/3431/420\x00TYPE=9/0/1\x00BUSNUM=001\x00DEVNUM=002\x00SEQNUM=4020\x00")
+	// udevd sends its own messages to the same group after it handled a uevent
+	udevAdd = []byte("libudev\x00\xfe\xed\xca\xfe\x28\x00\x00\x00\x28\x00\x00\x00\x2c\x01\x00\x00ACTION=add\x00SUBSYSTEM=usb\x00")
+)
+
+// describe prints what the forwarding loop looks at of a device
+func describe(d Device) string {
+	return fmt.Sprintf("%s %d.%d %s class %s hub %v interfaces %v", d.Port, d.Bus, d.Address, d.ID(), d.Class, d.Hub, d.InterfaceClasses)
+}
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   []byte
+		ok        bool
+		action    string
+		subsystem string
+		devtype   string
+	}{
+		{name: "add", message: picoAdd, ok: true, action: "add", subsystem: "usb", devtype: "usb_device"},
+		{name: "bind", message: picoBind, ok: true, action: "bind", subsystem: "usb", devtype: "usb_device"},
+		{name: "remove", message: picoRemove, ok: true, action: "remove", subsystem: "usb", devtype: "usb_device"},
+		{name: "interface", message: picoInterfaceBind, ok: true, action: "bind", subsystem: "usb", devtype: "usb_interface"},
+		{name: "tty subsystem", message: picoTTYAdd, ok: true, action: "add", subsystem: "tty"},
+		{name: "udevd message", message: udevAdd},
+		{name: "header without variables", message: []byte("add@" + picoPath + "\x00")},
+		{name: "empty", message: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uevent, ok := ParseUevent(test.message)
+			if ok != test.ok {
+				t.Fatalf("ParseUevent() ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if uevent["ACTION"] != test.action || uevent["SUBSYSTEM"] != test.subsystem || uevent["DEVTYPE"] != test.devtype {
+				t.Errorf("ParseUevent() = ACTION %q SUBSYSTEM %q DEVTYPE %q, want %q %q %q",
+					uevent["ACTION"], uevent["SUBSYSTEM"], uevent["DEVTYPE"], test.action, test.subsystem, test.devtype)
+			}
+		})
+	}
+
+	uevent, _ := ParseUevent(picoAdd)
+	if uevent["DEVPATH"] != picoPath || uevent["PRODUCT"] != "2e8a/a/100" || uevent["SEQNUM"] != "3981" {
+		t.Errorf("ParseUevent() = %v, want every variable of the message", uevent)
+	}
+}
+
+func TestDeviceEvent(t *testing.T) {
+	// The bound Pico is read from a fake sysfs tree, like the kernel has it by the time it sends bind
+	root := t.TempDir()
+	saved := sysfsRoot
+	sysfsRoot = root
+	t.Cleanup(func() { sysfsRoot = saved })
+	writeFakeDevice(t, filepath.Join(root, filepath.Dir(picoPath)), fakeDevice{
+		port: "1-1.3", bus: 1, address: 6, vendor: "2e8a", product: "000a", class: "ef", name: "Pico", interfaces: []string{"02", "0a", "ff"},
+	})
+
+	tests := []struct {
+		name    string
+		message []byte
+		ok      bool
+		add     bool
+		device  string
+	}{
+		{name: "add waits for bind", message: picoAdd},
+		{name: "bind reads sysfs", message: picoBind, ok: true, add: true, device: "1-1.3 1.6 2e8a:000a class ef hub false interfaces [02 0a ff]"},
+		{name: "remove reads the uevent", message: picoRemove, ok: true, device: "1-1.3 1.6 2e8a:000a class ef hub false interfaces []"},
+		{name: "hub remove", message: hubRemove, ok: true, device: "1-1 1.2 2109:3431 class 09 hub true interfaces []"},
+		{name: "interface", message: picoInterfaceBind},
+		{name: "tty subsystem", message: picoTTYAdd},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uevent, ok := ParseUevent(test.message)
+			if !ok {
+				t.Fatal("ParseUevent() failed")
+			}
+			event, ok := DeviceEvent(uevent)
+			if ok != test.ok {
+				t.Fatalf("DeviceEvent() ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if event.Add != test.add || describe(event.Device) != test.device {
+				t.Errorf("DeviceEvent() = add %v %s, want add %v %s", event.Add, describe(event.Device), test.add, test.device)
+			}
+		})
+	}
+
+	// A device unplugged right after it was bound is gone from sysfs, the uevent describes it
+	sysfsRoot = t.TempDir()
+	uevent, _ := ParseUevent(picoBind)
+	event, ok := DeviceEvent(uevent)
+	if want := "1-1.3 1.6 2e8a:000a class ef hub false interfaces []"; !ok || !event.Add || describe(event.Device) != want {
+		t.Errorf("DeviceEvent() without sysfs = %v add %v %s, want add true %s", ok, event.Add, describe(event.Device), want)
+	}
+	if !(Rule{Class: "ef"}).Matches(event.Device) {
+		t.Error("class:ef doesn't match a device described by its uevent")
+	}
+}
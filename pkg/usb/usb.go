@@ -0,0 +1,272 @@
+// Package usb finds USB devices of the host in sysfs and parses the selectors usb_passthrough and bvm usb pick them with.
+//
+// A selector is either vendor:product like lsusb prints it, 05dc:a720, or bus.device like 1.5. The device number
+// changes every time a device enumerates again, after it was replugged or a guest driver reset it, so hypervisors
+// are given vendor and product IDs whenever they are enough to tell a device apart.
+package usb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SysfsDevices is where the kernel lists USB devices
+const SysfsDevices = "/sys/bus/usb/devices"
+
+// sysfsDevices is the directory List reads, tests point it at a fake sysfs tree
+var sysfsDevices = SysfsDevices
+
+// Device is a USB device of the host
+type Device struct {
+	// Bus and Address are the bus and device numbers lsusb prints
+	Bus     int
+	Address int
+	// Port is the sysfs name, like 1-1.2. It stays the same while the device is plugged into the same port.
+	Port      string
+	VendorID  string
+	ProductID string
+	// Manufacturer and Product are the strings the device reports, or the names from usb.ids
+	Manufacturer string
+	Product      string
+	// Class is bDeviceClass, 00 when the interfaces tell their class
+	Class string
+	// InterfaceClasses are the bInterfaceClass of the interfaces of the active configuration
+	InterfaceClasses []string
+	// Hub is whether the device is a hub, hubs can't be passed through
+	Hub bool
+}
+
+// Name is the manufacturer and product of the device
+func (d Device) Name() string {
+	name := strings.TrimSpace(d.Manufacturer + " " + d.Product)
+	if name == "" {
+		return "Unknown device"
+	}
+	return name
+}
+
+// ID is the vendor:product of the device
+func (d Device) ID() string {
+	return d.VendorID + ":" + d.ProductID
+}
+
+// Selector picks a device by vendor:product or by bus.device
+type Selector struct {
+	VendorID  string
+	ProductID string
+	Bus       int
+	Address   int
+}
+
+// ByID is whether the selector picks devices by vendor and product ID
+func (s Selector) ByID() bool {
+	return s.VendorID != ""
+}
+
+func (s Selector) String() string {
+	if s.ByID() {
+		return s.VendorID + ":" + s.ProductID
+	}
+	return fmt.Sprintf("%d.%d", s.Bus, s.Address)
+}
+
+// Matches reports whether the selector picks a device
+func (s Selector) Matches(d Device) bool {
+	if s.ByID() {
+		return s.VendorID == d.VendorID && s.ProductID == d.ProductID
+	}
+	return s.Bus == d.Bus && s.Address == d.Address
+}
+
+// ParseSelector parses vendor:product (hexadecimal) or bus.device (decimal)
+func ParseSelector(value string) (Selector, error) {
+	value = strings.TrimSpace(value)
+	if vendor, product, found := strings.Cut(value, ":"); found {
+		if !isHexID(vendor) || !isHexID(product) {
+			return Selector{}, fmt.Errorf("invalid USB device %q, vendor:product are four hex digits each like 05dc:a720", value)
+		}
+		return Selector{VendorID: strings.ToLower(vendor), ProductID: strings.ToLower(product)}, nil
+	}
+	if bus, address, found := strings.Cut(value, "."); found {
+		busNumber, err1 := strconv.Atoi(bus)
+		addressNumber, err2 := strconv.Atoi(address)
+		if err1 == nil && err2 == nil && busNumber > 0 && addressNumber > 0 {
+			return Selector{Bus: busNumber, Address: addressNumber}, nil
+		}
+	}
+	return Selector{}, fmt.Errorf("invalid USB device %q, expected vendor:product like 05dc:a720 or bus.device like 1.5", value)
+}
+
+// ParseSelectors parses a space separated list of selectors, like usb_passthrough
+func ParseSelectors(value string) ([]Selector, error) {
+	var selectors []Selector
+	for _, field := range strings.Fields(value) {
+		selector, err := ParseSelector(field)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+func isHexID(value string) bool {
+	if len(value) != 4 {
+		return false
+	}
+	_, err := strconv.ParseUint(value, 16, 16)
+	return err == nil
+}
+
+// List returns the USB devices of the host, root hubs left out, sorted by bus and device number
+func List() ([]Device, error) {
+	entries, err := os.ReadDir(sysfsDevices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list USB devices: %v", err)
+	}
+
+	var devices []Device
+	for _, entry := range entries {
+		name := entry.Name()
+		// Interfaces are named like 1-1.2:1.0 and root hubs like usb1
+		if strings.Contains(name, ":") || strings.HasPrefix(name, "usb") {
+			continue
+		}
+		device, err := ReadDevice(filepath.Join(sysfsDevices, name))
+		if err != nil {
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	ids := loadUSBIDs()
+	for i := range devices {
+		names := ids[devices[i].VendorID]
+		if devices[i].Manufacturer == "" {
+			devices[i].Manufacturer = names.vendor
+		}
+		if devices[i].Product == "" {
+			devices[i].Product = names.products[devices[i].ProductID]
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Bus != devices[j].Bus {
+			return devices[i].Bus < devices[j].Bus
+		}
+		return devices[i].Address < devices[j].Address
+	})
+	return devices, nil
+}
+
+// ReadDevice reads a device directory of sysfs
+func ReadDevice(dir string) (Device, error) {
+	read := func(file string) string {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	device := Device{
+		Port:         filepath.Base(dir),
+		VendorID:     read("idVendor"),
+		ProductID:    read("idProduct"),
+		Manufacturer: read("manufacturer"),
+		Product:      read("product"),
+		Class:        read("bDeviceClass"),
+	}
+	device.Hub = device.Class == "09"
+	// Interfaces are directories like 1-1.2:1.0 in the device directory
+	interfaces, _ := filepath.Glob(filepath.Join(dir, filepath.Base(dir)+":*"))
+	for _, iface := range interfaces {
+		if class, err := os.ReadFile(filepath.Join(iface, "bInterfaceClass")); err == nil {
+			device.InterfaceClasses = append(device.InterfaceClasses, strings.TrimSpace(string(class)))
+		}
+	}
+	var err error
+	if device.Bus, err = strconv.Atoi(read("busnum")); err != nil {
+		return Device{}, fmt.Errorf("%s is not a USB device", dir)
+	}
+	if device.Address, err = strconv.Atoi(read("devnum")); err != nil {
+		return Device{}, fmt.Errorf("%s is not a USB device", dir)
+	}
+	return device, nil
+}
+
+// Find returns the devices a selector picks
+func Find(devices []Device, selector Selector) []Device {
+	var found []Device
+	for _, device := range devices {
+		if selector.Matches(device) {
+			found = append(found, device)
+		}
+	}
+	return found
+}
+
+// Stable returns a selector for a device that keeps working after it enumerates again.
+// That is vendor:product unless another device of the host has the same IDs.
+func Stable(devices []Device, device Device) Selector {
+	byID := Selector{VendorID: device.VendorID, ProductID: device.ProductID}
+	if len(Find(devices, byID)) == 1 {
+		return byID
+	}
+	return Selector{Bus: device.Bus, Address: device.Address}
+}
+
+// usbIDNames are the names usb.ids has for a vendor and its products
+type usbIDNames struct {
+	vendor   string
+	products map[string]string
+}
+
+// loadUSBIDs reads the usb.ids database of the hwdata or usbutils package, it is empty when neither is installed
+func loadUSBIDs() map[string]usbIDNames {
+	ids := map[string]usbIDNames{}
+	var file *os.File
+	for _, path := range []string{"/usr/share/hwdata/usb.ids", "/usr/share/misc/usb.ids", "/var/lib/usbutils/usb.ids"} {
+		if f, err := os.Open(path); err == nil {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		return ids
+	}
+	defer file.Close()
+
+	// Vendors start a line with their ID, their products follow indented by a tab
+	var vendor string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "" || line[0] == '#':
+		case strings.HasPrefix(line, "\t\t"):
+		case line[0] == '\t':
+			if vendor == "" {
+				continue
+			}
+			if id, name, found := strings.Cut(line[1:], "  "); found {
+				ids[vendor].products[id] = name
+			}
+		default:
+			id, name, found := strings.Cut(line, "  ")
+			// The device classes and other lists after the vendors have a keyword in front
+			if !found || !isHexID(id) {
+				vendor = ""
+				continue
+			}
+			vendor = id
+			ids[vendor] = usbIDNames{vendor: name, products: map[string]string{}}
+		}
+	}
+	return ids
+}
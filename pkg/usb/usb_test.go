@@ -0,0 +1,222 @@
+package usb
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeDevice is a device directory of a fake sysfs tree
+type fakeDevice struct {
+	port       string
+	bus        int
+	address    int
+	vendor     string
+	product    string
+	class      string
+	name       string
+	interfaces []string
+}
+
+// writeFakeDevice writes a device directory and its interfaces to a fake sysfs tree, the kernel also lists the
+// interfaces next to the devices
+func writeFakeDevice(t *testing.T, root string, d fakeDevice) {
+	t.Helper()
+	files := map[string]string{
+		"busnum":       strconv.Itoa(d.bus),
+		"devnum":       strconv.Itoa(d.address),
+		"idVendor":     d.vendor,
+		"idProduct":    d.product,
+		"bDeviceClass": d.class,
+		"manufacturer": "Test",
+		"product":      d.name,
+	}
+	for i, class := range d.interfaces {
+		iface := d.port + ":1." + strconv.Itoa(i)
+		files[filepath.Join(iface, "bInterfaceClass")] = class
+		if err := os.MkdirAll(filepath.Join(root, iface), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, iface, "bInterfaceClass"), []byte(class+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, content := range files {
+		path := filepath.Join(root, d.port, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeSysfs writes a host with a hub, a Pico, and two flash drives of the same model, and points List at it
+func fakeSysfs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, d := range []fakeDevice{
+		{port: "usb1", bus: 1, address: 1, vendor: "1d6b", product: "0002", class: "09", name: "xHCI Host Controller", interfaces: []string{"09"}},
+		{port: "1-1", bus: 1, address: 2, vendor: "2109", product: "3431", class: "09", name: "USB2.0 Hub", interfaces: []string{"09"}},
+		{port: "1-1.2", bus: 1, address: 5, vendor: "0781", product: "5583", class: "00", name: "Ultra Fit", interfaces: []string{"08"}},
+		{port: "1-1.3", bus: 1, address: 6, vendor: "2e8a", product: "000a", class: "ef", name: "Pico", interfaces: []string{"02", "0a", "ff"}},
+		{port: "usb3", bus: 3, address: 1, vendor: "1d6b", product: "0003", class: "09", name: "xHCI Host Controller", interfaces: []string{"09"}},
+		{port: "3-1", bus: 3, address: 2, vendor: "0781", product: "5583", class: "00", name: "Ultra Fit", interfaces: []string{"08"}},
+	} {
+		writeFakeDevice(t, root, d)
+	}
+	saved := sysfsDevices
+	sysfsDevices = root
+	t.Cleanup(func() { sysfsDevices = saved })
+	return root
+}
+
+// ports lists the sysfs names of the devices a selector matches
+func ports(devices []Device, selector Selector) string {
+	var matched []string
+	for _, device := range devices {
+		if selector.Matches(device) {
+			matched = append(matched, device.Port)
+		}
+	}
+	return strings.Join(matched, " ")
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Selector
+		err   string
+	}{
+		{value: "05dc:a720", want: Selector{VendorID: "05dc", ProductID: "a720"}},
+		{value: "2E8A:000A", want: Selector{VendorID: "2e8a", ProductID: "000a"}},
+		{value: " 0781:5583\n", want: Selector{VendorID: "0781", ProductID: "5583"}},
+		{value: "1.5", want: Selector{Bus: 1, Address: 5}},
+		{value: "3.117", want: Selector{Bus: 3, Address: 117}},
+		{value: "5dc:a720", err: "four hex digits"},
+		{value: "05dc:a72g", err: "four hex digits"},
+		{value: "05dc:", err: "four hex digits"},
+		{value: "05dc:*", err: "four hex digits"},
+		{value: "1.0", err: "bus.device like 1.5"},
+		{value: "0.5", err: "bus.device like 1.5"},
+		{value: "-1.5", err: "bus.device like 1.5"},
+		{value: "1.5.2", err: "bus.device like 1.5"},
+		{value: "1-1.2", err: "bus.device like 1.5"},
+		{value: "usb1", err: "bus.device like 1.5"},
+		{value: "", err: "bus.device like 1.5"},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			selector, err := ParseSelector(test.value)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("ParseSelector(%q) = %+v, %v, want an error with %q", test.value, selector, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q) failed: %v", test.value, err)
+			}
+			if selector != test.want {
+				t.Errorf("ParseSelector(%q) = %+v, want %+v", test.value, selector, test.want)
+			}
+			if again, err := ParseSelector(selector.String()); err != nil || again != selector {
+				t.Errorf("ParseSelector(%q) = %+v, %v, want the selector back", selector.String(), again, err)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	root := fakeSysfs(t)
+	devices, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Root hubs and interfaces are left out, the rest is sorted by bus and device number
+	var got []string
+	for _, device := range devices {
+		got = append(got, device.Port+"="+strconv.Itoa(device.Bus)+"."+strconv.Itoa(device.Address))
+	}
+	if want := "1-1=1.2 1-1.2=1.5 1-1.3=1.6 3-1=3.2"; strings.Join(got, " ") != want {
+		t.Errorf("List() = %s, want %s", strings.Join(got, " "), want)
+	}
+	if !devices[0].Hub || devices[1].Hub {
+		t.Errorf("List() hubs = %v %v, want only 1-1 to be a hub", devices[0].Hub, devices[1].Hub)
+	}
+	if classes := strings.Join(devices[2].InterfaceClasses, " "); classes != "02 0a ff" {
+		t.Errorf("interface classes of 1-1.3 = %q, want %q", classes, "02 0a ff")
+	}
+	if _, err := ReadDevice(filepath.Join(root, "1-1.3:1.0")); err == nil {
+		t.Error("ReadDevice() of an interface succeeded, want an error")
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	root := fakeSysfs(t)
+	before, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A guest driver reset makes the Pico enumerate again, the kernel gives it the next device number on its bus
+	writeFakeDevice(t, root, fakeDevice{port: "1-1.3", bus: 1, address: 7, vendor: "2e8a", product: "000a", class: "ef", name: "Pico", interfaces: []string{"02", "0a", "ff"}})
+	after, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		selector string
+		before   string
+		after    string
+	}{
+		{name: "vendor:product follows a device that enumerated again", selector: "2e8a:000a", before: "1-1.3", after: "1-1.3"},
+		{name: "bus.device loses a device that enumerated again", selector: "1.6", before: "1-1.3", after: ""},
+		{name: "bus.device picks the new device number", selector: "1.7", before: "", after: "1-1.3"},
+		{name: "vendor:product matches every device of the model", selector: "0781:5583", before: "1-1.2 3-1", after: "1-1.2 3-1"},
+		{name: "bus.device tells devices of the same model apart", selector: "3.2", before: "3-1", after: "3-1"},
+		{name: "same device number on another bus", selector: "1.2", before: "1-1", after: "1-1"},
+		{name: "root hubs are not listed", selector: "1.1", before: "", after: ""},
+		{name: "unplugged device", selector: "05dc:a720", before: "", after: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector, err := ParseSelector(test.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ports(before, selector); got != test.before {
+				t.Errorf("%s matches %q before the reset, want %q", test.selector, got, test.before)
+			}
+			if got := ports(after, selector); got != test.after {
+				t.Errorf("%s matches %q after the reset, want %q", test.selector, got, test.after)
+			}
+		})
+	}
+}
+
+func TestStable(t *testing.T) {
+	fakeSysfs(t)
+	devices, err := List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"1-1.3": "2e8a:000a",
+		// Two flash drives of the same model can only be told apart by bus and device number
+		"1-1.2": "1.5",
+		"3-1":   "3.2",
+	}
+	for _, device := range devices {
+		if want[device.Port] == "" {
+			continue
+		}
+		if got := Stable(devices, device).String(); got != want[device.Port] {
+			t.Errorf("Stable(%s) = %s, want %s", device.Port, got, want[device.Port])
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package vmstate tracks how far a VM directory got on its way from bvm new-vm to an installed Windows, in state.json.
+//
+// Every step moves the VM to a new state: new-vm to created, download to downloaded, prepare to prepared, firstboot
+// to installing and then installed. A step that fails moves it to failed and remembers which step that was. The
+// files a step made are recorded with it, and every change of state is kept in the history.
+//
+// Older versions wrote a bare step number into gui-steps-complete instead. A VM directory that only has that file
+// gets its state from it and from the files in the directory, and the file is removed once state.json is written.
+package vmstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileName is the name of the state file in the VM directory
+const FileName = "state.json"
+
+// legacyStepsFile is what older versions tracked the setup progress in, "1" after new-vm and "5" after firstboot
+const legacyStepsFile = "gui-steps-complete"
+
+// State is a step of the life of a VM
+type State string
+
+const (
+	Created    State = "created"
+	Downloaded State = "downloaded"
+	Prepared   State = "prepared"
+	Installing State = "installing"
+	Installed  State = "installed"
+	Failed     State = "failed"
+)
+
+// Steps are the bvm commands that move a VM to a state
+const (
+	StepNewVM     = "new-vm"
+	StepDownload  = "download"
+	StepPrepare   = "prepare"
+	StepFirstboot = "firstboot"
+)
+
+// allowedFrom lists the states a VM may be in to move to a state. Failed can be reached from every state, and a
+// failed VM moves on as if it was still in the state it had before the step failed.
+var allowedFrom = map[State][]State{
+	Created:    {Created},
+	Downloaded: {Created, Downloaded, Prepared, Installed},
+	Prepared:   {Downloaded, Prepared, Installing, Installed},
+	Installing: {Prepared, Installing},
+	Installed:  {Installing},
+}
+
+// Artifact is a file a step made, its path relative to the VM directory
+type Artifact struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Transition is a change of state
+type Transition struct {
+	From State     `json:"from,omitempty"`
+	To   State     `json:"to"`
+	Step string    `json:"step"`
+	Time time.Time `json:"time"`
+	// Error is why the step failed, only set when To is Failed
+	Error string `json:"error,omitempty"`
+}
+
+// VMState is the content of state.json
+type VMState struct {
+	State   State     `json:"state"`
+	Updated time.Time `json:"updated"`
+	// FailedStep and Error are the step that failed and why, only set in Failed
+	FailedStep string `json:"failed_step,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Phase is the installation phase an interrupted or failed firstboot resumes from
+	Phase string `json:"phase,omitempty"`
+	// Artifacts are the files each step made, by step
+	Artifacts map[string][]Artifact `json:"artifacts,omitempty"`
+	History   []Transition          `json:"history"`
+	// Migrated is set when the state was worked out from gui-steps-complete, state.json doesn't exist yet
+	Migrated bool `json:"-"`
+	vmdir    string
+}
+
+// New is the state of a VM directory that is being made, it has no state yet
+func New(vmdir string) *VMState {
+	return &VMState{vmdir: vmdir}
+}
+
+// Load reads state.json of a VM directory. Without one the state is worked out from gui-steps-complete and the files in it.
+func Load(vmdir string) (*VMState, error) {
+	state := &VMState{vmdir: vmdir}
+	data, err := os.ReadFile(filepath.Join(vmdir, FileName))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(vmdir); err != nil {
+			return nil, fmt.Errorf("VM directory does not exist: %s", vmdir)
+		}
+		state.migrate()
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", FileName, err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filepath.Join(vmdir, FileName), err)
+	}
+	return state, nil
+}
+
+// migrate works out the state of a VM directory made by an older version
+func (s *VMState) migrate() {
+	s.Migrated = true
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(s.vmdir, name))
+		return err == nil
+	}
+	step, _ := os.ReadFile(filepath.Join(s.vmdir, legacyStepsFile))
+	switch {
+	case strings.TrimSpace(string(step)) == "5":
+		s.State = Installed
+	case exists("disk.qcow2") && exists("unattended.iso"):
+		s.State = Prepared
+	case exists("installer.iso"):
+		s.State = Downloaded
+	default:
+		s.State = Created
+	}
+	if info, err := os.Stat(filepath.Join(s.vmdir, legacyStepsFile)); err == nil {
+		s.Updated = info.ModTime().Truncate(time.Second)
+	}
+}
+
+// Save writes state.json, replacing it at once so it is never half written, and removes gui-steps-complete
+func (s *VMState) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to save the VM state: %v", err)
+	}
+	temp, err := os.CreateTemp(s.vmdir, ".state-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to save the VM state: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(append(data, '\n')); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to save the VM state: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to save the VM state: %v", err)
+	}
+	if err := os.Rename(temp.Name(), filepath.Join(s.vmdir, FileName)); err != nil {
+		return fmt.Errorf("failed to save the VM state: %v", err)
+	}
+	s.Migrated = false
+	os.Remove(filepath.Join(s.vmdir, legacyStepsFile))
+	return nil
+}
+
+// CanMoveTo reports whether the VM may move to a state from the one it is in
+func (s *VMState) CanMoveTo(to State) bool {
+	if to == Failed {
+		return true
+	}
+	from := s.State
+	if from == Failed {
+		from = s.beforeFailure()
+	}
+	// A VM directory without any state is only ever created
+	if from == "" {
+		return to == Created
+	}
+	for _, allowed := range allowedFrom[to] {
+		if from == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// beforeFailure is the state the VM had before it failed, steps that failed again in between don't count
+func (s *VMState) beforeFailure() State {
+	for i := len(s.History) - 1; i >= 0; i-- {
+		if s.History[i].From != Failed {
+			return s.History[i].From
+		}
+	}
+	return ""
+}
+
+// Set moves the VM to a state after a step finished and records the files the step made, then saves.
+// Artifacts that don't exist are left out.
+func (s *VMState) Set(to State, step string, artifacts ...string) error {
+	if to == Failed {
+		return fmt.Errorf("use Fail to record a failed step")
+	}
+	if !s.CanMoveTo(to) {
+		return fmt.Errorf("a VM that is %s can't become %s", s.State, to)
+	}
+	s.move(to, step, "")
+	s.FailedStep, s.Error = "", ""
+	if to != Installing {
+		s.Phase = ""
+	}
+
+	if s.Artifacts == nil {
+		s.Artifacts = map[string][]Artifact{}
+	}
+	s.Artifacts[step] = nil
+	for _, path := range artifacts {
+		info, err := os.Stat(filepath.Join(s.vmdir, path))
+		if err != nil {
+			continue
+		}
+		s.Artifacts[step] = append(s.Artifacts[step], Artifact{Path: path, Size: info.Size(), Modified: info.ModTime().Truncate(time.Second)})
+	}
+	if len(s.Artifacts[step]) == 0 {
+		delete(s.Artifacts, step)
+	}
+	return s.Save()
+}
+
+// Fail moves the VM to Failed because a step failed, then saves
+func (s *VMState) Fail(step string, stepErr error) error {
+	s.move(Failed, step, stepErr.Error())
+	s.FailedStep, s.Error = step, stepErr.Error()
+	return s.Save()
+}
+
+// SetPhase records the installation phase firstboot resumes from, then saves
+func (s *VMState) SetPhase(phase string) error {
+	s.Phase = phase
+	return s.Save()
+}
+
+// move records a change of state in the history
+func (s *VMState) move(to State, step string, stepErr string) {
+	now := time.Now().Truncate(time.Second)
+	s.History = append(s.History, Transition{From: s.State, To: to, Step: step, Time: now, Error: stepErr})
+	s.State = to
+	s.Updated = now
+}
+
+// Record loads the state of a VM directory and moves it to a state, see Set
+func Record(vmdir string, to State, step string, artifacts ...string) error {
+	state, err := Load(vmdir)
+	if err != nil {
+		return err
+	}
+	return state.Set(to, step, artifacts...)
+}
+
+// RecordFailure loads the state of a VM directory and records that a step failed
+func RecordFailure(vmdir string, step string, stepErr error) error {
+	state, err := Load(vmdir)
+	if err != nil {
+		return err
+	}
+	return state.Fail(step, stepErr)
+}
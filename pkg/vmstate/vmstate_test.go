@@ -0,0 +1,233 @@
+package vmstate
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles creates files in a VM directory
+func writeFiles(t *testing.T, vmdir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(vmdir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCanMoveTo(t *testing.T) {
+	tests := []struct {
+		from State
+		to   State
+		want bool
+	}{
+		{from: "", to: Created, want: true},
+		{from: "", to: Downloaded},
+		{from: "", to: Failed, want: true},
+		{from: Created, to: Created, want: true},
+		{from: Created, to: Downloaded, want: true},
+		{from: Created, to: Prepared},
+		{from: Created, to: Installing},
+		{from: Downloaded, to: Downloaded, want: true},
+		{from: Downloaded, to: Prepared, want: true},
+		{from: Downloaded, to: Installing},
+		{from: Downloaded, to: Created},
+		{from: Prepared, to: Downloaded, want: true},
+		{from: Prepared, to: Prepared, want: true},
+		{from: Prepared, to: Installing, want: true},
+		{from: Prepared, to: Installed},
+		{from: Installing, to: Installing, want: true},
+		{from: Installing, to: Installed, want: true},
+		{from: Installing, to: Prepared, want: true},
+		{from: Installing, to: Downloaded},
+		{from: Installed, to: Downloaded, want: true},
+		{from: Installed, to: Prepared, want: true},
+		{from: Installed, to: Installing},
+		{from: Installed, to: Installed},
+		{from: Installed, to: Failed, want: true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.from)+" to "+string(test.to), func(t *testing.T) {
+			state := &VMState{State: test.from}
+			if got := state.CanMoveTo(test.to); got != test.want {
+				t.Errorf("CanMoveTo(%s) from %q = %v, want %v", test.to, test.from, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCanMoveToAfterFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Transition
+		allowed []State
+		refused []State
+	}{
+		{
+			name:    "download failed",
+			history: []Transition{{To: Created}, {From: Created, To: Failed}},
+			allowed: []State{Created, Downloaded},
+			refused: []State{Prepared, Installing},
+		},
+		{
+			name:    "prepare failed twice",
+			history: []Transition{{To: Created}, {From: Created, To: Downloaded}, {From: Downloaded, To: Failed}, {From: Failed, To: Failed}},
+			allowed: []State{Downloaded, Prepared},
+			refused: []State{Created, Installing},
+		},
+		{
+			name:    "firstboot failed while installing",
+			history: []Transition{{From: Downloaded, To: Prepared}, {From: Prepared, To: Installing}, {From: Installing, To: Failed}},
+			allowed: []State{Prepared, Installing},
+			refused: []State{Created, Downloaded},
+		},
+		{
+			name:    "no history",
+			allowed: []State{Created},
+			refused: []State{Downloaded, Prepared},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := &VMState{State: Failed, History: test.history}
+			for _, to := range test.allowed {
+				if !state.CanMoveTo(to) {
+					t.Errorf("CanMoveTo(%s) = false, want true", to)
+				}
+			}
+			for _, to := range test.refused {
+				if state.CanMoveTo(to) {
+					t.Errorf("CanMoveTo(%s) = true, want false", to)
+				}
+			}
+		})
+	}
+}
+
+func TestSetAndFail(t *testing.T) {
+	vmdir := t.TempDir()
+	writeFiles(t, vmdir, map[string]string{"installer.iso": "iso"})
+
+	state := New(vmdir)
+	if err := state.Set(Created, StepNewVM); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Fail(StepDownload, errors.New("connection reset")); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Set(Prepared, StepPrepare); err == nil || err.Error() != "a VM that is failed can't become prepared" {
+		t.Errorf("Set(prepared) after a failed download = %v, want an error", err)
+	}
+
+	// The download is retried from where the VM was before it failed
+	state, err := Load(vmdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != Failed || state.FailedStep != StepDownload || state.Error != "connection reset" {
+		t.Errorf("Load() after Fail = %s %s %q, want failed download", state.State, state.FailedStep, state.Error)
+	}
+	if err := state.Set(Downloaded, StepDownload, "installer.iso", "missing.iso"); err != nil {
+		t.Fatal(err)
+	}
+	state, err = Load(vmdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != Downloaded || state.FailedStep != "" || state.Error != "" {
+		t.Errorf("Load() after the retry = %s %s %q, want downloaded without an error", state.State, state.FailedStep, state.Error)
+	}
+	if artifacts := state.Artifacts[StepDownload]; len(artifacts) != 1 || artifacts[0].Path != "installer.iso" || artifacts[0].Size != 3 {
+		t.Errorf("download artifacts = %+v, want installer.iso of 3 bytes", artifacts)
+	}
+
+	var moves []string
+	for _, transition := range state.History {
+		moves = append(moves, string(transition.From)+">"+string(transition.To))
+	}
+	if got, want := strings.Join(moves, " "), ">created created>failed failed>downloaded"; got != want {
+		t.Errorf("history = %s, want %s", got, want)
+	}
+	if state.History[1].Step != StepDownload || state.History[1].Error != "connection reset" {
+		t.Errorf("failure in the history = %+v, want the failed download", state.History[1])
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  State
+	}{
+		{name: "installed", files: map[string]string{legacyStepsFile: "5\n", "disk.qcow2": "", "unattended.iso": ""}, want: Installed},
+		{name: "prepared", files: map[string]string{legacyStepsFile: "1\n", "installer.iso": "", "disk.qcow2": "", "unattended.iso": ""}, want: Prepared},
+		{name: "disk without unattended.iso", files: map[string]string{legacyStepsFile: "1\n", "installer.iso": "", "disk.qcow2": ""}, want: Downloaded},
+		{name: "downloaded", files: map[string]string{legacyStepsFile: "1\n", "installer.iso": ""}, want: Downloaded},
+		{name: "created", files: map[string]string{legacyStepsFile: "1\n"}, want: Created},
+		{name: "without gui-steps-complete", files: map[string]string{"installer.iso": ""}, want: Downloaded},
+		{name: "empty directory", want: Created},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vmdir := t.TempDir()
+			writeFiles(t, vmdir, test.files)
+			state, err := Load(vmdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.State != test.want || !state.Migrated {
+				t.Errorf("Load() = %s, migrated %v, want %s, migrated", state.State, state.Migrated, test.want)
+			}
+		})
+	}
+}
+
+func TestMigrateSave(t *testing.T) {
+	vmdir := t.TempDir()
+	writeFiles(t, vmdir, map[string]string{legacyStepsFile: "5\n"})
+	modified := time.Date(2023, 11, 2, 18, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(vmdir, legacyStepsFile), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := Load(vmdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Updated.Equal(modified) {
+		t.Errorf("Updated = %v, want the time gui-steps-complete was written, %v", state.Updated, modified)
+	}
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(vmdir, legacyStepsFile)); !os.IsNotExist(err) {
+		t.Errorf("gui-steps-complete is still there after Save: %v", err)
+	}
+
+	state, err = Load(vmdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != Installed || state.Migrated {
+		t.Errorf("Load() of the saved state = %s, migrated %v, want installed from state.json", state.State, state.Migrated)
+	}
+	// A migrated VM that is installed can only be downloaded or prepared again
+	if state.CanMoveTo(Installing) || !state.CanMoveTo(Prepared) {
+		t.Error("a migrated installed VM can move to installing or can't move to prepared")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); err == nil || !strings.Contains(err.Error(), "VM directory does not exist") {
+		t.Errorf("Load() of a missing directory = %v, want an error", err)
+	}
+	vmdir := t.TempDir()
+	writeFiles(t, vmdir, map[string]string{FileName: "{\"state\": "})
+	if _, err := Load(vmdir); err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Errorf("Load() of a broken state.json = %v, want a parse error", err)
+	}
+}